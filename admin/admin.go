@@ -0,0 +1,125 @@
+// Package admin serves commands for operating the proxy, like draining it or
+// reloading its configuration, over a plain text protocol on a loopback
+// address separate from the addresses at which the proxy serves clients.
+//
+// Clients send one command per line and get the command's output followed by
+// a line reading OK, or a line reading ERR and the error, e.g.
+//
+//	$ echo stats | nc 127.0.0.1 9001
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/hidden"
+)
+
+const (
+	// idleTimeout is how long connections may wait between commands.
+	idleTimeout = time.Minute
+
+	helpCommand = "help"
+)
+
+var (
+	log = golog.LoggerFor("admin")
+)
+
+// Command runs an admin command, returning output for the client, if any.
+type Command func() (string, error)
+
+// Listen listens for admin commands at addr, which must be a loopback
+// address like 127.0.0.1:9001 or localhost:9001.
+func Listen(addr string) (net.Listener, error) {
+	if err := checkLoopback(addr); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for admin commands at %v: %v", addr, err)
+	}
+	return l, nil
+}
+
+// Serve serves the given commands, by name, to clients connecting to l until
+// l is closed. A help command listing the available commands is always
+// available.
+func Serve(l net.Listener, commands map[string]Command) error {
+	log.Debugf("Serving admin commands at %v", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, commands)
+	}
+}
+
+func serveConn(conn net.Conn, commands map[string]Command) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+		output, err := run(name, commands)
+		if err != nil {
+			log.Debugf("Admin command %v from %v failed: %v", name, conn.RemoteAddr(), err)
+			fmt.Fprintf(w, "ERR %v\n", hidden.Clean(err.Error()))
+		} else {
+			log.Debugf("Ran admin command %v from %v", name, conn.RemoteAddr())
+			w.WriteString(output)
+			if output != "" && !strings.HasSuffix(output, "\n") {
+				w.WriteString("\n")
+			}
+			w.WriteString("OK\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func run(name string, commands map[string]Command) (string, error) {
+	if name == helpCommand {
+		names := []string{helpCommand}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, "\n"), nil
+	}
+	command, found := commands[name]
+	if !found {
+		return "", fmt.Errorf("Unknown command %q, try %v", name, helpCommand)
+	}
+	return command()
+}
+
+// checkLoopback makes sure that addr doesn't expose admin commands beyond the
+// local host.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Invalid admin address %v: %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("Admin address %v is not a loopback address", addr)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package admin
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServe(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	drained := make(chan bool, 1)
+	go Serve(l, map[string]Command{
+		"drain": func() (string, error) {
+			drained <- true
+			return "", nil
+		},
+		"stats": func() (string, error) {
+			return "tunnels 1\nconns 2", nil
+		},
+		"reload-ports": func() (string, error) {
+			return "", errors.New("no ports file")
+		},
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	expectLines := func(command string, expected ...string) {
+		_, err := conn.Write([]byte(command + "\n"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, line := range expected {
+			read, err := br.ReadString('\n')
+			if assert.NoError(t, err, command) {
+				assert.Equal(t, line+"\n", read, command)
+			}
+		}
+	}
+
+	expectLines("stats", "tunnels 1", "conns 2", "OK")
+	expectLines("  drain ", "OK")
+	assert.Len(t, drained, 1, "should have run drain")
+	expectLines("reload-ports", "ERR no ports file")
+	expectLines("shutdown", `ERR Unknown command "shutdown", try help`)
+	expectLines("help", "drain", "help", "reload-ports", "stats", "OK")
+}
+
+func TestCheckLoopback(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:9001", "[::1]:9001", "localhost:9001", "127.0.0.2:0"} {
+		assert.NoError(t, checkLoopback(addr), addr)
+	}
+	for _, addr := range []string{":9001", "0.0.0.0:9001", "192.168.1.1:9001", "example.com:9001", "127.0.0.1"} {
+		assert.Error(t, checkLoopback(addr), addr)
+	}
+	_, err := Listen(":0")
+	assert.Error(t, err, "should refuse to listen at all interfaces")
+}
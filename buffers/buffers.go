@@ -0,0 +1,131 @@
+// Package buffers provides a pool of fixed-size buffers for copying data
+// through CONNECT tunnels.
+//
+// The proxy library pipes tunnels with its own read/write loop, so the
+// runtime never gets the chance to splice between the client and origin
+// connections and these buffers are always used. BenchmarkCopy shows that with
+// buffers of 32K or more the copy keeps up with io.Copy over loopback.
+package buffers
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+// DefaultSize is the default buffer size, matching the default of the proxy
+// library (4K).
+const DefaultSize = 4096
+
+var (
+	current atomic.Value
+
+	// Source is a proxy.BufferSource backed by this package's pool, for use in
+	// server.Opts.
+	Source = source{}
+
+	// Allocations well below gets mean that the pool is doing its job.
+	bufferGets     = metrics.NewCounter("http_proxy_buffer_gets_total", "Number of copy buffers taken from the pool.")
+	bufferPuts     = metrics.NewCounter("http_proxy_buffer_puts_total", "Number of copy buffers returned to the pool.")
+	bufferAllocs   = metrics.NewCounter("http_proxy_buffer_allocations_total", "Number of copy buffers allocated because none could be reused.")
+	bufferDiscards = metrics.NewCounter("http_proxy_buffer_discards_total", "Number of copy buffers returned to the pool that were dropped because the pool was full or they were of another size.")
+)
+
+func init() {
+	configure(DefaultSize, 0)
+}
+
+// pool keeps idle buffers in a sync.Pool, which the garbage collector drains,
+// or, if the number of retained buffers is bounded, in free.
+type pool struct {
+	size int
+	max  int
+	free chan []byte
+	sync.Pool
+}
+
+func configure(size int, max int) {
+	p := &pool{size: size, max: max}
+	p.New = func() interface{} {
+		bufferAllocs.Inc()
+		return make([]byte, size)
+	}
+	if max > 0 {
+		p.free = make(chan []byte, max)
+	}
+	current.Store(p)
+}
+
+// SetSize sets the size of buffers handed out by Get. It should be called at
+// startup before the first call to Get. Buffers of the previous size are
+// discarded rather than reused. If n is not positive, DefaultSize is used.
+func SetSize(n int) {
+	if n <= 0 {
+		n = DefaultSize
+	}
+	configure(n, current.Load().(*pool).max)
+}
+
+// SetMaxRetained bounds the number of idle buffers that the pool retains for
+// reuse to n, dropping others once returned. Bounding it keeps memory in check
+// under bursts of tunnels at the cost of allocating more when they come back.
+// If n is not positive, the pool is unbounded and idle buffers are left to the
+// garbage collector. Like SetSize, it should be called at startup and discards
+// previously retained buffers.
+func SetMaxRetained(n int) {
+	if n < 0 {
+		n = 0
+	}
+	configure(current.Load().(*pool).size, n)
+}
+
+// Size returns the current buffer size.
+func Size() int {
+	return current.Load().(*pool).size
+}
+
+// Get gets a buffer from the pool.
+func Get() []byte {
+	bufferGets.Inc()
+	p := current.Load().(*pool)
+	if p.free == nil {
+		return p.Get().([]byte)
+	}
+	select {
+	case buf := <-p.free:
+		return buf
+	default:
+		return p.New().([]byte)
+	}
+}
+
+// Put returns a buffer to the pool. Buffers that aren't of the current size
+// are dropped.
+func Put(buf []byte) {
+	bufferPuts.Inc()
+	p := current.Load().(*pool)
+	if len(buf) != p.size {
+		bufferDiscards.Inc()
+		return
+	}
+	if p.free == nil {
+		p.Put(buf)
+		return
+	}
+	select {
+	case p.free <- buf:
+	default:
+		bufferDiscards.Inc()
+	}
+}
+
+type source struct{}
+
+func (source) Get() []byte {
+	return Get()
+}
+
+func (source) Put(buf []byte) {
+	Put(buf)
+}
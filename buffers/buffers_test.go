@@ -0,0 +1,132 @@
+package buffers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ proxy.BufferSource = Source
+
+func TestSetSize(t *testing.T) {
+	defer SetSize(DefaultSize)
+
+	assert.Len(t, Get(), DefaultSize)
+
+	SetSize(32768)
+	assert.Equal(t, 32768, Size())
+	buf := Get()
+	assert.Len(t, buf, 32768)
+	Put(buf)
+	Put(make([]byte, DefaultSize))
+	for i := 0; i < 10; i++ {
+		assert.Len(t, Get(), 32768, "stale buffers should not be handed out")
+	}
+
+	SetSize(0)
+	assert.Equal(t, DefaultSize, Size())
+}
+
+func TestSetMaxRetained(t *testing.T) {
+	defer SetMaxRetained(0)
+
+	SetMaxRetained(2)
+	bufs := [][]byte{Get(), Get(), Get()}
+	discards := bufferDiscards.Value()
+	for _, buf := range bufs {
+		Put(buf)
+	}
+	assert.EqualValues(t, 1, bufferDiscards.Value()-discards, "buffers over the bound should be dropped")
+
+	gets, allocs := bufferGets.Value(), bufferAllocs.Value()
+	for i := 0; i < 3; i++ {
+		assert.Len(t, Get(), DefaultSize)
+	}
+	assert.EqualValues(t, 3, bufferGets.Value()-gets)
+	assert.EqualValues(t, 1, bufferAllocs.Value()-allocs, "retained buffers should be reused")
+
+	SetSize(32768)
+	defer SetSize(DefaultSize)
+	assert.Equal(t, 2, current.Load().(*pool).max, "SetSize should keep the bound")
+}
+
+// BenchmarkCopy compares copying between TCP connections with pooled buffers
+// of various sizes, which is how the proxy library pipes CONNECT tunnels,
+// against io.Copy, which lets the runtime splice on Linux.
+func BenchmarkCopy(b *testing.B) {
+	defer SetSize(DefaultSize)
+	for _, size := range []int{DefaultSize, 32768, 131072} {
+		size := size
+		b.Run(fmt.Sprintf("pooled/%d", size), func(b *testing.B) {
+			SetSize(size)
+			benchmarkCopy(b, func(dst, src net.Conn) error {
+				buf := Get()
+				defer Put(buf)
+				// Hide ReaderFrom and WriterTo to force a read/write loop.
+				_, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+				return err
+			})
+		})
+	}
+	b.Run("iocopy", func(b *testing.B) {
+		benchmarkCopy(b, func(dst, src net.Conn) error {
+			_, err := io.Copy(dst, src)
+			return err
+		})
+	})
+}
+
+func benchmarkCopy(b *testing.B, cp func(dst, src net.Conn) error) {
+	const chunk = 1 << 20
+
+	in, inPeer := tcpPair(b)
+	out, outPeer := tcpPair(b)
+	defer in.Close()
+	defer out.Close()
+
+	go func() {
+		data := make([]byte, chunk)
+		for i := 0; i < b.N; i++ {
+			if _, err := inPeer.Write(data); err != nil {
+				break
+			}
+		}
+		inPeer.Close()
+	}()
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, outPeer)
+		outPeer.Close()
+		close(drained)
+	}()
+
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	if err := cp(out, in); err != nil {
+		b.Fatal(err)
+	}
+	out.Close()
+	<-drained
+}
+
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return accepted, dialed
+}
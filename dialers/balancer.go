@@ -0,0 +1,159 @@
+package dialers
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+var upstreamEjections = metrics.NewCounter("http_proxy_upstream_ejections_total", "Number of times upstream proxies were taken out of rotation for failing to connect repeatedly.")
+
+// Upstream is one of the upstream proxies among which a Balancer spreads
+// dials.
+type Upstream struct {
+	// Name identifies the upstream in logs and stats, e.g. its address.
+	Name string
+
+	// Weight is the share of dials that go to the upstream relative to the
+	// others. It must be positive.
+	Weight int
+
+	// Dial dials through the upstream, e.g. one made with HTTPUpstream.
+	Dial proxy.DialFunc
+}
+
+// UpstreamStats are the outcomes of dials through an upstream. Refusals are
+// dials that the upstream answered with an error, e.g. because the origin was
+// unreachable, as opposed to Failures, which are dials that didn't reach a
+// working upstream.
+type UpstreamStats struct {
+	Name      string
+	Weight    int
+	Successes int64
+	Failures  int64
+	Refusals  int64
+	Ejected   bool
+}
+
+// Balancer spreads dials among upstream proxies by weighted round-robin. An
+// upstream that fails maxFailures dials in a row is ejected, taking it out of
+// rotation for ejectFor, after which it gets dials again but is ejected right
+// away if the next one fails too. If all upstreams are ejected, they're all
+// used. A dial that fails through one upstream is retried through the next if
+// the server retries dials, see server.Opts.DialRetries.
+type Balancer struct {
+	upstreams   []*balancedUpstream
+	maxFailures int
+	ejectFor    time.Duration
+	mx          sync.Mutex
+}
+
+type balancedUpstream struct {
+	Upstream
+	// current is the upstream's weight in the current round, see pick.
+	current       int
+	failuresInRow int
+	ejectedUntil  time.Time
+	stats         UpstreamStats
+}
+
+// NewBalancer creates a Balancer among the given upstreams. If maxFailures is
+// zero or negative, upstreams are never ejected.
+func NewBalancer(upstreams []Upstream, maxFailures int, ejectFor time.Duration) (*Balancer, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("No upstreams to balance")
+	}
+	b := &Balancer{maxFailures: maxFailures, ejectFor: ejectFor}
+	for _, u := range upstreams {
+		if u.Weight <= 0 {
+			return nil, errors.New("Invalid weight %d of upstream %v", u.Weight, u.Name)
+		}
+		b.upstreams = append(b.upstreams, &balancedUpstream{
+			Upstream: u,
+			stats:    UpstreamStats{Name: u.Name, Weight: u.Weight},
+		})
+	}
+	return b, nil
+}
+
+// Dial dials through the next upstream, see proxy.DialFunc. Only the outcomes
+// of dials for CONNECT requests count towards ejecting upstreams, since
+// the others may not go through upstreams.
+func (b *Balancer) Dial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	u := b.pick(time.Now())
+	conn, err := u.Dial(ctx, isCONNECT, network, addr)
+	if isCONNECT && ctx.Err() != context.Canceled {
+		b.record(u, err, time.Now())
+	}
+	return conn, err
+}
+
+// pick picks the next upstream by smooth weighted round-robin, which spreads
+// the dials to each upstream evenly over a round rather than in bursts.
+func (b *Balancer) pick(now time.Time) *balancedUpstream {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	eligible := make([]*balancedUpstream, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		if !now.Before(u.ejectedUntil) {
+			eligible = append(eligible, u)
+		}
+	}
+	if len(eligible) == 0 {
+		eligible = b.upstreams
+	}
+	var picked *balancedUpstream
+	total := 0
+	for _, u := range eligible {
+		u.current += u.Weight
+		total += u.Weight
+		if picked == nil || u.current > picked.current {
+			picked = u
+		}
+	}
+	picked.current -= total
+	return picked
+}
+
+func (b *Balancer) record(u *balancedUpstream, err error, now time.Time) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	var refusal *refusedError
+	switch {
+	case err == nil:
+		u.stats.Successes++
+		u.failuresInRow = 0
+	case stderrors.As(err, &refusal):
+		u.stats.Refusals++
+		u.failuresInRow = 0
+	default:
+		u.stats.Failures++
+		u.failuresInRow++
+		if b.maxFailures > 0 && u.failuresInRow >= b.maxFailures {
+			log.Errorf("Ejecting upstream %v for %v after %d failures in a row: %v", u.Name, b.ejectFor, u.failuresInRow, err)
+			u.ejectedUntil = now.Add(b.ejectFor)
+			upstreamEjections.Inc()
+		}
+	}
+}
+
+// Stats returns the stats of the upstreams, in the order they were given.
+func (b *Balancer) Stats() []UpstreamStats {
+	now := time.Now()
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	stats := make([]UpstreamStats, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		st := u.stats
+		st.Ejected = now.Before(u.ejectedUntil)
+		stats = append(stats, st)
+	}
+	return stats
+}
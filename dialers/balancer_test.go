@@ -0,0 +1,135 @@
+package dialers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDial counts the dials to the upstream with the given name in dials,
+// failing them with err if it's not nil.
+func countingDial(dials map[string]int, name string, err *error) func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		dials[name]++
+		if *err != nil {
+			return nil, *err
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+}
+
+func TestBalancerWeights(t *testing.T) {
+	dials := make(map[string]int)
+	var noErr error
+	b, err := NewBalancer([]Upstream{
+		{Name: "a", Weight: 3, Dial: countingDial(dials, "a", &noErr)},
+		{Name: "b", Weight: 1, Dial: countingDial(dials, "b", &noErr)},
+	}, 3, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for i := 0; i < 4; i++ {
+		b.Dial(context.Background(), true, "tcp", "example.com:443")
+	}
+	assert.Equal(t, map[string]int{"a": 3, "b": 1}, dials, "every round should follow the weights")
+	for i := 0; i < 400; i++ {
+		b.Dial(context.Background(), true, "tcp", "example.com:443")
+	}
+	assert.Equal(t, map[string]int{"a": 303, "b": 101}, dials)
+
+	stats := b.Stats()
+	if assert.Len(t, stats, 2) {
+		assert.Equal(t, UpstreamStats{Name: "a", Weight: 3, Successes: 303}, stats[0])
+		assert.Equal(t, UpstreamStats{Name: "b", Weight: 1, Successes: 101}, stats[1])
+	}
+}
+
+func TestBalancerEjection(t *testing.T) {
+	dials := make(map[string]int)
+	var noErr error
+	failure := error(errRefused)
+	b, err := NewBalancer([]Upstream{
+		{Name: "good", Weight: 1, Dial: countingDial(dials, "good", &noErr)},
+		{Name: "bad", Weight: 1, Dial: countingDial(dials, "bad", &failure)},
+	}, 2, 50*time.Millisecond)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dial := func(n int) {
+		for i := 0; i < n; i++ {
+			b.Dial(context.Background(), true, "tcp", "example.com:443")
+		}
+	}
+
+	dial(4)
+	assert.Equal(t, map[string]int{"good": 2, "bad": 2}, dials)
+	assert.True(t, b.Stats()[1].Ejected, "should eject upstream after failures in a row")
+	dial(4)
+	assert.Equal(t, map[string]int{"good": 6, "bad": 2}, dials, "ejected upstream should be out of rotation")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, b.Stats()[1].Ejected)
+	dial(2)
+	assert.Equal(t, 3, dials["bad"], "upstream should be back in rotation after ejection")
+	assert.True(t, b.Stats()[1].Ejected, "upstream back in rotation should be ejected right away if it fails again")
+	assert.Equal(t, UpstreamStats{Name: "bad", Weight: 1, Failures: 3, Ejected: true}, b.Stats()[1])
+
+	time.Sleep(60 * time.Millisecond)
+	failure = nil
+	dial(2)
+	failure = errRefused
+	dial(2)
+	assert.False(t, b.Stats()[1].Ejected, "success should reset failures in a row")
+}
+
+func TestBalancerAllEjected(t *testing.T) {
+	dials := make(map[string]int)
+	failure := error(errRefused)
+	b, _ := NewBalancer([]Upstream{
+		{Name: "a", Weight: 1, Dial: countingDial(dials, "a", &failure)},
+		{Name: "b", Weight: 1, Dial: countingDial(dials, "b", &failure)},
+	}, 1, time.Minute)
+	for i := 0; i < 4; i++ {
+		b.Dial(context.Background(), true, "tcp", "example.com:443")
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, dials, "all upstreams should be used when all are ejected")
+}
+
+func TestBalancerRefusals(t *testing.T) {
+	upstream, err := newUpstreamProxy(http.StatusBadGateway)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	b, _ := NewBalancer([]Upstream{
+		{Name: "refusing", Weight: 1, Dial: HTTPUpstream(upstream.Addr().String(), Direct)},
+	}, 1, time.Minute)
+	for i := 0; i < 3; i++ {
+		_, err = b.Dial(context.Background(), true, "tcp", "example.com:443")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, UpstreamStats{Name: "refusing", Weight: 1, Refusals: 3}, b.Stats()[0], "refusals should not eject upstream")
+}
+
+func TestBalancerIgnoresNonCONNECT(t *testing.T) {
+	dials := make(map[string]int)
+	failure := error(errRefused)
+	b, _ := NewBalancer([]Upstream{{Name: "a", Weight: 1, Dial: countingDial(dials, "a", &failure)}}, 1, time.Minute)
+	b.Dial(context.Background(), false, "tcp", "example.com:80")
+	assert.Equal(t, 1, dials["a"])
+	assert.Equal(t, UpstreamStats{Name: "a", Weight: 1}, b.Stats()[0], "dials for plain HTTP requests should not count")
+}
+
+func TestNewBalancerInvalid(t *testing.T) {
+	_, err := NewBalancer(nil, 3, time.Minute)
+	assert.Error(t, err, "should require upstreams")
+	_, err = NewBalancer([]Upstream{{Name: "a", Weight: 0, Dial: Direct}}, 3, time.Minute)
+	assert.Error(t, err, "should require positive weights")
+}
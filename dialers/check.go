@@ -0,0 +1,66 @@
+package dialers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/getlantern/errors"
+)
+
+// AddressCheck refuses dialing an IP address by returning an error.
+type AddressCheck func(ip net.IP) error
+
+type addressCheckKey struct{}
+
+// WithAddressCheck returns a copy of ctx in which Direct and its variants
+// refuse to connect to IP addresses that check rejects, on top of those that
+// checks already in ctx reject. The check applies to every address that a dial
+// tries, after resolving host names, so that DNS rebinding can't switch a
+// destination that was checked before dialing to a refused address, while
+// dials still race IPv6 and IPv4 and fall back to other addresses. Dials of
+// upstream proxies aren't checked, as those proxies resolve destinations
+// themselves.
+func WithAddressCheck(ctx context.Context, check AddressCheck) context.Context {
+	if prev, ok := ctx.Value(addressCheckKey{}).(AddressCheck); ok && prev != nil {
+		next := check
+		check = func(ip net.IP) error {
+			if err := prev(ip); err != nil {
+				return err
+			}
+			return next(ip)
+		}
+	}
+	return context.WithValue(ctx, addressCheckKey{}, check)
+}
+
+// withoutAddressChecks returns a copy of ctx without the checks of
+// WithAddressCheck.
+func withoutAddressChecks(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(addressCheckKey{}).(AddressCheck); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, addressCheckKey{}, AddressCheck(nil))
+}
+
+// checkAddress is the ControlContext of the dialers of Direct and its
+// variants. It runs the checks in ctx on the address about to be connected to.
+func checkAddress(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	check, _ := ctx.Value(addressCheckKey{}).(AddressCheck)
+	if check == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.New("Unable to check address %v: %v", address, err)
+	}
+	if zone := strings.IndexByte(host, '%'); zone >= 0 {
+		host = host[:zone]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("Unable to check address %v: not an IP address", address)
+	}
+	return check(ip)
+}
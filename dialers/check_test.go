@@ -0,0 +1,74 @@
+package dialers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithAddressCheck(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	errRefused := errors.New("refused")
+	var checked []string
+	var mx sync.Mutex
+	refuseLoopback := func(ip net.IP) error {
+		mx.Lock()
+		checked = append(checked, ip.String())
+		mx.Unlock()
+		if ip.IsLoopback() {
+			return errRefused
+		}
+		return nil
+	}
+	allow := func(ip net.IP) error { return nil }
+
+	ctx := WithAddressCheck(context.Background(), allow)
+	conn, err := Direct(ctx, true, "tcp", addr)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	ctx = WithAddressCheck(ctx, refuseLoopback)
+	_, err = Direct(ctx, true, "tcp", addr)
+	assert.True(t, errors.Is(err, errRefused), "should have refused resolved address: %v", err)
+	assert.Contains(t, checked, "127.0.0.1")
+
+	checked = nil
+	cached := WithDNSCache(Direct, time.Minute, 10)
+	_, err = cached(ctx, true, "tcp", addr)
+	assert.True(t, errors.Is(err, errRefused), "should have refused cached address: %v", err)
+	assert.Contains(t, checked, "127.0.0.1")
+
+	_, err = Direct(WithAddressCheck(context.Background(), refuseLoopback), false, "udp", l.Addr().String())
+	assert.True(t, errors.Is(err, errRefused), "should have refused UDP address: %v", err)
+}
+
+func TestAddressCheckSkipsUpstream(t *testing.T) {
+	upstream, err := newUpstreamProxy(http.StatusOK)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	ctx := WithAddressCheck(context.Background(), func(ip net.IP) error {
+		return fmt.Errorf("refused %v", ip)
+	})
+	conn, err := HTTPUpstream(upstream.Addr().String(), Direct)(ctx, true, "tcp", "example.com:443")
+	if assert.NoError(t, err, "the address of the upstream proxy shouldn't be checked") {
+		conn.Close()
+	}
+}
@@ -0,0 +1,109 @@
+package dialers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy/v2"
+)
+
+// connectionAttemptDelay is how long to wait for a connection over the
+// preferred IP version before racing one over the other version, as
+// recommended by RFC 8305.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+var (
+	log = golog.LoggerFor("dialers")
+
+	directDialer = &net.Dialer{FallbackDelay: connectionAttemptDelay, ControlContext: checkAddress}
+)
+
+// Direct dials the given address directly, without going through any other
+// proxy. It's the default dial function used by the server. When a host
+// resolves to both IPv6 and IPv4 addresses, it races connections over both
+// (Happy Eyeballs) and uses whichever connects first, so that a broken IPv6
+// path doesn't stall the dial. Addresses are checked as given by
+// WithAddressCheck.
+func Direct(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	return directDialer.DialContext(ctx, network, addr)
+}
+
+// DirectWithKeepAlive is like Direct but uses keepAlive as the TCP keep-alive
+// period of dialed connections, which start sending probes once they've
+// been idle that long, instead of Go's default of 15 seconds. If keepAlive is
+// negative, keep-alives are disabled.
+func DirectWithKeepAlive(keepAlive time.Duration) proxy.DialFunc {
+	dialer := &net.Dialer{FallbackDelay: connectionAttemptDelay, KeepAlive: keepAlive, ControlContext: checkAddress}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// DirectFromIP is like DirectWithKeepAlive but binds dialed connections to
+// the given local IP, so that they egress from it on hosts with several
+// addresses. Only destinations resolving to addresses of the same IP version
+// can be reached. UDP is sent from ip too. It fails if ip is invalid or not
+// assigned to this host.
+func DirectFromIP(ip string, keepAlive time.Duration) (proxy.DialFunc, error) {
+	localIP := net.ParseIP(ip)
+	if localIP == nil {
+		return nil, errors.New("Invalid IP %v", ip)
+	}
+	// Binding a listener is the simplest way to make sure that the kernel lets
+	// us use the address
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		return nil, errors.New("Unable to bind to %v: %v", ip, err)
+	}
+	l.Close()
+
+	dialer := &net.Dialer{
+		FallbackDelay:  connectionAttemptDelay,
+		KeepAlive:      keepAlive,
+		LocalAddr:      &net.TCPAddr{IP: localIP},
+		ControlContext: checkAddress,
+	}
+	udpDialer := &net.Dialer{LocalAddr: &net.UDPAddr{IP: localIP}, ControlContext: checkAddress}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(network, "udp") {
+			return udpDialer.DialContext(ctx, network, addr)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// WithNagle wraps the given dial function so that dialed TCP connections have
+// Nagle's algorithm enabled, clearing the TCP_NODELAY that Go sets by default,
+// so that the kernel batches small writes, like those of bulk uploads, at the
+// cost of latency. It only affects connections that dial returns as is, so wrap
+// Direct or one of its variants with it directly.
+func WithNagle(dial proxy.DialFunc) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err := tcpConn.SetNoDelay(false); err != nil {
+				log.Debugf("Unable to enable Nagle's algorithm on connection to %v: %v", addr, err)
+			}
+		}
+		return conn, nil
+	}
+}
+
+// ForceNetwork wraps the given dial function so that TCP dials always use the
+// given network, for example "tcp4" to only dial over IPv4 or "tcp6" to only
+// dial over IPv6.
+func ForceNetwork(dial proxy.DialFunc, forced string) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(network, "tcp") {
+			network = forced
+		}
+		return dial(ctx, isCONNECT, network, addr)
+	}
+}
@@ -0,0 +1,87 @@
+package dialers
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectFromIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// All of 127.0.0.0/8 is local on Linux
+	dial, err := DirectFromIP("127.0.0.2", 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := dial(context.Background(), true, "tcp", l.Addr().String())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.TCPAddr).IP.String(), "should have dialed from given IP")
+		conn.Close()
+	}
+
+	_, err = DirectFromIP("127.0.0", 0)
+	assert.Error(t, err, "should reject invalid IP")
+	_, err = DirectFromIP("192.0.2.1", 0)
+	assert.Error(t, err, "should reject IP not assigned to this host")
+}
+
+func TestDirectWithKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := DirectWithKeepAlive(7*time.Second)(context.Background(), true, "tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, 1, tcpOption(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE), "should enable keep-alive")
+	assert.Equal(t, 7, tcpOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE), "should start probing after configured idle time")
+	assert.Equal(t, 1, tcpOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY), "should disable Nagle's algorithm")
+
+	conn, err = DirectWithKeepAlive(-1)(context.Background(), true, "tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, 0, tcpOption(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE), "should disable keep-alive")
+}
+
+func TestWithNagle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := WithNagle(Direct)(context.Background(), true, "tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, 0, tcpOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY), "should enable Nagle's algorithm")
+}
+
+func tcpOption(t *testing.T, conn net.Conn, level, option int) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if !assert.NoError(t, err) {
+		return -1
+	}
+	value := -1
+	raw.Control(func(fd uintptr) {
+		value, err = syscall.GetsockoptInt(int(fd), level, option)
+	})
+	assert.NoError(t, err)
+	return value
+}
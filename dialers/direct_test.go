@@ -0,0 +1,81 @@
+package dialers
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForceNetwork(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	conn, err := ForceNetwork(Direct, "tcp4")(context.Background(), true, "tcp", addr)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, conn.RemoteAddr().(*net.TCPAddr).IP.To4(), "should have dialed over IPv4")
+		conn.Close()
+	}
+
+	_, err = ForceNetwork(Direct, "tcp6")(context.Background(), true, "tcp", addr)
+	assert.Error(t, err, "should not have dialed IPv4 only listener over IPv6")
+}
+
+// BenchmarkNagle measures the round trip of a request sent in two small writes
+// with and without Nagle's algorithm, which holds back the second write until
+// the first is acknowledged. Interactive sessions see that latency, especially
+// as peers delay acknowledgements.
+func BenchmarkNagle(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request := make([]byte, 2)
+				for {
+					if _, err := io.ReadFull(conn, request); err != nil {
+						return
+					}
+					if _, err := conn.Write(request[:1]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	for name, dial := range map[string]proxy.DialFunc{"NoDelay": Direct, "Nagle": WithNagle(Direct)} {
+		b.Run(name, func(b *testing.B) {
+			conn, err := dial(context.Background(), true, "tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			response := make([]byte, 1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn.Write([]byte("a"))
+				conn.Write([]byte("b"))
+				if _, err := io.ReadFull(conn, response); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
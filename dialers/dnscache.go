@@ -0,0 +1,224 @@
+package dialers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/v2"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+// maxNegativeTTL bounds how long failed lookups of non-existent hosts are
+// cached.
+const maxNegativeTTL = 5 * time.Second
+
+var (
+	dnsCacheHits   = metrics.NewCounter("http_proxy_dns_cache_hits_total", "Number of DNS lookups answered from the cache.")
+	dnsCacheMisses = metrics.NewCounter("http_proxy_dns_cache_misses_total", "Number of DNS lookups not found in the cache.")
+
+	// lookupIPAddr is overridden in tests
+	lookupIPAddr = net.DefaultResolver.LookupIPAddr
+)
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// dnsCache caches DNS lookups for a limited time.
+type dnsCache struct {
+	ttl     time.Duration
+	entries *lru.Cache
+	// lookups deduplicates concurrent lookups of the same host
+	lookups   map[string]*sync.WaitGroup
+	lookupsMx sync.Mutex
+}
+
+// WithDNSCache wraps the given dial function so that host names are resolved
+// through an in-process cache holding up to maxEntries hosts for ttl. Lookups
+// of hosts that don't exist are cached for at most 5 seconds. If ttl or
+// maxEntries are not positive, caching is disabled.
+//
+// Like Direct, dials race IPv6 and IPv4 addresses if a host has both.
+func WithDNSCache(dial proxy.DialFunc, ttl time.Duration, maxEntries int) proxy.DialFunc {
+	if ttl <= 0 || maxEntries <= 0 {
+		return dial
+	}
+	entries, _ := lru.New(maxEntries)
+	cache := &dnsCache{ttl: ttl, entries: entries, lookups: make(map[string]*sync.WaitGroup)}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, isCONNECT, network, addr)
+		}
+		addrs, err := cache.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = filterByNetwork(addrs, network)
+		if len(addrs) == 0 {
+			return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+		}
+		return dialParallel(ctx, dial, isCONNECT, network, addrs, port)
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	for {
+		if cached, found := c.entries.Get(host); found {
+			entry := cached.(*dnsCacheEntry)
+			if time.Now().Before(entry.expires) {
+				dnsCacheHits.Inc()
+				return entry.addrs, entry.err
+			}
+			c.entries.Remove(host)
+		}
+
+		c.lookupsMx.Lock()
+		inProgress, found := c.lookups[host]
+		if found {
+			// Wait for the other lookup and then check the cache again
+			c.lookupsMx.Unlock()
+			inProgress.Wait()
+			continue
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		c.lookups[host] = &wg
+		c.lookupsMx.Unlock()
+
+		dnsCacheMisses.Inc()
+		addrs, err := lookupIPAddr(ctx, host)
+		c.store(host, addrs, err)
+
+		c.lookupsMx.Lock()
+		delete(c.lookups, host)
+		c.lookupsMx.Unlock()
+		wg.Done()
+		return addrs, err
+	}
+}
+
+func (c *dnsCache) store(host string, addrs []net.IPAddr, err error) {
+	ttl := c.ttl
+	if err != nil {
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok || !dnsErr.IsNotFound {
+			// Don't cache transient failures
+			return
+		}
+		if ttl > maxNegativeTTL {
+			ttl = maxNegativeTTL
+		}
+	}
+	c.entries.Add(host, &dnsCacheEntry{addrs: addrs, err: err, expires: time.Now().Add(ttl)})
+}
+
+func filterByNetwork(addrs []net.IPAddr, network string) []net.IPAddr {
+	if network != "tcp4" && network != "tcp6" {
+		return addrs
+	}
+	filtered := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (network == "tcp4") {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+// dialParallel dials the given addresses of the first address's IP version in
+// order and, if that hasn't succeeded after connectionAttemptDelay or fails,
+// races the addresses of the other IP version, returning the first connection
+// that succeeds.
+func dialParallel(ctx context.Context, dial proxy.DialFunc, isCONNECT bool, network string, addrs []net.IPAddr, port string) (net.Conn, error) {
+	var primaries, fallbacks []net.IPAddr
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (addrs[0].IP.To4() != nil) {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	if len(fallbacks) == 0 {
+		return dialSerial(ctx, dial, isCONNECT, network, primaries, port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	start := func(addrs []net.IPAddr) {
+		go func() {
+			conn, err := dialSerial(ctx, dial, isCONNECT, network, addrs, port)
+			results <- result{conn, err}
+		}()
+	}
+
+	start(primaries)
+	pending := 1
+	fallbackStarted := false
+	fallbackTimer := time.NewTimer(connectionAttemptDelay)
+	defer fallbackTimer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// Close the other connection in case it succeeds too
+					go func() {
+						if other := <-results; other.conn != nil {
+							other.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func dialSerial(ctx context.Context, dial proxy.DialFunc, isCONNECT bool, network string, addrs []net.IPAddr, port string) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := dial(ctx, isCONNECT, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,101 @@
+package dialers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithDNSCache(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	lookups := 0
+	defer stubLookup(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if host == "missing.example" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	})()
+
+	dial := WithDNSCache(Direct, 100*time.Millisecond, 10)
+	hits := dnsCacheHits.Value()
+	for i := 0; i < 2; i++ {
+		conn, err := dial(context.Background(), true, "tcp", net.JoinHostPort("cached.example", port))
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Equal(t, 1, lookups, "second dial should have used cache")
+	assert.EqualValues(t, 1, dnsCacheHits.Value()-hits)
+
+	time.Sleep(150 * time.Millisecond)
+	conn, err := dial(context.Background(), true, "tcp", net.JoinHostPort("cached.example", port))
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, 2, lookups, "expired entry should have been looked up again")
+
+	for i := 0; i < 2; i++ {
+		_, err := dial(context.Background(), true, "tcp", "missing.example:443")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 3, lookups, "missing host should have been cached")
+
+	_, err = dial(context.Background(), true, "tcp6", net.JoinHostPort("cached.example", port))
+	assert.Error(t, err, "should not find IPv6 address")
+}
+
+func TestWithDNSCacheDisabled(t *testing.T) {
+	lookups := 0
+	defer stubLookup(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		return nil, nil
+	})()
+
+	attempts := 0
+	dial := WithDNSCache(failingDial(&attempts, nil, 0), 0, 10)
+	conn, err := dial(context.Background(), true, "tcp", "example.com:443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, 0, lookups)
+}
+
+func TestDialParallel(t *testing.T) {
+	// IPv6 blackholes, IPv4 works
+	dial := func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host).To4() == nil {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialParallel(ctx, dial, true, "tcp", []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}}, "443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.True(t, time.Since(start) < 2*time.Second, "should have fallen back to IPv4 quickly")
+}
+
+func stubLookup(lookup func(ctx context.Context, host string) ([]net.IPAddr, error)) func() {
+	orig := lookupIPAddr
+	lookupIPAddr = lookup
+	return func() {
+		lookupIPAddr = orig
+	}
+}
@@ -0,0 +1,54 @@
+package dialers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/proxy/v2"
+)
+
+// WithRetries wraps the given dial function so that dials failing with a
+// transient error (connection refused or timeout) are retried up to retries
+// times. The first retry waits for backoff, with the wait doubling on each
+// subsequent retry. Retrying stops once the context is done, so a deadline
+// on the context bounds the total time spent dialing.
+func WithRetries(dial proxy.DialFunc, retries int, backoff time.Duration) proxy.DialFunc {
+	if retries <= 0 {
+		return dial
+	}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		wait := backoff
+		for attempt := 0; ; attempt++ {
+			conn, err := dial(ctx, isCONNECT, network, addr)
+			if err == nil || attempt >= retries || !isTransient(err) {
+				return conn, err
+			}
+			log.Debugf("Dialing %v failed on attempt %d, retrying in %v: %v", addr, attempt+1, wait, err)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, err
+			case <-timer.C:
+			}
+			wait *= 2
+		}
+	}
+}
+
+// isTransient determines whether the given dial error is worth retrying.
+// Unresolvable host names are not.
+func isTransient(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound && dnsErr.IsTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,64 @@
+package dialers
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+func TestWithRetries(t *testing.T) {
+	attempts := 0
+	dial := WithRetries(failingDial(&attempts, errRefused, 2), 3, time.Millisecond)
+	conn, err := dial(context.Background(), true, "tcp", "example.com:443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	dial = WithRetries(failingDial(&attempts, errRefused, 10), 3, time.Millisecond)
+	_, err = dial(context.Background(), true, "tcp", "example.com:443")
+	assert.Equal(t, errRefused, err)
+	assert.Equal(t, 4, attempts, "should give up after configured retries")
+}
+
+func TestWithRetriesNotFound(t *testing.T) {
+	attempts := 0
+	notFound := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}
+	dial := WithRetries(failingDial(&attempts, notFound, 10), 3, time.Millisecond)
+	_, err := dial(context.Background(), true, "tcp", "example.invalid:443")
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts, "should not retry unresolvable hosts")
+}
+
+func TestWithRetriesBudget(t *testing.T) {
+	attempts := 0
+	dial := WithRetries(failingDial(&attempts, errRefused, 10), 3, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := dial(ctx, true, "tcp", "example.com:443")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "should stop retrying once context is done")
+	assert.Equal(t, 1, attempts)
+}
+
+// failingDial returns a dial function that fails with err the given number of
+// times before succeeding.
+func failingDial(attempts *int, err error, failures int) func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		*attempts++
+		if *attempts <= failures {
+			return nil, err
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+}
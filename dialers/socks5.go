@@ -0,0 +1,173 @@
+package dialers
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2"
+)
+
+const (
+	socks5Version = 5
+
+	socks5NoAuth           = 0
+	socks5UserPassAuth     = 2
+	socks5NoAcceptableAuth = 0xff
+	socks5UserPassVersion  = 1
+
+	socks5Connect = 1
+
+	socks5IPv4   = 1
+	socks5Domain = 3
+	socks5IPv6   = 4
+)
+
+var socks5Replies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// SOCKS5Upstream returns a DialFunc that reaches all destinations through the
+// SOCKS5 proxy at proxyAddr, using dial to connect to that proxy. If username
+// is not empty, it authenticates with username and password, otherwise it
+// requires the proxy to accept unauthenticated clients. Only TCP is supported.
+func SOCKS5Upstream(proxyAddr, username, password string, dial proxy.DialFunc) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil, errors.New("Unable to dial %v over %v through SOCKS5 proxy at %v", addr, network, proxyAddr)
+		}
+		// The upstream proxy resolves and dials the destination, only its
+		// own address is dialed here
+		conn, err := dial(withoutAddressChecks(ctx), isCONNECT, network, proxyAddr)
+		if err != nil {
+			return nil, errors.New("Unable to dial SOCKS5 proxy at %v: %v", proxyAddr, err)
+		}
+		if err := socks5Handshake(ctx, conn, addr, username, password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// socks5Handshake authenticates with the SOCKS5 proxy on conn and asks it to
+// connect to addr.
+func socks5Handshake(ctx context.Context, conn net.Conn, addr, username, password string) error {
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("Invalid address %v: %v", addr, err)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return errors.New("Invalid port in %v: %v", addr, err)
+	}
+
+	method := byte(socks5NoAuth)
+	if username != "" {
+		method = socks5UserPassAuth
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return errors.New("Unable to send SOCKS5 greeting: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.New("Unable to read SOCKS5 greeting reply: %v", err)
+	}
+	if reply[0] != socks5Version {
+		return errors.New("Unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] == socks5NoAcceptableAuth || reply[1] != method {
+		return errors.New("SOCKS5 proxy doesn't accept authentication method %d", method)
+	}
+
+	if method == socks5UserPassAuth {
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 username and password can't be longer than 255 bytes")
+		}
+		auth := []byte{socks5UserPassVersion, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return errors.New("Unable to send SOCKS5 credentials: %v", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return errors.New("Unable to read SOCKS5 authentication reply: %v", err)
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 proxy rejected credentials for %v", username)
+		}
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("Host name too long for SOCKS5: %v", host)
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return errors.New("Unable to send SOCKS5 connect request: %v", err)
+	}
+
+	// Version, reply, reserved and address type
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return errors.New("Unable to read SOCKS5 connect reply: %v", err)
+	}
+	if head[1] != 0 {
+		reason, found := socks5Replies[head[1]]
+		if !found {
+			reason = "unknown error " + strconv.Itoa(int(head[1]))
+		}
+		return refused(http.StatusBadGateway, "SOCKS5 proxy unable to connect to %v: %v", addr, reason)
+	}
+
+	// Discard the bound address and port
+	var boundLength int
+	switch head[3] {
+	case socks5IPv4:
+		boundLength = net.IPv4len
+	case socks5IPv6:
+		boundLength = net.IPv6len
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, head[:1]); err != nil {
+			return errors.New("Unable to read SOCKS5 connect reply: %v", err)
+		}
+		boundLength = int(head[0])
+	default:
+		return errors.New("Unknown address type %d in SOCKS5 connect reply", head[3])
+	}
+	bound := make([]byte, boundLength+2)
+	if _, err := io.ReadFull(conn, bound); err != nil {
+		return errors.New("Unable to read SOCKS5 connect reply: %v", err)
+	}
+	log.Tracef("SOCKS5 proxy connected to %v from port %d", addr, binary.BigEndian.Uint16(bound[boundLength:]))
+	return nil
+}
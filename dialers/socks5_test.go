@@ -0,0 +1,183 @@
+package dialers
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSOCKS5Upstream(t *testing.T) {
+	for _, addr := range []string{"example.com:443", "127.0.0.1:443", "[::1]:443"} {
+		upstream, requested, err := newSOCKS5Proxy("", "", 0)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer upstream.Close()
+
+		dial := SOCKS5Upstream(upstream.Addr().String(), "", "", Direct)
+		conn, err := dial(context.Background(), true, "tcp", addr)
+		if !assert.NoError(t, err, addr) {
+			continue
+		}
+		assert.Equal(t, addr, <-requested, "should ask proxy for the destination")
+		assertEchoes(t, conn)
+		conn.Close()
+	}
+}
+
+func TestSOCKS5UpstreamUserPass(t *testing.T) {
+	upstream, requested, err := newSOCKS5Proxy("user", "pass", 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	_, err = SOCKS5Upstream(upstream.Addr().String(), "", "", Direct)(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err, "should require credentials")
+
+	_, err = SOCKS5Upstream(upstream.Addr().String(), "user", "wrong", Direct)(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err, "should reject wrong password")
+
+	conn, err := SOCKS5Upstream(upstream.Addr().String(), "user", "pass", Direct)(context.Background(), false, "tcp", "example.com:80")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, "example.com:80", <-requested)
+	assertEchoes(t, conn)
+}
+
+func TestSOCKS5UpstreamRefused(t *testing.T) {
+	upstream, _, err := newSOCKS5Proxy("", "", 5)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	_, err = SOCKS5Upstream(upstream.Addr().String(), "", "", Direct)(context.Background(), true, "tcp", "example.com:443")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "connection refused")
+	}
+}
+
+func assertEchoes(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("ping"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ping", string(buf), "should tunnel through upstream")
+	}
+}
+
+// newSOCKS5Proxy starts a minimal SOCKS5 proxy that requires the given
+// credentials (if username isn't empty), reports each requested destination
+// on the returned channel and answers with reply. On success, it echoes back
+// whatever it receives.
+func newSOCKS5Proxy(username, password string, reply byte) (net.Listener, <-chan string, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	requested := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				addr, ok := serveSOCKS5Handshake(conn, username, password)
+				if !ok {
+					return
+				}
+				requested <- addr
+				// Bound address 0.0.0.0:0
+				if _, err := conn.Write([]byte{socks5Version, reply, 0, socks5IPv4, 0, 0, 0, 0, 0, 0}); err != nil || reply != 0 {
+					return
+				}
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l, requested, nil
+}
+
+func serveSOCKS5Handshake(conn net.Conn, username, password string) (string, bool) {
+	readBytes := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	greeting := readBytes(2)
+	if greeting == nil || greeting[0] != socks5Version {
+		return "", false
+	}
+	methods := readBytes(int(greeting[1]))
+	wanted := byte(socks5NoAuth)
+	if username != "" {
+		wanted = socks5UserPassAuth
+	}
+	accepted := false
+	for _, method := range methods {
+		accepted = accepted || method == wanted
+	}
+	if !accepted {
+		conn.Write([]byte{socks5Version, socks5NoAcceptableAuth})
+		return "", false
+	}
+	conn.Write([]byte{socks5Version, wanted})
+
+	if wanted == socks5UserPassAuth {
+		head := readBytes(2)
+		if head == nil {
+			return "", false
+		}
+		user := string(readBytes(int(head[1])))
+		passLength := readBytes(1)
+		if passLength == nil {
+			return "", false
+		}
+		pass := string(readBytes(int(passLength[0])))
+		if user != username || pass != password {
+			conn.Write([]byte{socks5UserPassVersion, 1})
+			return "", false
+		}
+		conn.Write([]byte{socks5UserPassVersion, 0})
+	}
+
+	req := readBytes(4)
+	if req == nil || req[1] != socks5Connect {
+		return "", false
+	}
+	var host string
+	switch req[3] {
+	case socks5IPv4:
+		host = net.IP(readBytes(net.IPv4len)).String()
+	case socks5IPv6:
+		host = net.IP(readBytes(net.IPv6len)).String()
+	case socks5Domain:
+		hostLength := readBytes(1)
+		if hostLength == nil {
+			return "", false
+		}
+		host = string(readBytes(int(hostLength[0])))
+	default:
+		return "", false
+	}
+	port := readBytes(2)
+	if port == nil {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), true
+}
@@ -0,0 +1,203 @@
+package dialers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/preconn"
+	"github.com/getlantern/proxy/v2"
+)
+
+const (
+	connectRequest = "CONNECT %v HTTP/1.1\r\nHost: %v\r\n"
+	modulePath     = "github.com/getlantern/http-proxy"
+)
+
+// DefaultUserAgent is the User-Agent of CONNECT requests sent to upstream
+// proxies unless specified otherwise. It identifies this module and its
+// version.
+var DefaultUserAgent = "http-proxy/" + moduleVersion()
+
+// HTTPUpstream returns a DialFunc that reaches the destinations of CONNECT
+// requests by tunneling through the HTTP proxy at proxyAddr, using dial to
+// connect to that proxy. Non-CONNECT requests are dialed directly using dial.
+// UDP can't be tunneled, so dialing it for CONNECT fails.
+//
+// If the upstream proxy doesn't respond with a 2xx status, dialing fails with
+// an error describing the upstream's response, and the server answers the
+// client with the upstream's error status, other than a 407, which becomes a
+// 502.
+func HTTPUpstream(proxyAddr string, dial proxy.DialFunc) proxy.DialFunc {
+	return HTTPUpstreamWithHeader(proxyAddr, nil, dial)
+}
+
+// HTTPUpstreamWithHeader is like HTTPUpstream but includes the given header,
+// for example a Via identifying this proxy, in CONNECT requests to the upstream
+// proxy. Unless header includes a User-Agent, DefaultUserAgent is sent. To
+// send none, set it to an empty value.
+func HTTPUpstreamWithHeader(proxyAddr string, header http.Header, dial proxy.DialFunc) proxy.DialFunc {
+	return upstream(proxyAddr, dial, nil, header)
+}
+
+// HTTPSUpstream is like HTTPUpstream but connects to the upstream proxy over
+// TLS using tlsConfig, which may be nil to use defaults. Unless tlsConfig
+// specifies a ServerName, the upstream's certificate is verified against the
+// host in proxyAddr.
+func HTTPSUpstream(proxyAddr string, tlsConfig *tls.Config, dial proxy.DialFunc) proxy.DialFunc {
+	return HTTPSUpstreamWithHeader(proxyAddr, tlsConfig, nil, dial)
+}
+
+// HTTPSUpstreamWithHeader is like HTTPSUpstream but includes the given header
+// in CONNECT requests, see HTTPUpstreamWithHeader.
+func HTTPSUpstreamWithHeader(proxyAddr string, tlsConfig *tls.Config, header http.Header, dial proxy.DialFunc) proxy.DialFunc {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(proxyAddr)
+	}
+	return upstream(proxyAddr, dial, tlsConfig, header)
+}
+
+func upstream(proxyAddr string, dial proxy.DialFunc, tlsConfig *tls.Config, header http.Header) proxy.DialFunc {
+	header = connectHeader(header)
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if !isCONNECT {
+			return dial(ctx, isCONNECT, network, addr)
+		}
+		if !strings.HasPrefix(network, "tcp") {
+			return nil, errors.New("Unable to dial %v over %v through upstream proxy at %v", addr, network, proxyAddr)
+		}
+
+		// The upstream proxy resolves and dials the destination, only its
+		// own address is dialed here
+		conn, err := dial(withoutAddressChecks(ctx), isCONNECT, network, proxyAddr)
+		if err != nil {
+			return nil, errors.New("Unable to dial upstream proxy at %v: %v", proxyAddr, err)
+		}
+		if tlsConfig != nil {
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, errors.New("Unable to establish TLS with upstream proxy at %v: %v", proxyAddr, err)
+			}
+			conn = tlsConn
+		}
+		conn, err = connectThrough(ctx, conn, addr, header)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// refusedError is returned when an upstream proxy refuses to connect to a
+// destination, which tells that the upstream itself is reachable.
+type refusedError struct {
+	msg    string
+	status int
+}
+
+func refused(status int, format string, args ...interface{}) error {
+	return &refusedError{fmt.Sprintf(format, args...), status}
+}
+
+func (e *refusedError) Error() string {
+	return e.msg
+}
+
+// StatusCode returns the status with which to answer clients whose requests
+// the upstream refused: the upstream's own error status, so that clients can
+// tell for example a destination it forbids from one it can't reach, but 502
+// if the upstream asked for authentication, which is the proxy's business.
+func (e *refusedError) StatusCode() int {
+	if e.status < http.StatusBadRequest || e.status > 599 || e.status == http.StatusProxyAuthRequired {
+		return http.StatusBadGateway
+	}
+	return e.status
+}
+
+// connectHeader returns a copy of header with DefaultUserAgent added if it
+// doesn't specify a User-Agent, and without an empty one.
+func connectHeader(header http.Header) http.Header {
+	result := header.Clone()
+	if result == nil {
+		result = make(http.Header)
+	}
+	if _, ok := result["User-Agent"]; !ok {
+		result.Set("User-Agent", DefaultUserAgent)
+	} else if result.Get("User-Agent") == "" {
+		result.Del("User-Agent")
+	}
+	return result
+}
+
+// moduleVersion returns the version of this module that the running binary was
+// built with, or "devel" if it's unknown, e.g. when built from a checkout.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	version := info.Main.Version
+	if info.Main.Path != modulePath {
+		version = ""
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+				break
+			}
+		}
+	}
+	if version == "" || version == "(devel)" {
+		return "devel"
+	}
+	return strings.TrimPrefix(version, "v")
+}
+
+// connectThrough issues a CONNECT for addr on the given connection to an
+// upstream proxy, including the given header, and waits for it to be
+// established.
+func connectThrough(ctx context.Context, conn net.Conn, addr string, header http.Header) (net.Conn, error) {
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	log.Tracef("Issuing CONNECT for %v to upstream proxy at %v", addr, conn.RemoteAddr())
+	var req bytes.Buffer
+	fmt.Fprintf(&req, connectRequest, addr, addr)
+	header.Write(&req)
+	req.WriteString("\r\n")
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return conn, errors.New("Unable to send CONNECT request to upstream proxy: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, errors.New("Unable to read CONNECT response from upstream proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return conn, refused(resp.StatusCode, "Upstream proxy responded to CONNECT %v with %v", addr, resp.Status)
+	}
+
+	if buffered := br.Buffered(); buffered > 0 {
+		// Don't lose anything the upstream sent along with its response
+		head, _ := br.Peek(buffered)
+		return preconn.Wrap(conn, head), nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,238 @@
+package dialers
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/proxy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPUpstream(t *testing.T) {
+	upstream, err := newUpstreamProxy(http.StatusOK)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	dial := HTTPUpstream(upstream.Addr().String(), Direct)
+	conn, err := dial(context.Background(), true, "tcp", "example.com:443")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ping", string(buf), "should tunnel through upstream")
+	}
+}
+
+func TestHTTPUpstreamRejected(t *testing.T) {
+	upstream, err := newUpstreamProxy(http.StatusProxyAuthRequired)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	dial := HTTPUpstream(upstream.Addr().String(), Direct)
+	_, err = dial(context.Background(), true, "tcp", "example.com:443")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "407")
+		assert.Equal(t, http.StatusBadGateway, err.(*refusedError).StatusCode(), "the upstream's authentication shouldn't be passed on to clients")
+	}
+}
+
+func TestRefusedStatusCode(t *testing.T) {
+	for status, expected := range map[int]int{
+		http.StatusForbidden:          http.StatusForbidden,
+		http.StatusNotFound:           http.StatusNotFound,
+		http.StatusServiceUnavailable: http.StatusServiceUnavailable,
+		http.StatusProxyAuthRequired:  http.StatusBadGateway,
+		http.StatusFound:              http.StatusBadGateway,
+	} {
+		err := refused(status, "Refused")
+		assert.Equal(t, expected, err.(*refusedError).StatusCode(), "%d", status)
+	}
+}
+
+func TestHTTPUpstreamHeader(t *testing.T) {
+	for _, test := range []struct {
+		header            http.Header
+		expectedUserAgent []string
+		expectedVia       string
+	}{
+		{nil, []string{DefaultUserAgent}, ""},
+		{http.Header{"Via": {"1.1 test-proxy"}}, []string{DefaultUserAgent}, "1.1 test-proxy"},
+		{http.Header{"User-Agent": {"custom/1.0"}}, []string{"custom/1.0"}, ""},
+		{http.Header{"User-Agent": {""}}, nil, ""},
+	} {
+		header := connectHeaderSentBy(t, func(proxyAddr string) proxy.DialFunc {
+			return HTTPUpstreamWithHeader(proxyAddr, test.header, Direct)
+		})
+		assert.Equal(t, test.expectedUserAgent, header["User-Agent"])
+		assert.Equal(t, test.expectedVia, header.Get("Via"))
+	}
+	assert.True(t, strings.HasPrefix(DefaultUserAgent, "http-proxy/"))
+}
+
+// connectHeaderSentBy returns the header of the CONNECT request sent to an
+// upstream proxy by the dial function returned by newDial.
+func connectHeaderSentBy(t *testing.T, newDial func(proxyAddr string) proxy.DialFunc) http.Header {
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer l.Close()
+	headers := make(chan http.Header, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			headers <- nil
+			return
+		}
+		headers <- req.Header
+		resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1}
+		resp.Write(conn)
+	}()
+
+	conn, err := newDial(l.Addr().String())(context.Background(), true, "tcp", "example.com:443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	return <-headers
+}
+
+func TestHTTPUpstreamUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dial := HTTPUpstream(addr, Direct)
+	_, err = dial(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err)
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	upstream, certs, err := newTLSUpstreamProxy(http.StatusOK)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	_, err = HTTPSUpstream(upstream.Addr().String(), nil, Direct)(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err, "should not trust unknown certificate")
+
+	dial := HTTPSUpstream(upstream.Addr().String(), &tls.Config{RootCAs: certs}, Direct)
+	conn, err := dial(context.Background(), true, "tcp", "example.com:443")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ping", string(buf), "should tunnel through upstream")
+	}
+}
+
+func TestHTTPSUpstreamSkipVerify(t *testing.T) {
+	upstream, _, err := newTLSUpstreamProxy(http.StatusOK)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	dial := HTTPSUpstream(upstream.Addr().String(), &tls.Config{InsecureSkipVerify: true}, Direct)
+	conn, err := dial(context.Background(), true, "tcp", "example.com:443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
+// newUpstreamProxy starts a stub upstream proxy that answers every CONNECT
+// with the given status and, on success, echoes back whatever it receives.
+func newUpstreamProxy(status int) (net.Listener, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	serveUpstreamProxy(l, status)
+	return l, nil
+}
+
+// newTLSUpstreamProxy is like newUpstreamProxy but serves over TLS with a
+// self-signed certificate, which is returned as a cert pool.
+func newTLSUpstreamProxy(status int) (net.Listener, *x509.CertPool, error) {
+	pk, err := keyman.GeneratePK(2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(time.Hour), true, nil, "Lantern", "127.0.0.1")
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPair, err := tls.X509KeyPair(cert.PEMEncoded(), pk.PEMEncoded())
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{keyPair}})
+	if err != nil {
+		return nil, nil, err
+	}
+	certs := x509.NewCertPool()
+	certs.AddCert(cert.X509())
+	serveUpstreamProxy(l, status)
+	return l, certs, nil
+}
+
+func serveUpstreamProxy(l net.Listener, status int) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+				if err := resp.Write(conn); err != nil || status != http.StatusOK {
+					return
+				}
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+}
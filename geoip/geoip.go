@@ -0,0 +1,348 @@
+// Package geoip looks up the countries of IP addresses in MaxMind DB files
+// (https://maxmind.github.io/MaxMind-DB/), like the GeoLite2 and GeoIP2
+// Country and City databases. It only implements what's needed for that, so
+// that the proxy doesn't depend on a full featured reader.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+
+	"github.com/getlantern/errors"
+)
+
+// dataSectionSeparator is the number of zero bytes between the search tree
+// and the data section.
+const dataSectionSeparator = 16
+
+// maxDecodeDepth bounds how deeply values nest so that corrupt databases
+// with cyclic pointers can't exhaust the stack.
+const maxDecodeDepth = 32
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// DB is an open MaxMind database. It's safe for concurrent use.
+type DB struct {
+	tree       []byte
+	data       decoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node for ::/96, under which IPv4 addresses are stored
+	// in IPv6 databases.
+	ipv4Start uint
+}
+
+// Open reads the MaxMind database at path into memory.
+func Open(path string) (*DB, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Unable to read GeoIP database %v: %v", path, err)
+	}
+	db, err := New(contents)
+	if err != nil {
+		return nil, errors.New("Invalid GeoIP database %v: %v", path, err)
+	}
+	return db, nil
+}
+
+// New parses a MaxMind database from its contents.
+func New(contents []byte) (*DB, error) {
+	markerAt := bytes.LastIndex(contents, metadataMarker)
+	if markerAt < 0 {
+		return nil, errors.New("No MaxMind DB metadata found")
+	}
+	metadata := decoder(contents[markerAt+len(metadataMarker):])
+	value, _, err := metadata.decode(0, 0)
+	if err != nil {
+		return nil, errors.New("Unable to decode metadata: %v", err)
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Metadata is a %T, not a map", value)
+	}
+	db := &DB{}
+	for name, field := range map[string]*uint{"node_count": &db.nodeCount, "record_size": &db.recordSize, "ip_version": &db.ipVersion} {
+		value, ok := fields[name].(uint64)
+		if !ok {
+			return nil, errors.New("Missing or invalid %v in metadata", name)
+		}
+		*field = uint(value)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, errors.New("Unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, errors.New("Unsupported IP version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+dataSectionSeparator > uint(markerAt) {
+		return nil, errors.New("Search tree of %d nodes doesn't fit in %d bytes", db.nodeCount, markerAt)
+	}
+	db.tree = contents[:treeSize]
+	db.data = decoder(contents[treeSize+dataSectionSeparator : markerAt])
+
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.readNode(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code (e.g. US) of the country in
+// which ip is located, or in which it's registered if its location is
+// unknown. It returns an empty code if ip isn't in the database.
+func (db *DB) Country(ip net.IP) (string, error) {
+	value, err := db.Lookup(ip)
+	if value == nil || err != nil {
+		return "", err
+	}
+	record, _ := value.(map[string]interface{})
+	for _, name := range []string{"country", "registered_country"} {
+		country, _ := record[name].(map[string]interface{})
+		if code, _ := country["iso_code"].(string); code != "" {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// Lookup returns the record for ip, decoded into maps, slices, strings,
+// bools, float32s, float64s, int32s, uint64s and *big.Ints, or nil if ip
+// isn't in the database.
+func (db *DB) Lookup(ip net.IP) (interface{}, error) {
+	var bits []byte
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if ip16 := ip.To16(); ip16 != nil && db.ipVersion == 6 {
+		bits = ip16
+	} else {
+		return nil, nil
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = db.readNode(node, bit)
+	}
+	if node <= db.nodeCount {
+		// Not found, or ran out of bits in a malformed tree
+		return nil, nil
+	}
+	offset := node - db.nodeCount - dataSectionSeparator
+	value, _, err := db.data.decode(offset, 0)
+	if err != nil {
+		return nil, errors.New("Unable to decode record for %v: %v", ip, err)
+	}
+	return value, nil
+}
+
+// readNode reads the left (bit 0) or right (bit 1) record of node.
+func (db *DB) readNode(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// decoder decodes values of the data section format, with pointers relative
+// to its start.
+type decoder []byte
+
+var errTruncated = errors.New("Truncated data")
+
+// decode decodes the value at offset, returning it and the offset following
+// it.
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, errors.New("Values nested too deeply")
+	}
+	ctrl, offset, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	kind := uint(ctrl[0] >> 5)
+	if kind == typePointer {
+		pointer, next, err := d.pointer(ctrl[0], offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+	if kind == typeExtended {
+		var extended []byte
+		if extended, offset, err = d.bytes(offset, 1); err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(extended[0])
+	}
+	size, offset, err := d.size(ctrl[0], offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("Map key is a %T, not a string", key)
+			}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[name] = value
+		}
+		return m, offset, nil
+	case typeArray:
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, errors.New("Invalid bool size %d", size)
+		}
+		return size == 1, offset, nil
+	}
+
+	b, next, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch kind {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("Invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("Invalid float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		maxSize := uint(8)
+		switch kind {
+		case typeUint16:
+			maxSize = 2
+		case typeUint32, typeInt32:
+			maxSize = 4
+		}
+		if size > maxSize {
+			return nil, 0, errors.New("Invalid size %d of integer type %d", size, kind)
+		}
+		value := uint64(0)
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		if kind == typeInt32 {
+			return int32(uint32(value)), next, nil
+		}
+		return value, next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errors.New("Invalid uint128 size %d", size)
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	default:
+		return nil, 0, errors.New("Unexpected data type %d", kind)
+	}
+}
+
+func (d decoder) bytes(offset uint, n uint) ([]byte, uint, error) {
+	if offset+n < offset || offset+n > uint(len(d)) {
+		return nil, 0, errTruncated
+	}
+	return d[offset : offset+n], offset + n, nil
+}
+
+func (d decoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	b, offset, err := d.bytes(offset, size-28)
+	if err != nil {
+		return 0, 0, err
+	}
+	value := uint(0)
+	for _, c := range b {
+		value = value<<8 | uint(c)
+	}
+	switch size {
+	case 29:
+		return 29 + value, offset, nil
+	case 30:
+		return 285 + value, offset, nil
+	default:
+		return 65821 + value, offset, nil
+	}
+}
+
+func (d decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	sizeBits := uint(ctrl>>3) & 0x3
+	b, offset, err := d.bytes(offset, sizeBits+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	value := uint(0)
+	if sizeBits < 3 {
+		value = uint(ctrl & 0x7)
+	}
+	for _, c := range b {
+		value = value<<8 | uint(c)
+	}
+	return value + [...]uint{0, 2048, 526336, 0}[sizeBits], offset, nil
+}
@@ -0,0 +1,247 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testNetworks = map[string]string{
+	"1.2.3.0/24":    "AU",
+	"81.0.0.0/8":    "DE",
+	"2001:db8::/32": "US",
+}
+
+func TestCountry(t *testing.T) {
+	for _, format := range []struct{ ipVersion, recordSize uint }{{4, 24}, {4, 32}, {6, 24}, {6, 28}, {6, 32}} {
+		db, err := New(buildDB(format.ipVersion, format.recordSize, testNetworks))
+		if !assert.NoError(t, err, "%+v", format) {
+			continue
+		}
+		expected := map[string]string{
+			"1.2.3.4":          "AU",
+			"::ffff:1.2.3.255": "AU",
+			"1.2.4.1":          "",
+			"81.9.9.9":         "DE",
+			"82.0.0.1":         "",
+			"2001:db8::1":      "US",
+			"2001:db9::1":      "",
+		}
+		if format.ipVersion == 4 {
+			expected["2001:db8::1"] = ""
+		}
+		for ip, country := range expected {
+			actual, err := db.Country(net.ParseIP(ip))
+			if assert.NoError(t, err, "%+v %v", format, ip) {
+				assert.Equal(t, country, actual, "%+v %v", format, ip)
+			}
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	db, err := New(buildDB(6, 28, testNetworks))
+	if !assert.NoError(t, err) {
+		return
+	}
+	record, err := db.Lookup(net.ParseIP("81.1.1.1"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE", "is_in_european_union": true, "geoname_id": uint64(2921044)},
+		}, record)
+	}
+	record, err = db.Lookup(net.ParseIP("82.1.1.1"))
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestInvalid(t *testing.T) {
+	_, err := New([]byte("not a database"))
+	assert.Error(t, err)
+
+	valid := buildDB(4, 24, testNetworks)
+	markerAt := strings.LastIndex(string(valid), string(metadataMarker))
+	_, err = New(append(append([]byte(nil), valid[:markerAt+len(metadataMarker)]...), valid[markerAt+len(metadataMarker)+1:]...))
+	assert.Error(t, err, "should fail to decode truncated metadata")
+	_, err = New(valid[markerAt-10:])
+	assert.Error(t, err, "should fail without room for the search tree")
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.mmdb")
+	_, err = Open(path)
+	assert.Error(t, err, "should fail to open missing database")
+	ioutil.WriteFile(path, valid, 0644)
+	db, err := Open(path)
+	if assert.NoError(t, err) {
+		country, _ := db.Country(net.ParseIP("1.2.3.4"))
+		assert.Equal(t, "AU", country)
+	}
+}
+
+func TestDecodeSizes(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	longer := strings.Repeat("y", 70000)
+	var encoded []byte
+	encoded = appendString(encoded, long)
+	encoded = appendString(encoded, longer)
+	d := decoder(encoded)
+	value, next, err := d.decode(0, 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, long, value)
+	}
+	value, _, err = d.decode(next, 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, longer, value)
+	}
+	_, _, err = d.decode(0, maxDecodeDepth+1)
+	assert.Error(t, err)
+	_, _, err = decoder(encoded[:100]).decode(0, 0)
+	assert.Error(t, err, "should fail to decode truncated string")
+}
+
+// buildDB builds a MaxMind database in which the given networks are in the
+// given countries.
+func buildDB(ipVersion, recordSize uint, networks map[string]string) []byte {
+	type node struct {
+		children [2]int
+		// data holds offsets in the data section plus one
+		data [2]int
+	}
+	nodes := []*node{{}}
+	var data []byte
+	countries := make(map[string]int)
+	for network, country := range networks {
+		_, ipNet, _ := net.ParseCIDR(network)
+		ones, bits := ipNet.Mask.Size()
+		ip := []byte(ipNet.IP)
+		if bits == 32 && ipVersion == 6 {
+			ip = append(make([]byte, 12), ip...)
+			ones += 96
+		} else if bits == 128 && ipVersion == 4 {
+			continue
+		}
+
+		// Share country records among networks through pointers
+		countryAt, found := countries[country]
+		if !found {
+			countryAt = len(data)
+			countries[country] = countryAt
+			data = appendControl(data, typeMap, 3)
+			data = appendString(data, "iso_code")
+			data = appendString(data, country)
+			data = appendString(data, "is_in_european_union")
+			data = appendControl(data, typeBool, map[bool]int{false: 0, true: 1}[country == "DE"])
+			data = appendString(data, "geoname_id")
+			data = appendUint(data, typeUint32, 2921044)
+		}
+		recordAt := len(data)
+		data = appendControl(data, typeMap, 1)
+		data = appendString(data, "country")
+		data = append(data, byte(typePointer<<5|countryAt>>8), byte(countryAt))
+
+		current := nodes[0]
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if i == ones-1 {
+				current.data[bit] = recordAt + 1
+			} else {
+				if current.children[bit] == 0 {
+					current.children[bit] = len(nodes)
+					nodes = append(nodes, &node{})
+				}
+				current = nodes[current.children[bit]]
+			}
+		}
+	}
+
+	nodeCount := uint(len(nodes))
+	var db []byte
+	for _, n := range nodes {
+		var records [2]uint
+		for bit := range records {
+			switch {
+			case n.children[bit] != 0:
+				records[bit] = uint(n.children[bit])
+			case n.data[bit] != 0:
+				records[bit] = nodeCount + dataSectionSeparator + uint(n.data[bit]-1)
+			default:
+				records[bit] = nodeCount
+			}
+		}
+		switch recordSize {
+		case 24:
+			for _, r := range records {
+				db = append(db, byte(r>>16), byte(r>>8), byte(r))
+			}
+		case 28:
+			db = append(db, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[0]>>20&0xf0|records[1]>>24&0x0f), byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 32:
+			for _, r := range records {
+				db = binary.BigEndian.AppendUint32(db, uint32(r))
+			}
+		}
+	}
+	db = append(db, make([]byte, dataSectionSeparator)...)
+	db = append(db, data...)
+	db = append(db, metadataMarker...)
+	db = appendControl(db, typeMap, 6)
+	db = appendString(db, "node_count")
+	db = appendUint(db, typeUint32, uint64(nodeCount))
+	db = appendString(db, "record_size")
+	db = appendUint(db, typeUint16, uint64(recordSize))
+	db = appendString(db, "ip_version")
+	db = appendUint(db, typeUint16, uint64(ipVersion))
+	db = appendString(db, "database_type")
+	db = appendString(db, "Test-Country")
+	db = appendString(db, "build_epoch")
+	db = appendUint(db, typeUint64, 1700000000)
+	db = appendString(db, "languages")
+	db = appendControl(db, typeArray, 1)
+	db = appendString(db, "en")
+	return db
+}
+
+func appendControl(b []byte, kind int, size int) []byte {
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		sizeBytes = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		sizeBytes = []byte{byte((size - 285) >> 8), byte(size - 285)}
+		size = 30
+	default:
+		sizeBytes = []byte{byte((size - 65821) >> 16), byte((size - 65821) >> 8), byte(size - 65821)}
+		size = 31
+	}
+	if kind > 7 {
+		b = append(b, byte(size), byte(kind-7))
+	} else {
+		b = append(b, byte(kind<<5|size))
+	}
+	return append(b, sizeBytes...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendControl(b, typeString, len(s)), s...)
+}
+
+func appendUint(b []byte, kind int, v uint64) []byte {
+	var value []byte
+	for ; v > 0; v >>= 8 {
+		value = append([]byte{byte(v)}, value...)
+	}
+	return append(appendControl(b, kind, len(value)), value...)
+}
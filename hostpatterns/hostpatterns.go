@@ -0,0 +1,63 @@
+// Package hostpatterns matches host names against patterns that are either
+// exact host names or wildcards like "*.example.com", which match any
+// subdomain of example.com (but not example.com itself).
+package hostpatterns
+
+import (
+	"strings"
+)
+
+// Patterns is a set of host patterns. Matching is case insensitive and
+// ignores trailing dots. An exact host name takes precedence over wildcards
+// and wildcards for closer parent domains take precedence over those for
+// farther ones.
+type Patterns struct {
+	exact    map[string]string
+	suffixes map[string]string
+}
+
+// New builds Patterns from the given patterns, ignoring empty ones.
+func New(patterns []string) *Patterns {
+	p := &Patterns{
+		exact:    make(map[string]string),
+		suffixes: make(map[string]string),
+	}
+	for _, pattern := range patterns {
+		normalized := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+		if normalized == "" {
+			continue
+		}
+		if strings.HasPrefix(normalized, "*.") {
+			p.suffixes[normalized[1:]] = pattern
+		} else {
+			p.exact[normalized] = pattern
+		}
+	}
+	return p
+}
+
+// Empty reports whether there are no patterns.
+func (p *Patterns) Empty() bool {
+	return len(p.exact) == 0 && len(p.suffixes) == 0
+}
+
+// Match checks whether the given host (without a port) matches any of the
+// patterns, returning the matching pattern as given to New.
+func (p *Patterns) Match(host string) (string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern, found := p.exact[host]; found {
+		return pattern, true
+	}
+	// Check each parent domain, e.g. ".example.com" for "www.example.com"
+	for rest := host; ; rest = rest[1:] {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			break
+		}
+		rest = rest[i:]
+		if pattern, found := p.suffixes[rest]; found {
+			return pattern, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,28 @@
+package hostpatterns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	p := New([]string{"*.example.com", "*.api.example.com", "Poll.API.example.com", "quiet.example.org.", " "})
+	match := func(host string) string {
+		pattern, _ := p.Match(host)
+		return pattern
+	}
+	assert.False(t, p.Empty())
+	assert.Equal(t, "*.example.com", match("www.example.com"))
+	assert.Equal(t, "*.api.example.com", match("v1.api.example.com"), "closer wildcard should take precedence")
+	assert.Equal(t, "Poll.API.example.com", match("poll.api.example.com."), "exact name should take precedence over wildcards")
+	assert.Equal(t, "*.example.com", match("api.example.com"), "wildcard should not match its own domain")
+	assert.Equal(t, "quiet.example.org.", match("QUIET.example.org"))
+	_, found := p.Match("example.com")
+	assert.False(t, found)
+	_, found = p.Match("other.org")
+	assert.False(t, found)
+
+	assert.True(t, New(nil).Empty())
+	assert.True(t, New([]string{"", " "}).Empty(), "empty patterns should be ignored")
+}
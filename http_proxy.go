@@ -1,72 +1,843 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy/v2"
 
-	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/admin"
+	"github.com/getlantern/http-proxy/buffers"
+	"github.com/getlantern/http-proxy/dialers"
+	"github.com/getlantern/http-proxy/geoip"
+	"github.com/getlantern/http-proxy/httpproxy"
 	"github.com/getlantern/http-proxy/logging"
+	"github.com/getlantern/http-proxy/metrics"
 	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/reporting"
 	"github.com/getlantern/http-proxy/server"
 )
 
+// version and buildDate identify the build, set with
+// -ldflags "-X main.version=1.2.3 -X main.buildDate=2020-01-02".
+var (
+	version   = "development"
+	buildDate = "unknown"
+)
+
 var (
 	log = golog.LoggerFor("http-proxy")
 
-	help      = flag.Bool("help", false, "Get usage help")
-	keyfile   = flag.String("key", "", "Private key file name")
-	certfile  = flag.String("cert", "", "Certificate file name")
-	https     = flag.Bool("https", false, "Use TLS for client to proxy communication")
-	addr      = flag.String("addr", ":8080", "Address to listen")
-	maxConns  = flag.Uint64("maxconns", 0, "Max number of simultaneous connections allowed connections")
-	idleClose = flag.Uint64("idleclose", 30, "Time in seconds that an idle connection will be allowed before closing it")
+	help         = flag.Bool("help", false, "Get usage help")
+	printVer     = flag.Bool("version", false, "Print the version and exit")
+	keyfile      = flag.String("key", "", "Private key file name")
+	certfile     = flag.String("cert", "", "Certificate file name")
+	https        = flag.Bool("https", false, "Use TLS for client to proxy communication")
+	tlsMin       = flag.String("tlsminversion", "1.2", "Minimum TLS version to accept when using -https, one of 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers   = flag.String("tlsciphers", "", "Comma separated list of TLS cipher suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) to accept when using -https; Go's defaults if empty")
+	clientCAs    = flag.String("clientcas", "", "PEM file with CA certificates; if set, only clients presenting a certificate signed by one of them are accepted when using -https")
+	sniCerts     = flag.String("snicerts", "", "Comma separated list of additional certfile:keyfile pairs to serve by SNI when using -https, -cert and -key are served by default")
+	addr         = flag.String("addr", ":8080", "Address to listen, or a comma-separated list of them. Prefix with unix: to listen at a Unix domain socket; $HTTPPROXY_ADDR if not given")
+	maxConns     = flag.Uint64("maxconns", 0, "Max number of simultaneous connections allowed connections")
+	forwardOnly  = flag.Bool("forwardonly", false, "Only forward plain HTTP requests, rejecting all CONNECT requests with 405 Method Not Allowed")
+	maxTunnels   = flag.Int("maxtunnels", 0, "Max number of simultaneous CONNECT tunnels allowed in total; unlimited if 0")
+	acceptRate   = flag.Int("maxacceptrate", 0, "Max number of new client connections to accept per second, delaying accepts beyond it; unlimited if 0")
+	maxConnsIP   = flag.Int("maxconnsperip", 0, "Max number of simultaneous CONNECT tunnels allowed per client IP; unlimited if 0")
+	clientQuota  = flag.Int64("clientquota", 0, "Max bytes that each client IP may send and receive through CONNECT tunnels within -clientquotawindow before new tunnels are rejected with 429; unlimited if 0")
+	quotaWindow  = flag.Uint64("clientquotawindow", 3600, "Time in seconds over which -clientquota applies, rolling in steps of a twelfth of it")
+	tunnelLife   = flag.Uint64("maxtunnelduration", 0, "Time in seconds after which CONNECT tunnels are closed regardless of activity; unlimited if 0")
+	idleClose    = flag.Uint64("idleclose", 30, "Time in seconds that an idle connection will be allowed before closing it; $HTTPPROXY_IDLECLOSE if not given")
+	idleOverride = flag.String("idleoverrides", "", "Comma separated list of host=seconds overriding -idleclose for connections to matching destinations, where host is an exact name or a wildcard like *.example.com; client connections idle after the override once they tunnel to a matching destination")
+	token        = flag.String("token", "", "Lantern token required in the -tokenheader header; $HTTPPROXY_TOKEN if not given, none if empty")
+	usersFile    = flag.String("proxyusersfile", "", "File with one user:password pair per line, whose Basic credentials are required in the Proxy-Authorization header of requests besides any -token; disabled if empty")
+	logAuthFail  = flag.Bool("logauthfailures", false, "Log the headers of requests rejected for lacking the -token or -proxyusersfile credentials, with the credentials redacted")
+	authRealm    = flag.String("proxyauthrealm", "http-proxy", "Realm to which clients are asked to authenticate when using -proxyusersfile")
+	tokenHeader  = flag.String("tokenheader", proxyfilters.DefaultTokenHeader, "Header in which clients send the -token, e.g. Proxy-Authorization for legacy clients")
+	tokenStatus  = flag.Int("tokenrejectstatus", 0, "Status of responses to requests lacking the -token, e.g. 302 along with a Location in -tokenrejectheaders, for clients that need to tell auth failures apart; 403 if 0")
+	tokenBody    = flag.String("tokenrejectbody", "", "Body of responses to requests lacking the -token")
+	tokenHeaders = flag.String("tokenrejectheaders", "", "Comma separated list of Name: value headers of responses to requests lacking the -token, e.g. Location: https://example.com/login")
+	upstream     = flag.String("upstream", "", "Address of an HTTP proxy through which to tunnel CONNECT requests, if any. Prefix with https:// to connect to it over TLS, or use socks5://[user:pass@]host:port to send all requests through a SOCKS5 proxy. Comma separated addresses, each optionally followed by =weight as in proxy1:8080=3,proxy2:8080, spread requests among several proxies by weighted round-robin")
+	ejectAfter   = flag.Int("upstreamejectafter", 3, "Number of failed dials in a row after which one of several -upstream proxies is taken out of rotation; never if 0")
+	ejectFor     = flag.Int("upstreamejectfor", 30, "Time in seconds for which one of several -upstream proxies is taken out of rotation after failing")
+	upstreamSkip = flag.Bool("upstreaminsecure", false, "Skip verifying the certificate of an https:// -upstream")
+	upstreamUA   = flag.String("upstreamuseragent", dialers.DefaultUserAgent, "User-Agent of CONNECT requests to an http:// or https:// -upstream; none if empty")
+	upstreamVia  = flag.String("upstreamvia", "", "Via header of CONNECT requests to an http:// or https:// -upstream, e.g. \"1.1 my-proxy\"; none if empty")
+	dialTimeout  = flag.Uint64("dialtimeout", 10, "Time in seconds to wait for dialing upstream before giving up, at least 1")
+	dnsCacheTTL  = flag.Uint64("dnscachettl", 0, "Time in seconds to cache DNS lookups for; caching is disabled if 0")
+	dnsCacheSize = flag.Int("dnscachesize", 10000, "Max number of hosts to keep in the DNS cache")
+	sourceIP     = flag.String("sourceip", "", "Local IP that connections to origins and upstream proxies are dialed from, for example to pick the egress address on multi-homed hosts; chosen by the OS if empty")
+	dialNetwork  = flag.String("dialnetwork", "tcp", "Network to use when dialing upstream, one of tcp, tcp4 or tcp6 to force IPv4 or IPv6 only")
+	dialRetries  = flag.Int("dialretries", 0, "Number of times to retry dialing upstream on connection refused or timeout errors")
+	dialBackoff  = flag.Uint64("dialretrybackoff", 100, "Time in milliseconds to wait before the first dial retry, doubling on each subsequent retry")
+	dialsPerHost = flag.Int("maxdialsperhost", 0, "Max number of CONNECT requests dialing the same host:port at once, others wait for -dialwait and are then rejected; unlimited if 0")
+	dialWait     = flag.Uint64("dialwait", 1000, "Time in milliseconds that CONNECT requests over -maxdialsperhost wait for a dial to finish")
+	breakerFails = flag.Int("breakerfailures", 0, "Number of dials to a CONNECT host:port that may fail in a row within -breakerwindow before requests to it are rejected with 503 Service Unavailable for -breakercooldown, after which one request probes it; disabled if 0")
+	breakerWin   = flag.Uint64("breakerwindow", 60, "Time in seconds within which failed dials to a host:port count towards -breakerfailures")
+	breakerCool  = flag.Uint64("breakercooldown", 30, "Time in seconds for which requests to a host:port are rejected after -breakerfailures")
+	allowedPorts = flag.String("allowedports", "", "Comma separated list of ports and port ranges (e.g. 443,1024-65535) to which CONNECT requests are allowed, or * for all ports 1-65535; unrestricted if empty, so that CONNECT requests without a valid port are passed on too; $HTTPPROXY_ALLOWEDPORTS if not given")
+	hintPorts    = flag.Bool("hintallowedports", false, "List the allowed ports in the 403 Forbidden errors of CONNECT requests to other ports, to help client developers; the errors leave them out if false")
+	portsFile    = flag.String("allowedportsfile", "", "File with allowed ports in the format of -allowedports, one or more entries per line, that is reloaded on SIGHUP; takes the place of -allowedports")
+	allowedHosts = flag.String("allowedhosts", "", "Comma separated list of hosts (e.g. example.com or *.example.com) to which CONNECT requests are allowed; all if empty")
+	serverNames  = flag.String("allowedservernames", "", "Comma separated list of TLS server names (e.g. example.com or *.example.com) that the ClientHello sent through CONNECT tunnels must be for, dropping other tunnels, including ones not carrying TLS; all if empty")
+	deniedHosts  = flag.String("deniedhosts", "", "Comma separated list of hosts to which CONNECT requests are denied, takes precedence over -allowedhosts")
+	connectPort  = flag.Int("defaultconnectport", 0, "Port assumed for CONNECT requests without one, e.g. 443 for clients that send CONNECT example.com; such requests are rejected with 400 Bad Request if 0")
+	routes       = flag.String("routes", "", "Comma separated list of host:port=host:port overrides of CONNECT destinations, e.g. example.com:443=10.0.0.5:443 to dial 10.0.0.5:443 for example.com:443")
+	blockPrivate = flag.Bool("blockprivate", false, "Reject CONNECT and forwarded requests to hosts that are or resolve to loopback, link-local or private network addresses, or that can't be resolved, and refuse dialing such addresses")
+	geoipDB      = flag.String("geoipdb", "", "MaxMind GeoIP2 or GeoLite2 Country or City database (.mmdb) in which to look up the countries of CONNECT destinations for -deniedcountries")
+	deniedCCs    = flag.String("deniedcountries", "", "Comma separated list of ISO country codes (e.g. KP,IR) of countries to which CONNECT requests are denied according to -geoipdb")
+	connectUDP   = flag.Bool("experimentalconnectudp", false, "EXPERIMENTAL: proxy UDP for clients upgrading HTTP/1.1 requests to connect-udp (RFC 9298), subject to the same restrictions as CONNECT destinations")
+	adminAddr    = flag.String("adminaddr", "", "Loopback address (e.g. 127.0.0.1:9001) at which to accept the admin commands drain, shutdown, reload-ports, stats and upstreams, one per line; disabled if empty")
+	metricsAddr  = flag.String("metricsaddr", "", "Address at which to serve Prometheus metrics under /metrics; disabled if empty")
+	tunnelBkts   = flag.String("tunneldurationbuckets", "", "Comma separated upper bounds in seconds, in increasing order, of the buckets of the CONNECT tunnel duration histogram; defaults to 0.1 seconds to an hour")
+	syslogAddr   = flag.String("syslog", "", "Send logs to syslog instead of stdout and stderr, either local for the local syslog daemon or the address of a remote one like udp:logs.example.com:514 or tcp:logs.example.com:601, UDP if no prefix; logs stay on stdout and stderr if syslog is unreachable at startup; $HTTPPROXY_SYSLOG if not given, disabled if empty")
+	syslogFac    = flag.String("syslogfacility", "daemon", "Syslog facility of logs sent to -syslog, e.g. daemon or local0; $HTTPPROXY_SYSLOGFACILITY if not given")
+	syslogTag    = flag.String("syslogtag", "http-proxy", "Tag of logs sent to -syslog; $HTTPPROXY_SYSLOGTAG if not given")
+	accessLog    = flag.String("accesslog", "", "File to which to append a JSON record for each CONNECT request; disabled if empty")
+	reporter     = flag.String("reporter", "none", "Where to report measured client traffic to, one of none or http")
+	reportURL    = flag.String("reporturl", "", "URL to which to POST reports when using -reporter http")
+	reportSecs   = flag.Uint64("reportinterval", 60, "Time in seconds between reports of measured client traffic")
+	flushSecs    = flag.Uint64("reportflushinterval", 0, "Time in seconds between posts of batched reports when using -reporter http, defaults to -reportinterval")
+	region       = flag.String("region", "", "Datacenter or region of the proxy, added to the context of all reports as region so that collectors can aggregate reports by region; $HTTPPROXY_REGION if not given, none if empty")
+	reportPrefix = flag.String("reportprefix", "", "Prefix for the context keys of reports, to keep deployments sharing a collector apart")
+	errorFormat  = flag.String("errorformat", "text", "Format of error responses sent to clients, one of text or json")
+	trustProxies = flag.String("trustedproxies", "", "Comma separated list of CIDRs of proxies in front of this one whose X-Forwarded-For headers are trusted to identify clients")
+	healthPath   = flag.String("healthpath", "/healthz", "Path at which to respond to health checks made directly to the proxy; disabled if empty")
+	statusPath   = flag.String("statuspath", "/debug/status", "Path at which to respond to status requests made directly to the proxy, which require -token; disabled if empty")
+	tunnelsPath  = flag.String("tunnelspath", "/debug/tunnels", "Path at which to list open CONNECT tunnels with their age and destination, oldest first, for requests made directly to the proxy, which require -token; disabled if empty")
+	okReason     = flag.String("connectokreason", "Connection established", "Reason phrase of OK responses to CONNECT requests, e.g. OK for clients that expect 200 OK")
+	writeTimeout = flag.Int64("responsewritetimeout", 5, "Time in seconds to wait for writing an error or CONNECT OK response to a client before giving up; unlimited if negative")
+	forwardPool  = flag.Int("forwardpool", 0, "Number of idle keep-alive connections per origin to share among all clients for forwarding plain HTTP requests; not shared if 0")
+	forwardIdle  = flag.Uint64("forwardidletimeout", 90, "Time in seconds after which idle shared connections to origins are closed")
+	keepAlive    = flag.Int64("tcpkeepalive", 15, "Time in seconds that client and upstream TCP connections may idle before sending keep-alive probes to detect dead peers; disabled if negative")
+	clientNagle  = flag.Bool("clientnagle", false, "Enable Nagle's algorithm on client connections, batching small writes to clients at the cost of latency; TCP_NODELAY is set otherwise")
+	upNagle      = flag.Bool("upstreamnagle", false, "Enable Nagle's algorithm on connections to origins and upstream proxies, batching small bulk writes at the cost of latency; TCP_NODELAY is set otherwise")
+	backlog      = flag.Int("listenbacklog", 0, "Max number of connections the kernel completes before the proxy accepts them, dropping further SYNs; capped by net.core.somaxconn on Linux, which is used if 0")
+	reusePort    = flag.Bool("reuseport", false, "Set SO_REUSEPORT on listening sockets so that a new instance can listen at the same address during a restart; Linux only, ignored elsewhere")
+	maxHeader    = flag.Int("maxheaderbytes", http.DefaultMaxHeaderBytes, "Maximum size in bytes of the header of each request on a client connection, such as a CONNECT; unlimited if negative")
+	maxBody      = flag.Int64("maxbodybytes", 0, "Maximum size in bytes of the bodies of forwarded plain HTTP requests, e.g. POSTs, doesn't apply to CONNECT tunnels; unlimited if 0")
+	maxRespHdr   = flag.Int("maxresponseheaderbytes", 0, "Maximum size in bytes of the headers of responses to forwarded plain HTTP requests, answering with 502 Bad Gateway if an origin exceeds it; unlimited if 0")
+	checkAddr    = flag.String("selfcheckaddr", "", "Address to resolve and dial on startup to check that origins can be reached, e.g. www.google.com:443; disabled if empty")
+	strictStart  = flag.Bool("strictstartup", false, "Exit if the startup self check fails instead of just logging the failure")
+	stopTimeout  = flag.Uint64("stoptimeout", 30, "Time in seconds to wait for open connections to finish when stopping on SIGINT or SIGTERM, after which they're closed")
+	drainIdle    = flag.Uint64("drainidle", 5, "Time in seconds without traffic after which connections are closed right away when stopping, instead of waiting for them up to -stoptimeout")
+	throttleUp   = flag.Int64("throttleup", 0, "Max bytes per second sent to origins through each CONNECT tunnel; unlimited if 0")
+	throttleDown = flag.Int64("throttledown", 0, "Max bytes per second received from origins through each CONNECT tunnel; unlimited if 0")
+	bufferSize   = flag.Int("buffersize", buffers.DefaultSize, "Size in bytes of the buffers used to copy data through CONNECT tunnels")
+	maxBuffers   = flag.Int("maxbuffers", 0, "Max number of idle copy buffers to retain for reuse; unbounded and left to the garbage collector if 0")
+	proxyProto   = flag.Bool("proxyprotocol", false, "Require a PROXY protocol v1 header on incoming connections, e.g. when behind a load balancer")
 )
 
 func main() {
 	var err error
 
 	_ = flag.CommandLine.Parse(os.Args[1:])
+	if err := applyEnvFallbacks(flag.CommandLine, envFallbacks); err != nil {
+		log.Fatal(err)
+	}
 	if *help {
 		flag.Usage()
 		return
 	}
+	if *printVer {
+		fmt.Printf("http-proxy %v (built %v with %v)\n", version, buildDate, runtime.Version())
+		return
+	}
 
 	// Logging
-	// TODO: use real parameters
-	err = logging.Init("instanceid", "version", "releasedate")
+	// TODO: use a real instance ID
+	err = logging.Init("instanceid", version, buildDate)
 	if err != nil {
 		log.Error(err)
 	}
+	if *syslogAddr != "" {
+		if err := logging.InitSyslog(*syslogAddr, *syslogFac, *syslogTag); err != nil {
+			log.Errorf("Logging to stdout and stderr instead of syslog: %v", err)
+		}
+	}
+
+	// Metrics
+	if *tunnelBkts != "" {
+		buckets, err := parseBuckets(*tunnelBkts)
+		if err != nil {
+			log.Fatalf("Invalid -tunneldurationbuckets: %v", err)
+		}
+		proxyfilters.SetTunnelDurationBuckets(buckets)
+	}
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	if *dialTimeout == 0 {
+		log.Fatal("-dialtimeout must be at least 1 second")
+	}
+	switch *dialNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		log.Fatalf("Invalid -dialnetwork %v, expected tcp, tcp4 or tcp6", *dialNetwork)
+	}
+
+	// Dial directly unless we're chaining to an upstream proxy
+	keepAlivePeriod := time.Duration(*keepAlive) * time.Second
+	direct := dialers.DirectWithKeepAlive(keepAlivePeriod)
+	if *sourceIP != "" {
+		direct, err = dialers.DirectFromIP(*sourceIP, keepAlivePeriod)
+		if err != nil {
+			log.Fatalf("Invalid -sourceip: %v", err)
+		}
+	}
+	if *upNagle {
+		direct = dialers.WithNagle(direct)
+	}
+	dial := dialers.WithDNSCache(direct, time.Duration(*dnsCacheTTL)*time.Second, *dnsCacheSize)
+	if *dialNetwork != "tcp" {
+		dial = dialers.ForceNetwork(dial, *dialNetwork)
+	}
+	connectHeader := http.Header{"User-Agent": {*upstreamUA}}
+	if *upstreamVia != "" {
+		connectHeader.Set("Via", *upstreamVia)
+	}
+	var balancer *dialers.Balancer
+	if *upstream != "" {
+		upstreams, err := parseUpstreams(*upstream, connectHeader, dial)
+		if err != nil {
+			log.Fatalf("Invalid -upstream: %v", err)
+		}
+		if len(upstreams) == 1 {
+			dial = upstreams[0].Dial
+		} else {
+			balancer, err = dialers.NewBalancer(upstreams, *ejectAfter, time.Duration(*ejectFor)*time.Second)
+			if err != nil {
+				log.Fatalf("Invalid -upstream: %v", err)
+			}
+			dial = balancer.Dial
+		}
+	}
+
+	// Make sure we can actually reach origins
+	if *checkAddr != "" {
+		// When chaining, the upstream proxy resolves origins
+		if err := selfCheck(dial, *checkAddr, *upstream == "", time.Duration(*dialTimeout)*time.Second); err != nil {
+			if *strictStart {
+				log.Fatalf("Startup self check failed: %v", err)
+			}
+			log.Errorf("Startup self check failed, origins may be unreachable: %v", err)
+		} else {
+			log.Debugf("Startup self check passed, reached %v", *checkAddr)
+		}
+	}
+
+	// Reporting
+	if *reportSecs == 0 {
+		log.Fatal("-reportinterval must be at least 1 second")
+	}
+	reportInterval := time.Duration(*reportSecs) * time.Second
+	flushInterval := reportInterval
+	if *flushSecs > 0 {
+		flushInterval = time.Duration(*flushSecs) * time.Second
+	}
+	rep, err := reporting.New(*reporter, *reportURL, *reportPrefix, flushInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *region != "" {
+		rep = reporting.WithLabels(rep, map[string]interface{}{"region": *region})
+	}
+
+	tlsConfig, err := buildTLSConfig(*tlsMin, *tlsCiphers, *sniCerts, *clientCAs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tokenRejection *proxyfilters.TokenRejection
+	if *tokenStatus != 0 || *tokenBody != "" || *tokenHeaders != "" {
+		header, err := parseHeaders(*tokenHeaders)
+		if err != nil {
+			log.Fatalf("Invalid -tokenrejectheaders: %v", err)
+		}
+		tokenRejection = &proxyfilters.TokenRejection{StatusCode: *tokenStatus, Header: header, Body: []byte(*tokenBody)}
+	}
+
+	routeOverrides, err := parseRoutes(*routes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idleOverrides, err := parseIdleOverrides(*idleOverride)
+	if err != nil {
+		log.Fatalf("Invalid -idleoverrides: %v", err)
+	}
+
+	var errorResponder server.ErrorResponder
+	switch *errorFormat {
+	case "text":
+	case "json":
+		errorResponder = jsonError
+	default:
+		log.Fatalf("Unknown error format %v", *errorFormat)
+	}
+
+	var accessLogFile io.Writer
+	if *accessLog != "" {
+		file, err := os.OpenFile(*accessLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Unable to open access log %v: %v", *accessLog, err)
+		}
+		defer file.Close()
+		accessLogFile = file
+	}
+	var ports []int
+	if *portsFile != "" {
+		if *allowedPorts != "" {
+			log.Fatal("Only one of -allowedports and -allowedportsfile may be specified")
+		}
+		ports, err = proxyfilters.AllowedPortsFromFile(*portsFile)
+	} else {
+		ports, err = proxyfilters.AllowedPortsFromCSV(*allowedPorts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	portList := proxyfilters.NewPortList(ports)
+	if *portsFile != "" {
+		go reloadAllowedPorts(*portsFile, portList)
+	}
+
+	var countries proxyfilters.CountryLookup
+	if *deniedCCs != "" {
+		if *geoipDB == "" {
+			log.Fatal("-deniedcountries requires -geoipdb")
+		}
+		db, err := geoip.Open(*geoipDB)
+		if err != nil {
+			// Better to keep proxying than to block everything
+			log.Errorf("NOT BLOCKING ANY COUNTRIES, unable to load GeoIP database: %v", err)
+		} else {
+			countries = db
+		}
+	}
+
+	var basicAuth func(user, password string) bool
+	if *usersFile != "" {
+		passwords, err := proxyfilters.BasicAuthUsersFromFile(*usersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		basicAuth = proxyfilters.BasicAuthUsers(passwords)
+	}
+
+	var adminListener net.Listener
+	if *adminAddr != "" {
+		adminListener, err = admin.Listen(*adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Create server
-	srv := server.New(&server.Opts{
-		IdleTimeout: time.Duration(*idleClose),
-		Filter:      proxyfilters.BlockLocal([]string{}),
+	buffers.SetSize(*bufferSize)
+	buffers.SetMaxRetained(*maxBuffers)
+	srv, err := httpproxy.New(&httpproxy.Opts{
+		Server: server.Opts{
+			BufferSource:           buffers.Source,
+			IdleTimeout:            time.Duration(*idleClose) * time.Second,
+			IdleTimeoutOverrides:   idleOverrides,
+			Dial:                   dial,
+			DialTimeout:            time.Duration(*dialTimeout) * time.Second,
+			DialRetries:            *dialRetries,
+			DialRetryBackoff:       time.Duration(*dialBackoff) * time.Millisecond,
+			ProxyProtocol:          *proxyProto,
+			TLSConfig:              tlsConfig,
+			ErrorResponder:         errorResponder,
+			ConnectOKReason:        *okReason,
+			ResponseWriteTimeout:   time.Duration(*writeTimeout) * time.Second,
+			MaxHeaderBytes:         *maxHeader,
+			MaxBodyBytes:           *maxBody,
+			MaxResponseHeaderBytes: *maxRespHdr,
+			ForwardPoolSize:        *forwardPool,
+			ForwardIdleTimeout:     time.Duration(*forwardIdle) * time.Second,
+			KeepAlive:              keepAlivePeriod,
+			ReusePort:              *reusePort,
+			ClientNagle:            *clientNagle,
+			Backlog:                *backlog,
+			MaxAcceptRate:          *acceptRate,
+		},
+		Token:           *token,
+		TokenHeader:     *tokenHeader,
+		LogAuthFailures: *logAuthFail,
+		TokenRejection:  tokenRejection,
+		BasicAuth:       basicAuth,
+		BasicAuthRealm:  *authRealm,
+		HealthPath:      *healthPath,
+		Version:         version,
+		StatusPath:      *statusPath,
+		TunnelsPath:     *tunnelsPath,
+		TrustedProxies:  strings.Split(*trustProxies, ","),
+		AccessLog:       accessLogFile,
+		Reporter:        rep,
+		ReportInterval:  reportInterval,
+		ForwardOnly:     *forwardOnly,
+		DefaultPort:     *connectPort,
+		MaxConns:        *maxConns,
+		MaxTunnels:      *maxTunnels,
+		MaxConnsPerIP:   *maxConnsIP,
+		ClientQuota:     *clientQuota,
+		QuotaWindow:     time.Duration(*quotaWindow) * time.Second,
+		TunnelLifetime:  time.Duration(*tunnelLife) * time.Second,
+		AllowedPortList: portList,
+		HintPorts:       *hintPorts,
+		AllowedHosts:    strings.Split(*allowedHosts, ","),
+		ServerNames:     strings.Split(*serverNames, ","),
+		DeniedHosts:     strings.Split(*deniedHosts, ","),
+		Routes:          routeOverrides,
+		BlockPrivate:    *blockPrivate,
+		Countries:       countries,
+		DeniedCountries: strings.Split(*deniedCCs, ","),
+		ConnectUDP:      *connectUDP,
+		ThrottleUp:      *throttleUp,
+		ThrottleDown:    *throttleDown,
+		BreakerFailures: *breakerFails,
+		BreakerWindow:   time.Duration(*breakerWin) * time.Second,
+		BreakerCooldown: time.Duration(*breakerCool) * time.Second,
+		MaxDialsPerHost: *dialsPerHost,
+		DialWait:        time.Duration(*dialWait) * time.Millisecond,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Add net.Listener wrappers for inbound connections
-	srv.AddListenerWrappers(
-		// Limit max number of simultaneous connections
-		func(ls net.Listener) net.Listener {
-			return listeners.NewLimitedListener(ls, *maxConns)
-		},
-		// Close connections after 30 seconds of no activity
-		func(ls net.Listener) net.Listener {
-			return listeners.NewIdleConnListener(ls, time.Duration(*idleClose)*time.Second)
-		},
-	)
+	// Stop gracefully on SIGINT and SIGTERM
+	stopper := newStopper(srv, time.Duration(*stopTimeout)*time.Second, time.Duration(*drainIdle)*time.Second)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		log.Debugf("Got %v, stopping", <-signals)
+		stopper.shutdown()
+	}()
 
-	// Serve HTTP/S
-	if *https {
-		err = srv.ListenAndServeHTTPS(*addr, *keyfile, *certfile, nil)
-	} else {
-		err = srv.ListenAndServeHTTP(*addr, nil)
+	if adminListener != nil {
+		go serveAdmin(adminListener, stopper, *portsFile, portList, balancer)
+	}
+
+	// Serve HTTP/S at all addresses, a failure at one doesn't affect the others
+	addrs := strings.Split(*addr, ",")
+	serveErrs := make(chan error, len(addrs))
+	for _, listenAddr := range addrs {
+		go func(listenAddr string) {
+			var err error
+			if *https {
+				err = srv.ListenAndServeHTTPS(listenAddr, *keyfile, *certfile, nil)
+			} else {
+				err = srv.ListenAndServeHTTP(listenAddr, nil)
+			}
+			if err != nil {
+				log.Errorf("Error serving at %v: %v", listenAddr, err)
+			}
+			serveErrs <- err
+		}(strings.TrimSpace(listenAddr))
+	}
+	gracefullyStopped := false
+	for range addrs {
+		if <-serveErrs == nil {
+			gracefullyStopped = true
+		}
 	}
+	if gracefullyStopped {
+		<-stopper.stopped
+		summary := proxyfilters.SummarizeTunnels()
+		log.Debugf("Stopped after %v, served %d tunnels with %d bytes up and %d bytes down, at most %d open at once",
+			summary.Uptime.Round(time.Second), summary.Total, summary.BytesSent, summary.BytesReceived, summary.PeakOpen)
+	}
+	logging.Flush()
+}
+
+// envFallbacks are the flags that fall back to environment variables when not
+// given on the command line, see applyEnvFallbacks.
+var envFallbacks = []string{"addr", "token", "allowedports", "idleclose", "syslog", "syslogfacility", "syslogtag", "region"}
+
+// applyEnvFallbacks sets each of the named flags that wasn't given on the
+// command line from the environment variable named after it, like
+// HTTPPROXY_ADDR for -addr, if that's not empty. Flags given on the command line
+// take precedence over the environment, which takes precedence over defaults.
+func applyEnvFallbacks(fs *flag.FlagSet, names []string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, name := range names {
+		if given[name] {
+			continue
+		}
+		envVar := "HTTPPROXY_" + strings.ToUpper(name)
+		value := os.Getenv(envVar)
+		if value == "" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("Invalid %v: %v", envVar, err)
+		}
+	}
+	return nil
+}
+
+// selfCheck resolves the host of addr, if resolve is true, and dials addr as
+// for a CONNECT request.
+func selfCheck(dial proxy.DialFunc, addr string, resolve bool, timeout time.Duration) error {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.Errorf("Error serving: %v", err)
+		return fmt.Errorf("Invalid self check address %v: %v", addr, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if resolve {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return fmt.Errorf("Unable to resolve %v: %v", host, err)
+		}
+	}
+	conn, err := dial(ctx, true, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Unable to dial %v: %v", addr, err)
+	}
+	return conn.Close()
+}
+
+func jsonError(status int, reason string) (string, []byte) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"status": status,
+		"error":  reason,
+	})
+	return "application/json", body
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func buildTLSConfig(minVersion string, cipherSuites string, sniCerts string, clientCAs string) (*tls.Config, error) {
+	version, found := tlsVersions[minVersion]
+	if !found {
+		return nil, fmt.Errorf("Unknown TLS version %v", minVersion)
+	}
+	tlsConfig := &tls.Config{MinVersion: version}
+
+	if cipherSuites != "" {
+		suitesByName := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suitesByName[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(cipherSuites, ",") {
+			id, found := suitesByName[strings.TrimSpace(name)]
+			if !found {
+				return nil, fmt.Errorf("Unknown TLS cipher suite %v", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	if sniCerts != "" {
+		for _, pair := range strings.Split(sniCerts, ",") {
+			files := strings.Split(strings.TrimSpace(pair), ":")
+			if len(files) != 2 {
+				return nil, fmt.Errorf("Expected certfile:keyfile, got %v", pair)
+			}
+			cert, err := tls.LoadX509KeyPair(files[0], files[1])
+			if err != nil {
+				return nil, fmt.Errorf("Unable to load certificate %v: %v", files[0], err)
+			}
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		}
+	}
+
+	if clientCAs != "" {
+		pem, err := ioutil.ReadFile(clientCAs)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read client CAs: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %v", clientCAs)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// parseHeaders parses a comma separated list of Name: value headers.
+func parseHeaders(csv string) (http.Header, error) {
+	header := make(http.Header)
+	for _, field := range strings.Split(csv, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		colon := strings.IndexByte(field, ':')
+		if colon <= 0 {
+			return nil, fmt.Errorf("Expected Name: value, got %v", field)
+		}
+		header.Add(strings.TrimSpace(field[:colon]), strings.TrimSpace(field[colon+1:]))
+	}
+	return header, nil
+}
+
+// parseRoutes parses a comma separated list of from=to route overrides.
+func parseRoutes(csv string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, route := range strings.Split(csv, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		parts := strings.Split(route, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected host:port=host:port, got %v", route)
+		}
+		routes[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return routes, nil
+}
+
+// parseIdleOverrides parses a comma separated list of host=seconds idle
+// timeout overrides.
+func parseIdleOverrides(csv string) (map[string]time.Duration, error) {
+	overrides := make(map[string]time.Duration)
+	for _, override := range strings.Split(csv, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		parts := strings.Split(override, "=")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Expected host=seconds, got %v", override)
+		}
+		seconds, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid seconds in %v", override)
+		}
+		overrides[strings.TrimSpace(parts[0])] = time.Duration(seconds) * time.Second
+	}
+	return overrides, nil
+}
+
+// parseUpstreams parses a comma separated list of upstream proxy URLs, each
+// optionally followed by =weight, into upstreams that dial through them using
+// dial.
+func parseUpstreams(csv string, connectHeader http.Header, dial proxy.DialFunc) ([]dialers.Upstream, error) {
+	var upstreams []dialers.Upstream
+	for _, spec := range strings.Split(csv, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		weight := 1
+		if i := strings.LastIndex(spec, "="); i >= 0 {
+			if w, err := strconv.Atoi(spec[i+1:]); err == nil {
+				if w <= 0 {
+					return nil, fmt.Errorf("Invalid weight of %v", spec)
+				}
+				spec, weight = spec[:i], w
+			}
+		}
+		upstreamDial, err := dialUpstream(spec, connectHeader, dial)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, dialers.Upstream{Name: spec, Weight: weight, Dial: upstreamDial})
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("No upstreams in %q", csv)
+	}
+	return upstreams, nil
+}
+
+// dialUpstream returns a dial function that goes through the upstream proxy
+// at the given URL using dial.
+func dialUpstream(upstreamURL string, connectHeader http.Header, dial proxy.DialFunc) (proxy.DialFunc, error) {
+	switch {
+	case strings.HasPrefix(upstreamURL, "https://"):
+		tlsConfig := &tls.Config{InsecureSkipVerify: *upstreamSkip}
+		return dialers.HTTPSUpstreamWithHeader(strings.TrimPrefix(upstreamURL, "https://"), tlsConfig, connectHeader, dial), nil
+	case strings.HasPrefix(upstreamURL, "socks5://"):
+		u, err := url.Parse(upstreamURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SOCKS5 upstream %v: %v", upstreamURL, err)
+		}
+		password, _ := u.User.Password()
+		return dialers.SOCKS5Upstream(u.Host, u.User.Username(), password, dial), nil
+	default:
+		return dialers.HTTPUpstreamWithHeader(strings.TrimPrefix(upstreamURL, "http://"), connectHeader, dial), nil
+	}
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	log.Debugf("Serving metrics at http://%v/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Error serving metrics: %v", err)
+	}
+}
+
+// reloadAllowedPorts reloads the allowed ports in list from path whenever the
+// process gets SIGHUP.
+func reloadAllowedPorts(path string, list *proxyfilters.PortList) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadPorts(path, list)
+	}
+}
+
+// reloadPorts reloads the allowed ports in list from path, keeping the
+// previous ports if the file is invalid.
+func reloadPorts(path string, list *proxyfilters.PortList) error {
+	ports, err := proxyfilters.AllowedPortsFromFile(path)
+	if err != nil {
+		log.Errorf("Keeping previous allowed ports: %v", err)
+		return err
+	}
+	list.Set(ports)
+	log.Debugf("Reloaded %d allowed ports from %v", len(ports), path)
+	return nil
+}
+
+// drainLogInterval is how often shutdown closes idle connections and logs how
+// many remain.
+const drainLogInterval = 5 * time.Second
+
+// stopper stops a server once, either by draining it or by shutting it down.
+type stopper struct {
+	srv          *server.Server
+	timeout      time.Duration
+	idleFor      time.Duration
+	ctx          context.Context
+	cancel       context.CancelFunc
+	once         sync.Once
+	shutdownOnce sync.Once
+	stopped      chan interface{}
+}
+
+func newStopper(srv *server.Server, timeout time.Duration, idleFor time.Duration) *stopper {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &stopper{srv: srv, timeout: timeout, idleFor: idleFor, ctx: ctx, cancel: cancel, stopped: make(chan interface{})}
+}
+
+// drain stops accepting connections and waits for open ones to finish, for
+// however long they take.
+func (s *stopper) drain() {
+	s.once.Do(func() {
+		go func() {
+			if err := s.srv.Stop(s.ctx); err != nil {
+				log.Errorf("Error stopping server: %v", err)
+			}
+			close(s.stopped)
+		}()
+	})
+}
+
+// shutdown stops accepting connections, even if already draining, and closes
+// open ones once they've been idle for idleFor or, at the latest, once the
+// stop timeout is up. Until then, it logs how many remain.
+func (s *stopper) shutdown() {
+	s.drain()
+	s.shutdownOnce.Do(func() {
+		go s.countdown(time.Now().Add(s.timeout))
+	})
+}
+
+func (s *stopper) countdown(deadline time.Time) {
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	for {
+		closed := s.srv.CloseIdle(s.idleFor)
+		log.Debugf("Draining, closed %d idle connections, %d connections with %d tunnels remaining, closing them in %v",
+			closed, s.srv.OpenConns(), proxyfilters.OpenTunnels(), time.Until(deadline).Round(time.Second))
+		select {
+		case <-s.stopped:
+			return
+		case <-timeout.C:
+			log.Debugf("Drain deadline reached, closing %d remaining connections", s.srv.OpenConns())
+			s.cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveAdmin serves admin commands to clients of l. reload-ports reloads the allowed
+// ports in list from portsFile, if any, and upstreams lists the stats of the
+// upstreams among which balancer, if any, spreads dials.
+func serveAdmin(l net.Listener, stopper *stopper, portsFile string, list *proxyfilters.PortList, balancer *dialers.Balancer) {
+	err := admin.Serve(l, map[string]admin.Command{
+		"drain": func() (string, error) {
+			stopper.drain()
+			return "Draining, no longer accepting connections", nil
+		},
+		"shutdown": func() (string, error) {
+			stopper.shutdown()
+			return fmt.Sprintf("Shutting down, closing connections still open in %v", stopper.timeout), nil
+		},
+		"reload-ports": func() (string, error) {
+			if portsFile == "" {
+				return "", fmt.Errorf("No -allowedportsfile to reload")
+			}
+			if err := reloadPorts(portsFile, list); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Allowed ports: %v", list.Ports()), nil
+		},
+		"stats": func() (string, error) {
+			var stats strings.Builder
+			err := metrics.WriteText(&stats)
+			return stats.String(), err
+		},
+		"upstreams": func() (string, error) {
+			if balancer == nil {
+				return "", fmt.Errorf("No multiple -upstream to balance")
+			}
+			var stats strings.Builder
+			for _, st := range balancer.Stats() {
+				fmt.Fprintf(&stats, "%v weight=%d successes=%d failures=%d refusals=%d ejected=%v\n", st.Name, st.Weight, st.Successes, st.Failures, st.Refusals, st.Ejected)
+			}
+			return stats.String(), nil
+		},
+	})
+	log.Errorf("Error serving admin commands: %v", err)
+}
+
+// parseBuckets parses a comma separated list of histogram bucket upper bounds,
+// which must be in increasing order.
+func parseBuckets(csv string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(csv, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", field)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("%v is not greater than %v", bound, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bound)
 	}
+	return buckets, nil
 }
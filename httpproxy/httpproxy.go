@@ -0,0 +1,424 @@
+// Package httpproxy assembles the proxy run by the http-proxy command, with its
+// full chain of filters and listener wrappers, so that other programs can
+// embed it.
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/dialers"
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/reporting"
+	"github.com/getlantern/http-proxy/server"
+)
+
+const (
+	defaultVia            = "http-proxy"
+	defaultBasicAuthRealm = "http-proxy"
+
+	defaultQuotaWindow    = time.Hour
+	defaultReportInterval = time.Minute
+	// maxQuotaClients bounds the number of clients whose usage is accounted
+	// for quotas.
+	maxQuotaClients = 100000
+)
+
+// Opts configures the proxy built by New. The zero value gives an open proxy
+// that allows all clients and destinations other than local ones.
+type Opts struct {
+	// Server configures the underlying server. Its Filter, if any, is applied
+	// to requests that made it through all of the proxy's own filters.
+	Server server.Opts
+
+	// Token, if not empty, is required in the TokenHeader header of all
+	// requests, X-Lantern-Auth-Token by default.
+	Token       string
+	TokenHeader string
+
+	// TokenRejection, if specified, is the response to requests lacking the
+	// Token instead of a 403 error, see
+	// proxyfilters.RequireTokenWithRejection.
+	TokenRejection *proxyfilters.TokenRejection
+
+	// BasicAuth, if specified, must accept the Basic credentials in the
+	// Proxy-Authorization header of all requests, in addition to any Token,
+	// see proxyfilters.RequireBasicAuth. Clients lacking them are asked to
+	// authenticate to BasicAuthRealm, "http-proxy" by default.
+	BasicAuth      func(user, password string) bool
+	BasicAuthRealm string
+
+	// LogAuthFailures logs the headers of requests rejected for lacking the
+	// Token or BasicAuth credentials, with the credentials redacted, see
+	// proxyfilters.LogAuthFailures.
+	LogAuthFailures bool
+
+	// Authorizer, if specified, decides whether to allow each request that
+	// made it through the Token and BasicAuth checks, based on its client IP,
+	// destination and headers together, see proxyfilters.Authorize. The
+	// credentials are removed from requests before it sees them.
+	Authorizer proxyfilters.Authorizer
+
+	// HealthPath is the path at which to respond to health checks made
+	// directly to the proxy. Disabled if empty.
+	HealthPath string
+
+	// StatusPath is the path at which to respond to status requests made
+	// directly to the proxy, which require Token. Disabled if empty.
+	StatusPath string
+
+	// TunnelsPath is the path at which to list open CONNECT tunnels, oldest
+	// first, to spot leaks, for requests made directly to the proxy with
+	// Token. Disabled if empty.
+	TunnelsPath string
+
+	// TrustedProxies are the CIDRs of proxies in front of this one whose
+	// X-Forwarded-For headers are trusted to identify clients.
+	TrustedProxies []string
+
+	// AccessLog, if specified, receives a JSON record for each CONNECT
+	// request.
+	AccessLog io.Writer
+
+	// OnTunnelOpen and OnTunnelClose, if specified, are called once each
+	// CONNECT tunnel is established and once it's torn down, for example to
+	// feed real-time dashboards, see proxyfilters.OnTunnels.
+	OnTunnelOpen  func(req *http.Request)
+	OnTunnelClose func(req *http.Request, up, down int64, d time.Duration)
+
+	// Reporter, if specified, is reported the traffic of client connections
+	// every ReportInterval, a minute if not positive, and checked by health
+	// checks.
+	Reporter       reporting.Reporter
+	ReportInterval time.Duration
+
+	// ForwardOnly makes the proxy forward plain HTTP requests only, rejecting
+	// all CONNECT requests with a 405 error.
+	ForwardOnly bool
+
+	// MaxConns limits the number of simultaneous client connections.
+	// Unlimited if 0.
+	MaxConns uint64
+
+	// MaxTunnels and MaxConnsPerIP limit the number of simultaneous CONNECT
+	// tunnels in total and per client IP. Unlimited if 0.
+	MaxTunnels    int
+	MaxConnsPerIP int
+
+	// ClientQuota limits the bytes that each client IP may transfer through
+	// CONNECT tunnels within QuotaWindow, an hour by default, rejecting
+	// its new tunnels over the limit, see proxyfilters.LimitClientUsage.
+	// Unlimited if 0. ClientUsage, if specified, accounts the bytes, so that
+	// callers can look up the usage of clients even without a quota.
+	ClientQuota int64
+	QuotaWindow time.Duration
+	ClientUsage *proxyfilters.ClientUsage
+
+	// TunnelLifetime is how long CONNECT tunnels may stay open, however busy
+	// they are, see proxyfilters.MaxTunnelDuration. Unlimited if 0.
+	TunnelLifetime time.Duration
+
+	// DefaultPort, if specified, is the port assumed for CONNECT requests
+	// lacking one, usually 443, see proxyfilters.DefaultConnectPort. Such
+	// requests are rejected with a 400 error otherwise.
+	DefaultPort int
+
+	// AllowedPorts, AllowedHosts and DeniedHosts restrict the destinations of
+	// CONNECT requests, see proxyfilters.RestrictConnectPorts,
+	// proxyfilters.RestrictConnectHosts and proxyfilters.DenyConnectHosts.
+	AllowedPorts []int
+	AllowedHosts []string
+	DeniedHosts  []string
+
+	// ServerNames, if not empty, only lets CONNECT tunnels carry TLS
+	// connections whose ClientHello is for one of these server names, see
+	// proxyfilters.RestrictTLSServerNames.
+	ServerNames []string
+
+	// AllowedPortList, if specified, is used instead of AllowedPorts so that
+	// the allowed ports can be changed while the proxy is running.
+	AllowedPortList *proxyfilters.PortList
+
+	// HintPorts lists the allowed ports in the 403 errors of CONNECT requests
+	// to other ports, to help client developers, see
+	// proxyfilters.RestrictConnectPortListWithHint.
+	HintPorts bool
+
+	// BlockPrivate rejects CONNECT and forwarded requests to destinations
+	// that are or resolve to loopback, link-local or private addresses, see
+	// proxyfilters.BlockPrivateNetworks. The addresses that are dialed are
+	// checked again, so that DNS rebinding can't get around the check, if
+	// Server.Dial is dialers.Direct or one of its variants, or dials through
+	// them, see dialers.WithAddressCheck. Targets of Routes aren't checked.
+	BlockPrivate bool
+
+	// DeniedCountries rejects CONNECT requests to destinations that
+	// Countries, e.g. a geoip.DB, locates in the given countries, see
+	// proxyfilters.DenyCountries. Disabled if Countries is nil. Like for
+	// BlockPrivate, the addresses that tunnels dial are checked again.
+	Countries       proxyfilters.CountryLookup
+	DeniedCountries []string
+
+	// Routes rewrites the destinations of CONNECT requests from one host:port
+	// to another before dialing, after the above restrictions have been
+	// checked, see proxyfilters.RouteOverrides.
+	Routes map[string]string
+
+	// ConnectUDP enables EXPERIMENTAL proxying of UDP over HTTP/1.1 upgrades,
+	// see proxyfilters.ConnectUDP. Its targets are subject to the same
+	// restrictions as CONNECT destinations, except for ServerNames, and dialed
+	// like them.
+	ConnectUDP bool
+
+	// ThrottleUp and ThrottleDown limit the bytes per second sent and received
+	// through each CONNECT tunnel. Unlimited if 0.
+	ThrottleUp   int64
+	ThrottleDown int64
+
+	// BreakerFailures, if positive, is the number of dials to a CONNECT
+	// destination that may fail in a row within BreakerWindow, a minute by
+	// default, before requests to it are rejected with a 503 error for
+	// BreakerCooldown, 30 seconds by default, see
+	// proxyfilters.BreakFailingDestinations.
+	BreakerFailures int
+	BreakerWindow   time.Duration
+	BreakerCooldown time.Duration
+
+	// MaxDialsPerHost limits the number of CONNECT requests dialing the same
+	// destination at once, with others waiting up to DialWait. Unlimited if
+	// 0.
+	MaxDialsPerHost int
+	DialWait        time.Duration
+
+	// Via is the pseudonym by which the proxy identifies itself in Via
+	// headers, "http-proxy" by default.
+	Via string
+
+	// Version, if specified, is the version of the proxy reported by the
+	// health check and as a comment in Via headers, as in
+	// "1.1 http-proxy (1.2.3)".
+	Version string
+}
+
+// New builds a proxy server configured with opts. Serve it with one of the
+// server's ListenAndServe methods or, to use listeners of your own, with
+// Serve.
+func New(opts *Opts) (*server.Server, error) {
+	reporter := opts.Reporter
+	if reporter == nil {
+		reporter = reporting.Noop
+	}
+	tokenHeader := opts.TokenHeader
+	if tokenHeader == "" {
+		tokenHeader = proxyfilters.DefaultTokenHeader
+	}
+	via := opts.Via
+	if via == "" {
+		via = defaultVia
+	}
+	if opts.Version != "" {
+		via = fmt.Sprintf("%v (%v)", via, opts.Version)
+	}
+
+	allowedPorts := opts.AllowedPortList
+	if allowedPorts == nil {
+		allowedPorts = proxyfilters.NewPortList(opts.AllowedPorts)
+	}
+
+	restrictPorts := proxyfilters.RestrictConnectPortList
+	if opts.HintPorts {
+		restrictPorts = proxyfilters.RestrictConnectPortListWithHint
+	}
+
+	filterChain := []filters.Filter{proxyfilters.HealthCheckWithVersion(opts.HealthPath, opts.Version, map[string]func() error{
+		"reporter": reporter.Check,
+	})}
+	trustForwardedFor, err := proxyfilters.TrustForwardedFor(opts.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	filterChain = append(filterChain, trustForwardedFor, proxyfilters.RequestID)
+	if opts.AccessLog != nil {
+		filterChain = append(filterChain, proxyfilters.AccessLog(opts.AccessLog))
+	}
+	filterChain = append(filterChain, proxyfilters.RecordTunnelMetrics)
+	if opts.OnTunnelOpen != nil || opts.OnTunnelClose != nil {
+		filterChain = append(filterChain, proxyfilters.OnTunnels(opts.OnTunnelOpen, opts.OnTunnelClose))
+	}
+	filterChain = append(filterChain, proxyfilters.RejectConnectBody)
+	auth := []filters.Filter{proxyfilters.RequireTokenWithRejection(opts.Token, tokenHeader, opts.TokenRejection)}
+	if opts.BasicAuth != nil {
+		realm := opts.BasicAuthRealm
+		if realm == "" {
+			realm = defaultBasicAuthRealm
+		}
+		auth = append(auth, proxyfilters.RequireBasicAuth(realm, opts.BasicAuth))
+	}
+	if opts.LogAuthFailures {
+		auth = []filters.Filter{proxyfilters.LogAuthFailures(filters.Join(auth...), tokenHeader)}
+	}
+	filterChain = append(filterChain, auth...)
+	if opts.Authorizer != nil {
+		filterChain = append(filterChain, proxyfilters.Authorize(opts.Authorizer))
+	}
+	filterChain = append(filterChain,
+		proxyfilters.DebugStatusPortList(opts.StatusPath, allowedPorts),
+		proxyfilters.DebugTunnels(opts.TunnelsPath),
+	)
+	if opts.ForwardOnly {
+		filterChain = append(filterChain, proxyfilters.DenyConnect)
+	}
+	if opts.DefaultPort != 0 {
+		defaultPort, err := proxyfilters.DefaultConnectPort(opts.DefaultPort)
+		if err != nil {
+			return nil, err
+		}
+		filterChain = append(filterChain, defaultPort)
+	}
+	// The filters that restrict CONNECT destinations also check the targets of
+	// CONNECT-UDP requests, apart from those that only apply to forwarded
+	// requests or to TLS over TCP tunnels
+	var destinations, udpChecks []filters.Filter
+	restrict := func(udp bool, fs ...filters.Filter) {
+		destinations = append(destinations, fs...)
+		if udp {
+			udpChecks = append(udpChecks, fs...)
+		}
+	}
+	restrict(true,
+		proxyfilters.ValidateConnectTarget,
+		proxyfilters.MaxTunnels(opts.MaxTunnels),
+		proxyfilters.MaxConnsPerIP(opts.MaxConnsPerIP),
+	)
+	usage := opts.ClientUsage
+	if usage == nil && opts.ClientQuota > 0 {
+		window := opts.QuotaWindow
+		if window <= 0 {
+			window = defaultQuotaWindow
+		}
+		usage = proxyfilters.NewClientUsage(window, maxQuotaClients)
+	}
+	if usage != nil {
+		restrict(true, proxyfilters.LimitClientUsage(usage, opts.ClientQuota))
+	}
+	restrict(true,
+		proxyfilters.MaxTunnelDuration(opts.TunnelLifetime),
+		proxyfilters.BlockLocal([]string{}),
+	)
+	restrict(false, proxyfilters.AddVia(via))
+	restrict(true,
+		restrictPorts(allowedPorts),
+		proxyfilters.DenyConnectHosts(opts.DeniedHosts),
+		proxyfilters.RestrictConnectHosts(opts.AllowedHosts),
+	)
+	// Its connection wrapper expects a TLS ClientHello, not capsules
+	restrict(false, proxyfilters.RestrictTLSServerNames(opts.ServerNames))
+	if opts.BlockPrivate {
+		restrict(true, proxyfilters.BlockPrivateNetworks())
+	}
+	if opts.Countries != nil {
+		restrict(true, proxyfilters.DenyCountries(opts.Countries, opts.DeniedCountries))
+	}
+	routes, err := proxyfilters.RouteOverrides(opts.Routes)
+	if err != nil {
+		return nil, err
+	}
+	restrict(true, routes)
+	var srv *server.Server
+	if opts.ConnectUDP {
+		// srv is only used once serving, after it's been set below
+		dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return srv.Dial(ctx, network, addr)
+		}
+		filterChain = append(filterChain, proxyfilters.ConnectUDP(dial, udpChecks...))
+	}
+	filterChain = append(filterChain, destinations...)
+	filterChain = append(filterChain,
+		proxyfilters.BreakFailingDestinations(opts.BreakerFailures, opts.BreakerWindow, opts.BreakerCooldown),
+		proxyfilters.ThrottleTunnels(opts.ThrottleUp, opts.ThrottleDown),
+		proxyfilters.MaxDialsPerHost(opts.MaxDialsPerHost, opts.DialWait),
+		proxyfilters.RecordTunnelLatency,
+	)
+	if opts.Server.Filter != nil {
+		filterChain = append(filterChain, opts.Server.Filter)
+	}
+
+	serverOpts := opts.Server
+	serverOpts.Filter = filters.Join(filterChain...)
+	var refusePrivate, refuseCountries dialers.AddressCheck
+	if opts.BlockPrivate {
+		refusePrivate = proxyfilters.RefusePrivateAddresses
+	}
+	if opts.Countries != nil && len(opts.DeniedCountries) > 0 {
+		refuseCountries = proxyfilters.RefuseCountries(opts.Countries, opts.DeniedCountries)
+	}
+	if refusePrivate != nil || refuseCountries != nil {
+		serverOpts.Dial = checkDialedAddresses(serverOpts.Dial, opts.Routes, refusePrivate, refuseCountries)
+	}
+	srv, err = server.New(&serverOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add net.Listener wrappers for inbound connections
+	srv.AddListenerWrappers(
+		// Limit max number of simultaneous connections
+		func(ls net.Listener) net.Listener {
+			return listeners.NewLimitedListener(ls, opts.MaxConns)
+		},
+	)
+	if opts.Server.IdleTimeout > 0 && len(opts.Server.IdleTimeoutOverrides) == 0 {
+		// Close connections after IdleTimeout of no activity. With overrides,
+		// the server idles connections itself so that tunnels to destinations
+		// with overrides may stay quiet for longer.
+		srv.AddListenerWrappers(func(ls net.Listener) net.Listener {
+			return listeners.NewIdleConnListener(ls, opts.Server.IdleTimeout)
+		})
+	}
+	if reporter != reporting.Noop {
+		reportInterval := opts.ReportInterval
+		if reportInterval <= 0 {
+			reportInterval = defaultReportInterval
+		}
+		// Measure traffic of client connections
+		srv.AddListenerWrappers(func(ls net.Listener) net.Listener {
+			return listeners.NewMeasuredListener(ls, reportInterval, reporter.Report)
+		})
+	}
+	return srv, nil
+}
+
+// checkDialedAddresses wraps dial, dialers.Direct if nil, so that the
+// addresses it connects to are checked again with check and, for CONNECT
+// tunnels, connectCheck, see dialers.WithAddressCheck, as the destinations
+// that filters checked may resolve to other addresses when dialed. Either
+// check may be nil. The targets of routes, which filters don't check, are
+// dialed as is.
+func checkDialedAddresses(dial proxy.DialFunc, routes map[string]string, check, connectCheck dialers.AddressCheck) proxy.DialFunc {
+	if dial == nil {
+		dial = dialers.Direct
+	}
+	routed := make(map[string]bool, len(routes))
+	for _, to := range routes {
+		routed[to] = true
+	}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if !routed[addr] {
+			if check != nil {
+				ctx = dialers.WithAddressCheck(ctx, check)
+			}
+			if isCONNECT && connectCheck != nil {
+				ctx = dialers.WithAddressCheck(ctx, connectCheck)
+			}
+		}
+		return dial(ctx, isCONNECT, network, addr)
+	}
+}
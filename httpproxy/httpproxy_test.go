@@ -0,0 +1,466 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/reporting"
+	"github.com/getlantern/http-proxy/server"
+)
+
+func TestNew(t *testing.T) {
+	teapot := filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return filters.ShortCircuit(cs, req, &http.Response{StatusCode: http.StatusTeapot})
+	})
+	srv, err := New(&Opts{
+		Server:     server.Opts{Filter: teapot},
+		Token:      "secret",
+		HealthPath: "/healthz",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	connect := func(token string) int {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nX-Lantern-Auth-Token: %v\r\n\r\n", token)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusForbidden, connect("wrong"), "should require token")
+	assert.Equal(t, http.StatusTeapot, connect("secret"), "should apply server's filter last")
+
+	resp, err := http.Get("http://" + addr + "/healthz")
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "reporter: ok\n", string(body), "should check reporter")
+	}
+}
+
+func TestNewReportIntervalDefault(t *testing.T) {
+	srv, err := New(&Opts{
+		Reporter:   reporting.NewHTTPReporter("http://localhost:0", "", time.Hour),
+		HealthPath: "/healthz",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	// Measured connections need a positive ReportInterval
+	resp, err := http.Get("http://" + addr + "/healthz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestNewVersion(t *testing.T) {
+	teapot := filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return filters.ShortCircuit(cs, req, &http.Response{StatusCode: http.StatusTeapot})
+	})
+	srv, err := New(&Opts{
+		Server:     server.Opts{Filter: teapot},
+		HealthPath: "/healthz",
+		Version:    "1.2.3",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	resp, err := http.Get("http://" + addr + "/healthz")
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "version: 1.2.3\nreporter: ok\n", string(body))
+	}
+
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err = client.Get("http://example.com/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+		assert.Equal(t, "1.1 http-proxy (1.2.3)", resp.Header.Get("Via"))
+	}
+}
+
+func TestNewBasicAuth(t *testing.T) {
+	teapot := filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return filters.ShortCircuit(cs, req, &http.Response{StatusCode: http.StatusTeapot})
+	})
+	srv, err := New(&Opts{
+		Server: server.Opts{Filter: teapot},
+		Token:  "secret",
+		BasicAuth: func(user, password string) bool {
+			return user == "alice" && password == "pass"
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	connect := func(headers string) *http.Response {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n%v\r\n", headers)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		resp.Body.Close()
+		return resp
+	}
+	// alice:pass
+	credentials := "Proxy-Authorization: Basic YWxpY2U6cGFzcw==\r\n"
+	if resp := connect("X-Lantern-Auth-Token: secret\r\n"); assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode, "should require credentials")
+		assert.Equal(t, `Basic realm="http-proxy", charset="UTF-8"`, resp.Header.Get("Proxy-Authenticate"))
+	}
+	if resp := connect(credentials); assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "should still require token")
+	}
+	if resp := connect(credentials + "X-Lantern-Auth-Token: secret\r\n"); assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+	}
+}
+
+func TestNewInvalidTrustedProxies(t *testing.T) {
+	_, err := New(&Opts{TrustedProxies: []string{"not a cidr"}})
+	assert.Error(t, err)
+}
+
+func TestNewInvalidRoutes(t *testing.T) {
+	_, err := New(&Opts{Routes: map[string]string{"example.com": "10.0.0.5:443"}})
+	assert.Error(t, err)
+}
+
+func TestNewForwardOnly(t *testing.T) {
+	srv, err := New(&Opts{ForwardOnly: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	conn, err := net.Dial("tcp", <-ready)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestNewDefaultPort(t *testing.T) {
+	var dialed string
+	recordTarget := filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		dialed = req.URL.Host
+		return filters.ShortCircuit(cs, req, &http.Response{StatusCode: http.StatusTeapot})
+	})
+	connect := func(opts *Opts) int {
+		opts.Server = server.Opts{Filter: recordTarget}
+		srv, err := New(opts)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		ready := make(chan string)
+		go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+		conn, err := net.Dial("tcp", <-ready)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusBadRequest, connect(&Opts{}), "missing port should be rejected by default")
+	assert.Equal(t, http.StatusTeapot, connect(&Opts{DefaultPort: 443}))
+	assert.Equal(t, "example.com:443", dialed, "missing port should default")
+
+	_, err := New(&Opts{DefaultPort: 65536})
+	assert.Error(t, err)
+}
+
+func TestNewConnectUDP(t *testing.T) {
+	var dialed []string
+	dial := func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		return nil, errors.New("Unable to dial %v", addr)
+	}
+	srv, err := New(&Opts{
+		Server:       server.Opts{Dial: dial},
+		AllowedPorts: []int{443},
+		ConnectUDP:   true,
+		BlockPrivate: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	connectUDP := func(target string) int {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET /.well-known/masque/udp/%v/ HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\n\r\n", target, addr)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusForbidden, connectUDP("127.0.0.1/443"), "private targets should be rejected")
+	assert.Equal(t, http.StatusForbidden, connectUDP("8.8.8.8/25"), "targets on disallowed ports should be rejected")
+	assert.Equal(t, http.StatusBadGateway, connectUDP("8.8.8.8/443"))
+	assert.Equal(t, []string{"udp 8.8.8.8:443"}, dialed, "should only dial allowed targets, with the server's dialer")
+}
+
+func TestNewConnectUDPRelays(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// Server names are only checked for TCP tunnels
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	srv, err := New(&Opts{
+		ConnectUDP:  true,
+		ServerNames: []string{"example.com"},
+		Routes:      map[string]string{net.JoinHostPort("8.8.8.8", port): echo.LocalAddr().String()},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /.well-known/masque/udp/8.8.8.8/%v/ HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\n\r\n", port, addr)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Via"), "upgrades shouldn't be treated as forwarded requests")
+
+	// A DATAGRAM capsule with a context ID of 0
+	capsule := []byte{0x00, 0x06, 0x00, 'h', 'e', 'l', 'l', 'o'}
+	_, err = conn.Write(capsule)
+	if assert.NoError(t, err) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		echoed := make([]byte, len(capsule))
+		_, err = io.ReadFull(br, echoed)
+		if assert.NoError(t, err) {
+			assert.Equal(t, capsule, echoed, "datagram should have been echoed")
+		}
+	}
+}
+
+func TestNewTokenRejection(t *testing.T) {
+	srv, err := New(&Opts{
+		Token:          "secret",
+		TokenRejection: &proxyfilters.TokenRejection{StatusCode: http.StatusProxyAuthRequired, Body: []byte("reauthenticate")},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	conn, err := net.Dial("tcp", <-ready)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+		assert.Equal(t, "reauthenticate", string(body))
+	}
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	teapot := filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return filters.ShortCircuit(cs, req, &http.Response{StatusCode: http.StatusTeapot})
+	})
+	srv, err := New(&Opts{
+		Server: server.Opts{Filter: teapot},
+		Token:  "secret",
+		Authorizer: func(req *http.Request) (bool, int, string) {
+			if req.Header.Get("X-Lantern-Auth-Token") != "" {
+				return false, http.StatusInternalServerError, "Token should have been removed"
+			}
+			if req.Host == "internal.example.com:443" {
+				return false, http.StatusUnavailableForLegalReasons, "Destination off limits"
+			}
+			return true, 0, ""
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	connect := func(host, token string) (int, string) {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\nX-Lantern-Auth-Token: %v\r\n\r\n", host, host, token)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	status, _ := connect("internal.example.com:443", "wrong")
+	assert.Equal(t, http.StatusForbidden, status, "should check token before authorizer")
+	status, body := connect("internal.example.com:443", "secret")
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, status)
+	assert.Contains(t, body, "Destination off limits")
+	status, _ = connect("example.com:443", "secret")
+	assert.Equal(t, http.StatusTeapot, status)
+}
+
+func TestNewRejectsSmuggling(t *testing.T) {
+	reached := false
+	srv, err := New(&Opts{
+		Server: server.Opts{Filter: filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			reached = true
+			return filters.ShortCircuit(cs, req, &http.Response{StatusCode: http.StatusTeapot})
+		})},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	for _, smuggling := range []string{
+		"Content-Length: 18\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+		"Transfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+		"Content-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"Content-Length: 0\r\nContent-Length: 18\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+		"Transfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n%v", smuggling)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if assert.NoError(t, err, smuggling) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, smuggling)
+		}
+		conn.Close()
+	}
+	assert.False(t, reached, "smuggling requests should have been rejected before the server's filter")
+}
+
+func TestCheckDialedAddresses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	routed := l.Addr().String()
+	_, port, _ := net.SplitHostPort(routed)
+
+	dial := checkDialedAddresses(nil, map[string]string{"example.com:443": routed}, proxyfilters.RefusePrivateAddresses, nil)
+	_, err = dial(context.Background(), true, "tcp", net.JoinHostPort("localhost", port))
+	var refused *proxyfilters.Error
+	if assert.True(t, stderrors.As(err, &refused), "should refuse dialing a private address: %v", err) {
+		assert.Equal(t, proxyfilters.PrivateAddress, refused.Kind)
+	}
+	conn, err := dial(context.Background(), true, "tcp", routed)
+	if assert.NoError(t, err, "targets of routes should be dialed as is") {
+		conn.Close()
+	}
+
+	dial = checkDialedAddresses(nil, nil, nil, proxyfilters.RefusePrivateAddresses)
+	conn, err = dial(context.Background(), false, "tcp", routed)
+	if assert.NoError(t, err, "CONNECT checks shouldn't apply to other requests") {
+		conn.Close()
+	}
+	_, err = dial(context.Background(), true, "tcp", routed)
+	assert.Error(t, err)
+}
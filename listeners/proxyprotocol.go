@@ -0,0 +1,138 @@
+package listeners
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// proxyProtocolMaxHeaderLength is the maximum length of a PROXY protocol v1
+	// header including the trailing CRLF, see
+	// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+	proxyProtocolMaxHeaderLength = 107
+
+	proxyProtocolHeaderTimeout = 10 * time.Second
+)
+
+// proxyProtocolListener is a listener whose connections start with a PROXY
+// protocol v1 header, as sent by load balancers like AWS NLB and HAProxy.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+// NewProxyProtocolListener wraps the given listener so that its connections
+// are expected to start with a PROXY protocol v1 header, which is consumed and
+// used as the connection's RemoteAddr. Connections without a valid header fail
+// on their first read. The header is read lazily on the first call to Read or
+// RemoteAddr so that slow clients don't hold up Accept.
+//
+// This must wrap the raw TCP listener, before any TLS.
+func NewProxyProtocolListener(l net.Listener) net.Listener {
+	return &proxyProtocolListener{l}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	headerErr  error
+	headerOnce sync.Once
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.headerOnce.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		// bufio requires a bigger buffer than the header, which is fine since we
+		// keep reading through it.
+		c.reader = bufio.NewReaderSize(c.Conn, proxyProtocolMaxHeaderLength+1)
+		line, err := c.reader.ReadSlice('\n')
+		if err != nil {
+			c.headerErr = errors.New("Unable to read PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), err)
+		} else {
+			c.remoteAddr, c.headerErr = parseProxyProtocolHeader(string(line))
+		}
+		if c.headerErr != nil {
+			// Scanners and misconfigured clients aren't the proxy's errors
+			log.Debug(c.headerErr)
+		}
+	})
+}
+
+// parseProxyProtocolHeader parses a PROXY protocol v1 header line, returning
+// the source address it specifies. For the UNKNOWN protocol, the returned
+// address is nil.
+func parseProxyProtocolHeader(line string) (net.Addr, error) {
+	if len(line) > proxyProtocolMaxHeaderLength || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("Malformed PROXY protocol header: %q", line)
+	}
+	parts := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if len(parts) < 2 || parts[0] != "PROXY" {
+		return nil, errors.New("Malformed PROXY protocol header: %q", line)
+	}
+
+	switch parts[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(parts) != 6 {
+			return nil, errors.New("Malformed PROXY protocol header: %q", line)
+		}
+		ip := net.ParseIP(parts[2])
+		if ip == nil || net.ParseIP(parts[3]) == nil {
+			return nil, errors.New("Invalid address in PROXY protocol header: %q", line)
+		}
+		// Go by the textual form, TCP6 headers may carry IPv4-mapped IPv6
+		// addresses like ::ffff:192.0.2.1
+		if strings.Contains(parts[2], ":") != (parts[1] == "TCP6") {
+			return nil, errors.New("Address family mismatch in PROXY protocol header: %q", line)
+		}
+		port, err := strconv.ParseUint(parts[4], 10, 16)
+		if err != nil {
+			return nil, errors.New("Invalid port in PROXY protocol header: %q", line)
+		}
+		if _, err := strconv.ParseUint(parts[5], 10, 16); err != nil {
+			return nil, errors.New("Invalid port in PROXY protocol header: %q", line)
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, errors.New("Unsupported protocol in PROXY protocol header: %q", line)
+	}
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the source address from the PROXY protocol header, or the
+// actual remote address if the header didn't specify one.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) Wrapped() net.Conn {
+	return c.Conn
+}
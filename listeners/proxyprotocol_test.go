@@ -0,0 +1,78 @@
+package listeners
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProxyProtocolHeader(t *testing.T) {
+	addr, err := parseProxyProtocolHeader("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.168.0.1:56324", addr.String())
+	}
+
+	addr, err = parseProxyProtocolHeader("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "[2001:db8::1]:56324", addr.String())
+	}
+
+	addr, err = parseProxyProtocolHeader("PROXY TCP6 ::ffff:192.168.0.1 ::ffff:192.168.0.11 56324 443\r\n")
+	if assert.NoError(t, err, "IPv4-mapped addresses should be accepted for TCP6") {
+		assert.Equal(t, "192.168.0.1:56324", addr.String())
+	}
+
+	addr, err = parseProxyProtocolHeader("PROXY UNKNOWN\r\n")
+	assert.NoError(t, err)
+	assert.Nil(t, addr)
+
+	for _, malformed := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 ::ffff:192.168.0.1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP6 192.168.0.1 2001:db8::2 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n",
+		"PROXY TCP4 bad 192.168.0.11 56324 443\r\n",
+		"PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+	} {
+		_, err := parseProxyProtocolHeader(malformed)
+		assert.Error(t, err, malformed)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	conn := doTestProxyProtocolListener(t, "PROXY TCP4 10.1.2.3 10.0.0.1 1234 80\r\nhello")
+	assert.Equal(t, "10.1.2.3:1234", conn.RemoteAddr().String())
+	b, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	conn = doTestProxyProtocolListener(t, "hello\r\n")
+	_, err = ioutil.ReadAll(conn)
+	assert.Error(t, err)
+}
+
+func doTestProxyProtocolListener(t *testing.T, sent string) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	pl := NewProxyProtocolListener(l)
+
+	go func() {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		client.Write([]byte(sent))
+		client.Close()
+	}()
+
+	conn, err := pl.Accept()
+	require.NoError(t, err)
+	return conn
+}
@@ -98,6 +98,7 @@ func Flush() {
 
 func Close() error {
 	golog.ResetOutputs()
+	closeSyslog()
 	return logFile.Close()
 }
 
@@ -0,0 +1,106 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logging
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/getlantern/golog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+var syslogWriter *syslog.Writer
+
+// syslogLevel writes each log line to syslog with a fixed severity.
+type syslogLevel func(m string) error
+
+func (l syslogLevel) Write(p []byte) (int, error) {
+	if err := l(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// InitSyslog sends logs to syslog at addr instead of stdout and stderr, in
+// addition to the log file set up by Init, if any. addr is either "local" for
+// the local syslog daemon or the address of a remote one, as in
+// udp:logs.example.com:514 or tcp:logs.example.com:601, using UDP without a
+// prefix. facility is the name of a syslog facility like daemon or local0 and
+// tag identifies the proxy's messages. Errors are sent with severity err and
+// debug and trace output with severity debug. If syslog can't be reached, the
+// logs are left as they were, e.g. on stdout and stderr.
+func InitSyslog(addr string, facility string, tag string) error {
+	priority, found := syslogFacilities[strings.ToLower(facility)]
+	if !found {
+		return fmt.Errorf("Unknown syslog facility %q", facility)
+	}
+	network, raddr := syslogNetwork(addr)
+	w, err := syslog.Dial(network, raddr, priority, tag)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to syslog at %v: %v", addr, err)
+	}
+
+	outLock.Lock()
+	defer outLock.Unlock()
+	if syslogWriter != nil {
+		syslogWriter.Close()
+	}
+	syslogWriter = w
+	errorOut, debugOut = syslogLevel(w.Err), syslogLevel(w.Debug)
+	if logFile != nil {
+		errorOut = NonStopWriter(errorOut, timestamped{logFile})
+		debugOut = NonStopWriter(debugOut, timestamped{logFile})
+	}
+	golog.SetOutputs(errorOut, debugOut)
+	return nil
+}
+
+// syslogNetwork splits addr into the network and address to dial, both empty
+// for the local syslog daemon.
+func syslogNetwork(addr string) (string, string) {
+	if addr == "local" {
+		return "", ""
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		if strings.HasPrefix(addr, network+":") {
+			return network, addr[len(network)+1:]
+		}
+	}
+	return "udp", addr
+}
+
+func closeSyslog() error {
+	outLock.Lock()
+	defer outLock.Unlock()
+	if syslogWriter == nil {
+		return nil
+	}
+	err := syslogWriter.Close()
+	syslogWriter = nil
+	return err
+}
@@ -0,0 +1,58 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logging
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	assert.Error(t, InitSyslog("udp:"+conn.LocalAddr().String(), "nonsense", "test"), "should reject unknown facility")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l.Close()
+	assert.Error(t, InitSyslog("tcp:"+l.Addr().String(), "daemon", "test"), "should fail if syslog is unreachable")
+
+	if !assert.NoError(t, InitSyslog(conn.LocalAddr().String(), "local3", "test")) {
+		return
+	}
+	defer func() {
+		golog.ResetOutputs()
+		closeSyslog()
+	}()
+
+	receive := func() string {
+		b := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(b)
+		assert.NoError(t, err)
+		return string(b[:n])
+	}
+	logger := golog.LoggerFor("syslog-test")
+	logger.Error("something broke")
+	msg := receive()
+	// local3 is facility 19, err severity 3
+	assert.True(t, strings.HasPrefix(msg, "<155>"), msg)
+	assert.Contains(t, msg, " test[")
+	assert.Contains(t, msg, "something broke")
+	logger.Debug("all good")
+	msg = receive()
+	// debug severity 7
+	assert.True(t, strings.HasPrefix(msg, "<159>"), msg)
+	assert.Contains(t, msg, "all good")
+}
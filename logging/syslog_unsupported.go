@@ -0,0 +1,18 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logging
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// InitSyslog fails as there's no syslog on this platform.
+func InitSyslog(addr string, facility string, tag string) error {
+	return fmt.Errorf("Syslog is not supported on %v", runtime.GOOS)
+}
+
+func closeSyslog() error {
+	return nil
+}
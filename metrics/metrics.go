@@ -0,0 +1,242 @@
+// Package metrics provides simple counters, gauges and histograms that can be
+// exposed to Prometheus using its text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	registered   []metric
+	registeredMx sync.RWMutex
+	names        = make(map[string]bool)
+)
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func register(name string, m metric) {
+	registeredMx.Lock()
+	defer registeredMx.Unlock()
+	if names[name] {
+		panic(fmt.Sprintf("metric %v already registered", name))
+	}
+	names[name] = true
+	registered = append(registered, m)
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// Counter is a metric whose value only ever increases.
+type Counter struct {
+	value int64
+	name  string
+	help  string
+}
+
+// NewCounter creates and registers a new Counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by delta, which must not be negative.
+func (c *Counter) Add(delta int64) {
+	atomic.AddInt64(&c.value, delta)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// Gauge is a metric whose value can go up and down.
+type Gauge struct {
+	value int64
+	name  string
+	help  string
+}
+
+// NewGauge creates and registers a new Gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(name, g)
+	return g
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+// Set sets the gauge to value.
+func (g *Gauge) Set(value int64) {
+	atomic.StoreInt64(&g.value, value)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.Value())
+}
+
+// GaugeFunc is a gauge whose value is computed whenever it's exposed.
+type GaugeFunc struct {
+	value func() int64
+	name  string
+	help  string
+}
+
+// NewGaugeFunc creates and registers a new GaugeFunc whose value is returned
+// by value, which must be safe to call concurrently.
+func NewGaugeFunc(name, help string, value func() int64) *GaugeFunc {
+	g := &GaugeFunc{value: value, name: name, help: help}
+	register(name, g)
+	return g
+}
+
+// Value returns the current value of the gauge.
+func (g *GaugeFunc) Value() int64 {
+	return g.value()
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.Value())
+}
+
+// DefaultBuckets are the default upper bounds of histogram buckets, suitable
+// for latencies in seconds. They match those of the Prometheus client library.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is a metric that counts observed values in buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []int64
+	count   int64
+	sum     float64
+	name    string
+	help    string
+	mx      sync.Mutex
+}
+
+// NewHistogram creates and registers a new Histogram with buckets of the
+// given upper bounds, which must be sorted in increasing order. If buckets is
+// nil, DefaultBuckets is used.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{buckets: buckets, counts: make([]int64, len(buckets)), name: name, help: help}
+	register(name, h)
+	return h
+}
+
+// SetBuckets replaces the histogram's buckets with ones of the given upper
+// bounds, which must be sorted in increasing order, discarding all values
+// observed so far. It's meant to be called at startup to configure buckets.
+func (h *Histogram) SetBuckets(buckets []float64) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.buckets = buckets
+	h.counts = make([]int64, len(buckets))
+	h.count = 0
+	h.sum = 0
+}
+
+// Observe adds value to the histogram.
+func (h *Histogram) Observe(value float64) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Count returns the number of observed values.
+func (h *Histogram) Count() int64 {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	return h.count
+}
+
+// Sum returns the sum of observed values.
+func (h *Histogram) Sum() float64 {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	cumulative := int64(0)
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %v\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Handler returns an http.Handler that serves all registered metrics in the
+// Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(resp)
+	})
+}
+
+// WriteText writes all registered metrics to w in the Prometheus text
+// exposition format.
+func WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	registeredMx.RLock()
+	for _, m := range registered {
+		m.write(bw)
+	}
+	registeredMx.RUnlock()
+	return bw.Flush()
+}
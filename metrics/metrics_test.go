@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	c := NewCounter("test_requests_total", "Total test requests.")
+	g := NewGauge("test_active", "Active tests.")
+	c.Inc()
+	c.Add(2)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, "# HELP test_requests_total Total test requests.\n# TYPE test_requests_total counter\ntest_requests_total 3\n")
+	assert.Contains(t, body, "# TYPE test_active gauge\ntest_active 1\n")
+}
+
+func TestGaugeFunc(t *testing.T) {
+	value := int64(3)
+	g := NewGaugeFunc("test_computed", "Computed test value.", func() int64 {
+		return value
+	})
+	assert.EqualValues(t, 3, g.Value())
+	value = 5
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), "# TYPE test_computed gauge\ntest_computed 5\n")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_latency_seconds", "Test latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(0.5)
+	h.Observe(2)
+	assert.EqualValues(t, 4, h.Count())
+	assert.EqualValues(t, 3.05, h.Sum())
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), "# TYPE test_latency_seconds histogram\n"+
+		"test_latency_seconds_bucket{le=\"0.1\"} 1\n"+
+		"test_latency_seconds_bucket{le=\"1\"} 3\n"+
+		"test_latency_seconds_bucket{le=\"+Inf\"} 4\n"+
+		"test_latency_seconds_sum 3.05\n"+
+		"test_latency_seconds_count 4\n")
+}
+
+func TestHistogramSetBuckets(t *testing.T) {
+	h := NewHistogram("test_rebucketed_seconds", "Test durations.", nil)
+	h.Observe(1)
+	h.SetBuckets([]float64{60})
+	assert.EqualValues(t, 0, h.Count(), "values observed with previous buckets should be discarded")
+	h.Observe(30)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), "test_rebucketed_seconds_bucket{le=\"60\"} 1\n"+
+		"test_rebucketed_seconds_bucket{le=\"+Inf\"} 1\n")
+}
+
+func TestDuplicateRegistration(t *testing.T) {
+	NewCounter("test_duplicate", "")
+	assert.Panics(t, func() {
+		NewGauge("test_duplicate", "")
+	})
+}
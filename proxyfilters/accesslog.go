@@ -0,0 +1,105 @@
+package proxyfilters
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const (
+	outcomeOK         = "ok"
+	outcomeDenied     = "denied"
+	outcomeDialFailed = "dial-failed"
+)
+
+// accessLogEntry is the record written to the access log for each CONNECT.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Host       string    `json:"host"`
+	Port       string    `json:"port"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	DurationMS int64     `json:"duration_ms"`
+	Outcome    string    `json:"outcome"`
+	RequestID  string    `json:"request_id,omitempty"`
+	ClientCN   string    `json:"client_cn,omitempty"`
+}
+
+// AccessLog writes one newline-delimited JSON record to w for each completed
+// CONNECT request, including ones that were denied or failed to dial. Records
+// for tunnels are written once the tunnel closes. They include the
+// ClientCommonName of clients authenticated with TLS certificates. Place it
+// first, after only RequestID if used, so that it sees requests rejected by
+// later filters.
+func AccessLog(w io.Writer) filters.Filter {
+	var mx sync.Mutex
+	write := func(entry *accessLogEntry) {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			log.Errorf("Unable to marshal access log entry: %v", err)
+			return
+		}
+		mx.Lock()
+		_, err = w.Write(append(b, '\n'))
+		mx.Unlock()
+		if err != nil {
+			log.Errorf("Unable to write access log entry: %v", err)
+		}
+	}
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+
+		start := time.Now()
+		entry := &accessLogEntry{Time: start, RequestID: RequestIDFrom(req.Context()), ClientCN: ClientCommonName(cs)}
+		entry.ClientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+		var err error
+		entry.Host, entry.Port, err = net.SplitHostPort(req.Host)
+		if err != nil {
+			entry.Host = req.Host
+		}
+
+		tunneling := false
+		resp, nextCS, err := onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			tunneling = true
+			return newTunnelConn(upstream, func(sent, received int64) {
+				entry.BytesUp = sent
+				entry.BytesDown = received
+				entry.DurationMS = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+				entry.Outcome = outcomeOK
+				write(entry)
+			})
+		})
+		if !tunneling {
+			entry.DurationMS = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+			entry.Outcome = connectOutcome(resp, err)
+			write(entry)
+		}
+		return resp, nextCS, err
+	})
+}
+
+func connectOutcome(resp *http.Response, err error) string {
+	if resp == nil {
+		if err != nil {
+			return outcomeDialFailed
+		}
+		return outcomeOK
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return outcomeOK
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout:
+		return outcomeDialFailed
+	default:
+		return outcomeDenied
+	}
+}
@@ -0,0 +1,88 @@
+package proxyfilters
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+type entryWriter chan *accessLogEntry
+
+func (w entryWriter) Write(b []byte) (int, error) {
+	entry := &accessLogEntry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return 0, err
+	}
+	w <- entry
+	return len(b), nil
+}
+
+func TestAccessLog(t *testing.T) {
+	entries := make(entryWriter, 10)
+	proxyAddr, target, stop, err := startTunnelProxy(filters.Join(
+		AccessLog(entries),
+		DenyConnectHosts([]string{"denied.example.com"}),
+	))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	conn, br, resp, err := openTunnel(proxyAddr, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	conn.Write([]byte("hello"))
+	io.ReadFull(br, make([]byte, 5))
+	conn.Close()
+	entry := nextEntry(t, entries)
+	if assert.NotNil(t, entry) {
+		host, port, _ := net.SplitHostPort(target)
+		assert.Equal(t, outcomeOK, entry.Outcome)
+		assert.Equal(t, "127.0.0.1", entry.ClientIP)
+		assert.Equal(t, host, entry.Host)
+		assert.Equal(t, port, entry.Port)
+		assert.EqualValues(t, 5, entry.BytesUp)
+		assert.EqualValues(t, 5, entry.BytesDown)
+		assert.False(t, entry.Time.IsZero())
+	}
+
+	conn, _, _, err = openTunnel(proxyAddr, "denied.example.com:443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	entry = nextEntry(t, entries)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, outcomeDenied, entry.Outcome)
+		assert.Equal(t, "denied.example.com", entry.Host)
+		assert.Equal(t, "443", entry.Port)
+	}
+
+	l, _ := net.Listen("tcp", "localhost:0")
+	closedAddr := l.Addr().String()
+	l.Close()
+	conn, _, _, err = openTunnel(proxyAddr, closedAddr)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	entry = nextEntry(t, entries)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, outcomeDialFailed, entry.Outcome)
+	}
+}
+
+func nextEntry(t *testing.T, entries entryWriter) *accessLogEntry {
+	select {
+	case entry := <-entries:
+		return entry
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+}
@@ -0,0 +1,56 @@
+package proxyfilters
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// LogAuthFailures wraps auth, a filter checking the credentials of clients
+// like RequireToken or RequireBasicAuth, so that the headers of requests it
+// rejects are logged, for debugging misbehaving clients without logging all
+// requests. The values of Proxy-Authorization and of the given headers, e.g.
+// the token header, are redacted. Requests are considered rejected if auth
+// doesn't pass them on.
+func LogAuthFailures(auth filters.Filter, sensitiveHeaders ...string) filters.Filter {
+	redacted := map[string]bool{proxyAuthorization: true}
+	for _, header := range sensitiveHeaders {
+		redacted[http.CanonicalHeaderKey(header)] = true
+	}
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		// auth removes credentials from the request, so describe it up front
+		dump := dumpHeaders(req.Header, redacted)
+		passed := false
+		resp, nextCS, err := auth.Apply(cs, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			passed = true
+			return next(cs, req)
+		})
+		if !passed {
+			log.Debugf("Rejected %v %v from %v with headers: %v", req.Method, req.Host, req.RemoteAddr, dump)
+		}
+		return resp, nextCS, err
+	})
+}
+
+// dumpHeaders formats the given headers sorted by name, replacing the values
+// of the redacted ones.
+func dumpHeaders(header http.Header, redacted map[string]bool) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range header[name] {
+			if redacted[http.CanonicalHeaderKey(name)] {
+				value = "[redacted]"
+			}
+			fields = append(fields, fmt.Sprintf("%v: %q", name, value))
+		}
+	}
+	return strings.Join(fields, ", ")
+}
@@ -0,0 +1,45 @@
+package proxyfilters
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/golog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestLogAuthFailures(t *testing.T) {
+	var errorOut, debugOut bytes.Buffer
+	defer golog.SetOutputs(&errorOut, &debugOut)()
+
+	filter := LogAuthFailures(filters.Join(
+		RequireTokenInHeader("secret", "X-Token"),
+		RequireBasicAuth("test", BasicAuthUsers(map[string]string{"user": "password"})),
+	), "x-token")
+	doConnect := func(token string) int {
+		next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		}
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		req.Header.Set("X-Token", token)
+		req.Header.Set("User-Agent", "misbehaving")
+		req.SetBasicAuth("user", "password")
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, doConnect("secret"))
+	assert.NotContains(t, debugOut.String(), "Rejected", "should not log allowed requests")
+
+	assert.Equal(t, http.StatusForbidden, doConnect("wrong"))
+	logged := debugOut.String()
+	assert.Contains(t, logged, `Rejected CONNECT example.com:443 from 1.2.3.4:5678 with headers: Proxy-Authorization: "[redacted]", User-Agent: "misbehaving", X-Token: "[redacted]"`)
+	assert.NotContains(t, logged, "wrong", "should not log token")
+	assert.NotContains(t, logged, "dXNlcjpwYXNzd29yZA", "should not log credentials")
+}
@@ -0,0 +1,37 @@
+package proxyfilters
+
+import (
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// Authorizer decides whether to allow a request based on all of it, e.g. its
+// client IP (RemoteAddr), its destination (Host) and its headers together. It
+// returns the status code and reason with which to reject requests that
+// aren't allowed.
+type Authorizer func(req *http.Request) (allowed bool, status int, reason string)
+
+// Authorize rejects requests that authorize doesn't allow with the status code
+// and reason it returns, which becomes the body of the response. The status
+// defaults to 403 if it's not an error status and the reason to "Not
+// authorized" if empty. All requests are allowed if authorize is nil.
+func Authorize(authorize Authorizer) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if authorize == nil {
+			return next(cs, req)
+		}
+		allowed, status, reason := authorize(req)
+		if allowed {
+			return next(cs, req)
+		}
+		if reason == "" {
+			reason = "Not authorized"
+		}
+		err := newError(NotAuthorized, req, nil, "%v", reason)
+		if status >= http.StatusBadRequest && status < 600 {
+			err.statusCode = status
+		}
+		return failWithError(cs, req, err)
+	})
+}
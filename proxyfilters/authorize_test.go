@@ -0,0 +1,61 @@
+package proxyfilters
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestAuthorize(t *testing.T) {
+	filter := Authorize(func(req *http.Request) (bool, int, string) {
+		switch {
+		case strings.HasPrefix(req.RemoteAddr, "10.") && req.Header.Get("X-Team") == "ops":
+			return true, 0, ""
+		case req.Host == "internal.example.com:443":
+			return false, http.StatusUnavailableForLegalReasons, "Destination off limits"
+		case req.Host == "odd.example.com:443":
+			return false, http.StatusOK, ""
+		}
+		return false, 0, ""
+	})
+	doConnect := func(remoteAddr, host, team string) (*http.Response, error) {
+		next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		}
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+host, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Team", team)
+		resp, _, err := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		return resp, err
+	}
+
+	resp, err := doConnect("10.0.0.1:5678", "internal.example.com:443", "ops")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = doConnect("1.2.3.4:5678", "internal.example.com:443", "ops")
+	assert.EqualError(t, err, "Destination off limits")
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, resp.StatusCode)
+	var filterErr *Error
+	if assert.True(t, errors.As(err, &filterErr)) {
+		assert.Equal(t, NotAuthorized, filterErr.Kind)
+	}
+
+	for _, host := range []string{"www.example.com:443", "odd.example.com:443"} {
+		resp, err = doConnect("10.0.0.1:5678", host, "dev")
+		assert.EqualError(t, err, "Not authorized")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "should default to 403 for %v", host)
+	}
+
+	filter = Authorize(nil)
+	resp, err = doConnect("1.2.3.4:5678", "www.example.com:443", "")
+	if assert.NoError(t, err, "should allow all requests without authorizer") {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
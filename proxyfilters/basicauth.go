@@ -0,0 +1,96 @@
+package proxyfilters
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const (
+	proxyAuthorization = "Proxy-Authorization"
+
+	// proxyAuthenticate is deliberately not canonical. The proxy strips
+	// hop-by-hop headers like Proxy-Authenticate from the responses it
+	// writes, expecting them to come from origins, but only matches canonical
+	// keys, and canonicalizes the others when writing them.
+	proxyAuthenticate = "proxy-authenticate"
+)
+
+// RequireBasicAuth rejects requests that don't carry credentials accepted by
+// authenticate in a Proxy-Authorization header using the Basic scheme
+// (RFC 7617) with a 407 error, asking clients to authenticate to the given
+// realm. The header is removed from allowed requests so that it's never
+// forwarded upstream. It can be combined with RequireToken to require both.
+func RequireBasicAuth(realm string, authenticate func(user, password string) bool) filters.Filter {
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		user, password, ok := parseBasicAuth(req.Header.Get(proxyAuthorization))
+		req.Header.Del(proxyAuthorization)
+		if !ok || !authenticate(user, password) {
+			resp, nextCS, err := fail(cs, req, InvalidCredentials, "Missing or invalid proxy credentials from %v", req.RemoteAddr)
+			resp.Header[proxyAuthenticate] = []string{challenge}
+			return resp, nextCS, err
+		}
+		return next(cs, req)
+	})
+}
+
+func parseBasicAuth(header string) (user string, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	credentials := string(decoded)
+	colon := strings.IndexByte(credentials, ':')
+	if colon < 0 {
+		return "", "", false
+	}
+	return credentials[:colon], credentials[colon+1:], true
+}
+
+// BasicAuthUsers returns a function for RequireBasicAuth that accepts the
+// given passwords by user name. Passwords are compared in constant time.
+func BasicAuthUsers(passwords map[string]string) func(user, password string) bool {
+	return func(user, password string) bool {
+		expected, found := passwords[user]
+		// Compare anyway so that unknown users take as long as wrong passwords
+		match := subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+		return found && match
+	}
+}
+
+// BasicAuthUsersFromFile reads passwords by user name for BasicAuthUsers from
+// the file at path, which has one user:password pair per line. Blank lines
+// and lines starting with # are ignored.
+func BasicAuthUsersFromFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Unable to read proxy users from %v: %v", path, err)
+	}
+	passwords := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return nil, errors.New("Invalid proxy user on line %d of %v, expected user:password", i+1, path)
+		}
+		passwords[line[:colon]] = line[colon+1:]
+	}
+	if len(passwords) == 0 {
+		return nil, errors.New("No proxy users in %v", path)
+	}
+	return passwords, nil
+}
@@ -0,0 +1,76 @@
+package proxyfilters
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireBasicAuth(t *testing.T) {
+	filter := RequireBasicAuth("test", BasicAuthUsers(map[string]string{"alice": "secret", "bob": ""}))
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	for header, expectedStatus := range map[string]int{
+		basic("alice:secret"):       http.StatusOK,
+		"basic YWxpY2U6c2VjcmV0":    http.StatusOK,
+		basic("bob:"):               http.StatusOK,
+		basic("alice:wrong"):        http.StatusProxyAuthRequired,
+		basic("alice:secret:extra"): http.StatusProxyAuthRequired,
+		basic("carol:secret"):       http.StatusProxyAuthRequired,
+		basic("alice"):              http.StatusProxyAuthRequired,
+		"Bearer secret":             http.StatusProxyAuthRequired,
+		"Basic !!!":                 http.StatusProxyAuthRequired,
+		"":                          http.StatusProxyAuthRequired,
+	} {
+		var forwarded *http.Request
+		next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			forwarded = req
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		}
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		if header != "" {
+			req.Header.Set(proxyAuthorization, header)
+		}
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		if !assert.Equal(t, expectedStatus, resp.StatusCode, header) {
+			continue
+		}
+		if forwarded != nil {
+			assert.Empty(t, forwarded.Header.Get(proxyAuthorization), "credentials should not be forwarded")
+		} else {
+			assert.Equal(t, []string{`Basic realm="test", charset="UTF-8"`}, resp.Header[proxyAuthenticate], "should challenge client")
+		}
+	}
+}
+
+func TestBasicAuthUsersFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basicauth")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+
+	ioutil.WriteFile(path, []byte("# Proxy users\nalice:secret\n\n  bob:pass:word  \n"), 0600)
+	passwords, err := BasicAuthUsersFromFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"alice": "secret", "bob": "pass:word"}, passwords)
+	}
+
+	for _, contents := range []string{"", "# none\n", "alice\n", ":secret\n"} {
+		ioutil.WriteFile(path, []byte(contents), 0600)
+		_, err = BasicAuthUsersFromFile(path)
+		assert.Error(t, err, contents)
+	}
+
+	_, err = BasicAuthUsersFromFile(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
@@ -40,7 +40,7 @@ func BlockLocal(exceptions []string) filters.Filter {
 		// in the form host or host:port
 		if err == nil {
 			if ipt.IsPrivate(ipAddr) {
-				return fail(cs, req, http.StatusForbidden, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
+				return fail(cs, req, LocalAddress, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
 			}
 		}
 
@@ -0,0 +1,82 @@
+package proxyfilters
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// privateLookupTimeout bounds how long BlockPrivateNetworks and DenyCountries
+// wait for resolving a destination.
+const privateLookupTimeout = 10 * time.Second
+
+// lookupIPAddr resolves destinations for checking them, replaced in tests.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// BlockPrivateNetworks rejects requests to loopback, link-local, private (RFC
+// 1918 and IPv6 unique local) and unspecified addresses with a 403 error, so
+// that clients can't reach the proxy host or its network, like cloud metadata
+// endpoints at 169.254.169.254. This applies to CONNECT requests as well as to
+// forwarded plain HTTP requests. Host names are resolved first and rejected if
+// any of their addresses is private. Destinations that can't be resolved are
+// rejected with a 502 error.
+//
+// The dial resolves host names again, so DNS rebinding could still switch the
+// destination to a private address. To refuse those, check the addresses that
+// are actually dialed with RefusePrivateAddresses, see
+// dialers.WithAddressCheck.
+func BlockPrivateNetworks() filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		addrs, err := resolveDestination(req)
+		if err != nil {
+			return failWithCause(cs, req, DialFailed, err, "Unable to resolve %v to check for private addresses: %v", req.Host, err)
+		}
+		for _, addr := range addrs {
+			if isPrivateIP(addr.IP) {
+				connectRejectedByHost.Inc()
+				return fail(cs, req, PrivateAddress, "%v requested private address %v (%v)", req.RemoteAddr, req.Host, addr.IP)
+			}
+		}
+		return next(cs, req)
+	})
+}
+
+// RefusePrivateAddresses refuses the addresses that BlockPrivateNetworks
+// rejects, with an Error of kind PrivateAddress. It's meant for checking the
+// addresses that are dialed, see dialers.WithAddressCheck.
+func RefusePrivateAddresses(ip net.IP) error {
+	if !isPrivateIP(ip) {
+		return nil
+	}
+	connectRejectedByHost.Inc()
+	return &Error{Kind: PrivateAddress, Host: ip.String(), message: fmt.Sprintf("Refusing to dial private address %v", ip)}
+}
+
+// resolveDestination resolves the host that req is to be dialed at, the host
+// of its URL. Hosts that are IP addresses aren't resolved.
+func resolveDestination(req *http.Request) ([]net.IPAddr, error) {
+	host, _, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		host = req.URL.Host
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), privateLookupTimeout)
+	addrs, err := lookupIPAddr(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("No addresses for %v", host)
+	}
+	return addrs, nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
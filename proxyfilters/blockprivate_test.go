@@ -0,0 +1,171 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/dialers"
+	"github.com/getlantern/http-proxy/server"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestBlockPrivateNetworks(t *testing.T) {
+	filter := BlockPrivateNetworks()
+	for _, host := range []string{
+		"127.0.0.1:443",
+		"localhost:443",
+		"10.1.2.3:443",
+		"172.16.0.1:443",
+		"192.168.0.1:443",
+		"169.254.169.254:80",
+		"0.0.0.0:443",
+		"[::1]:443",
+		"[fe80::1]:443",
+		"[fd00::1]:443",
+		"[::ffff:127.0.0.1]:443",
+	} {
+		doTestConnectHosts(t, filter, http.MethodConnect, host, http.StatusForbidden)
+	}
+	for _, host := range []string{
+		"93.184.216.34:443",
+		"[2606:2800:220:1:248:1893:25c8:1946]:443",
+		"172.32.0.1:443",
+	} {
+		doTestConnectHosts(t, filter, http.MethodConnect, host, http.StatusOK)
+	}
+	doTestConnectHosts(t, filter, http.MethodGet, "127.0.0.1:80", http.StatusForbidden)
+	doTestConnectHosts(t, filter, http.MethodGet, "169.254.169.254", http.StatusForbidden)
+	doTestConnectHosts(t, filter, http.MethodGet, "93.184.216.34", http.StatusOK)
+}
+
+// withLookups makes destinations resolve to the given addresses until the
+// returned function is called, counting how many times each host is resolved.
+func withLookups(addrs map[string][]string) (map[string]int, func()) {
+	lookups := make(map[string]int)
+	orig := lookupIPAddr
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups[host]++
+		if ip := net.ParseIP(host); ip != nil {
+			return []net.IPAddr{{IP: ip}}, nil
+		}
+		var resolved []net.IPAddr
+		for _, addr := range addrs[host] {
+			resolved = append(resolved, net.IPAddr{IP: net.ParseIP(addr)})
+		}
+		if len(resolved) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return resolved, nil
+	}
+	return lookups, func() {
+		lookupIPAddr = orig
+	}
+}
+
+func TestBlockPrivateNetworksResolves(t *testing.T) {
+	_, restore := withLookups(map[string][]string{
+		"public.example.com": {"93.184.216.34"},
+		"mixed.example.com":  {"93.184.216.34", "169.254.169.254"},
+	})
+	defer restore()
+	filter := BlockPrivateNetworks()
+	apply := func(method, rawURL, host string) (*http.Response, *http.Request) {
+		req, _ := http.NewRequest(method, rawURL, nil)
+		req.Host = host
+		var dialed *http.Request
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			dialed = req
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		})
+		return resp, dialed
+	}
+
+	resp, dialed := apply(http.MethodConnect, "http://public.example.com:443", "public.example.com:443")
+	if assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		assert.Equal(t, "public.example.com:443", dialed.URL.Host, "should leave the destination to the dialer")
+	}
+	resp, dialed = apply(http.MethodConnect, "http://mixed.example.com:443", "mixed.example.com:443")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "should reject host with any private address")
+	assert.Nil(t, dialed)
+	resp, dialed = apply(http.MethodConnect, "http://unknown.example.com:443", "unknown.example.com:443")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "should reject host that can't be resolved")
+	assert.Nil(t, dialed)
+}
+
+func TestRefusePrivateAddresses(t *testing.T) {
+	err := RefusePrivateAddresses(net.ParseIP("169.254.169.254"))
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*Error).StatusCode())
+	}
+	assert.NoError(t, RefusePrivateAddresses(net.ParseIP("93.184.216.34")))
+}
+
+// TestBlockPrivateNetworksRebinding checks that a host that resolves to a
+// public address when checked but to a private one when dialed is refused.
+func TestBlockPrivateNetworksRebinding(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	// The filter sees a public address, the dial resolves localhost again
+	rebinding := net.JoinHostPort("localhost", port)
+	_, restore := withLookups(map[string][]string{"localhost": {"93.184.216.34"}})
+	defer restore()
+
+	checkedDial := func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		return dialers.Direct(dialers.WithAddressCheck(ctx, RefusePrivateAddresses), isCONNECT, network, addr)
+	}
+	request := func(proxyAddr, method string) int {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer conn.Close()
+		target := rebinding
+		if method != http.MethodConnect {
+			target = "http://" + rebinding + "/"
+		}
+		fmt.Fprintf(conn, "%v %v HTTP/1.1\r\nHost: %v\r\n\r\n", method, target, rebinding)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, poolSize := range []int{0, 2} {
+		for _, checked := range []bool{false, true} {
+			dial := dialers.Direct
+			expected := http.StatusOK
+			if checked {
+				dial, expected = checkedDial, http.StatusForbidden
+			}
+			srv, err := server.New(&server.Opts{Filter: BlockPrivateNetworks(), Dial: dial, ForwardPoolSize: poolSize})
+			if !assert.NoError(t, err) {
+				return
+			}
+			ready := make(chan string)
+			go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+			proxyAddr := <-ready
+
+			atomic.StoreInt32(&hits, 0)
+			assert.Equal(t, expected, request(proxyAddr, http.MethodGet), "pool size %d, checked %v", poolSize, checked)
+			assert.Equal(t, expected, request(proxyAddr, http.MethodConnect), "pool size %d, checked %v", poolSize, checked)
+			if checked {
+				assert.Zero(t, atomic.LoadInt32(&hits), "should not have reached the origin")
+			}
+			srv.Stop(context.Background())
+		}
+	}
+}
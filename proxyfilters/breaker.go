@@ -0,0 +1,157 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	defaultBreakerWindow   = time.Minute
+	defaultBreakerCooldown = 30 * time.Second
+	// maxBrokenDestinations bounds the number of destinations with failing
+	// dials that are tracked.
+	maxBrokenDestinations = 10000
+)
+
+// BreakFailingDestinations rejects CONNECT requests to a host:port right away
+// with a 503 error, without dialing it, for cooldown after the given number of
+// dials to it failed in a row within window, so that clients retrying a
+// destination that's down don't each wait for a dial to time out. Once the
+// cooldown is over, the next request probes the destination while others are
+// still rejected: if its dial succeeds, the destination is no longer rejected,
+// otherwise it's rejected for another cooldown. Requests that later filters
+// reject without dialing don't count either way. If window or cooldown are zero,
+// a minute and 30 seconds are used. If failures is zero or negative,
+// destinations are never rejected.
+//
+// Dials are only seen if the proxy waits for upstream before responding OK to
+// CONNECT requests, which is the server's default. Place it after
+// ValidateConnectTarget.
+func BreakFailingDestinations(failures int, window, cooldown time.Duration) filters.Filter {
+	if failures <= 0 {
+		return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			return next(cs, req)
+		})
+	}
+	if window <= 0 {
+		window = defaultBreakerWindow
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	b := newBreaker(failures, window, cooldown)
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+		key, err := routeKey(req.Host)
+		if err != nil {
+			return next(cs, req)
+		}
+		probe, allowed := b.allow(key, time.Now())
+		if !allowed {
+			connectShortCircuited.Inc()
+			return fail(cs, req, DestinationDown, "Dials to %v kept failing, not dialing it for now", key)
+		}
+		// Record even if a later filter panics, so that a probe doesn't keep
+		// the destination rejected for good
+		outcome := outcomeDenied
+		defer func() {
+			b.record(key, probe, outcome, time.Now())
+		}()
+		resp, nextCS, err := next(cs, req)
+		outcome = connectOutcome(resp, err)
+		return resp, nextCS, err
+	})
+}
+
+type breaker struct {
+	failures     int
+	window       time.Duration
+	cooldown     time.Duration
+	mx           sync.Mutex
+	destinations *lru.Cache
+}
+
+func newBreaker(failures int, window, cooldown time.Duration) *breaker {
+	destinations, _ := lru.New(maxBrokenDestinations)
+	return &breaker{failures: failures, window: window, cooldown: cooldown, destinations: destinations}
+}
+
+// destinationDials tracks the failing dials to a destination. Destinations are
+// forgotten once dialed successfully.
+type destinationDials struct {
+	failures     int
+	firstFailure time.Time
+	// rejectUntil is when the cooldown after the destination failed ends.
+	rejectUntil time.Time
+	probing     bool
+}
+
+// allow tells whether a request to the destination with the given key may be
+// dialed and, if so, whether it's probing the destination after a cooldown.
+func (b *breaker) allow(key string, now time.Time) (probe bool, allowed bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	cached, found := b.destinations.Get(key)
+	if !found {
+		return false, true
+	}
+	dials := cached.(*destinationDials)
+	if dials.rejectUntil.IsZero() {
+		return false, true
+	}
+	if now.Before(dials.rejectUntil) || dials.probing {
+		return false, false
+	}
+	dials.probing = true
+	return true, true
+}
+
+// record records the outcome of a request to the destination with the given
+// key, one of those of connectOutcome. Requests denied by later filters didn't
+// dial the destination and only end probing, so that the next request probes
+// it instead.
+func (b *breaker) record(key string, probe bool, outcome string, now time.Time) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if outcome == outcomeDenied {
+		if cached, found := b.destinations.Get(key); found && probe {
+			cached.(*destinationDials).probing = false
+		}
+		return
+	}
+	if outcome == outcomeOK {
+		if probe {
+			log.Debugf("Dialed %v again, no longer rejecting it", key)
+		}
+		b.destinations.Remove(key)
+		return
+	}
+
+	var dials *destinationDials
+	if cached, found := b.destinations.Get(key); found {
+		dials = cached.(*destinationDials)
+	} else {
+		dials = &destinationDials{}
+		b.destinations.Add(key, dials)
+	}
+	if probe {
+		dials.probing = false
+		dials.rejectUntil = now.Add(b.cooldown)
+		return
+	}
+	if dials.failures == 0 || now.Sub(dials.firstFailure) > b.window {
+		dials.failures, dials.firstFailure = 0, now
+	}
+	dials.failures++
+	if dials.failures >= b.failures && dials.rejectUntil.IsZero() {
+		log.Debugf("%d dials to %v failed within %v, rejecting it for %v", dials.failures, key, b.window, b.cooldown)
+		dials.rejectUntil = now.Add(b.cooldown)
+	}
+}
@@ -0,0 +1,153 @@
+package proxyfilters
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestBreakFailingDestinations(t *testing.T) {
+	filter := BreakFailingDestinations(2, time.Minute, 50*time.Millisecond)
+	dials := 0
+	down := true
+	connect := func(target string) int {
+		next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			dials++
+			if down {
+				return nil, cs, fmt.Errorf("Unable to dial %v", req.Host)
+			}
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		}
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+target, nil)
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		if resp == nil {
+			return http.StatusBadGateway
+		}
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusBadGateway, connect("down.example.com:443"))
+	assert.Equal(t, http.StatusBadGateway, connect("DOWN.example.com.:443"))
+	assert.Equal(t, 2, dials)
+	assert.Equal(t, http.StatusServiceUnavailable, connect("down.example.com:443"), "should reject destination after failures")
+	assert.Equal(t, 2, dials, "should not dial rejected destination")
+	down = false
+	assert.Equal(t, http.StatusOK, connect("down.example.com:8443"), "should only reject host:port that failed")
+
+	time.Sleep(60 * time.Millisecond)
+	down = true
+	assert.Equal(t, http.StatusBadGateway, connect("down.example.com:443"), "should probe after cooldown")
+	assert.Equal(t, http.StatusServiceUnavailable, connect("down.example.com:443"), "should reject again after failed probe")
+
+	time.Sleep(60 * time.Millisecond)
+	down = false
+	assert.Equal(t, http.StatusOK, connect("down.example.com:443"), "should probe after cooldown")
+	down = true
+	assert.Equal(t, http.StatusBadGateway, connect("down.example.com:443"), "should stop rejecting after successful probe")
+	assert.Equal(t, http.StatusBadGateway, connect("down.example.com:443"))
+	assert.Equal(t, http.StatusServiceUnavailable, connect("down.example.com:443"))
+}
+
+func TestBreakerProbing(t *testing.T) {
+	b := newBreaker(1, time.Minute, time.Minute)
+	now := time.Now()
+	b.record("example.com:443", false, outcomeDialFailed, now)
+	_, allowed := b.allow("example.com:443", now.Add(time.Second))
+	assert.False(t, allowed, "should reject during cooldown")
+
+	probe, allowed := b.allow("example.com:443", now.Add(2*time.Minute))
+	assert.True(t, allowed)
+	assert.True(t, probe, "first request after cooldown should probe")
+	_, allowed = b.allow("example.com:443", now.Add(2*time.Minute))
+	assert.False(t, allowed, "should reject others while probing")
+}
+
+func TestBreakerWindow(t *testing.T) {
+	b := newBreaker(2, time.Minute, time.Minute)
+	now := time.Now()
+	b.record("example.com:443", false, outcomeDialFailed, now)
+	b.record("example.com:443", false, outcomeDialFailed, now.Add(2*time.Minute))
+	_, allowed := b.allow("example.com:443", now.Add(2*time.Minute))
+	assert.True(t, allowed, "failures outside of window should not add up")
+	b.record("example.com:443", false, outcomeDialFailed, now.Add(2*time.Minute+time.Second))
+	_, allowed = b.allow("example.com:443", now.Add(2*time.Minute+time.Second))
+	assert.False(t, allowed)
+
+	b.record("example.org:443", false, outcomeDialFailed, now)
+	b.record("example.org:443", false, outcomeOK, now)
+	b.record("example.org:443", false, outcomeDialFailed, now)
+	_, allowed = b.allow("example.org:443", now)
+	assert.True(t, allowed, "success should reset failures")
+}
+
+func TestBreakerProbeNotDialed(t *testing.T) {
+	filter := BreakFailingDestinations(2, time.Minute, 50*time.Millisecond)
+	connect := func(next filters.Next) (status int, panicked bool) {
+		defer func() {
+			panicked = recover() != nil
+		}()
+		req, _ := http.NewRequest(http.MethodConnect, "http://down.example.com:443", nil)
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		if resp == nil {
+			return http.StatusBadGateway, false
+		}
+		return resp.StatusCode, false
+	}
+	respond := func(status int) filters.Next {
+		return func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return &http.Response{StatusCode: status}, cs, nil
+		}
+	}
+
+	connect(respond(http.StatusBadGateway))
+	connect(respond(http.StatusBadGateway))
+	status, _ := connect(respond(http.StatusOK))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	time.Sleep(60 * time.Millisecond)
+	_, panicked := connect(func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		panic("boom")
+	})
+	assert.True(t, panicked)
+	status, _ = connect(respond(http.StatusTooManyRequests))
+	assert.Equal(t, http.StatusTooManyRequests, status, "should probe again after a probe panicked")
+	status, _ = connect(respond(http.StatusBadGateway))
+	assert.Equal(t, http.StatusBadGateway, status, "a probe rejected by a later filter shouldn't count as a successful dial")
+	status, _ = connect(respond(http.StatusOK))
+	assert.Equal(t, http.StatusServiceUnavailable, status, "should reject again after the probe's dial failed")
+}
+
+func TestBreakFailingDestinationsDisabled(t *testing.T) {
+	filter := BreakFailingDestinations(0, 0, 0)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, applyToTarget(filter, http.MethodConnect, "example.com:443"))
+	}
+}
+
+func TestBreakFailingDestinationsTunnel(t *testing.T) {
+	proxyAddr, _, stop, err := startTunnelProxy(BreakFailingDestinations(2, time.Minute, time.Minute))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+	closed, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	target := closed.Addr().String()
+	closed.Close()
+
+	for _, expected := range []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		conn, _, resp, err := openTunnel(proxyAddr, target)
+		if assert.NoError(t, err) {
+			conn.Close()
+			assert.Equal(t, expected, resp.StatusCode)
+		}
+	}
+}
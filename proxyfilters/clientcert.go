@@ -0,0 +1,33 @@
+package proxyfilters
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// ClientCommonName returns the common name of the certificate that the client
+// presented over TLS, for logging or authorizing clients in filters. It's only
+// set if the certificate was verified, i.e. if the server's TLSConfig has
+// ClientCAs and ClientAuth set to tls.VerifyClientCertIfGiven or
+// tls.RequireAndVerifyClientCert; otherwise, and for plain HTTP connections,
+// it's empty.
+func ClientCommonName(cs *filters.ConnectionState) string {
+	conn := cs.Downstream()
+	for conn != nil {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			chains := tlsConn.ConnectionState().VerifiedChains
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return ""
+			}
+			return chains[0][0].Subject.CommonName
+		}
+		wrapped, ok := conn.(interface{ Wrapped() net.Conn })
+		if !ok {
+			return ""
+		}
+		conn = wrapped.Wrapped()
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+type wrappingConn struct {
+	net.Conn
+}
+
+func (c *wrappingConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+func TestClientCommonNameWithoutTLS(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	assert.Empty(t, ClientCommonName(filters.NewConnectionState(req, nil, nil)))
+
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	assert.Empty(t, ClientCommonName(filters.NewConnectionState(req, nil, &wrappingConn{&wrappingConn{conn}})))
+}
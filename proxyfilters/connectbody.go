@@ -0,0 +1,30 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// RejectConnectBody rejects CONNECT requests that declare a body, through a
+// non-zero Content-Length or a Transfer-Encoding, with a 400 error. CONNECT
+// requests have no body, so whatever follows their headers is tunneled, and a
+// declared body means that the client, or a proxy in front of this one, may
+// disagree with this proxy on where the request ends, which can be used to
+// smuggle requests. Requests with both Content-Length and Transfer-Encoding
+// count as chunked, so they're rejected too, whereas requests with conflicting
+// Content-Length headers or an unsupported Transfer-Encoding already fail
+// parsing with a 400 error.
+var RejectConnectBody = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	if req.Method != http.MethodConnect {
+		return next(cs, req)
+	}
+	if len(req.TransferEncoding) > 0 {
+		return fail(cs, req, ConnectWithBody, "CONNECT request to %v from %v must not have a body, got Transfer-Encoding %v", req.Host, req.RemoteAddr, strings.Join(req.TransferEncoding, ", "))
+	}
+	if req.ContentLength != 0 {
+		return fail(cs, req, ConnectWithBody, "CONNECT request to %v from %v must not have a body, got Content-Length %d", req.Host, req.RemoteAddr, req.ContentLength)
+	}
+	return next(cs, req)
+})
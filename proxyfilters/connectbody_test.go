@@ -0,0 +1,38 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestRejectConnectBody(t *testing.T) {
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	for raw, expectedStatus := range map[string]int{
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n":                                                    http.StatusOK,
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nContent-Length: 0\r\n\r\n":                               http.StatusOK,
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nContent-Length: 5\r\n\r\n":                               http.StatusBadRequest,
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nTransfer-Encoding: chunked\r\n\r\n":                      http.StatusBadRequest,
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nContent-Length: 0\r\nTransfer-Encoding: chunked\r\n\r\n": http.StatusBadRequest,
+		"POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\n":                                  http.StatusOK,
+	} {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+		if !assert.NoError(t, err, raw) {
+			continue
+		}
+		resp, _, err := RejectConnectBody.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		assert.Equal(t, expectedStatus, resp.StatusCode, raw)
+		if expectedStatus == http.StatusOK {
+			assert.NoError(t, err, raw)
+		} else {
+			assert.Contains(t, err.Error(), "must not have a body", raw)
+		}
+	}
+}
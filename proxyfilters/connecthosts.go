@@ -0,0 +1,61 @@
+package proxyfilters
+
+import (
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/hostpatterns"
+)
+
+// RestrictConnectHosts restricts CONNECT requests to the given list of allowed
+// hosts and returns a 403 error if the host is not allowed. Patterns are either
+// exact host names or wildcards like "*.example.com", which match any
+// subdomain of example.com (but not example.com itself). Matching is case
+// insensitive and ignores the port. Requests with an invalid target, as checked
+// by ValidateConnectTarget, are rejected with a 400 error. An empty list allows
+// all hosts.
+func RestrictConnectHosts(allowedHosts []string) filters.Filter {
+	allowed := hostpatterns.New(allowedHosts)
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect || allowed.Empty() {
+			return next(cs, req)
+		}
+
+		host, _, kind, err := parseConnectTarget(req.Host)
+		if err != nil {
+			connectRejectedByHost.Inc()
+			return fail(cs, req, kind, "Invalid CONNECT target %q: %v", req.Host, err)
+		}
+		if _, ok := allowed.Match(host); !ok {
+			connectRejectedByHost.Inc()
+			return fail(cs, req, HostNotAllowed, "Host not allowed: %v", req.Host)
+		}
+		return next(cs, req)
+	})
+}
+
+// DenyConnectHosts rejects CONNECT requests to any of the given hosts with a
+// 403 error, using the same patterns as RestrictConnectHosts. To have denials
+// take precedence over allowed hosts, place this filter before
+// RestrictConnectHosts.
+func DenyConnectHosts(deniedHosts []string) filters.Filter {
+	denied := hostpatterns.New(deniedHosts)
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect || denied.Empty() {
+			return next(cs, req)
+		}
+
+		host, _, kind, err := parseConnectTarget(req.Host)
+		if err != nil {
+			connectRejectedByHost.Inc()
+			return fail(cs, req, kind, "Invalid CONNECT target %q: %v", req.Host, err)
+		}
+		if pattern, ok := denied.Match(host); ok {
+			log.Debugf("CONNECT to %v from %v denied by pattern %v", req.Host, req.RemoteAddr, pattern)
+			connectRejectedByHost.Inc()
+			return filters.Fail(cs, req, HostDenied.StatusCode(), newError(HostDenied, req, nil, "Host not allowed: %v", req.Host))
+		}
+		return next(cs, req)
+	})
+}
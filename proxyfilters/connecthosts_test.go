@@ -0,0 +1,64 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestRestrictConnectHosts(t *testing.T) {
+	allowed := []string{"example.com", "*.Example.org"}
+	doTestRestrictConnectHosts(t, allowed, http.MethodConnect, "example.com:443", http.StatusOK)
+	doTestRestrictConnectHosts(t, allowed, http.MethodConnect, "EXAMPLE.com:443", http.StatusOK)
+	doTestRestrictConnectHosts(t, allowed, http.MethodConnect, "www.example.com:443", http.StatusForbidden)
+	doTestRestrictConnectHosts(t, allowed, http.MethodConnect, "www.example.org:443", http.StatusOK)
+	doTestRestrictConnectHosts(t, allowed, http.MethodConnect, "a.b.example.org:443", http.StatusOK)
+	doTestRestrictConnectHosts(t, allowed, http.MethodConnect, "example.org:443", http.StatusForbidden)
+	doTestRestrictConnectHosts(t, allowed, http.MethodConnect, "badexample.org:443", http.StatusForbidden)
+	doTestRestrictConnectHosts(t, allowed, http.MethodConnect, "example.net:443", http.StatusForbidden)
+}
+
+func TestRestrictConnectHostsEmpty(t *testing.T) {
+	doTestRestrictConnectHosts(t, []string{}, http.MethodConnect, "example.net:443", http.StatusOK)
+}
+
+func TestRestrictConnectHostsNonConnect(t *testing.T) {
+	doTestRestrictConnectHosts(t, []string{"example.com"}, http.MethodGet, "example.net", http.StatusOK)
+}
+
+func TestDenyConnectHosts(t *testing.T) {
+	denied := []string{"bad.example.com", "*.evil.org"}
+	doTestConnectHosts(t, DenyConnectHosts(denied), http.MethodConnect, "bad.example.com:443", http.StatusForbidden)
+	doTestConnectHosts(t, DenyConnectHosts(denied), http.MethodConnect, "www.evil.org:443", http.StatusForbidden)
+	doTestConnectHosts(t, DenyConnectHosts(denied), http.MethodConnect, "good.example.com:443", http.StatusOK)
+	doTestConnectHosts(t, DenyConnectHosts(nil), http.MethodConnect, "bad.example.com:443", http.StatusOK)
+}
+
+func TestDenyConnectHostsPrecedence(t *testing.T) {
+	filter := filters.Join(
+		DenyConnectHosts([]string{"bad.example.com"}),
+		RestrictConnectHosts([]string{"*.example.com"}),
+	)
+	doTestConnectHosts(t, filter, http.MethodConnect, "bad.example.com:443", http.StatusForbidden)
+	doTestConnectHosts(t, filter, http.MethodConnect, "good.example.com:443", http.StatusOK)
+}
+
+func doTestRestrictConnectHosts(t *testing.T, allowed []string, method string, host string, expectedStatus int) {
+	doTestConnectHosts(t, RestrictConnectHosts(allowed), method, host, expectedStatus)
+}
+
+func doTestConnectHosts(t *testing.T, filter filters.Filter, method string, host string, expectedStatus int) {
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+		}, cs, nil
+	}
+
+	req, _ := http.NewRequest(method, "http://"+host, nil)
+	cs := filters.NewConnectionState(req, nil, nil)
+	resp, _, _ := filter.Apply(cs, req, next)
+	assert.Equal(t, expectedStatus, resp.StatusCode, "%v %v", method, host)
+}
@@ -1,41 +1,119 @@
 package proxyfilters
 
 import (
-	"fmt"
-	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/getlantern/errors"
 	"github.com/getlantern/proxy/v2/filters"
 )
 
+// allPorts is the token that allows all ports in AllowedPortsFromCSV.
+const allPorts = "*"
+
 // RestrictConnectPorts restricts CONNECT requests to the given list of allowed
 // ports and returns either a 400 error if the request is missing a port or a
-// 403 error if the port is not allowed.
+// 403 error if the port is not allowed. Requests with an invalid target, as
+// checked by ValidateConnectTarget, are rejected with a 400 error. IPv6 hosts
+// must be bracketed as in [2001:db8::1]:443 and may include a zone.
 func RestrictConnectPorts(allowedPorts []int) filters.Filter {
+	return RestrictConnectPortList(NewPortList(allowedPorts))
+}
+
+// RestrictConnectPortList is like RestrictConnectPorts but checks requests
+// against whatever ports the given list allows at the time.
+func RestrictConnectPortList(list *PortList) filters.Filter {
+	return restrictConnectPorts(list, false)
+}
+
+// RestrictConnectPortListWithHint is like RestrictConnectPortList but lists
+// the allowed ports, with consecutive ports as ranges like 1024-65535, in the
+// 403 error, so that client developers can tell what went wrong. Use it where
+// the allowed ports aren't sensitive.
+func RestrictConnectPortListWithHint(list *PortList) filters.Filter {
+	return restrictConnectPorts(list, true)
+}
+
+func restrictConnectPorts(list *PortList, hint bool) filters.Filter {
 	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
-		if req.Method != http.MethodConnect || len(allowedPorts) == 0 {
+		set := list.get()
+		if req.Method != http.MethodConnect || len(set.ports) == 0 {
 			return next(cs, req)
 		}
 
-		log.Tracef("Checking CONNECT tunnel to %s against allowed ports %v", req.Host, allowedPorts)
-		_, portString, err := net.SplitHostPort(req.Host)
+		log.Tracef("Checking CONNECT tunnel to %s against allowed ports %v", req.Host, set.ports)
+		_, port, kind, err := parseConnectTarget(req.Host)
 		if err != nil {
-			// CONNECT request should always include port in req.Host.
-			// Ref https://tools.ietf.org/html/rfc2817#section-5.2.
-			return fail(cs, req, http.StatusBadRequest, "No port field in Request-URI / Host header")
+			connectRejectedByPort.Inc()
+			return fail(cs, req, kind, "Invalid CONNECT target %q: %v", req.Host, err)
 		}
 
-		port, err := strconv.Atoi(portString)
-		if err != nil {
-			return fail(cs, req, http.StatusBadRequest, fmt.Sprintf("Invalid port for %v: %v", req.Host, portString))
+		if set.allowed[port] {
+			return next(cs, req)
 		}
+		connectRejectedByPort.Inc()
+		if hint {
+			return fail(cs, req, PortNotAllowed, "Port not allowed for %v: %d, allowed ports are %v", req.Host, port, strings.Join(formatPortRanges(set.ports), ","))
+		}
+		return fail(cs, req, PortNotAllowed, "Port not allowed for %v: %d", req.Host, port)
+	})
+}
 
-		for _, p := range allowedPorts {
-			if port == p {
-				return next(cs, req)
+// AllowedPortsFromCSV parses a comma separated list of ports and port ranges
+// like 1024-65535 for use with RestrictConnectPorts. Ranges are expanded into
+// the individual ports they include. "*" on its own stands for all ports from
+// 1 to 65535. That's not the same as an empty list, which doesn't restrict
+// CONNECT requests at all: with "*", requests with a missing or invalid port
+// are still rejected.
+func AllowedPortsFromCSV(csv string) ([]int, error) {
+	if strings.TrimSpace(csv) == allPorts {
+		return expandPortRange(1, 65535), nil
+	}
+	var ports []int
+	for _, field := range strings.Split(csv, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if field == allPorts {
+			return nil, errors.New("%v can't be combined with other ports in %v", allPorts, csv)
+		}
+		bounds := strings.SplitN(field, "-", 2)
+		first, err := parsePort(bounds[0])
+		if err != nil {
+			return nil, errors.New("Invalid port %v: %v", field, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = parsePort(bounds[1])
+			if err != nil {
+				return nil, errors.New("Invalid port range %v: %v", field, err)
+			}
+			if first > last {
+				return nil, errors.New("Invalid port range %v: %d is greater than %d", field, first, last)
 			}
 		}
-		return fail(cs, req, http.StatusForbidden, fmt.Sprintf("Port not allowed for %v: %d", req.Host, port))
-	})
+		ports = append(ports, expandPortRange(first, last)...)
+	}
+	return ports, nil
+}
+
+func expandPortRange(first, last int) []int {
+	ports := make([]int, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, errors.New("%q is not a number", s)
+	}
+	if port < 1 || port > 65535 {
+		return 0, errors.New("%d is not between 1 and 65535", port)
+	}
+	return port, nil
 }
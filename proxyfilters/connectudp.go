@@ -0,0 +1,268 @@
+package proxyfilters
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/buffers"
+)
+
+const (
+	// connectUDPPrefix is the path prefix of the default URI template of
+	// RFC 9298, /.well-known/masque/udp/{target_host}/{target_port}/.
+	connectUDPPrefix = "/.well-known/masque/udp/"
+
+	// capsuleDatagram is the type of DATAGRAM capsules (RFC 9297), the only
+	// ones that are relayed.
+	capsuleDatagram = 0x00
+
+	// maxCapsuleHeader is the most space needed in front of a UDP payload to
+	// encode it as a DATAGRAM capsule: one byte of type, up to four of length
+	// and one of context ID.
+	maxCapsuleHeader = 6
+
+	// maxUDPPayload is the largest UDP payload accepted from clients.
+	maxUDPPayload = 65527
+)
+
+var connectUDPResponse = []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+
+// ConnectUDP is EXPERIMENTAL support for proxying UDP over HTTP/1.1 as
+// specified by RFC 9298 (MASQUE CONNECT-UDP). It handles upgrade requests like
+//
+//	GET /.well-known/masque/udp/192.0.2.6/443/ HTTP/1.1
+//	Connection: Upgrade
+//	Upgrade: connect-udp
+//
+// by responding 101 Switching Protocols and then relaying the UDP payloads of
+// DATAGRAM capsules between the client connection and the target, through
+// the proxy's usual tunneling. Other capsules and datagrams with a non-zero
+// context ID are dropped. UDP datagrams received from targets are read into
+// buffers from the buffers package, so ones too large for them are truncated.
+//
+// Before dialing the target over "udp" with dial, the request is passed
+// through checks as a CONNECT request to the target, so that the filters that
+// restrict CONNECT destinations, like allowed ports and hosts, apply to UDP
+// too. The target is dialed at the host of the checked request's URL, which
+// they may have rewritten, and tunnels are only opened if all checks pass.
+func ConnectUDP(dial func(ctx context.Context, network, addr string) (net.Conn, error), checks ...filters.Filter) filters.Filter {
+	check := filters.Join(checks...)
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodGet || !strings.HasPrefix(req.URL.Path, connectUDPPrefix) ||
+			!headerHasToken(req.Header, "Upgrade", "connect-udp") {
+			return next(cs, req)
+		}
+		if !headerHasToken(req.Header, "Connection", "upgrade") {
+			return fail(cs, req, UDPRequestInvalid, "Missing Connection: Upgrade in CONNECT-UDP request")
+		}
+		target := strings.Split(strings.TrimPrefix(req.URL.Path, connectUDPPrefix), "/")
+		if len(target) < 2 || target[0] == "" || target[1] == "" || (len(target) > 2 && target[2] != "") {
+			return fail(cs, req, UDPRequestInvalid, "Invalid CONNECT-UDP target %v", req.URL.Path)
+		}
+		if _, err := parsePort(target[1]); err != nil {
+			return fail(cs, req, UDPRequestInvalid, "Invalid CONNECT-UDP target port %v: %v", target[1], err)
+		}
+		addr := net.JoinHostPort(target[0], target[1])
+		if cs.Downstream() == nil {
+			return fail(cs, req, InternalError, "No client connection to upgrade for CONNECT-UDP to %v", addr)
+		}
+
+		udpReq := req.Clone(req.Context())
+		udpReq.Method = http.MethodConnect
+		udpReq.Host = addr
+		udpReq.URL = &url.URL{Host: addr}
+		udpReq.RequestURI = addr
+		return check.Apply(cs, udpReq, func(cs *filters.ConnectionState, udpReq *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return relayUDP(cs, udpReq, dial)
+		})
+	})
+}
+
+// relayUDP dials the UDP target of the checked CONNECT request req and turns
+// the client connection into a tunnel to it.
+func relayUDP(cs *filters.ConnectionState, req *http.Request, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*http.Response, *filters.ConnectionState, error) {
+	addr := req.URL.Host
+	conn, err := dial(req.Context(), "udp", addr)
+	if err != nil {
+		return failWithCause(cs, req, DialFailed, err, "Unable to dial UDP target %v: %v", addr, err)
+	}
+	if _, err := cs.Downstream().Write(connectUDPResponse); err != nil {
+		conn.Close()
+		return nil, cs, errors.New("Unable to respond to CONNECT-UDP from %v: %v", req.RemoteAddr, err)
+	}
+	log.Debugf("Relaying UDP from %v to %v", req.RemoteAddr, addr)
+	// With an upstream connection and no response to write, the proxy pipes
+	// data between the client and it like for CONNECT tunnels
+	cs.SetUpstream(newCapsuleConn(conn))
+	return nil, cs, nil
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capsuleConn adapts a UDP connection to the capsule stream of a CONNECT-UDP
+// tunnel. Writes are parsed into DATAGRAM capsules whose payloads are sent as
+// UDP datagrams and reads return received datagrams encoded as capsules.
+type capsuleConn struct {
+	net.Conn
+	in []byte
+	// mx guards the fields below, as tunnels can be closed while reading, for
+	// example by MaxTunnelDuration
+	mx      sync.Mutex
+	readBuf []byte
+	pending []byte
+	reading bool
+	closed  bool
+}
+
+func newCapsuleConn(udp net.Conn) *capsuleConn {
+	return &capsuleConn{Conn: udp}
+}
+
+func (c *capsuleConn) Write(b []byte) (int, error) {
+	c.in = append(c.in, b...)
+	for {
+		capsuleType, typeLen := readVarint(c.in)
+		if typeLen == 0 {
+			break
+		}
+		length, lengthLen := readVarint(c.in[typeLen:])
+		if lengthLen == 0 {
+			break
+		}
+		if length > maxUDPPayload+8 {
+			return 0, errors.New("Capsule of %d bytes is too large", length)
+		}
+		start := typeLen + lengthLen
+		end := start + int(length)
+		if len(c.in) < end {
+			break
+		}
+		if capsuleType == capsuleDatagram {
+			value := c.in[start:end]
+			if contextID, n := readVarint(value); n > 0 && contextID == 0 {
+				if _, err := c.Conn.Write(value[n:]); err != nil {
+					log.Debugf("Unable to send UDP datagram to %v: %v", c.Conn.RemoteAddr(), err)
+				}
+			}
+		}
+		c.in = c.in[end:]
+	}
+	if len(c.in) == 0 {
+		// Don't hold on to the capacity of large writes
+		c.in = nil
+	}
+	return len(b), nil
+}
+
+func (c *capsuleConn) Read(b []byte) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed {
+		return 0, io.EOF
+	}
+	if len(c.pending) == 0 {
+		if c.readBuf == nil {
+			c.readBuf = buffers.Get()
+		}
+		buf := c.readBuf
+		// Don't block Close while waiting for a datagram, the buffer is only
+		// returned once reading stops
+		c.reading = true
+		c.mx.Unlock()
+		n, err := c.Conn.Read(buf[maxCapsuleHeader:])
+		c.mx.Lock()
+		c.reading = false
+		if c.closed {
+			c.releaseBuffer()
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		// Encode the capsule in front of the payload, with a context ID of 0
+		header := appendVarint(appendVarint(nil, capsuleDatagram), uint64(n+1))
+		header = append(header, 0)
+		start := maxCapsuleHeader - len(header)
+		copy(buf[start:], header)
+		c.pending = buf[start : maxCapsuleHeader+n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *capsuleConn) Close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	err := c.Conn.Close()
+	if !c.reading {
+		c.releaseBuffer()
+	}
+	return err
+}
+
+// releaseBuffer returns the read buffer to the pool, once nothing reads into
+// it anymore. c.mx must be held.
+func (c *capsuleConn) releaseBuffer() {
+	if c.readBuf != nil {
+		buffers.Put(c.readBuf)
+		c.readBuf = nil
+		c.pending = nil
+	}
+}
+
+func (c *capsuleConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000) from the start of
+// b, returning it and its length, which is 0 if b is too short.
+func readVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	length := 1 << (b[0] >> 6)
+	if len(b) < length {
+		return 0, 0
+	}
+	value := uint64(b[0] & 0x3f)
+	for _, next := range b[1:length] {
+		value = value<<8 | uint64(next)
+	}
+	return value, length
+}
+
+// appendVarint appends v to b as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
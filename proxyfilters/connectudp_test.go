@@ -0,0 +1,215 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// The target is routed to the echo server by the checks
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	target := net.JoinHostPort("192.0.2.1", port)
+	routes, err := RouteOverrides(map[string]string{target: echo.LocalAddr().String()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	proxyAddr, _, stop, err := startTunnelProxy(ConnectUDP(dial, routes))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /.well-known/masque/udp/192.0.2.1/%v/ HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n", port, proxyAddr)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "connect-udp", resp.Header.Get("Upgrade"))
+	assert.Equal(t, []string{"udp " + echo.LocalAddr().String()}, dialed, "should have dialed the routed target with the given dial function")
+
+	// An unknown capsule, which is skipped, followed by two datagrams in one
+	// write, the second with a length that needs a two byte varint
+	large := make([]byte, 1000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	var capsules []byte
+	capsules = append(capsules, 0x3f, 0x02, 'x', 'y')
+	capsules = appendDatagramCapsule(capsules, []byte("hello"))
+	capsules = appendDatagramCapsule(capsules, large)
+	_, err = conn.Write(capsules)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, expected := range [][]byte{[]byte("hello"), large} {
+		payload, err := readDatagramCapsule(br)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, payload, "datagram should have been echoed")
+		}
+	}
+}
+
+func TestConnectUDPChecks(t *testing.T) {
+	dialed := 0
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed++
+		return nil, errors.New("Should not dial %v", addr)
+	}
+	proxyAddr, _, stop, err := startTunnelProxy(ConnectUDP(dial, RestrictConnectPorts([]int{443}), BlockPrivateNetworks()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	for _, target := range []string{"192.0.2.1/53", "127.0.0.1/443", "169.254.169.254/443", "::1/443"} {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fmt.Fprintf(conn, "GET /.well-known/masque/udp/%v/ HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\n\r\n", target, proxyAddr)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if assert.NoError(t, err, target) {
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, target)
+		}
+	}
+	assert.Zero(t, dialed, "rejected targets should not be dialed")
+}
+
+func TestConnectUDPInvalid(t *testing.T) {
+	proxyAddr, _, stop, err := startTunnelProxy(ConnectUDP((&net.Dialer{}).DialContext))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	for _, path := range []string{
+		"/.well-known/masque/udp/example.com/",
+		"/.well-known/masque/udp/example.com/x/",
+		"/.well-known/masque/udp/example.com/443/extra",
+	} {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\n\r\n", path, proxyAddr)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if assert.NoError(t, err, path) {
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+		}
+	}
+}
+
+func TestCapsuleConnCloseWhileReading(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer udp.Close()
+	conn, err := net.Dial("udp", udp.LocalAddr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := newCapsuleConn(conn)
+	read := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 10))
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// Like MaxTunnelDuration closing a tunnel that's waiting for datagrams
+	assert.NoError(t, c.Close())
+	assert.Equal(t, io.EOF, <-read)
+	_, err = c.Read(make([]byte, 10))
+	assert.Equal(t, io.EOF, err, "reads after closing should fail")
+	assert.Nil(t, c.readBuf, "buffer should have been returned")
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+		b := appendVarint(nil, v)
+		decoded, n := readVarint(b)
+		assert.Equal(t, len(b), n, "%d", v)
+		assert.Equal(t, v, decoded)
+		_, n = readVarint(b[:len(b)-1])
+		assert.Equal(t, 0, n, "truncated varint of %d should not be read", v)
+	}
+	// Example from RFC 9000 appendix A.1
+	v, n := readVarint([]byte{0x9d, 0x7f, 0x3e, 0x7d})
+	assert.EqualValues(t, 494878333, v)
+	assert.Equal(t, 4, n)
+}
+
+func appendDatagramCapsule(b []byte, payload []byte) []byte {
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = append(b, 0)
+	return append(b, payload...)
+}
+
+func readDatagramCapsule(br *bufio.Reader) ([]byte, error) {
+	readVarintFrom := func() (uint64, error) {
+		first, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		b := make([]byte, 1<<(first[0]>>6))
+		if _, err := io.ReadFull(br, b); err != nil {
+			return 0, err
+		}
+		v, _ := readVarint(b)
+		return v, nil
+	}
+	if _, err := readVarintFrom(); err != nil {
+		return nil, err
+	}
+	length, err := readVarintFrom()
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(br, value); err != nil {
+		return nil, err
+	}
+	return value[1:], nil
+}
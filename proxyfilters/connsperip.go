@@ -0,0 +1,65 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// MaxConnsPerIP limits the number of simultaneously open CONNECT tunnels per
+// client IP, rejecting new CONNECT requests over the limit with a 429 error. A
+// limit of 0 or less means unlimited.
+//
+// Tunnels are only tracked while open if the proxy waits for upstream before
+// responding OK to CONNECT requests, which is the server's default.
+func MaxConnsPerIP(limit int) filters.Filter {
+	if limit <= 0 {
+		return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			return next(cs, req)
+		})
+	}
+
+	var mx sync.Mutex
+	open := make(map[string]int)
+	release := func(ip string) {
+		mx.Lock()
+		open[ip]--
+		if open[ip] <= 0 {
+			delete(open, ip)
+		}
+		mx.Unlock()
+	}
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ip = req.RemoteAddr
+		}
+		mx.Lock()
+		if open[ip] >= limit {
+			mx.Unlock()
+			return fail(cs, req, TooManyTunnelsFromIP, "Too many open tunnels from %v", ip)
+		}
+		open[ip]++
+		mx.Unlock()
+
+		tunneling := false
+		resp, nextCS, err := onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			tunneling = true
+			return newTunnelConn(upstream, func(sent, received int64) {
+				release(ip)
+			})
+		})
+		if !tunneling {
+			// Rejected or failed to dial
+			release(ip)
+		}
+		return resp, nextCS, err
+	})
+}
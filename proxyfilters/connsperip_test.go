@@ -0,0 +1,66 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxConnsPerIP(t *testing.T) {
+	proxyAddr, target, stop, err := startTunnelProxy(MaxConnsPerIP(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	conn, _, resp, err := openTunnel(proxyAddr, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	rejected, _, resp, err := openTunnel(proxyAddr, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rejected.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "second tunnel should have been rejected")
+
+	// Closing the first tunnel frees up its slot
+	conn.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		next, _, resp, err := openTunnel(proxyAddr, target)
+		if !assert.NoError(t, err) {
+			return
+		}
+		next.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			assert.Fail(t, "slot should have been released when tunnel closed")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestMaxConnsPerIPUnlimited(t *testing.T) {
+	proxyAddr, target, stop, err := startTunnelProxy(MaxConnsPerIP(0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		conn, _, resp, err := openTunnel(proxyAddr, target)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
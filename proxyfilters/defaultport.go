@@ -0,0 +1,36 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// DefaultConnectPort fills in the given port, usually 443, for CONNECT
+// requests whose target lacks one, like "CONNECT example.com", for lenient
+// clients that expect the proxy to assume HTTPS. Without it, such requests are
+// rejected with a 400 error as RFC 7231 requires a port. Place it before
+// ValidateConnectTarget and the filters that check destinations.
+func DefaultConnectPort(port int) (filters.Filter, error) {
+	if port < 1 || port > 65535 {
+		return nil, errors.New("Invalid default CONNECT port %d", port)
+	}
+	portString := strconv.Itoa(port)
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+		if _, _, kind, _ := parseConnectTarget(req.Host); kind == PortMissing {
+			host := strings.TrimSuffix(req.Host, ":")
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			req.Host = net.JoinHostPort(host, portString)
+			req.URL.Host = req.Host
+		}
+		return next(cs, req)
+	}), nil
+}
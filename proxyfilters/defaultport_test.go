@@ -0,0 +1,57 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestDefaultConnectPort(t *testing.T) {
+	filter, err := DefaultConnectPort(443)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	apply := func(method string, target string) (string, string) {
+		var dialed string
+		next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			dialed = req.URL.Host
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		}
+		req, _ := http.NewRequest(method, "http://example.com", nil)
+		req.Host = target
+		filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		return dialed, req.Host
+	}
+
+	for target, expected := range map[string]string{
+		"example.com":        "example.com:443",
+		"example.com:":       "example.com:443",
+		"[2001:db8::1]":      "[2001:db8::1]:443",
+		"example.com:8443":   "example.com:8443",
+		"[2001:db8::1]:8443": "[2001:db8::1]:8443",
+		"example.com:0":      "example.com:0",
+		"":                   "",
+	} {
+		dialed, host := apply(http.MethodConnect, target)
+		assert.Equal(t, expected, host, "%q", target)
+		if expected != target {
+			assert.Equal(t, expected, dialed, "%q should be dialed with the default port", target)
+		}
+	}
+	_, host := apply(http.MethodGet, "example.com")
+	assert.Equal(t, "example.com", host, "only CONNECT requests should get a port")
+
+	assert.Equal(t, http.StatusOK, applyToTarget(filters.Join(filter, ValidateConnectTarget), http.MethodConnect, "example.com"))
+	assert.Equal(t, http.StatusBadRequest, applyToTarget(ValidateConnectTarget, http.MethodConnect, "example.com"), "should be strict without default port")
+}
+
+func TestDefaultConnectPortInvalid(t *testing.T) {
+	for _, port := range []int{-1, 0, 65536} {
+		_, err := DefaultConnectPort(port)
+		assert.Error(t, err, "%d", port)
+	}
+}
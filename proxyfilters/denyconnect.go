@@ -0,0 +1,19 @@
+package proxyfilters
+
+import (
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// DenyConnect rejects all CONNECT requests with a 405 error, for running as a
+// forward proxy for plain HTTP only. Other requests are passed on.
+var DenyConnect = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	if req.Method != http.MethodConnect {
+		return next(cs, req)
+	}
+	resp, nextCS, err := fail(cs, req, ConnectNotAllowed, "CONNECT tunnels are not allowed")
+	// Tell the client which methods it can use instead
+	resp.Header.Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+	return resp, nextCS, err
+})
@@ -0,0 +1,20 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDenyConnect(t *testing.T) {
+	doTestConnectHosts(t, DenyConnect, http.MethodConnect, "example.com:443", http.StatusMethodNotAllowed)
+	doTestConnectHosts(t, DenyConnect, http.MethodGet, "example.com:80", http.StatusOK)
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	resp, _, err := DenyConnect.Apply(filters.NewConnectionState(req, nil, nil), req, nil)
+	assert.Error(t, err)
+	assert.NotEmpty(t, resp.Header.Get("Allow"), "should list allowed methods")
+	assert.NotContains(t, resp.Header.Get("Allow"), http.MethodConnect)
+}
@@ -0,0 +1,120 @@
+package proxyfilters
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/proxy/v2/filters"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// countryCacheSize is the number of IPs whose countries DenyCountries
+// remembers.
+const countryCacheSize = 10000
+
+// CountryLookup looks up the ISO 3166-1 alpha-2 codes of the countries of IP
+// addresses, like geoip.DB does. An empty code means that the country is
+// unknown.
+type CountryLookup interface {
+	Country(ip net.IP) (string, error)
+}
+
+// DenyCountries rejects CONNECT requests to destinations in the given
+// countries (ISO 3166-1 alpha-2 codes like US, in any case) with a 403 error.
+// Host names are resolved first and rejected if any of their addresses is in
+// one of the countries. The countries of the most recently requested IPs are
+// cached. Destinations that can't be resolved are rejected with a 502 error,
+// whereas IPs whose country is unknown are passed on.
+//
+// The dial resolves host names again, so it could still end up at an address
+// in a denied country. To refuse those, check the addresses that are actually
+// dialed with RefuseCountries, see dialers.WithAddressCheck.
+func DenyCountries(countries CountryLookup, denied []string) filters.Filter {
+	check := newCountryCheck(countries, denied)
+	if check == nil {
+		return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			return next(cs, req)
+		})
+	}
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+
+		addrs, err := resolveDestination(req)
+		if err != nil {
+			return failWithCause(cs, req, DialFailed, err, "Unable to resolve %v to check its country: %v", req.Host, err)
+		}
+		for _, addr := range addrs {
+			if country, denied := check.denied(addr.IP); denied {
+				connectRejectedByHost.Inc()
+				return fail(cs, req, CountryDenied, "%v requested %v (%v) in denied country %v", req.RemoteAddr, req.Host, addr.IP, country)
+			}
+		}
+		return next(cs, req)
+	})
+}
+
+// RefuseCountries returns a check refusing the addresses that DenyCountries
+// rejects, with an Error of kind CountryDenied. It's meant for checking the
+// addresses that are dialed, see dialers.WithAddressCheck.
+func RefuseCountries(countries CountryLookup, denied []string) func(ip net.IP) error {
+	check := newCountryCheck(countries, denied)
+	return func(ip net.IP) error {
+		if check == nil {
+			return nil
+		}
+		country, denied := check.denied(ip)
+		if !denied {
+			return nil
+		}
+		connectRejectedByHost.Inc()
+		return &Error{Kind: CountryDenied, Host: ip.String(), message: fmt.Sprintf("Refusing to dial %v in denied country %v", ip, country)}
+	}
+}
+
+// countryCheck tells whether IPs are in denied countries, caching their
+// countries.
+type countryCheck struct {
+	countries CountryLookup
+	deniedSet map[string]bool
+	cache     *lru.Cache
+}
+
+// newCountryCheck returns nil if no countries are denied.
+func newCountryCheck(countries CountryLookup, denied []string) *countryCheck {
+	deniedSet := make(map[string]bool, len(denied))
+	for _, country := range denied {
+		if country = strings.ToUpper(strings.TrimSpace(country)); country != "" {
+			deniedSet[country] = true
+		}
+	}
+	if len(deniedSet) == 0 {
+		return nil
+	}
+	cache, _ := lru.New(countryCacheSize)
+	return &countryCheck{countries: countries, deniedSet: deniedSet, cache: cache}
+}
+
+// denied returns the country of ip and whether it's denied.
+func (c *countryCheck) denied(ip net.IP) (string, bool) {
+	country := c.countryOf(ip)
+	return country, c.deniedSet[country]
+}
+
+func (c *countryCheck) countryOf(ip net.IP) string {
+	key := ip.String()
+	if cached, found := c.cache.Get(key); found {
+		return cached.(string)
+	}
+	country, err := c.countries.Country(ip)
+	if err != nil {
+		log.Errorf("Unable to look up country of %v, allowing it: %v", ip, err)
+		return ""
+	}
+	c.cache.Add(key, country)
+	return country
+}
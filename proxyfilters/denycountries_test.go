@@ -0,0 +1,99 @@
+package proxyfilters
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+type testCountries struct {
+	countries map[string]string
+	lookups   int
+}
+
+func (c *testCountries) Country(ip net.IP) (string, error) {
+	c.lookups++
+	if ip.String() == "192.0.2.99" {
+		return "", errors.New("corrupt record")
+	}
+	return c.countries[ip.String()], nil
+}
+
+func TestDenyCountries(t *testing.T) {
+	countries := &testCountries{countries: map[string]string{
+		"192.0.2.1":   "KP",
+		"192.0.2.2":   "US",
+		"2001:db8::1": "IR",
+	}}
+	filter := DenyCountries(countries, []string{"kp", " IR", ""})
+	doTestConnectHosts(t, filter, http.MethodConnect, "192.0.2.1:443", http.StatusForbidden)
+	doTestConnectHosts(t, filter, http.MethodConnect, "[2001:db8::1]:443", http.StatusForbidden)
+	doTestConnectHosts(t, filter, http.MethodConnect, "192.0.2.2:443", http.StatusOK)
+	doTestConnectHosts(t, filter, http.MethodConnect, "192.0.2.3:443", http.StatusOK)
+	doTestConnectHosts(t, filter, http.MethodConnect, "192.0.2.99:443", http.StatusOK)
+	doTestConnectHosts(t, filter, http.MethodGet, "192.0.2.1:80", http.StatusOK)
+
+	lookups := countries.lookups
+	doTestConnectHosts(t, filter, http.MethodConnect, "192.0.2.1:443", http.StatusForbidden)
+	doTestConnectHosts(t, filter, http.MethodConnect, "192.0.2.2:443", http.StatusOK)
+	assert.Equal(t, lookups, countries.lookups, "countries should be cached")
+	doTestConnectHosts(t, filter, http.MethodConnect, "192.0.2.99:443", http.StatusOK)
+	assert.Equal(t, lookups+1, countries.lookups, "failed lookups should not be cached")
+}
+
+func TestDenyCountriesNone(t *testing.T) {
+	countries := &testCountries{}
+	doTestConnectHosts(t, DenyCountries(countries, nil), http.MethodConnect, "192.0.2.1:443", http.StatusOK)
+	assert.Zero(t, countries.lookups)
+}
+
+func TestDenyCountriesResolves(t *testing.T) {
+	_, restore := withLookups(map[string][]string{
+		"rebind.example.com": {"192.0.2.2"},
+		"denied.example.com": {"192.0.2.1", "192.0.2.2"},
+	})
+	defer restore()
+	countries := &testCountries{countries: map[string]string{
+		"192.0.2.1": "KP",
+		"192.0.2.2": "US",
+	}}
+	filter := filters.Join(BlockPrivateNetworks(), DenyCountries(countries, []string{"KP"}))
+	apply := func(host string) (*http.Response, *http.Request) {
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+host, nil)
+		var dialed *http.Request
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			dialed = req
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		})
+		return resp, dialed
+	}
+
+	resp, dialed := apply("rebind.example.com:443")
+	if assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		assert.Equal(t, "rebind.example.com:443", dialed.URL.Host, "should leave the destination to the dialer")
+	}
+	resp, _ = apply("denied.example.com:443")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = apply("unknown.example.com:443")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "should reject host that can't be resolved")
+}
+
+func TestRefuseCountries(t *testing.T) {
+	countries := &testCountries{countries: map[string]string{
+		"192.0.2.1": "KP",
+		"192.0.2.2": "US",
+	}}
+	check := RefuseCountries(countries, []string{"KP"})
+	err := check(net.ParseIP("192.0.2.1"))
+	if assert.Error(t, err) {
+		assert.Equal(t, CountryDenied, err.(*Error).Kind)
+		assert.Equal(t, http.StatusForbidden, err.(*Error).StatusCode())
+	}
+	assert.NoError(t, check(net.ParseIP("192.0.2.2")))
+	assert.NoError(t, RefuseCountries(countries, nil)(net.ParseIP("192.0.2.1")), "should allow all if no countries are denied")
+}
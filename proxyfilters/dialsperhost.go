@@ -0,0 +1,97 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// MaxDialsPerHost limits the number of CONNECT requests that concurrently dial
+// the same host:port to limit, so that a thundering herd of clients doesn't
+// overwhelm an origin. Requests over the limit wait up to wait for another
+// dial to finish and are then rejected with a 503 error. A limit of 0 or less
+// means unlimited.
+//
+// Dials are only limited if the proxy waits for upstream before responding OK
+// to CONNECT requests, which is the server's default.
+func MaxDialsPerHost(limit int, wait time.Duration) filters.Filter {
+	if limit <= 0 {
+		return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			return next(cs, req)
+		})
+	}
+
+	slots := &dialSlots{limit: limit, byHost: make(map[string]*hostDialSlots)}
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+
+		host := strings.ToLower(req.Host)
+		if !slots.acquire(host, wait) {
+			connectRejectedByDial.Inc()
+			return fail(cs, req, TooManyDials, "Too many concurrent dials to %v", host)
+		}
+		defer slots.release(host)
+		return next(cs, req)
+	})
+}
+
+// dialSlots tracks the dials in progress to each host, only keeping track of
+// hosts that are being dialed or waited on.
+type dialSlots struct {
+	limit  int
+	mx     sync.Mutex
+	byHost map[string]*hostDialSlots
+}
+
+type hostDialSlots struct {
+	sem   chan struct{}
+	users int
+}
+
+func (s *dialSlots) acquire(host string, wait time.Duration) bool {
+	s.mx.Lock()
+	slots := s.byHost[host]
+	if slots == nil {
+		slots = &hostDialSlots{sem: make(chan struct{}, s.limit)}
+		s.byHost[host] = slots
+	}
+	slots.users++
+	s.mx.Unlock()
+
+	select {
+	case slots.sem <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		s.done(host, slots)
+		return false
+	}
+}
+
+func (s *dialSlots) release(host string) {
+	s.mx.Lock()
+	slots := s.byHost[host]
+	s.mx.Unlock()
+	<-slots.sem
+	s.done(host, slots)
+}
+
+func (s *dialSlots) done(host string, slots *hostDialSlots) {
+	s.mx.Lock()
+	slots.users--
+	if slots.users == 0 {
+		delete(s.byHost, host)
+	}
+	s.mx.Unlock()
+}
@@ -0,0 +1,60 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxDialsPerHost(t *testing.T) {
+	dialing := make(chan bool)
+	finishDial := make(chan bool)
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		if req.Host == "slow.example.com:443" {
+			dialing <- true
+			<-finishDial
+		}
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	filter := MaxDialsPerHost(1, 200*time.Millisecond)
+	connect := func(host string) int {
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+host, nil)
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		return resp.StatusCode
+	}
+
+	firstStatus := make(chan int)
+	go func() {
+		firstStatus <- connect("slow.example.com:443")
+	}()
+	<-dialing
+
+	rejectedBefore := connectRejectedByDial.Value()
+	assert.Equal(t, http.StatusServiceUnavailable, connect("SLOW.example.com:443"), "concurrent dial to same host should be rejected")
+	assert.Equal(t, rejectedBefore+1, connectRejectedByDial.Value())
+	assert.Equal(t, http.StatusOK, connect("other.example.com:443"), "dials to other hosts should not be limited")
+
+	// Waiting dials proceed once the dial in progress finishes
+	secondStatus := make(chan int)
+	go func() {
+		secondStatus <- connect("slow.example.com:443")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	finishDial <- true
+	<-dialing
+	finishDial <- true
+	assert.Equal(t, http.StatusOK, <-firstStatus)
+	assert.Equal(t, http.StatusOK, <-secondStatus)
+}
+
+func TestDialSlotsCleanup(t *testing.T) {
+	slots := &dialSlots{limit: 1, byHost: make(map[string]*hostDialSlots)}
+	assert.True(t, slots.acquire("example.com:443", time.Millisecond))
+	assert.False(t, slots.acquire("example.com:443", time.Millisecond))
+	assert.Len(t, slots.byHost, 1)
+	slots.release("example.com:443")
+	assert.Empty(t, slots.byHost, "hosts should be forgotten once no longer dialed")
+}
@@ -0,0 +1,150 @@
+package proxyfilters
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ErrorKind identifies why one of the filters in this package rejected a
+// request.
+type ErrorKind int
+
+const (
+	// PortMissing means that a CONNECT request didn't include a port.
+	PortMissing ErrorKind = iota + 1
+	// PortInvalid means that the port of a CONNECT request isn't a number
+	// from 1 to 65535.
+	PortInvalid
+	// PortNotAllowed means that the port of a CONNECT request isn't allowed.
+	PortNotAllowed
+	// HostNotAllowed means that the host of a request isn't among the allowed
+	// ones.
+	HostNotAllowed
+	// HostDenied means that the host of a CONNECT request is explicitly
+	// denied.
+	HostDenied
+	// LocalAddress means that a request was addressed to the proxy's own host.
+	LocalAddress
+	// PrivateAddress means that the host of a CONNECT request is or resolves to
+	// a loopback, link-local or private address.
+	PrivateAddress
+	// InvalidToken means that a request lacked the required auth token.
+	InvalidToken
+	// ConnectNotAllowed means that the proxy doesn't open CONNECT tunnels.
+	ConnectNotAllowed
+	// TooManyTunnels means that the maximum number of open tunnels was reached.
+	TooManyTunnels
+	// TooManyTunnelsFromIP means that the client has too many open tunnels.
+	TooManyTunnelsFromIP
+	// TooManyDials means that too many dials to the host were in progress.
+	TooManyDials
+	// RateLimited means that the client accessed the host too often.
+	RateLimited
+	// UDPRequestInvalid means that a CONNECT-UDP request is malformed.
+	UDPRequestInvalid
+	// DialFailed means that the destination of a request couldn't be reached.
+	DialFailed
+	// InvalidParameter means that a request to the proxy itself, like for its
+	// debug endpoints, has an invalid query parameter.
+	InvalidParameter
+	// InvalidCredentials means that a request lacked valid proxy credentials.
+	InvalidCredentials
+	// CountryDenied means that the destination of a CONNECT request is in a
+	// denied country.
+	CountryDenied
+	// QuotaExceeded means that the client transferred more data than its
+	// quota allows.
+	QuotaExceeded
+	// HostInvalid means that the target of a CONNECT request isn't a valid
+	// host.
+	HostInvalid
+	// DestinationDown means that dials to the destination of a CONNECT request
+	// kept failing recently, so it isn't dialed for a while.
+	DestinationDown
+	// ConnectWithBody means that a CONNECT request declared a body, which
+	// could smuggle a request past the proxy.
+	ConnectWithBody
+	// NotAuthorized means that the proxy's authorizer rejected a request.
+	NotAuthorized
+	// InternalError means that the proxy failed to handle a request.
+	InternalError
+)
+
+var errorKinds = map[ErrorKind]struct {
+	name       string
+	statusCode int
+}{
+	PortMissing:          {"port_missing", http.StatusBadRequest},
+	PortInvalid:          {"port_invalid", http.StatusBadRequest},
+	PortNotAllowed:       {"port_not_allowed", http.StatusForbidden},
+	HostNotAllowed:       {"host_not_allowed", http.StatusForbidden},
+	HostDenied:           {"host_denied", http.StatusForbidden},
+	LocalAddress:         {"local_address", http.StatusForbidden},
+	PrivateAddress:       {"private_address", http.StatusForbidden},
+	InvalidToken:         {"invalid_token", http.StatusForbidden},
+	ConnectNotAllowed:    {"connect_not_allowed", http.StatusMethodNotAllowed},
+	TooManyTunnels:       {"too_many_tunnels", http.StatusServiceUnavailable},
+	TooManyTunnelsFromIP: {"too_many_tunnels_from_ip", http.StatusTooManyRequests},
+	TooManyDials:         {"too_many_dials", http.StatusServiceUnavailable},
+	RateLimited:          {"rate_limited", http.StatusForbidden},
+	UDPRequestInvalid:    {"udp_request_invalid", http.StatusBadRequest},
+	DialFailed:           {"dial_failed", http.StatusBadGateway},
+	InvalidParameter:     {"invalid_parameter", http.StatusBadRequest},
+	InvalidCredentials:   {"invalid_credentials", http.StatusProxyAuthRequired},
+	CountryDenied:        {"country_denied", http.StatusForbidden},
+	QuotaExceeded:        {"quota_exceeded", http.StatusTooManyRequests},
+	HostInvalid:          {"host_invalid", http.StatusBadRequest},
+	DestinationDown:      {"destination_down", http.StatusServiceUnavailable},
+	ConnectWithBody:      {"connect_with_body", http.StatusBadRequest},
+	NotAuthorized:        {"not_authorized", http.StatusForbidden},
+	InternalError:        {"internal_error", http.StatusInternalServerError},
+}
+
+// StatusCode returns the status code of responses to requests rejected for
+// this kind of error.
+func (k ErrorKind) StatusCode() int {
+	if kind, ok := errorKinds[k]; ok {
+		return kind.statusCode
+	}
+	return http.StatusInternalServerError
+}
+
+func (k ErrorKind) String() string {
+	if kind, ok := errorKinds[k]; ok {
+		return kind.name
+	}
+	return fmt.Sprintf("unknown(%d)", int(k))
+}
+
+// Error is the error returned along with the failure response when a filter
+// in this package rejects a request. Its message is the body of the response.
+type Error struct {
+	Kind ErrorKind
+	// Host is the destination of the rejected request.
+	Host string
+	// Cause is the underlying error, if any.
+	Cause   error
+	message string
+	// statusCode, if not zero, overrides the status code of Kind.
+	statusCode int
+}
+
+func newError(kind ErrorKind, req *http.Request, cause error, description string, params ...interface{}) *Error {
+	return &Error{Kind: kind, Host: req.Host, Cause: cause, message: fmt.Sprintf(description, params...)}
+}
+
+func (e *Error) Error() string {
+	return e.message
+}
+
+// StatusCode returns the status code of the response to the rejected request.
+func (e *Error) StatusCode() int {
+	if e.statusCode != 0 {
+		return e.statusCode
+	}
+	return e.Kind.StatusCode()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
@@ -0,0 +1,60 @@
+package proxyfilters
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKinds(t *testing.T) {
+	for kind := PortMissing; kind <= InternalError; kind++ {
+		_, ok := errorKinds[kind]
+		assert.True(t, ok, "kind %d should have a name and status code", kind)
+	}
+	assert.Equal(t, http.StatusForbidden, PortNotAllowed.StatusCode())
+	assert.Equal(t, "port_not_allowed", PortNotAllowed.String())
+	assert.Equal(t, http.StatusInternalServerError, ErrorKind(0).StatusCode())
+	assert.Equal(t, "unknown(0)", ErrorKind(0).String())
+}
+
+func TestFilterErrors(t *testing.T) {
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	for _, test := range []struct {
+		filter filters.Filter
+		host   string
+		kind   ErrorKind
+	}{
+		{RestrictConnectPorts([]int{443}), "example.com", PortMissing},
+		{RestrictConnectPorts([]int{443}), "example.com:https", PortInvalid},
+		{RestrictConnectPorts([]int{443}), "example.com:80", PortNotAllowed},
+		{RestrictConnectHosts([]string{"example.org"}), "example.com:443", HostNotAllowed},
+		{DenyConnectHosts([]string{"example.com"}), "example.com:443", HostDenied},
+		{DenyConnect, "example.com:443", ConnectNotAllowed},
+		{ValidateConnectTarget, "example.com:+443", PortInvalid},
+		{ValidateConnectTarget, "2001:db8::1:443", HostInvalid},
+	} {
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com", nil)
+		req.Host = test.host
+		resp, _, err := test.filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		var filterErr *Error
+		if !assert.True(t, errors.As(err, &filterErr), "%v should have been rejected with an Error", test.host) {
+			continue
+		}
+		assert.Equal(t, test.kind, filterErr.Kind, test.host)
+		assert.Equal(t, test.host, filterErr.Host)
+		assert.Equal(t, test.kind.StatusCode(), resp.StatusCode, test.host)
+	}
+}
+
+func TestErrorCause(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	_, _, err := failWithCause(nil, req, InternalError, io.ErrUnexpectedEOF, "Unable to do it: %v", io.ErrUnexpectedEOF)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.EqualError(t, err, "Unable to do it: unexpected EOF")
+}
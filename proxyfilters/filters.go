@@ -3,14 +3,31 @@ package proxyfilters
 import (
 	"net/http"
 
-	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/proxy/v2/filters"
 )
 
 var log = golog.LoggerFor("http-proxy.filters")
 
-func fail(cs *filters.ConnectionState, req *http.Request, statusCode int, description string, params ...interface{}) (*http.Response, *filters.ConnectionState, error) {
-	log.Errorf("Filter fail: "+description, params...)
-	return filters.Fail(cs, req, statusCode, errors.New(description, params...))
+// fail rejects req with an Error of the given kind and description, responding
+// with the status code for that kind. Rejections of client requests (4xx) are
+// common, e.g. from scanners, so they're only logged at debug level, whereas
+// server errors (5xx) are logged as errors.
+func fail(cs *filters.ConnectionState, req *http.Request, kind ErrorKind, description string, params ...interface{}) (*http.Response, *filters.ConnectionState, error) {
+	return failWithCause(cs, req, kind, nil, description, params...)
+}
+
+// failWithCause is like fail but records the error that caused the rejection.
+func failWithCause(cs *filters.ConnectionState, req *http.Request, kind ErrorKind, cause error, description string, params ...interface{}) (*http.Response, *filters.ConnectionState, error) {
+	return failWithError(cs, req, newError(kind, req, cause, description, params...))
+}
+
+// failWithError is like fail but rejects the request with the given error.
+func failWithError(cs *filters.ConnectionState, req *http.Request, err *Error) (*http.Response, *filters.ConnectionState, error) {
+	if err.StatusCode() < http.StatusInternalServerError {
+		log.Debugf("Filter fail with %d: %v", err.StatusCode(), err)
+	} else {
+		log.Errorf("Filter fail with %d: %v", err.StatusCode(), err)
+	}
+	return filters.Fail(cs, req, err.StatusCode(), err)
 }
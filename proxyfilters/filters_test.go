@@ -2,6 +2,7 @@ package proxyfilters
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"io/ioutil"
 	"net"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/getlantern/golog"
 	"github.com/getlantern/proxy/v2"
 	"github.com/getlantern/proxy/v2/filters"
 	"github.com/stretchr/testify/assert"
@@ -45,6 +47,39 @@ func TestPersistent(t *testing.T) {
 		})
 }
 
+func TestAddVia(t *testing.T) {
+	doTestFilter(t,
+		AddVia("test-proxy"),
+		func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+			err := send(http.MethodGet, http.Header{via: []string{"1.0 upstream"}}, expectedBody)
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp, body, err := recv()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, expectedBody, body)
+			assert.Equal(t, []string{"1.0 upstream", "1.1 test-proxy"}, resp.Header["Reflected-Via"], "request should have been marked as going through proxy")
+			assert.Equal(t, "1.1 test-proxy", resp.Header.Get(via), "response should have been marked as going through proxy")
+		})
+}
+
+func TestFailLogLevels(t *testing.T) {
+	var errorOut, debugOut bytes.Buffer
+	defer golog.SetOutputs(&errorOut, &debugOut)()
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	resp, _, err := fail(nil, req, PortNotAllowed, "Rejected %v", "client")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NotContains(t, errorOut.String(), "Rejected client", "client errors should not be logged as errors")
+	assert.Contains(t, debugOut.String(), "Filter fail with 403: Rejected client")
+
+	fail(nil, req, InternalError, "Broken %v", "server")
+	assert.Contains(t, errorOut.String(), "Filter fail with 500: Broken server", "server errors should be logged as errors")
+}
+
 func TestRestrictConnectPortDisallowed(t *testing.T) {
 	doTestRestrictConnectPort(t, []int{9999999}, http.MethodConnect, http.StatusForbidden)
 }
@@ -57,6 +92,68 @@ func TestRestrictConnectNonConnect(t *testing.T) {
 	doTestRestrictConnectPort(t, []int{9999999}, http.MethodGet, http.StatusOK)
 }
 
+func TestRestrictConnectPortHosts(t *testing.T) {
+	filter := RestrictConnectPorts([]int{443})
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	for host, expectedStatus := range map[string]int{
+		"example.com:443":      http.StatusOK,
+		"192.0.2.1:443":        http.StatusOK,
+		"[2001:db8::1]:443":    http.StatusOK,
+		"[fe80::1%eth0]:443":   http.StatusOK,
+		"[fe80::1%25eth0]:443": http.StatusOK,
+		"example.com:80":       http.StatusForbidden,
+		"[2001:db8::1]:80":     http.StatusForbidden,
+		"[fe80::1%eth0]:80":    http.StatusForbidden,
+		"example.com":          http.StatusBadRequest,
+		"[2001:db8::1]":        http.StatusBadRequest,
+		"2001:db8::1:443":      http.StatusBadRequest,
+		"[2001:db8::1]:https":  http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com", nil)
+		req.Host = host
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		assert.Equal(t, expectedStatus, resp.StatusCode, host)
+	}
+}
+
+func TestAllowedPortsFromCSV(t *testing.T) {
+	ports, err := AllowedPortsFromCSV("")
+	assert.NoError(t, err)
+	assert.Empty(t, ports)
+
+	ports, err = AllowedPortsFromCSV("80, 443,8000-8003,65535-65535")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{80, 443, 8000, 8001, 8002, 8003, 65535}, ports)
+	}
+
+	ports, err = AllowedPortsFromCSV("1-65535")
+	if assert.NoError(t, err) {
+		assert.Len(t, ports, 65535)
+	}
+
+	ports, err = AllowedPortsFromCSV(" * ")
+	if assert.NoError(t, err) {
+		assert.Len(t, ports, 65535, "* should allow all ports")
+		assert.Equal(t, 1, ports[0])
+		assert.Equal(t, 65535, ports[65534])
+	}
+
+	for _, invalid := range []string{"x", "0", "65536", "443-", "-443", "x-y", "443-80", "1-2-3", "80,,x", "*,443", "443,*", "*-80"} {
+		_, err := AllowedPortsFromCSV(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRestrictConnectAllPorts(t *testing.T) {
+	ports, _ := AllowedPortsFromCSV("*")
+	filter := RestrictConnectPorts(ports)
+	doTestConnectHosts(t, filter, http.MethodConnect, "example.com:8443", http.StatusOK)
+	doTestConnectHosts(t, filter, http.MethodConnect, "example.com", http.StatusBadRequest)
+	doTestConnectHosts(t, RestrictConnectPorts(nil), http.MethodConnect, "example.com", http.StatusOK)
+}
+
 func doTestRestrictConnectPort(t *testing.T, ports []int, method string, expectedStatus int) {
 	doTestFilter(t,
 		RestrictConnectPorts(ports),
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/getlantern/errors"
 	"github.com/getlantern/proxy/v2/filters"
 )
 
@@ -25,3 +26,64 @@ var AddForwardedFor = filters.FilterFunc(func(cs *filters.ConnectionState, req *
 	}
 	return next(cs, req)
 })
+
+// TrustForwardedFor rewrites the RemoteAddr of requests from the given trusted
+// proxies (CIDRs or IP addresses) to the client IP given by the right-most
+// X-Forwarded-For entry that isn't itself a trusted proxy, so that later
+// filters see the actual client. X-Forwarded-For headers from untrusted peers
+// are ignored to prevent spoofing. Place it first.
+func TrustForwardedFor(trustedProxies []string) (filters.Filter, error) {
+	var trusted []*net.IPNet
+	for _, cidr := range trustedProxies {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("Invalid trusted proxy %v: %v", cidr, err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	isTrusted := func(ip net.IP) bool {
+		for _, ipNet := range trusted {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		peer, port, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil || len(trusted) == 0 {
+			return next(cs, req)
+		}
+		peerIP := net.ParseIP(peer)
+		if peerIP == nil || !isTrusted(peerIP) {
+			return next(cs, req)
+		}
+
+		clientIP := peerIP
+		entries := strings.Split(strings.Join(req.Header[xForwardedFor], ","), ",")
+		for i := len(entries) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(entries[i]))
+			if ip == nil {
+				break
+			}
+			clientIP = ip
+			if !isTrusted(ip) {
+				break
+			}
+		}
+		req.RemoteAddr = net.JoinHostPort(clientIP.String(), port)
+		return next(cs, req)
+	}), nil
+}
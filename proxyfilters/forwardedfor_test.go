@@ -0,0 +1,47 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustForwardedFor(t *testing.T) {
+	filter, err := TrustForwardedFor([]string{"10.0.0.0/8", "192.168.1.1"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		xff        []string
+		expected   string
+	}{
+		{"10.0.0.1:1234", []string{"1.2.3.4"}, "1.2.3.4:1234"},
+		{"10.0.0.1:1234", []string{"5.6.7.8, 1.2.3.4, 10.0.0.2"}, "1.2.3.4:1234"},
+		{"10.0.0.1:1234", []string{"5.6.7.8", "1.2.3.4, 192.168.1.1"}, "1.2.3.4:1234"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3:1234"},
+		{"10.0.0.1:1234", []string{"1.2.3.4, garbage"}, "10.0.0.1:1234"},
+		{"10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"8.8.8.8:1234", []string{"1.2.3.4"}, "8.8.8.8:1234"},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.xff != nil {
+			req.Header[xForwardedFor] = tc.xff
+		}
+		var remoteAddr string
+		filter.Apply(filters.NewConnectionState(req, nil, nil), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			remoteAddr = req.RemoteAddr
+			return nil, cs, nil
+		})
+		assert.Equal(t, tc.expected, remoteAddr, "%v via %v", tc.xff, tc.remoteAddr)
+	}
+}
+
+func TestTrustForwardedForInvalid(t *testing.T) {
+	_, err := TrustForwardedFor([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
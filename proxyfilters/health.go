@@ -0,0 +1,61 @@
+package proxyfilters
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// HealthCheck responds with 200 OK to GET requests for the given path that
+// are addressed to the proxy itself rather than proxied to an origin, for use
+// as a liveness probe by load balancers. The response body lists the result
+// of each of the given checks. Failing checks don't change the status so that
+// a degraded but alive proxy isn't taken out of rotation. Place it first so
+// that probes don't require a token. An empty path disables health checks.
+func HealthCheck(path string, checks map[string]func() error) filters.Filter {
+	return HealthCheckWithVersion(path, "", checks)
+}
+
+// HealthCheckWithVersion is like HealthCheck but also reports the given
+// version of the proxy on the first line of the response body, unless it's
+// empty.
+func HealthCheckWithVersion(path string, version string, checks map[string]func() error) filters.Filter {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		// Proxied requests use absolute URIs
+		if path == "" || req.Method != http.MethodGet || !strings.HasPrefix(req.RequestURI, "/") || req.URL.Path != path {
+			return next(cs, req)
+		}
+
+		var body bytes.Buffer
+		if version != "" {
+			fmt.Fprintf(&body, "version: %v\n", version)
+		}
+		if len(names) == 0 {
+			body.WriteString("ok\n")
+		}
+		for _, name := range names {
+			if err := checks[name](); err != nil {
+				fmt.Fprintf(&body, "%v: %v\n", name, err)
+			} else {
+				fmt.Fprintf(&body, "%v: ok\n", name)
+			}
+		}
+		return filters.ShortCircuit(cs, req, &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			Body:          ioutil.NopCloser(&body),
+			ContentLength: int64(body.Len()),
+		})
+	})
+}
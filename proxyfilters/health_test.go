@@ -0,0 +1,67 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheck(t *testing.T) {
+	filter := filters.Join(
+		HealthCheck("/healthz", map[string]func() error{
+			"good": func() error { return nil },
+			"bad":  func() error { return errors.New("down") },
+		}),
+		RequireToken("secret"),
+	)
+	proxyAddr, _, stop, err := startTunnelProxy(filter)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	resp, body := doHealthCheck(t, proxyAddr, "/healthz")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "bad: down\ngood: ok\n", body)
+	}
+
+	resp, _ = doHealthCheck(t, proxyAddr, "/other")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "other paths should require token")
+	}
+}
+
+func TestHealthCheckWithVersion(t *testing.T) {
+	proxyAddr, _, stop, err := startTunnelProxy(HealthCheckWithVersion("/healthz", "1.2.3", nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	_, body := doHealthCheck(t, proxyAddr, "/healthz")
+	assert.Equal(t, "version: 1.2.3\nok\n", body)
+}
+
+func doHealthCheck(t *testing.T, proxyAddr string, path string) (*http.Response, string) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if !assert.NoError(t, err) {
+		return nil, ""
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\n\r\n", path, proxyAddr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if !assert.NoError(t, err) {
+		return nil, ""
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
@@ -0,0 +1,40 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// MaxTunnelDuration closes CONNECT tunnels, both the client and the upstream
+// connection, once they have been open for d, however busy they are. Unlike
+// idle timeouts, this keeps clients from pinning tunnels indefinitely. A
+// duration of 0 or less means no limit.
+//
+// Tunnels are only timed from when upstream is dialed, and only if the proxy
+// waits for upstream before responding OK to CONNECT requests.
+func MaxTunnelDuration(d time.Duration) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if d <= 0 || req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+		downstream := cs.Downstream()
+		return onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			var expiry *time.Timer
+			conn := newTunnelConn(upstream, func(sent, received int64) {
+				expiry.Stop()
+			})
+			expiry = time.AfterFunc(d, func() {
+				log.Debugf("Closing tunnel from %v to %v after reaching maximum duration of %v", req.RemoteAddr, req.Host, d)
+				tunnelsExpired.Inc()
+				conn.Close()
+				if downstream != nil {
+					downstream.Close()
+				}
+			})
+			return conn
+		})
+	})
+}
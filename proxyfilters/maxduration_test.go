@@ -0,0 +1,53 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxTunnelDuration(t *testing.T) {
+	expiredBefore := tunnelsExpired.Value()
+	doTestTunnel(t, MaxTunnelDuration(250*time.Millisecond), func(conn net.Conn, br *bufio.Reader, resp *http.Response) {
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		// Keep the tunnel busy until it's closed
+		start := time.Now()
+		conn.SetDeadline(start.Add(5 * time.Second))
+		buf := make([]byte, 5)
+		var err error
+		for err == nil {
+			if _, err = conn.Write([]byte("hello")); err == nil {
+				_, err = io.ReadFull(br, buf)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		elapsed := time.Since(start)
+		assert.True(t, elapsed > 200*time.Millisecond, "tunnel closed too early, after %v", elapsed)
+		assert.True(t, elapsed < 2*time.Second, "tunnel should have been closed despite activity, took %v", elapsed)
+		assert.Equal(t, expiredBefore+1, tunnelsExpired.Value())
+	})
+}
+
+func TestMaxTunnelDurationUnlimited(t *testing.T) {
+	expiredBefore := tunnelsExpired.Value()
+	doTestTunnel(t, MaxTunnelDuration(0), func(conn net.Conn, br *bufio.Reader, resp *http.Response) {
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		_, err := conn.Write([]byte("hello"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.ReadFull(br, make([]byte, 5))
+		assert.NoError(t, err)
+		assert.Equal(t, expiredBefore, tunnelsExpired.Value())
+	})
+}
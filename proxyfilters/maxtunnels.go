@@ -0,0 +1,50 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// MaxTunnels limits the total number of simultaneously open CONNECT tunnels,
+// rejecting new CONNECT requests over the limit with a 503 error so that the
+// proxy doesn't run out of file descriptors. A limit of 0 or less means
+// unlimited.
+//
+// Like MaxConnsPerIP, tunnels are only tracked while open if the proxy waits
+// for upstream before responding OK to CONNECT requests.
+func MaxTunnels(limit int) filters.Filter {
+	if limit <= 0 {
+		return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			return next(cs, req)
+		})
+	}
+
+	var open int64
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+
+		if atomic.AddInt64(&open, 1) > int64(limit) {
+			atomic.AddInt64(&open, -1)
+			connectRejectedByCap.Inc()
+			return fail(cs, req, TooManyTunnels, "Too many open tunnels, limit is %d", limit)
+		}
+
+		tunneling := false
+		resp, nextCS, err := onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			tunneling = true
+			return newTunnelConn(upstream, func(sent, received int64) {
+				atomic.AddInt64(&open, -1)
+			})
+		})
+		if !tunneling {
+			// Rejected or failed to dial
+			atomic.AddInt64(&open, -1)
+		}
+		return resp, nextCS, err
+	})
+}
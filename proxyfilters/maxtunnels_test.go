@@ -0,0 +1,70 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxTunnels(t *testing.T) {
+	proxyAddr, target, stop, err := startTunnelProxy(MaxTunnels(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	conn, _, resp, err := openTunnel(proxyAddr, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	rejectedBefore := connectRejectedByCap.Value()
+	rejected, _, resp, err := openTunnel(proxyAddr, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rejected.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "second tunnel should have been rejected")
+	assert.Equal(t, rejectedBefore+1, connectRejectedByCap.Value())
+
+	// Closing the first tunnel frees up its slot
+	conn.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		next, _, resp, err := openTunnel(proxyAddr, target)
+		if !assert.NoError(t, err) {
+			return
+		}
+		next.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			assert.Fail(t, "slot should have been released when tunnel closed")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestMaxTunnelsReleasesRejected(t *testing.T) {
+	// Tunnels rejected by later filters must not take up slots
+	proxyAddr, target, stop, err := startTunnelProxy(filters.Join(MaxTunnels(1), RestrictConnectPorts([]int{1})))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		conn, _, resp, err := openTunnel(proxyAddr, target)
+		if !assert.NoError(t, err) {
+			return
+		}
+		conn.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
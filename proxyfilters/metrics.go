@@ -0,0 +1,136 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+var (
+	connectRequests       = metrics.NewCounter("http_proxy_connect_requests_total", "Total number of CONNECT requests received.")
+	connectRejectedByPort = metrics.NewCounter("http_proxy_connect_rejected_port_total", "Number of CONNECT requests rejected because of their port.")
+	connectRejectedByHost = metrics.NewCounter("http_proxy_connect_rejected_host_total", "Number of CONNECT requests rejected because of their host.")
+	connectRejectedByDial = metrics.NewCounter("http_proxy_connect_rejected_dial_limit_total", "Number of CONNECT requests rejected because too many dials to their host were in progress.")
+	connectRejectedByCap  = metrics.NewCounter("http_proxy_connect_rejected_capacity_total", "Number of CONNECT requests rejected because the maximum number of open tunnels was reached.")
+	connectShortCircuited = metrics.NewCounter("http_proxy_connect_rejected_destination_down_total", "Number of CONNECT requests rejected without dialing because dials to their destination kept failing.")
+	activeTunnels         = metrics.NewGauge("http_proxy_active_tunnels", "Number of currently open CONNECT tunnels.")
+	tunnelsOpened         = metrics.NewCounter("http_proxy_tunnels_total", "Total number of CONNECT tunnels opened.")
+	tunnelsExpired        = metrics.NewCounter("http_proxy_tunnels_expired_total", "Number of CONNECT tunnels closed for reaching their maximum duration, as opposed to idling.")
+	tunnelsDroppedByName  = metrics.NewCounter("http_proxy_tunnels_dropped_server_name_total", "Number of CONNECT tunnels dropped because the TLS server name sent by their client wasn't allowed.")
+	tunnelBytesSent       = metrics.NewCounter("http_proxy_tunnel_sent_bytes_total", "Bytes sent to origins through CONNECT tunnels.")
+	tunnelBytesReceived   = metrics.NewCounter("http_proxy_tunnel_received_bytes_total", "Bytes received from origins through CONNECT tunnels.")
+	tunnelDialLatency     = metrics.NewHistogram("http_proxy_tunnel_dial_seconds", "Time taken to dial origins for CONNECT tunnels.", nil)
+	tunnelFirstByte       = metrics.NewHistogram("http_proxy_tunnel_first_byte_seconds", "Time from dialing an origin to receiving the first byte from it through a CONNECT tunnel.", nil)
+	tunnelDuration        = metrics.NewHistogram("http_proxy_tunnel_duration_seconds", "Time from dialing an origin to closing a CONNECT tunnel to it.", DefaultTunnelDurationBuckets)
+)
+
+// DefaultTunnelDurationBuckets are the default upper bounds in seconds of the
+// buckets of the tunnel duration histogram, from a fraction of a second for
+// single requests to an hour for long lived connections.
+var DefaultTunnelDurationBuckets = []float64{.1, .5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// SetTunnelDurationBuckets sets the upper bounds in seconds, sorted in
+// increasing order, of the buckets of the tunnel duration histogram recorded by
+// RecordTunnelMetrics. Call it at startup, durations recorded before are
+// discarded.
+func SetTunnelDurationBuckets(buckets []float64) {
+	tunnelDuration.SetBuckets(buckets)
+}
+
+// RecordTunnelMetrics records metrics about CONNECT requests and the tunnels
+// they open. Place it first so that it sees requests rejected by later
+// filters.
+var RecordTunnelMetrics = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	if req.Method != http.MethodConnect {
+		return next(cs, req)
+	}
+	connectRequests.Inc()
+	return onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+		activeTunnels.Inc()
+		tunnelsOpened.Inc()
+		c := &meteredConn{Conn: upstream, destination: req.Host, client: req.RemoteAddr, opened: time.Now()}
+		trackTunnel(c)
+		return c
+	})
+})
+
+// RecordTunnelLatency records how long dialing origins for CONNECT tunnels
+// takes and how long after that origins send their first byte, which tells
+// slow connecting to origins apart from origins that are slow to respond.
+// Place it last so that the time spent in other filters isn't counted as
+// dialing.
+var RecordTunnelLatency = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	if req.Method != http.MethodConnect {
+		return next(cs, req)
+	}
+	start := time.Now()
+	return onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+		dialed := time.Now()
+		tunnelDialLatency.Observe(dialed.Sub(start).Seconds())
+		return &firstByteConn{Conn: upstream, dialed: dialed}
+	})
+})
+
+// firstByteConn records the time to the first byte received from the origin.
+type firstByteConn struct {
+	net.Conn
+	dialed   time.Time
+	received int32
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && atomic.CompareAndSwapInt32(&c.received, 0, 1) {
+		tunnelFirstByte.Observe(time.Since(c.dialed).Seconds())
+	}
+	return n, err
+}
+
+func (c *firstByteConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// meteredConn records the bytes carried by a tunnel as they flow, and its
+// duration once closed.
+type meteredConn struct {
+	net.Conn
+	sent        int64
+	received    int64
+	destination string
+	client      string
+	opened      time.Time
+	closeOnce   sync.Once
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	tunnelBytesReceived.Add(int64(n))
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	tunnelBytesSent.Add(int64(n))
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	c.closeOnce.Do(func() {
+		untrackTunnel(c)
+		activeTunnels.Dec()
+		tunnelDuration.Observe(time.Since(c.opened).Seconds())
+	})
+	return c.Conn.Close()
+}
+
+func (c *meteredConn) Wrapped() net.Conn {
+	return c.Conn
+}
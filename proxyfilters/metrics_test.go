@@ -0,0 +1,84 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordTunnelMetrics(t *testing.T) {
+	requestsBefore := connectRequests.Value()
+	sentBefore := tunnelBytesSent.Value()
+	receivedBefore := tunnelBytesReceived.Value()
+	activeBefore := activeTunnels.Value()
+	durationsBefore := tunnelDuration.Count()
+	durationSumBefore := tunnelDuration.Sum()
+
+	doTestTunnel(t, RecordTunnelMetrics, func(conn net.Conn, br *bufio.Reader, resp *http.Response) {
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		assert.Equal(t, requestsBefore+1, connectRequests.Value())
+		assert.Equal(t, activeBefore+1, activeTunnels.Value())
+
+		_, err := conn.Write([]byte("hello"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(br, buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, sentBefore+5, tunnelBytesSent.Value())
+		assert.Equal(t, receivedBefore+5, tunnelBytesReceived.Value())
+
+		conn.Close()
+		for i := 0; i < 50 && activeTunnels.Value() != activeBefore; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, activeBefore, activeTunnels.Value(), "tunnel should no longer be active")
+		assert.Equal(t, durationsBefore+1, tunnelDuration.Count(), "should record duration of closed tunnel")
+		assert.InDelta(t, durationSumBefore, tunnelDuration.Sum(), 10, "duration should be measured from opening the tunnel")
+	})
+}
+
+func TestRecordTunnelLatency(t *testing.T) {
+	dialsBefore := tunnelDialLatency.Count()
+	firstBytesBefore := tunnelFirstByte.Count()
+
+	doTestTunnel(t, RecordTunnelLatency, func(conn net.Conn, br *bufio.Reader, resp *http.Response) {
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		assert.Equal(t, dialsBefore+1, tunnelDialLatency.Count(), "should record dial")
+		assert.Equal(t, firstBytesBefore, tunnelFirstByte.Count(), "nothing received yet")
+
+		for i := 0; i < 2; i++ {
+			_, err := conn.Write([]byte("hello"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = io.ReadFull(br, make([]byte, 5))
+			if !assert.NoError(t, err) {
+				return
+			}
+		}
+		assert.Equal(t, firstBytesBefore+1, tunnelFirstByte.Count(), "should record only first byte")
+	})
+}
+
+func TestRejectionMetrics(t *testing.T) {
+	portsBefore := connectRejectedByPort.Value()
+	hostsBefore := connectRejectedByHost.Value()
+	doTestConnectHosts(t, RestrictConnectPorts([]int{443}), http.MethodConnect, "example.com:80", http.StatusForbidden)
+	doTestConnectHosts(t, RestrictConnectHosts([]string{"example.org"}), http.MethodConnect, "example.com:443", http.StatusForbidden)
+	doTestConnectHosts(t, DenyConnectHosts([]string{"example.com"}), http.MethodConnect, "example.com:443", http.StatusForbidden)
+	assert.Equal(t, portsBefore+1, connectRejectedByPort.Value())
+	assert.Equal(t, hostsBefore+2, connectRejectedByHost.Value())
+}
@@ -0,0 +1,76 @@
+package proxyfilters
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+)
+
+// PortList is a list of ports allowed for CONNECT requests that can be
+// replaced while the proxy is running, for example to pick up changes to a
+// file loaded with AllowedPortsFromFile, without restarting and dropping open
+// tunnels. Use it with RestrictConnectPortList and DebugStatusPortList.
+type PortList struct {
+	current atomic.Value // *portSet
+}
+
+type portSet struct {
+	ports   []int
+	allowed map[int]bool
+}
+
+// NewPortList creates a PortList allowing the given ports.
+func NewPortList(ports []int) *PortList {
+	l := &PortList{}
+	l.Set(ports)
+	return l
+}
+
+// Set atomically replaces the allowed ports. Requests already being checked
+// against the previous ports aren't affected.
+func (l *PortList) Set(ports []int) {
+	set := &portSet{ports: ports, allowed: make(map[int]bool, len(ports))}
+	for _, p := range ports {
+		set.allowed[p] = true
+	}
+	l.current.Store(set)
+}
+
+// Ports returns the currently allowed ports.
+func (l *PortList) Ports() []int {
+	return l.get().ports
+}
+
+func (l *PortList) get() *portSet {
+	return l.current.Load().(*portSet)
+}
+
+// AllowedPortsFromFile reads allowed ports from the file at path, in the
+// format of AllowedPortsFromCSV but with newlines also separating entries and
+// lines starting with # ignored. Unlike an empty -allowedports, a file without
+// any ports is an error, so that truncating the file doesn't open up all
+// ports; use * to allow all ports instead.
+func AllowedPortsFromFile(path string) ([]int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Unable to read allowed ports from %v: %v", path, err)
+	}
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	ports, err := AllowedPortsFromCSV(strings.Join(entries, ","))
+	if err != nil {
+		return nil, errors.New("Invalid allowed ports in %v: %v", path, err)
+	}
+	if len(ports) == 0 {
+		return nil, errors.New("No allowed ports in %v", path)
+	}
+	return ports, nil
+}
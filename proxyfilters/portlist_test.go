@@ -0,0 +1,75 @@
+package proxyfilters
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestRestrictConnectPortList(t *testing.T) {
+	list := NewPortList([]int{443})
+	filter := RestrictConnectPortList(list)
+	doTestConnectHosts(t, filter, http.MethodConnect, "example.com:443", http.StatusOK)
+	doTestConnectHosts(t, filter, http.MethodConnect, "example.com:8443", http.StatusForbidden)
+
+	list.Set([]int{8443})
+	assert.Equal(t, []int{8443}, list.Ports())
+	doTestConnectHosts(t, filter, http.MethodConnect, "example.com:443", http.StatusForbidden)
+	doTestConnectHosts(t, filter, http.MethodConnect, "example.com:8443", http.StatusOK)
+}
+
+func TestAllowedPortsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portlist")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ports")
+
+	write := func(contents string) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	write("# web\n80, 443\n\n  8000-8002\n")
+	ports, err := AllowedPortsFromFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{80, 443, 8000, 8001, 8002}, ports)
+	}
+
+	write("*\n")
+	ports, err = AllowedPortsFromFile(path)
+	if assert.NoError(t, err) {
+		assert.Len(t, ports, 65535)
+	}
+
+	for _, invalid := range []string{"", "# nothing\n\n", "443\nx\n", "*\n443\n"} {
+		write(invalid)
+		_, err := AllowedPortsFromFile(path)
+		assert.Error(t, err, invalid)
+	}
+
+	_, err = AllowedPortsFromFile(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestRestrictConnectPortListWithHint(t *testing.T) {
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	doConnect := func(filter filters.Filter) error {
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:80", nil)
+		req.Host = "example.com:80"
+		_, _, err := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		return err
+	}
+
+	list := NewPortList([]int{443, 8000, 8001, 8002})
+	assert.EqualError(t, doConnect(RestrictConnectPortList(list)), "Port not allowed for example.com:80: 80")
+	assert.EqualError(t, doConnect(RestrictConnectPortListWithHint(list)), "Port not allowed for example.com:80: 80, allowed ports are 443,8000-8002")
+}
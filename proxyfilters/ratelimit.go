@@ -31,7 +31,7 @@ func RateLimit(numClients int, hostPeriods map[string]time.Duration) filters.Fil
 		defer mx.Unlock()
 		period := hostPeriods[host]
 		if period == 0 {
-			return fail(cs, req, http.StatusForbidden, "Access to %v not allowed", host)
+			return fail(cs, req, HostNotAllowed, "Access to %v not allowed", host)
 		}
 		var hostAccesses map[string]time.Time
 		_hostAccesses, found := hostAccessesByClient.Get(client)
@@ -46,7 +46,7 @@ func RateLimit(numClients int, hostPeriods map[string]time.Duration) filters.Fil
 			hostAccessesByClient.Add(client, hostAccesses)
 		}
 		if !allowed {
-			return fail(cs, req, http.StatusForbidden, "Rate limit for %v exceeded", host)
+			return fail(cs, req, RateLimited, "Rate limit for %v exceeded", host)
 		}
 
 		return next(cs, req)
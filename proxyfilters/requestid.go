@@ -0,0 +1,67 @@
+package proxyfilters
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const (
+	// xRequestID is the header that carries the ID used to correlate logs for
+	// a request across services.
+	xRequestID = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+// RequestID takes the request ID from the X-Request-ID header or, if that's
+// missing or invalid, generates a random UUID. The ID is set on the request's
+// header and context, where filters can get it with RequestIDFrom, and on the
+// request_id op so that it's included in log lines for the request. Place it
+// before AccessLog so that the ID is logged too.
+var RequestID = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	id := req.Header.Get(xRequestID)
+	if !validRequestID(id) {
+		id = newRequestID()
+		req.Header.Set(xRequestID, id)
+	}
+	op := ops.Begin("request_id").Set("request_id", id)
+	defer op.End()
+	return next(cs, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+})
+
+// RequestIDFrom returns the ID set by RequestID in ctx, if any.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID makes sure that IDs from clients can't mess up our logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Errorf("Unable to generate request ID: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,61 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestID(t *testing.T) {
+	assert.Equal(t, "abc-123", doTestRequestID(t, "abc-123"), "should keep ID from client")
+
+	for _, invalid := range []string{"", "bad id", "bad\nid", strings.Repeat("a", maxRequestIDLength+1)} {
+		id := doTestRequestID(t, invalid)
+		assert.Regexp(t, uuidPattern, id, "should generate ID in place of %q", invalid)
+	}
+	assert.NotEqual(t, doTestRequestID(t, ""), doTestRequestID(t, ""), "generated IDs should be unique")
+}
+
+func TestAccessLogRequestID(t *testing.T) {
+	entries := make(entryWriter, 10)
+	proxyAddr, target, stop, err := startTunnelProxy(filters.Join(RequestID, AccessLog(entries)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	conn, _, _, err := openTunnel(proxyAddr, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+	entry := nextEntry(t, entries)
+	if assert.NotNil(t, entry) {
+		assert.Regexp(t, uuidPattern, entry.RequestID)
+	}
+}
+
+// doTestRequestID returns the request ID seen by the next filter for a request
+// with the given X-Request-ID header.
+func doTestRequestID(t *testing.T, header string) string {
+	var fromContext, fromHeader string
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		fromContext = RequestIDFrom(req.Context())
+		fromHeader = req.Header.Get(xRequestID)
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	if header != "" {
+		req.Header.Set(xRequestID, header)
+	}
+	RequestID.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+	assert.Equal(t, fromContext, fromHeader, "header and context should carry same ID")
+	return fromContext
+}
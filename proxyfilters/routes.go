@@ -0,0 +1,56 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// RouteOverrides rewrites the destinations of CONNECT requests according to
+// the given static routes from a host:port, like example.com:443, to the
+// host:port to dial instead, like 10.0.0.5:443, for pinning hosts to given
+// backends or for testing. Hosts are matched case insensitively. The request's
+// Host is left as is, so only the dial is affected. Place it after the filters
+// that check destinations, like RestrictConnectHosts and BlockPrivateNetworks,
+// which see the requested destination rather than its override.
+func RouteOverrides(routes map[string]string) (filters.Filter, error) {
+	overrides := make(map[string]string, len(routes))
+	for from, to := range routes {
+		key, err := routeKey(from)
+		if err != nil {
+			return nil, errors.New("Invalid route from %v: %v", from, err)
+		}
+		if _, _, _, err := parseConnectTarget(to); err != nil {
+			return nil, errors.New("Invalid route from %v to %v: %v", from, to, err)
+		}
+		overrides[key] = to
+	}
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect || len(overrides) == 0 {
+			return next(cs, req)
+		}
+		key, err := routeKey(req.Host)
+		if err != nil {
+			return next(cs, req)
+		}
+		if to, found := overrides[key]; found {
+			log.Debugf("Routing CONNECT to %v from %v to %v", req.Host, req.RemoteAddr, to)
+			req.URL.Host = to
+		}
+		return next(cs, req)
+	}), nil
+}
+
+// routeKey normalizes the given CONNECT target for looking up routes.
+func routeKey(hostport string) (string, error) {
+	host, port, _, err := parseConnectTarget(hostport)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(strings.ToLower(strings.TrimSuffix(host, ".")), strconv.Itoa(port)), nil
+}
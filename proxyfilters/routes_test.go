@@ -0,0 +1,92 @@
+package proxyfilters
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestRouteOverrides(t *testing.T) {
+	filter, err := RouteOverrides(map[string]string{
+		"example.com:443":   "10.0.0.5:443",
+		"[2001:db8::1]:443": "[2001:db8::2]:8443",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	routed := func(method string, target string) (string, string) {
+		var dialed string
+		next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			dialed = req.URL.Host
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		}
+		req, _ := http.NewRequest(method, "http://"+target, nil)
+		filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		return dialed, req.Host
+	}
+
+	dialed, host := routed(http.MethodConnect, "example.com:443")
+	assert.Equal(t, "10.0.0.5:443", dialed)
+	assert.Equal(t, "example.com:443", host, "Host should be left as is")
+	dialed, _ = routed(http.MethodConnect, "EXAMPLE.com.:443")
+	assert.Equal(t, "10.0.0.5:443", dialed, "hosts should be matched case insensitively")
+	dialed, _ = routed(http.MethodConnect, "[2001:db8::1]:443")
+	assert.Equal(t, "[2001:db8::2]:8443", dialed)
+
+	for _, target := range []string{"example.com:8443", "www.example.com:443", "example.org:443"} {
+		dialed, _ = routed(http.MethodConnect, target)
+		assert.Equal(t, target, dialed, "%v should have been passed through", target)
+	}
+	dialed, _ = routed(http.MethodGet, "example.com:443")
+	assert.Equal(t, "example.com:443", dialed, "only CONNECT requests should be routed")
+}
+
+func TestRouteOverridesInvalid(t *testing.T) {
+	for _, route := range [][2]string{
+		{"example.com", "10.0.0.5:443"},
+		{"example.com:0", "10.0.0.5:443"},
+		{"example.com:443", "10.0.0.5"},
+		{"example.com:443", "10.0.0.5:https"},
+	} {
+		_, err := RouteOverrides(map[string]string{route[0]: route[1]})
+		assert.Error(t, err, "%v -> %v", route[0], route[1])
+	}
+}
+
+func TestRouteOverridesTunnel(t *testing.T) {
+	var routes filters.Filter
+	proxyAddr, target, stop, err := startTunnelProxy(filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return routes.Apply(cs, req, next)
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+	routes, err = RouteOverrides(map[string]string{"pinned.invalid:443": target})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, br, resp, err := openTunnel(proxyAddr, "pinned.invalid:443")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	_, err = conn.Write([]byte("ping"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ping", string(buf), "tunnel should have reached the overridden destination")
+	}
+}
@@ -0,0 +1,211 @@
+package proxyfilters
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/hostpatterns"
+)
+
+const (
+	recordTypeHandshake  = 22
+	handshakeClientHello = 1
+	extensionServerName  = 0
+	serverNameHostName   = 0
+	maxTLSRecordBytes    = 16384 + 2048
+	maxClientHelloBytes  = 64 * 1024
+	tlsRecordHeaderBytes = 5
+	handshakeHeaderBytes = 4
+)
+
+var errIncompleteClientHello = errors.New("Incomplete ClientHello")
+
+// RestrictTLSServerNames only lets CONNECT tunnels carry TLS connections to the
+// given server names. It holds back what the client sends through the tunnel
+// until it has the whole TLS ClientHello, without terminating TLS, and drops
+// the tunnel unless the ClientHello's server name (SNI) matches one of the
+// given patterns, which are like those of RestrictConnectHosts. Otherwise, the
+// ClientHello is passed on to upstream as is. Tunnels not starting with a
+// ClientHello with a server name are dropped too. An empty list allows all
+// tunnels without looking into them.
+//
+// Tunnels are only seen if the proxy waits for upstream before responding OK
+// to CONNECT requests, which is the server's default.
+func RestrictTLSServerNames(allowedNames []string) filters.Filter {
+	allowed := hostpatterns.New(allowedNames)
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if allowed.Empty() {
+			return next(cs, req)
+		}
+		return onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			return &serverNameConn{Conn: upstream, allowed: allowed, req: req}
+		})
+	})
+}
+
+// serverNameConn is an upstream connection that holds back writes until they
+// add up to a ClientHello with an allowed server name.
+type serverNameConn struct {
+	net.Conn
+	allowed *hostpatterns.Patterns
+	req     *http.Request
+	mx      sync.Mutex
+	held    []byte
+	checked bool
+}
+
+func (c *serverNameConn) Write(b []byte) (int, error) {
+	c.mx.Lock()
+	if c.checked {
+		c.mx.Unlock()
+		return c.Conn.Write(b)
+	}
+	defer c.mx.Unlock()
+
+	c.held = append(c.held, b...)
+	serverName, err := clientHelloServerName(c.held)
+	if err == errIncompleteClientHello {
+		return len(b), nil
+	}
+	if err == nil {
+		if _, ok := c.allowed.Match(serverName); !ok {
+			err = errors.New("Server name %q not allowed", serverName)
+		}
+	}
+	if err != nil {
+		log.Debugf("Dropping tunnel to %v from %v: %v", c.req.Host, c.req.RemoteAddr, err)
+		tunnelsDroppedByName.Inc()
+		c.Conn.Close()
+		// The drop is logged above, so have the proxy treat it like the tunnel
+		// closing rather than an error
+		return 0, io.ErrClosedPipe
+	}
+
+	c.checked = true
+	held := c.held
+	c.held = nil
+	if _, err := c.Conn.Write(held); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *serverNameConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// clientHelloServerName returns the server name in the TLS ClientHello at the
+// start of b, which may be split among several records. It returns
+// errIncompleteClientHello if b doesn't hold all of it yet.
+func clientHelloServerName(b []byte) (string, error) {
+	if len(b) > 0 && b[0] != recordTypeHandshake {
+		return "", errors.New("Not a TLS handshake")
+	}
+	if len(b) > maxClientHelloBytes {
+		return "", errors.New("ClientHello larger than %d bytes", maxClientHelloBytes)
+	}
+	var handshake []byte
+	for rest := b; len(rest) >= tlsRecordHeaderBytes; {
+		if rest[0] != recordTypeHandshake {
+			return "", errors.New("ClientHello interrupted by record of type %d", rest[0])
+		}
+		length := int(rest[3])<<8 | int(rest[4])
+		if length > maxTLSRecordBytes {
+			return "", errors.New("TLS record of %d bytes too large", length)
+		}
+		if len(rest) < tlsRecordHeaderBytes+length {
+			break
+		}
+		handshake = append(handshake, rest[tlsRecordHeaderBytes:tlsRecordHeaderBytes+length]...)
+		rest = rest[tlsRecordHeaderBytes+length:]
+
+		if len(handshake) < handshakeHeaderBytes {
+			continue
+		}
+		if handshake[0] != handshakeClientHello {
+			return "", errors.New("Not a ClientHello but handshake message of type %d", handshake[0])
+		}
+		length = int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if len(handshake) >= handshakeHeaderBytes+length {
+			return parseClientHello(handshake[handshakeHeaderBytes : handshakeHeaderBytes+length])
+		}
+	}
+	return "", errIncompleteClientHello
+}
+
+// parseClientHello returns the host name in the server_name extension of the
+// given ClientHello body.
+func parseClientHello(hello []byte) (string, error) {
+	r := &tlsReader{b: hello}
+	r.skip(2 + 32) // version and random
+	r.skip(r.uint8())
+	r.skip(r.uint16())
+	r.skip(r.uint8())
+	extensions := &tlsReader{b: r.next(r.uint16())}
+	if r.truncated {
+		return "", errors.New("Malformed ClientHello")
+	}
+	for len(extensions.b) > 0 && !extensions.truncated {
+		extType := extensions.uint16()
+		data := &tlsReader{b: extensions.next(extensions.uint16())}
+		if extType != extensionServerName {
+			continue
+		}
+		names := &tlsReader{b: data.next(data.uint16())}
+		for len(names.b) > 0 && !names.truncated {
+			nameType := names.uint8()
+			name := names.next(names.uint16())
+			if nameType == serverNameHostName && !names.truncated && len(name) > 0 {
+				return string(name), nil
+			}
+		}
+		return "", errors.New("Malformed server_name extension")
+	}
+	if extensions.truncated {
+		return "", errors.New("Malformed ClientHello extensions")
+	}
+	return "", errors.New("No server name in ClientHello")
+}
+
+// tlsReader reads the big-endian, length-prefixed fields of TLS messages,
+// recording whether it ran past the end.
+type tlsReader struct {
+	b         []byte
+	truncated bool
+}
+
+func (r *tlsReader) next(n int) []byte {
+	if r.truncated || n > len(r.b) {
+		r.truncated = true
+		r.b = nil
+		return nil
+	}
+	field := r.b[:n]
+	r.b = r.b[n:]
+	return field
+}
+
+func (r *tlsReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *tlsReader) uint8() int {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *tlsReader) uint16() int {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
@@ -0,0 +1,101 @@
+package proxyfilters
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clientHello returns a ClientHello for serverName as sent by crypto/tls.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, tlsRecordHeaderBytes)
+	if _, err := io.ReadFull(server, header); !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return append(header, body...)
+}
+
+func TestClientHelloServerName(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	serverName, err := clientHelloServerName(hello)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "www.example.com", serverName)
+	}
+	for i := 0; i < len(hello); i++ {
+		_, err := clientHelloServerName(hello[:i])
+		assert.Equal(t, errIncompleteClientHello, err, "partial ClientHello of %d bytes should be incomplete", i)
+	}
+
+	// Split the handshake message among two records
+	handshake := hello[tlsRecordHeaderBytes:]
+	split := append([]byte{recordTypeHandshake, 3, 1, 0, 10}, handshake[:10]...)
+	split = append(split, recordTypeHandshake, 3, 1, byte((len(handshake)-10)>>8), byte(len(handshake)-10))
+	split = append(split, handshake[10:]...)
+	serverName, err = clientHelloServerName(split)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "www.example.com", serverName, "should reassemble ClientHello split among records")
+	}
+
+	_, err = clientHelloServerName([]byte("GET / HTTP/1.1\r\n"))
+	assert.Error(t, err, "should reject non TLS traffic right away")
+	_, err = clientHelloServerName(clientHello(t, ""))
+	assert.Error(t, err, "should reject ClientHello without server name")
+	corrupt := append([]byte{}, hello...)
+	corrupt[tlsRecordHeaderBytes+handshakeHeaderBytes+2+32] = 255
+	_, err = clientHelloServerName(corrupt)
+	assert.Error(t, err, "should reject malformed ClientHello")
+}
+
+func TestRestrictTLSServerNames(t *testing.T) {
+	proxyAddr, target, stop, err := startTunnelProxy(RestrictTLSServerNames([]string{"*.example.com"}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	for serverName, allowed := range map[string]bool{
+		"www.example.com": true,
+		"example.com":     false,
+		"www.example.org": false,
+	} {
+		conn, br, _, err := openTunnel(proxyAddr, target)
+		if !assert.NoError(t, err) {
+			return
+		}
+		hello := clientHello(t, serverName)
+		// Send the ClientHello in pieces to make sure it's held back until
+		// complete
+		conn.Write(hello[:10])
+		time.Sleep(10 * time.Millisecond)
+		conn.Write(hello[10:])
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if allowed {
+			echoed := make([]byte, len(hello))
+			_, err := io.ReadFull(br, echoed)
+			if assert.NoError(t, err) {
+				assert.True(t, bytes.Equal(hello, echoed), "ClientHello for %v should have been passed on as is", serverName)
+			}
+		} else {
+			echoed, err := ioutil.ReadAll(br)
+			assert.NoError(t, err, "tunnel for %v should have been dropped", serverName)
+			assert.Empty(t, echoed, "ClientHello for %v should not have been passed on", serverName)
+		}
+		conn.Close()
+	}
+}
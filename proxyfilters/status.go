@@ -0,0 +1,82 @@
+package proxyfilters
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// processStart approximates when the process started
+var processStart = time.Now()
+
+type status struct {
+	UptimeSeconds int64    `json:"uptime_seconds"`
+	ActiveTunnels int64    `json:"active_tunnels"`
+	TotalTunnels  int64    `json:"total_tunnels"`
+	AllowedPorts  []string `json:"allowed_ports"`
+}
+
+// DebugStatus responds to GET requests for the given path that are addressed
+// to the proxy itself with a JSON summary of the process uptime, the number of
+// currently open and total CONNECT tunnels, and the given allowed ports, with
+// consecutive ports listed as ranges like 1024-65535.
+// Tunnels are only counted if RecordTunnelMetrics is in the filter chain.
+// Place it after RequireToken so that the status requires a token. An empty
+// path disables the status.
+func DebugStatus(path string, allowedPorts []int) filters.Filter {
+	return DebugStatusPortList(path, NewPortList(allowedPorts))
+}
+
+// DebugStatusPortList is like DebugStatus but reports whatever ports the given
+// list allows at the time.
+func DebugStatusPortList(path string, list *PortList) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		// Proxied requests use absolute URIs
+		if path == "" || req.Method != http.MethodGet || !strings.HasPrefix(req.RequestURI, "/") || req.URL.Path != path {
+			return next(cs, req)
+		}
+
+		body, err := json.Marshal(&status{
+			UptimeSeconds: int64(time.Since(processStart) / time.Second),
+			ActiveTunnels: activeTunnels.Value(),
+			TotalTunnels:  tunnelsOpened.Value(),
+			AllowedPorts:  formatPortRanges(list.Ports()),
+		})
+		if err != nil {
+			return failWithCause(cs, req, InternalError, err, "Unable to encode status: %v", err)
+		}
+		return filters.ShortCircuit(cs, req, &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		})
+	})
+}
+
+func formatPortRanges(ports []int) []string {
+	sorted := append([]int(nil), ports...)
+	sort.Ints(sorted)
+	ranges := []string{}
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			ranges = append(ranges, strconv.Itoa(sorted[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return ranges
+}
@@ -0,0 +1,56 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugStatus(t *testing.T) {
+	filter := filters.Join(RequireToken("secret"), DebugStatus("/debug/status", []int{8443, 443, 80, 81, 82}))
+	proxyAddr, _, stop, err := startTunnelProxy(filter)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	resp, _ := doTestStatus(t, proxyAddr, "")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "status should require token")
+	}
+
+	resp, st := doTestStatus(t, proxyAddr, "secret")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, activeTunnels.Value(), st.ActiveTunnels)
+		assert.Equal(t, tunnelsOpened.Value(), st.TotalTunnels)
+		assert.Equal(t, []string{"80-82", "443", "8443"}, st.AllowedPorts)
+		assert.True(t, st.UptimeSeconds >= 0)
+	}
+}
+
+func doTestStatus(t *testing.T, proxyAddr string, token string) (*http.Response, *status) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /debug/status HTTP/1.1\r\nHost: %v\r\n%v: %v\r\n\r\n", proxyAddr, xLanternAuthToken, token)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	defer resp.Body.Close()
+	st := &status{}
+	if resp.StatusCode == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(st))
+	}
+	return resp, st
+}
@@ -0,0 +1,128 @@
+package proxyfilters
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const (
+	maxHostLength  = 253
+	maxLabelLength = 63
+)
+
+// ValidateConnectTarget rejects CONNECT requests whose target isn't a valid
+// host:port with a 400 error, before any filter resolves or dials it. Hosts
+// must be DNS names or IPv4 addresses, or IPv6 addresses in brackets that may
+// include a zone as in [fe80::1%eth0]:443, and ports must be numbers from 1 to
+// 65535. RestrictConnectPorts and the host filters check targets the same way.
+var ValidateConnectTarget = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	if req.Method != http.MethodConnect {
+		return next(cs, req)
+	}
+	if _, _, kind, err := parseConnectTarget(req.Host); err != nil {
+		return fail(cs, req, kind, "Invalid CONNECT target %q: %v", req.Host, err)
+	}
+	return next(cs, req)
+})
+
+// parseConnectTarget splits the target of a CONNECT request into its host,
+// without brackets, and port. If the target is invalid, it returns the kind of
+// error to reject the request with.
+func parseConnectTarget(hostport string) (string, int, ErrorKind, error) {
+	if hostport == "" {
+		return "", 0, HostInvalid, fmt.Errorf("missing host")
+	}
+	host, portString, err := net.SplitHostPort(hostport)
+	if err != nil {
+		bracketed := strings.HasPrefix(hostport, "[") && strings.HasSuffix(hostport, "]")
+		if !strings.Contains(hostport, ":") || bracketed {
+			// CONNECT request should always include port in req.Host.
+			// Ref https://tools.ietf.org/html/rfc2817#section-5.2.
+			return "", 0, PortMissing, fmt.Errorf("missing port")
+		}
+		return "", 0, HostInvalid, fmt.Errorf("malformed host:port")
+	}
+	if portString == "" {
+		return "", 0, PortMissing, fmt.Errorf("missing port")
+	}
+	port, err := parseTargetPort(portString)
+	if err != nil {
+		return "", 0, PortInvalid, err
+	}
+	if strings.HasPrefix(hostport, "[") {
+		err = checkIPv6Host(host)
+	} else {
+		err = checkHostName(host)
+	}
+	if err != nil {
+		return "", 0, HostInvalid, err
+	}
+	return host, port, 0, nil
+}
+
+// parseTargetPort is stricter than strconv.Atoi, which accepts signs.
+func parseTargetPort(s string) (int, error) {
+	if len(s) > 5 {
+		return 0, fmt.Errorf("port %q out of range", s)
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, fmt.Errorf("port %q is not a number", s)
+		}
+	}
+	port, _ := strconv.Atoi(s)
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %q out of range", s)
+	}
+	return port, nil
+}
+
+func checkIPv6Host(host string) error {
+	ip := host
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		ip = host[:i]
+		if !validLabel(host[i+1:]) {
+			return fmt.Errorf("invalid zone in %q", host)
+		}
+	}
+	if !strings.Contains(ip, ":") || net.ParseIP(ip) == nil {
+		return fmt.Errorf("%q is not an IPv6 address", host)
+	}
+	return nil
+}
+
+// checkHostName checks that host is made of labels of letters, digits, hyphens
+// and underscores, which also covers IPv4 addresses. A trailing dot is allowed.
+func checkHostName(host string) error {
+	name := strings.TrimSuffix(host, ".")
+	if name == "" {
+		return fmt.Errorf("missing host")
+	}
+	if len(name) > maxHostLength {
+		return fmt.Errorf("host is longer than %d characters", maxHostLength)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !validLabel(label) {
+			return fmt.Errorf("invalid host %q", host)
+		}
+	}
+	return nil
+}
+
+func validLabel(label string) bool {
+	if label == "" || len(label) > maxLabelLength {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
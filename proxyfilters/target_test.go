@@ -0,0 +1,148 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+var connectTargets = map[string]ErrorKind{
+	"example.com:443":       0,
+	"EXAMPLE.com.:443":      0,
+	"_srv.example.com:443":  0,
+	"192.0.2.1:443":         0,
+	"[2001:db8::1]:443":     0,
+	"[fe80::1%eth0]:443":    0,
+	"example.com:0443":      0,
+	"":                      HostInvalid,
+	":443":                  HostInvalid,
+	"example.com":           PortMissing,
+	"example.com:":          PortMissing,
+	"[2001:db8::1]":         PortMissing,
+	"example.com:https":     PortInvalid,
+	"example.com:+443":      PortInvalid,
+	"example.com:-1":        PortInvalid,
+	"example.com:0":         PortInvalid,
+	"example.com:65536":     PortInvalid,
+	"example.com:000443":    PortInvalid,
+	"example.com: 443":      PortInvalid,
+	"2001:db8::1:443":       HostInvalid,
+	"example.com:443:443":   HostInvalid,
+	"exa mple.com:443":      HostInvalid,
+	" example.com:443":      HostInvalid,
+	"example.com\t:443":     HostInvalid,
+	"example..com:443":      HostInvalid,
+	".example.com:443":      HostInvalid,
+	"example.com/x:443":     HostInvalid,
+	"user@example.com:443":  HostInvalid,
+	"[example.com]:443":     HostInvalid,
+	"[192.0.2.1]:443":       HostInvalid,
+	"[fe80::1%]:443":        HostInvalid,
+	"[fe80::1%eth 0]:443":   HostInvalid,
+	"[2001:db8::1]x:443":    HostInvalid,
+	"[2001:db8::1:443":      HostInvalid,
+	"éxample.com:443":       HostInvalid,
+	"example.com.example:1": 0,
+}
+
+func TestParseConnectTarget(t *testing.T) {
+	for target, expectedKind := range connectTargets {
+		host, port, kind, err := parseConnectTarget(target)
+		assert.Equal(t, expectedKind, kind, "%q", target)
+		if expectedKind == 0 {
+			assert.NoError(t, err, "%q", target)
+			assert.True(t, port >= 1 && port <= 65535, "%q", target)
+			assert.NotEmpty(t, host, "%q", target)
+		} else {
+			assert.Error(t, err, "%q", target)
+		}
+	}
+
+	host, port, _, _ := parseConnectTarget("[fe80::1%eth0]:443")
+	assert.Equal(t, "fe80::1%eth0", host)
+	assert.Equal(t, 443, port)
+
+	_, _, kind, _ := parseConnectTarget(strings.Repeat("a", 64) + ".com:443")
+	assert.Equal(t, HostInvalid, kind, "labels are limited to 63 characters")
+	_, _, kind, _ = parseConnectTarget(strings.Repeat("a.", 127) + "aa:443")
+	assert.Equal(t, HostInvalid, kind, "hosts are limited to 253 characters")
+}
+
+func TestValidateConnectTarget(t *testing.T) {
+	filter := ValidateConnectTarget
+	for target, kind := range connectTargets {
+		expectedStatus := http.StatusOK
+		if kind != 0 {
+			expectedStatus = kind.StatusCode()
+		}
+		assert.Equal(t, expectedStatus, applyToTarget(filter, http.MethodConnect, target), "%q", target)
+	}
+	assert.Equal(t, http.StatusOK, applyToTarget(filter, http.MethodGet, "example.com"), "only CONNECT requests should be validated")
+}
+
+func FuzzParseConnectTarget(f *testing.F) {
+	for target := range connectTargets {
+		f.Add(target)
+	}
+	f.Fuzz(func(t *testing.T, target string) {
+		host, port, kind, err := parseConnectTarget(target)
+		if err != nil {
+			if kind != PortMissing && kind != PortInvalid && kind != HostInvalid {
+				t.Fatalf("%q rejected with unexpected kind %v", target, kind)
+			}
+			return
+		}
+		if kind != 0 || host == "" || port < 1 || port > 65535 {
+			t.Fatalf("%q parsed into host %q, port %d, kind %v", target, host, port, kind)
+		}
+		if strings.ContainsAny(host, " \t\r\n/@[]") {
+			t.Fatalf("%q parsed into host %q with invalid characters", target, host)
+		}
+		rejoined := net.JoinHostPort(host, strconv.Itoa(port))
+		reHost, rePort, _, err := parseConnectTarget(rejoined)
+		if err != nil || reHost != host || rePort != port {
+			t.Fatalf("%q parsed into %q, which doesn't parse back the same: %q, %d, %v", target, rejoined, reHost, rePort, err)
+		}
+	})
+}
+
+// FuzzConnectTargetFilters checks that the filters that parse CONNECT targets
+// agree on which ones are invalid.
+func FuzzConnectTargetFilters(f *testing.F) {
+	allPorts, _ := AllowedPortsFromCSV("*")
+	validate := ValidateConnectTarget
+	others := []filters.Filter{
+		RestrictConnectPorts(allPorts),
+		RestrictConnectHosts([]string{"*"}),
+		DenyConnectHosts([]string{"denied.invalid"}),
+	}
+	for target := range connectTargets {
+		f.Add(target)
+	}
+	f.Fuzz(func(t *testing.T, target string) {
+		expectedStatus := applyToTarget(validate, http.MethodConnect, target)
+		for i, filter := range others {
+			status := applyToTarget(filter, http.MethodConnect, target)
+			if expectedStatus == http.StatusBadRequest && status != http.StatusBadRequest ||
+				expectedStatus != http.StatusBadRequest && status == http.StatusBadRequest {
+				t.Fatalf("%q got %d from filter %d but %d from ValidateConnectTarget", target, status, i, expectedStatus)
+			}
+		}
+	})
+}
+
+func applyToTarget(filter filters.Filter, method string, target string) int {
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	req, _ := http.NewRequest(method, "http://example.com", nil)
+	req.Host = target
+	resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+	return resp.StatusCode
+}
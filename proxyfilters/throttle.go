@@ -0,0 +1,110 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// ThrottleTunnels limits the throughput of each CONNECT tunnel to the given
+// number of bytes per second. up limits data sent to the origin and down data
+// received from it. A limit of 0 or less disables throttling in that
+// direction. Each tunnel may burst up to one second's worth of data.
+func ThrottleTunnels(up int64, down int64) filters.Filter {
+	if up <= 0 && down <= 0 {
+		return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			return next(cs, req)
+		})
+	}
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			return &throttledConn{Conn: upstream, up: newTokenBucket(up), down: newTokenBucket(down)}
+		})
+	})
+}
+
+// throttledConn throttles reads and writes using token buckets. A nil bucket
+// means no throttling.
+type throttledConn struct {
+	net.Conn
+	up   *tokenBucket
+	down *tokenBucket
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if c.down == nil {
+		return c.Conn.Read(b)
+	}
+	if int64(len(b)) > c.down.burst {
+		b = b[:c.down.burst]
+	}
+	n, err := c.Conn.Read(b)
+	time.Sleep(c.down.take(int64(n)))
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if c.up == nil {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if int64(len(chunk)) > c.up.burst {
+			chunk = chunk[:c.up.burst]
+		}
+		time.Sleep(c.up.take(int64(len(chunk))))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *throttledConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// tokenBucket is a simple token bucket that allows going into debt, in which
+// case callers have to wait until the debt is paid off.
+type tokenBucket struct {
+	rate   int64
+	burst  int64
+	tokens float64
+	last   time.Time
+	mx     sync.Mutex
+}
+
+// newTokenBucket creates a full bucket holding up to rate tokens that refills
+// at rate tokens per second. It returns nil if rate is not positive.
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// take takes n tokens from the bucket, returning how long to wait before the
+// bucket is no longer in debt.
+func (b *tokenBucket) take(n int64) time.Duration {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
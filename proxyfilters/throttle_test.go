@@ -0,0 +1,46 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottleTunnelsUp(t *testing.T) {
+	doTestThrottleTunnels(t, ThrottleTunnels(4096, 0))
+}
+
+func TestThrottleTunnelsDown(t *testing.T) {
+	doTestThrottleTunnels(t, ThrottleTunnels(0, 4096))
+}
+
+func doTestThrottleTunnels(t *testing.T, filter filters.Filter) {
+	doTestTunnel(t, filter, func(conn net.Conn, br *bufio.Reader, resp *http.Response) {
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		// The first 4096 bytes fit in the burst, the rest has to wait a second
+		start := time.Now()
+		go conn.Write(make([]byte, 8192))
+		_, err := io.ReadFull(br, make([]byte, 8192))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, time.Since(start) > 900*time.Millisecond, "transfer should have been throttled")
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	assert.Nil(t, newTokenBucket(0))
+
+	b := newTokenBucket(1000)
+	assert.EqualValues(t, 0, b.take(1000), "full bucket should allow bursting")
+	wait := b.take(500)
+	assert.True(t, wait > 400*time.Millisecond && wait <= 500*time.Millisecond, "unexpected wait %v", wait)
+}
@@ -0,0 +1,89 @@
+package proxyfilters
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const (
+	// xLanternAuthToken is the header that carries the token authorizing
+	// clients to use the proxy.
+	xLanternAuthToken = "X-Lantern-Auth-Token"
+
+	// DefaultTokenHeader is the header in which RequireToken expects the token.
+	DefaultTokenHeader = xLanternAuthToken
+)
+
+// RequireToken rejects requests that don't carry the given token in the
+// X-Lantern-Auth-Token header with a 403 error. The header is removed from
+// allowed requests so that it's never forwarded upstream. If token is empty,
+// all requests are allowed.
+func RequireToken(token string) filters.Filter {
+	return RequireTokenInHeader(token, xLanternAuthToken)
+}
+
+// RequireTokenInHeader is like RequireToken but expects the token in the
+// given header instead, e.g. Proxy-Authorization for clients that send it
+// there. The whole value of the header must match the token.
+func RequireTokenInHeader(token string, header string) filters.Filter {
+	return RequireTokenWithRejection(token, header, nil)
+}
+
+// TokenRejection is the response to requests lacking the required token, for
+// clients that need to tell auth failures from other errors, e.g. to know that
+// they have to re-authenticate.
+type TokenRejection struct {
+	// StatusCode is the status of the response, 403 if zero.
+	StatusCode int
+
+	// Header holds the headers of the response, e.g. its Content-Type or the
+	// Location to redirect clients to.
+	Header http.Header
+
+	// Body is the body of the response.
+	Body []byte
+}
+
+// RequireTokenWithRejection is like RequireTokenInHeader but rejects requests
+// with the given response instead of a 403 error describing the failure. The
+// response is sent as is, so the server's ErrorResponder doesn't apply to it.
+// If rejection is nil, requests are rejected with the 403 error.
+func RequireTokenWithRejection(token string, header string, rejection *TokenRejection) filters.Filter {
+	expected := []byte(token)
+	header = http.CanonicalHeaderKey(header)
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if len(expected) == 0 {
+			return next(cs, req)
+		}
+
+		actual := []byte(req.Header.Get(header))
+		req.Header.Del(header)
+		if subtle.ConstantTimeCompare(expected, actual) != 1 {
+			if rejection != nil {
+				log.Debugf("Rejecting request from %v with missing or invalid auth token in %v", req.RemoteAddr, header)
+				return filters.ShortCircuit(cs, req, rejection.response())
+			}
+			return fail(cs, req, InvalidToken, "Missing or invalid auth token in %v from %v", header, req.RemoteAddr)
+		}
+		return next(cs, req)
+	})
+}
+
+func (r *TokenRejection) response() *http.Response {
+	status := r.StatusCode
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Header:        r.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		// Like other rejections
+		Close: true,
+	}
+}
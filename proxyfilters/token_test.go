@@ -0,0 +1,97 @@
+package proxyfilters
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+func TestRequireTokenValid(t *testing.T) {
+	doTestRequireToken(t, "secret", "secret", http.StatusOK)
+}
+
+func TestRequireTokenInvalid(t *testing.T) {
+	doTestRequireToken(t, "secret", "wrong", http.StatusForbidden)
+}
+
+func TestRequireTokenMissing(t *testing.T) {
+	doTestRequireToken(t, "secret", "", http.StatusForbidden)
+}
+
+func TestRequireTokenDisabled(t *testing.T) {
+	doTestRequireToken(t, "", "", http.StatusOK)
+}
+
+func TestRequireTokenInHeader(t *testing.T) {
+	doTestRequireTokenInHeader(t, "secret", "proxy-authorization", "Proxy-Authorization", "secret", http.StatusOK)
+	doTestRequireTokenInHeader(t, "secret", "Proxy-Authorization", "Proxy-Authorization", "wrong", http.StatusForbidden)
+	doTestRequireTokenInHeader(t, "secret", "Proxy-Authorization", xLanternAuthToken, "secret", http.StatusForbidden)
+}
+
+func doTestRequireToken(t *testing.T, token string, sent string, expectedStatus int) {
+	doTestRequireTokenInHeader(t, token, xLanternAuthToken, xLanternAuthToken, sent, expectedStatus)
+}
+
+func doTestRequireTokenInHeader(t *testing.T, token string, header string, sentHeader string, sent string, expectedStatus int) {
+	var forwarded *http.Request
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		forwarded = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+		}, cs, nil
+	}
+
+	filter := RequireTokenInHeader(token, header)
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	if sent != "" {
+		req.Header.Set(sentHeader, sent)
+	}
+	cs := filters.NewConnectionState(req, nil, nil)
+	resp, _, _ := filter.Apply(cs, req, next)
+	assert.Equal(t, expectedStatus, resp.StatusCode)
+	if forwarded != nil {
+		assert.Empty(t, forwarded.Header.Get(header), "token should not be forwarded")
+	}
+}
+
+func TestRequireTokenWithRejection(t *testing.T) {
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	apply := func(filter filters.Filter, sent string) *http.Response {
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		if sent != "" {
+			req.Header.Set(xLanternAuthToken, sent)
+		}
+		resp, _, _ := filter.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		return resp
+	}
+
+	filter := RequireTokenWithRejection("secret", xLanternAuthToken, &TokenRejection{
+		StatusCode: http.StatusFound,
+		Header:     http.Header{"Location": {"https://example.com/login"}},
+		Body:       []byte("please log in"),
+	})
+	resp := apply(filter, "wrong")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://example.com/login", resp.Header.Get("Location"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "please log in", string(body))
+	assert.EqualValues(t, len(body), resp.ContentLength)
+	assert.True(t, resp.Close, "should close connection like other rejections")
+	resp = apply(filter, "")
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "missing token should get the same response")
+	assert.Equal(t, http.StatusOK, apply(filter, "secret").StatusCode)
+
+	resp = apply(RequireTokenWithRejection("secret", xLanternAuthToken, &TokenRejection{Body: []byte("denied")}), "wrong")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "should default to 403")
+
+	resp = apply(RequireTokenWithRejection("secret", xLanternAuthToken, nil), "wrong")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "Missing or invalid auth token", "should describe failure without custom rejection")
+}
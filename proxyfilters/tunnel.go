@@ -0,0 +1,100 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// onTunnel continues processing req and, if that results in a CONNECT tunnel
+// to an already dialed upstream, replaces the upstream connection with the one
+// returned by wrap. Upstream is only dialed at this point if the proxy waits
+// for upstream before responding OK to CONNECT requests, which is the server's
+// default.
+func onTunnel(cs *filters.ConnectionState, req *http.Request, next filters.Next, wrap func(upstream net.Conn) net.Conn) (*http.Response, *filters.ConnectionState, error) {
+	resp, nextCS, err := next(cs, req)
+	if err != nil || req.Method != http.MethodConnect || nextCS == nil {
+		return resp, nextCS, err
+	}
+	if upstream := nextCS.Upstream(); upstream != nil {
+		nextCS.SetUpstream(wrap(upstream))
+	}
+	return resp, nextCS, err
+}
+
+// tunnelConn is an upstream connection for a CONNECT tunnel that counts the
+// bytes sent and received and reports them once closed.
+type tunnelConn struct {
+	net.Conn
+	sent      int64
+	received  int64
+	onClose   func(sent, received int64)
+	closeOnce sync.Once
+}
+
+func newTunnelConn(upstream net.Conn, onClose func(sent, received int64)) *tunnelConn {
+	return &tunnelConn{Conn: upstream, onClose: onClose}
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.onClose(atomic.LoadInt64(&c.sent), atomic.LoadInt64(&c.received))
+	})
+	return err
+}
+
+func (c *tunnelConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// OnTunnelBytes reports the number of bytes carried by each CONNECT tunnel
+// once it closes. up is the number of bytes sent to the origin and down the
+// number of bytes received from it.
+func OnTunnelBytes(onBytes func(req *http.Request, up, down int64)) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			return newTunnelConn(upstream, func(sent, received int64) {
+				onBytes(req, sent, received)
+			})
+		})
+	})
+}
+
+// OnTunnels calls onOpen once each CONNECT tunnel is established and onClose
+// once it's torn down, for whatever reason, with the number of bytes it
+// carried as in OnTunnelBytes and how long it was open. Each is called exactly
+// once per tunnel and either may be nil. Tunnels are only seen if the proxy
+// waits for upstream before responding OK to CONNECT requests, which is the
+// server's default.
+func OnTunnels(onOpen func(req *http.Request), onClose func(req *http.Request, up, down int64, d time.Duration)) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			opened := time.Now()
+			if onOpen != nil {
+				onOpen(req)
+			}
+			return newTunnelConn(upstream, func(sent, received int64) {
+				if onClose != nil {
+					onClose(req, sent, received, time.Since(opened))
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,199 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnTunnelBytes(t *testing.T) {
+	type counts struct{ up, down int64 }
+	reported := make(chan counts, 1)
+	filter := OnTunnelBytes(func(req *http.Request, up, down int64) {
+		reported <- counts{up, down}
+	})
+
+	doTestTunnel(t, filter, func(conn net.Conn, br *bufio.Reader, resp *http.Response) {
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		_, err := conn.Write([]byte("hello"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(br, buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		conn.Close()
+
+		select {
+		case c := <-reported:
+			assert.EqualValues(t, 5, c.up)
+			assert.EqualValues(t, 5, c.down)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "bytes should have been reported when tunnel closed")
+		}
+	})
+}
+
+func TestOnTunnels(t *testing.T) {
+	var opened, closed int32
+	reported := make(chan time.Duration, 1)
+	filter := OnTunnels(func(req *http.Request) {
+		atomic.AddInt32(&opened, 1)
+	}, func(req *http.Request, up, down int64, d time.Duration) {
+		atomic.AddInt32(&closed, 1)
+		assert.EqualValues(t, 5, up)
+		assert.EqualValues(t, 5, down)
+		reported <- d
+	})
+
+	doTestTunnel(t, filter, func(conn net.Conn, br *bufio.Reader, resp *http.Response) {
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		assert.EqualValues(t, 1, atomic.LoadInt32(&opened), "should report tunnel open once established")
+		assert.EqualValues(t, 0, atomic.LoadInt32(&closed))
+		_, err := conn.Write([]byte("hello"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(br, buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+
+		select {
+		case d := <-reported:
+			assert.True(t, d >= 10*time.Millisecond, "should report how long tunnel was open")
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "close should have been reported when tunnel closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&opened))
+		assert.EqualValues(t, 1, atomic.LoadInt32(&closed), "should report tunnel close once")
+	})
+}
+
+func TestOnTunnelsFailedDial(t *testing.T) {
+	called := false
+	filter := OnTunnels(func(req *http.Request) {
+		called = true
+	}, nil)
+	proxyAddr, _, stop, err := startTunnelProxy(filter)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+	closed, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	target := closed.Addr().String()
+	closed.Close()
+
+	conn, _, resp, err := openTunnel(proxyAddr, target)
+	if assert.NoError(t, err) {
+		conn.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	}
+	assert.False(t, called, "should not report tunnels that failed to open")
+}
+
+// doTestTunnel runs the given filter on a proxy that waits for upstream
+// before responding OK and opens a CONNECT tunnel through it to an echo
+// server.
+func doTestTunnel(t *testing.T, filter filters.Filter, run func(conn net.Conn, br *bufio.Reader, resp *http.Response)) {
+	proxyAddr, target, stop, err := startTunnelProxy(filter)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	conn, br, resp, err := openTunnel(proxyAddr, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	run(conn, br, resp)
+}
+
+// startTunnelProxy starts an echo server and a proxy running the given filter
+// that waits for upstream before responding OK.
+func startTunnelProxy(filter filters.Filter) (proxyAddr string, target string, stop func(), err error) {
+	el, err := newEchoServer()
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	pl, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		el.Close()
+		return "", "", nil, err
+	}
+
+	p, _ := proxy.New(&proxy.Opts{
+		Filter:             filter,
+		OKWaitsForUpstream: true,
+	})
+	go p.Serve(pl)
+
+	return pl.Addr().String(), el.Addr().String(), func() {
+		pl.Close()
+		el.Close()
+	}, nil
+}
+
+// openTunnel sends a CONNECT request for target to the proxy at proxyAddr.
+func openTunnel(proxyAddr string, target string) (net.Conn, *bufio.Reader, *http.Response, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, err = fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, br, resp, nil
+}
+
+func newEchoServer() (net.Listener, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l, nil
+}
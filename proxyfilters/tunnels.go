@@ -0,0 +1,170 @@
+package proxyfilters
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const defaultTunnelsLimit = 100
+
+var (
+	openTunnels     = make(map[*meteredConn]bool)
+	peakOpenTunnels int
+	openTunnelsMx   sync.Mutex
+)
+
+func trackTunnel(c *meteredConn) {
+	openTunnelsMx.Lock()
+	openTunnels[c] = true
+	if len(openTunnels) > peakOpenTunnels {
+		peakOpenTunnels = len(openTunnels)
+	}
+	openTunnelsMx.Unlock()
+}
+
+func untrackTunnel(c *meteredConn) {
+	openTunnelsMx.Lock()
+	delete(openTunnels, c)
+	openTunnelsMx.Unlock()
+}
+
+// OpenTunnels returns the number of open CONNECT tunnels. Tunnels are only
+// tracked if RecordTunnelMetrics is in the filter chain.
+func OpenTunnels() int {
+	openTunnelsMx.Lock()
+	defer openTunnelsMx.Unlock()
+	return len(openTunnels)
+}
+
+// TunnelSummary summarizes the CONNECT tunnels served over the life of the
+// process.
+type TunnelSummary struct {
+	// Total is the number of tunnels opened.
+	Total int64
+	// BytesSent and BytesReceived are the bytes sent to and received from
+	// origins through tunnels.
+	BytesSent     int64
+	BytesReceived int64
+	// PeakOpen is the largest number of tunnels open at the same time.
+	PeakOpen int
+	Uptime   time.Duration
+}
+
+// SummarizeTunnels returns a summary of the CONNECT tunnels served so far, for
+// example to log when stopping. Tunnels are only counted if
+// RecordTunnelMetrics is in the filter chain.
+func SummarizeTunnels() TunnelSummary {
+	openTunnelsMx.Lock()
+	peak := peakOpenTunnels
+	openTunnelsMx.Unlock()
+	return TunnelSummary{
+		Total:         tunnelsOpened.Value(),
+		BytesSent:     tunnelBytesSent.Value(),
+		BytesReceived: tunnelBytesReceived.Value(),
+		PeakOpen:      peak,
+		Uptime:        time.Since(processStart),
+	}
+}
+
+type tunnelsStatus struct {
+	OpenTunnels int          `json:"open_tunnels"`
+	Goroutines  int          `json:"goroutines"`
+	Tunnels     []tunnelInfo `json:"tunnels"`
+}
+
+type tunnelInfo struct {
+	Destination   string  `json:"destination"`
+	Client        string  `json:"client"`
+	AgeSeconds    float64 `json:"age_seconds"`
+	SentBytes     int64   `json:"sent_bytes"`
+	ReceivedBytes int64   `json:"received_bytes"`
+}
+
+// DebugTunnels responds to GET requests for the given path that are addressed
+// to the proxy itself with a JSON list of the open CONNECT tunnels, oldest
+// first, with their destination, client, age and the bytes they carried, along
+// with the number of goroutines in the process. Tunnels that stay open long
+// after their clients should have closed them, and goroutines growing faster
+// than tunnels, point to leaks. The min_age query parameter only lists tunnels
+// open for at least that many seconds and limit lists at most that many
+// tunnels, 100 by default.
+// Tunnels are only tracked if RecordTunnelMetrics is in the filter chain.
+// Place it after RequireToken so that the list requires a token. An empty path
+// disables the list.
+func DebugTunnels(path string) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		// Proxied requests use absolute URIs
+		if path == "" || req.Method != http.MethodGet || !strings.HasPrefix(req.RequestURI, "/") || req.URL.Path != path {
+			return next(cs, req)
+		}
+
+		query := req.URL.Query()
+		minAge := 0.0
+		if value := query.Get("min_age"); value != "" {
+			var err error
+			if minAge, err = strconv.ParseFloat(value, 64); err != nil || minAge < 0 {
+				return fail(cs, req, InvalidParameter, "Invalid min_age %q", value)
+			}
+		}
+		limit := defaultTunnelsLimit
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+				return fail(cs, req, InvalidParameter, "Invalid limit %q", value)
+			}
+		}
+
+		body, err := json.Marshal(listTunnels(time.Duration(minAge*float64(time.Second)), limit))
+		if err != nil {
+			return failWithCause(cs, req, InternalError, err, "Unable to encode tunnels: %v", err)
+		}
+		return filters.ShortCircuit(cs, req, &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		})
+	})
+}
+
+func listTunnels(minAge time.Duration, limit int) *tunnelsStatus {
+	now := time.Now()
+	openTunnelsMx.Lock()
+	st := &tunnelsStatus{OpenTunnels: len(openTunnels), Tunnels: []tunnelInfo{}}
+	var old []*meteredConn
+	for c := range openTunnels {
+		if now.Sub(c.opened) >= minAge {
+			old = append(old, c)
+		}
+	}
+	openTunnelsMx.Unlock()
+
+	sort.Slice(old, func(i, j int) bool {
+		return old[i].opened.Before(old[j].opened)
+	})
+	if len(old) > limit {
+		old = old[:limit]
+	}
+	for _, c := range old {
+		st.Tunnels = append(st.Tunnels, tunnelInfo{
+			Destination:   c.destination,
+			Client:        c.client,
+			AgeSeconds:    now.Sub(c.opened).Seconds(),
+			SentBytes:     atomic.LoadInt64(&c.sent),
+			ReceivedBytes: atomic.LoadInt64(&c.received),
+		})
+	}
+	st.Goroutines = runtime.NumGoroutine()
+	return st
+}
@@ -0,0 +1,125 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugTunnels(t *testing.T) {
+	proxyAddr, target, stop, err := startTunnelProxy(filters.Join(RecordTunnelMetrics, DebugTunnels("/debug/tunnels")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	conn, br, _, err := openTunnel(proxyAddr, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadFull(br, make([]byte, 5))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	findTunnel := func(query string) *tunnelInfo {
+		resp, st := doTestTunnels(t, proxyAddr, query)
+		if resp == nil || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return nil
+		}
+		assert.True(t, st.Goroutines > 0)
+		for _, tunnel := range st.Tunnels {
+			if tunnel.Destination == target && tunnel.Client == conn.LocalAddr().String() {
+				return &tunnel
+			}
+		}
+		return nil
+	}
+
+	tunnel := findTunnel("")
+	if assert.NotNil(t, tunnel, "should list open tunnel") {
+		assert.EqualValues(t, 5, tunnel.SentBytes)
+		assert.EqualValues(t, 5, tunnel.ReceivedBytes)
+		assert.True(t, tunnel.AgeSeconds > 0 && tunnel.AgeSeconds < 60)
+	}
+	assert.True(t, listTunnels(0, 0).OpenTunnels >= 1, "should count open tunnels beyond limit")
+	assert.Nil(t, findTunnel("?min_age=3600"), "should not list tunnels younger than min_age")
+	assert.Nil(t, findTunnel("?limit=0"), "should list no more than limit tunnels")
+
+	for _, query := range []string{"?min_age=x", "?min_age=-1", "?limit=-1"} {
+		resp, _ := doTestTunnels(t, proxyAddr, query)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+		}
+	}
+
+	conn.Close()
+	for i := 0; i < 50 && findTunnel("") != nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Nil(t, findTunnel(""), "should no longer list closed tunnel")
+}
+
+func TestSummarizeTunnels(t *testing.T) {
+	proxyAddr, target, stop, err := startTunnelProxy(RecordTunnelMetrics)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	before := SummarizeTunnels()
+	for i := 0; i < 2; i++ {
+		conn, br, _, err := openTunnel(proxyAddr, target)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.ReadFull(br, make([]byte, 5))
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	after := SummarizeTunnels()
+	assert.EqualValues(t, 2, after.Total-before.Total)
+	assert.EqualValues(t, 10, after.BytesSent-before.BytesSent)
+	assert.EqualValues(t, 10, after.BytesReceived-before.BytesReceived)
+	assert.True(t, after.PeakOpen >= 2, "should count tunnels open at the same time")
+	assert.True(t, after.Uptime > before.Uptime)
+}
+
+func doTestTunnels(t *testing.T, proxyAddr string, query string) (*http.Response, *tunnelsStatus) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /debug/tunnels%v HTTP/1.1\r\nHost: %v\r\n\r\n", query, proxyAddr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	defer resp.Body.Close()
+	st := &tunnelsStatus{}
+	if resp.StatusCode == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(st))
+	}
+	return resp, st
+}
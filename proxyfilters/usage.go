@@ -0,0 +1,144 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// usageSlots is the number of slots into which ClientUsage divides its window.
+// Usage expires one slot at a time, so the window rolls in steps of 1/12th.
+const usageSlots = 12
+
+// ClientUsage accounts the bytes that clients, identified by IP address,
+// transfer over a rolling window of time. To bound memory, it only tracks the
+// clients that most recently transferred data, forgetting the usage of
+// others. It's safe for concurrent use.
+type ClientUsage struct {
+	slot    time.Duration
+	clients *lru.Cache
+	mx      sync.Mutex
+}
+
+type clientUsage struct {
+	bytes [usageSlots]int64
+	// epochs are the slot numbers since the Unix epoch for which bytes were
+	// counted, to tell current ones from expired ones.
+	epochs [usageSlots]int64
+}
+
+// NewClientUsage creates a ClientUsage over the given window, tracking up to
+// maxClients clients.
+func NewClientUsage(window time.Duration, maxClients int) *ClientUsage {
+	slot := window / usageSlots
+	if slot <= 0 {
+		slot = 1
+	}
+	clients, _ := lru.New(maxClients)
+	return &ClientUsage{slot: slot, clients: clients}
+}
+
+// Add accounts n bytes transferred by the client at ip.
+func (u *ClientUsage) Add(ip string, n int64) {
+	u.add(ip, n, time.Now())
+}
+
+func (u *ClientUsage) add(ip string, n int64, now time.Time) {
+	epoch := now.UnixNano() / int64(u.slot)
+	i := epoch % usageSlots
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	var usage *clientUsage
+	if cached, found := u.clients.Get(ip); found {
+		usage = cached.(*clientUsage)
+	} else {
+		usage = &clientUsage{}
+		u.clients.Add(ip, usage)
+	}
+	if usage.epochs[i] != epoch {
+		usage.epochs[i] = epoch
+		usage.bytes[i] = 0
+	}
+	usage.bytes[i] += n
+}
+
+// Bytes returns the number of bytes transferred by the client at ip within the
+// window.
+func (u *ClientUsage) Bytes(ip string) int64 {
+	return u.bytesAt(ip, time.Now())
+}
+
+func (u *ClientUsage) bytesAt(ip string, now time.Time) int64 {
+	epoch := now.UnixNano() / int64(u.slot)
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	cached, found := u.clients.Peek(ip)
+	if !found {
+		return 0
+	}
+	usage := cached.(*clientUsage)
+	total := int64(0)
+	for i, slotEpoch := range usage.epochs {
+		if epoch-slotEpoch < usageSlots {
+			total += usage.bytes[i]
+		}
+	}
+	return total
+}
+
+// LimitClientUsage accounts the bytes that clients send and receive through
+// CONNECT tunnels in usage as they flow and, if quota is positive, rejects
+// CONNECT requests from clients that transferred quota bytes or more within
+// usage's window with a 429 error. Tunnels that are already open aren't
+// closed when their client exceeds the quota.
+func LimitClientUsage(usage *ClientUsage, quota int64) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method != http.MethodConnect {
+			return next(cs, req)
+		}
+
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ip = req.RemoteAddr
+		}
+		if quota > 0 {
+			if used := usage.Bytes(ip); used >= quota {
+				return fail(cs, req, QuotaExceeded, "%v transferred %d bytes, over its quota of %d", ip, used, quota)
+			}
+		}
+		return onTunnel(cs, req, next, func(upstream net.Conn) net.Conn {
+			return &usageConn{Conn: upstream, usage: usage, ip: ip}
+		})
+	})
+}
+
+// usageConn accounts the bytes that flow through a tunnel to its client.
+type usageConn struct {
+	net.Conn
+	usage *ClientUsage
+	ip    string
+}
+
+func (c *usageConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.usage.Add(c.ip, int64(n))
+	}
+	return n, err
+}
+
+func (c *usageConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.usage.Add(c.ip, int64(n))
+	}
+	return n, err
+}
+
+func (c *usageConn) Wrapped() net.Conn {
+	return c.Conn
+}
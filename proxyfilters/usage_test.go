@@ -0,0 +1,74 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientUsageWindow(t *testing.T) {
+	usage := NewClientUsage(12*time.Minute, 10)
+	start := time.Unix(0, 0)
+	usage.add("1.1.1.1", 100, start)
+	usage.add("1.1.1.1", 20, start.Add(5*time.Minute))
+	usage.add("2.2.2.2", 7, start.Add(5*time.Minute))
+	assert.EqualValues(t, 120, usage.bytesAt("1.1.1.1", start.Add(6*time.Minute)))
+	assert.EqualValues(t, 7, usage.bytesAt("2.2.2.2", start.Add(6*time.Minute)))
+	assert.EqualValues(t, 120, usage.bytesAt("1.1.1.1", start.Add(11*time.Minute+59*time.Second)))
+	assert.EqualValues(t, 20, usage.bytesAt("1.1.1.1", start.Add(12*time.Minute)), "usage should expire after window")
+
+	// Slots get reused as the window rolls
+	usage.add("1.1.1.1", 3, start.Add(12*time.Minute))
+	assert.EqualValues(t, 23, usage.bytesAt("1.1.1.1", start.Add(12*time.Minute)))
+	assert.EqualValues(t, 0, usage.bytesAt("1.1.1.1", start.Add(30*time.Minute)))
+	assert.EqualValues(t, 0, usage.bytesAt("3.3.3.3", start), "unknown client should have no usage")
+}
+
+func TestClientUsageEviction(t *testing.T) {
+	usage := NewClientUsage(time.Hour, 2)
+	usage.Add("1.1.1.1", 1)
+	usage.Add("2.2.2.2", 2)
+	usage.Add("1.1.1.1", 1)
+	usage.Add("3.3.3.3", 3)
+	assert.EqualValues(t, 2, usage.Bytes("1.1.1.1"))
+	assert.EqualValues(t, 0, usage.Bytes("2.2.2.2"), "least recently active client should be forgotten")
+	assert.EqualValues(t, 3, usage.Bytes("3.3.3.3"))
+}
+
+func TestLimitClientUsage(t *testing.T) {
+	usage := NewClientUsage(time.Hour, 10)
+	doTestTunnel(t, LimitClientUsage(usage, 10), func(conn net.Conn, br *bufio.Reader, resp *http.Response) {
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		_, err := conn.Write([]byte("hello"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.ReadFull(br, make([]byte, 5))
+		if !assert.NoError(t, err) {
+			return
+		}
+		ip, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+		assert.EqualValues(t, 10, usage.Bytes(ip), "should account bytes sent and received")
+
+		_, err = conn.Write([]byte("still open"))
+		assert.NoError(t, err, "open tunnel should not be closed over quota")
+
+		proxyAddr := conn.RemoteAddr().String()
+		conn2, _, resp2, err := openTunnel(proxyAddr, "example.com:443")
+		if assert.NoError(t, err) {
+			conn2.Close()
+			assert.Equal(t, http.StatusTooManyRequests, resp2.StatusCode, "should reject new tunnels over quota")
+		}
+	})
+
+	unlimited := NewClientUsage(time.Hour, 10)
+	unlimited.Add("127.0.0.1", 1000)
+	doTestConnectHosts(t, LimitClientUsage(unlimited, 0), http.MethodConnect, "example.com:443", http.StatusOK)
+}
@@ -0,0 +1,40 @@
+package proxyfilters
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const (
+	via = "Via"
+)
+
+// AddVia adds a Via header identifying this proxy by the given pseudonym to
+// forwarded (non-CONNECT) requests and their responses, as required of
+// proxies by section 5.7.1 of RFC 7230. The proxy itself takes care of
+// stripping hop-by-hop headers.
+func AddVia(pseudonym string) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method == http.MethodConnect {
+			return next(cs, req)
+		}
+		req.Header.Add(via, viaValue(req.ProtoMajor, req.ProtoMinor, pseudonym))
+		resp, nextCS, err := next(cs, req)
+		if resp != nil {
+			if resp.Header == nil {
+				resp.Header = make(http.Header)
+			}
+			resp.Header.Add(via, viaValue(resp.ProtoMajor, resp.ProtoMinor, pseudonym))
+		}
+		return resp, nextCS, err
+	})
+}
+
+func viaValue(major, minor int, pseudonym string) string {
+	if major == 0 {
+		major, minor = 1, 1
+	}
+	return fmt.Sprintf("%d.%d %v", major, minor, pseudonym)
+}
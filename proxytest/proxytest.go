@@ -0,0 +1,57 @@
+// Package proxytest runs the proxy assembled by httpproxy for tests of
+// programs that embed it or talk to it, so that they can exercise its full
+// chain of filters rather than mocks.
+package proxytest
+
+import (
+	"context"
+	"net"
+
+	"github.com/getlantern/proxy/v2"
+
+	"github.com/getlantern/http-proxy/dialers"
+	"github.com/getlantern/http-proxy/httpproxy"
+)
+
+// Start builds a proxy configured with opts, or with the defaults if opts is
+// nil, and serves plain HTTP proxy connections with it at an ephemeral port on
+// localhost. It returns the proxy's host:port address and a stop func that
+// stops the proxy, forcibly closing the connections still open, such as idle
+// keep-alive connections of clients.
+//
+// The proxy blocks requests to localhost, so address local origins, such as
+// those started with httptest, by names that don't resolve and map those to
+// the origins' addresses with DialOrigins.
+func Start(opts *httpproxy.Opts) (addr string, stop func(), err error) {
+	if opts == nil {
+		opts = &httpproxy.Opts{}
+	}
+	srv, err := httpproxy.New(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", nil, err
+	}
+	go srv.Serve(l, nil)
+
+	stop = func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		srv.Stop(ctx)
+	}
+	return l.Addr().String(), stop, nil
+}
+
+// DialOrigins returns a dial function for httpproxy.Opts.Server.Dial that dials
+// the address that origins maps each host:port to instead of that host:port,
+// and dials the others directly.
+func DialOrigins(origins map[string]string) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if origin, found := origins[addr]; found {
+			addr = origin
+		}
+		return dialers.Direct(ctx, isCONNECT, network, addr)
+	}
+}
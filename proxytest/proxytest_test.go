@@ -0,0 +1,100 @@
+package proxytest
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/httpproxy"
+	"github.com/getlantern/http-proxy/server"
+)
+
+func TestStart(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "hello %v", req.Host)
+	}))
+	defer origin.Close()
+	originAddr := strings.TrimPrefix(origin.URL, "http://")
+
+	addr, stop, err := Start(&httpproxy.Opts{
+		Token:  "secret",
+		Server: server.Opts{Dial: DialOrigins(map[string]string{"origin.invalid:80": originAddr})},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:              http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+		ProxyConnectHeader: http.Header{"X-Lantern-Auth-Token": []string{"secret"}},
+	}}
+	req, _ := http.NewRequest(http.MethodGet, "http://origin.invalid/", nil)
+	req.Header.Set("X-Lantern-Auth-Token", "secret")
+	resp, err := client.Do(req)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "hello origin.invalid", string(body), "should forward to mapped origin")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	fmt.Fprint(conn, "CONNECT origin.invalid:80 HTTP/1.1\r\nHost: origin.invalid:80\r\nX-Lantern-Auth-Token: secret\r\n\r\n")
+	resp, err = http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: tunneled.invalid\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "hello tunneled.invalid", string(body), "should tunnel to mapped origin")
+	}
+
+	stop()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = br.ReadByte()
+	assert.Error(t, err, "stop should close open connections")
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err, "stop should stop listening")
+}
+
+func TestStartDefaults(t *testing.T) {
+	addr, stop, err := Start(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT localhost:80 HTTP/1.1\r\nHost: localhost:80\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "should apply the default chain")
+	}
+}
+
+func TestStartInvalidOpts(t *testing.T) {
+	_, _, err := Start(&httpproxy.Opts{Routes: map[string]string{"bad": "example.com:443"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,169 @@
+package reporting
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/measured"
+)
+
+const (
+	// maxPendingReports bounds how many reports are buffered between posts, so
+	// that an unreachable collector doesn't make us run out of memory.
+	maxPendingReports = 10000
+
+	postTimeout = 10 * time.Second
+
+	// minRetryBackoff is how long we wait before retrying a failed post. It
+	// doubles with each further failure, up to the reporting interval.
+	minRetryBackoff = 1 * time.Second
+
+	// defaultInterval is used in place of intervals that aren't positive.
+	defaultInterval = 1 * time.Minute
+)
+
+type report struct {
+	Context map[string]interface{} `json:"context,omitempty"`
+	Sent    int                    `json:"sent"`
+	Recv    int                    `json:"recv"`
+	Final   bool                   `json:"final"`
+}
+
+type httpReporter struct {
+	url       string
+	keyPrefix string
+	client    *http.Client
+	pending   []*report
+	dropped   int
+	lastErr   error
+	unhealthy bool
+	mx        sync.Mutex
+}
+
+// NewHTTPReporter creates a Reporter that batches reports and POSTs them as a
+// JSON array to the given URL every interval. Each report contains the
+// connection's context and the bytes sent and received since the prior
+// report. If keyPrefix is not empty, it is prepended to every context key so
+// that deployments sharing a collector can tell their reports apart. Reports
+// whose post fails are kept and retried with backoff until the collector is
+// reachable again, dropping the oldest ones once too many are pending. If
+// interval isn't positive, reports are posted every minute.
+func NewHTTPReporter(url string, keyPrefix string, interval time.Duration) Reporter {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	r := &httpReporter{
+		url:       url,
+		keyPrefix: keyPrefix,
+		client:    &http.Client{Timeout: postTimeout},
+	}
+	go func() {
+		wait, backoff := interval, minRetryBackoff
+		for {
+			time.Sleep(wait)
+			if err := r.flush(); err == nil {
+				wait, backoff = interval, minRetryBackoff
+				continue
+			}
+			wait = backoff
+			if backoff < interval {
+				backoff *= 2
+			}
+			if wait > interval {
+				wait = interval
+			}
+		}
+	}()
+	return r
+}
+
+func (r *httpReporter) Report(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+	if deltaStats.SentTotal == 0 && deltaStats.RecvTotal == 0 && !final {
+		return
+	}
+	if r.keyPrefix != "" {
+		prefixed := make(map[string]interface{}, len(ctx))
+		for key, value := range ctx {
+			prefixed[r.keyPrefix+key] = value
+		}
+		ctx = prefixed
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.pending = append(r.pending, &report{
+		Context: ctx,
+		Sent:    deltaStats.SentTotal,
+		Recv:    deltaStats.RecvTotal,
+		Final:   final,
+	})
+	r.trimPending()
+}
+
+// trimPending drops the oldest pending reports beyond maxPendingReports. It
+// must be called with mx held.
+func (r *httpReporter) trimPending() {
+	if excess := len(r.pending) - maxPendingReports; excess > 0 {
+		r.pending = append(r.pending[:0:0], r.pending[excess:]...)
+		r.dropped += excess
+	}
+}
+
+func (r *httpReporter) Check() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.lastErr
+}
+
+// flush posts all pending reports, returning them to the front of the queue if
+// that fails.
+func (r *httpReporter) flush() error {
+	r.mx.Lock()
+	pending, dropped := r.pending, r.dropped
+	r.pending, r.dropped = nil, 0
+	r.mx.Unlock()
+	if dropped > 0 {
+		log.Errorf("Dropped %d oldest reports because too many were pending", dropped)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := r.post(pending)
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.lastErr = err
+	if err != nil {
+		r.pending = append(pending, r.pending...)
+		r.trimPending()
+		if !r.unhealthy {
+			log.Errorf("Unable to post reports to %v, will keep retrying: %v", r.url, err)
+		}
+		r.unhealthy = true
+		return err
+	}
+	if r.unhealthy {
+		log.Debugf("Posting reports to %v succeeded again", r.url)
+	}
+	r.unhealthy = false
+	return nil
+}
+
+func (r *httpReporter) post(reports []*report) error {
+	body, err := json.Marshal(reports)
+	if err != nil {
+		return errors.New("Unable to marshal reports: %v", err)
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("Unexpected response status %v", resp.Status)
+	}
+	return nil
+}
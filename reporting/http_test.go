@@ -0,0 +1,115 @@
+package reporting
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPReporter(t *testing.T) {
+	posted := make(chan []*report, 10)
+	status := http.StatusOK
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var reports []*report
+		if assert.NoError(t, json.NewDecoder(req.Body).Decode(&reports)) {
+			posted <- reports
+		}
+		resp.WriteHeader(status)
+	}))
+	defer s.Close()
+
+	r := NewHTTPReporter(s.URL, "", time.Hour).(*httpReporter)
+	ctx := map[string]interface{}{"deviceid": "abc"}
+	r.Report(ctx, &measured.Stats{}, &measured.Stats{SentTotal: 10, RecvTotal: 20}, false)
+	r.Report(ctx, &measured.Stats{}, &measured.Stats{}, false)
+	r.Report(ctx, &measured.Stats{}, &measured.Stats{SentTotal: 1}, true)
+	r.flush()
+
+	select {
+	case reports := <-posted:
+		if assert.Len(t, reports, 2, "empty non-final report should have been skipped") {
+			assert.Equal(t, "abc", reports[0].Context["deviceid"])
+			assert.Equal(t, 10, reports[0].Sent)
+			assert.Equal(t, 20, reports[0].Recv)
+			assert.True(t, reports[1].Final)
+		}
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "reports should have been posted")
+	}
+	assert.NoError(t, r.Check())
+
+	status = http.StatusInternalServerError
+	r.Report(ctx, &measured.Stats{}, &measured.Stats{SentTotal: 1}, true)
+	r.flush()
+	<-posted
+	assert.Error(t, r.Check(), "failed post should make check fail")
+}
+
+func TestHTTPReporterMaxPending(t *testing.T) {
+	r := NewHTTPReporter("http://localhost:0", "", time.Hour).(*httpReporter)
+	for i := 0; i < maxPendingReports+5; i++ {
+		r.Report(nil, &measured.Stats{}, &measured.Stats{SentTotal: 1}, false)
+	}
+	r.Report(map[string]interface{}{"newest": true}, &measured.Stats{}, &measured.Stats{SentTotal: 1}, false)
+	assert.Len(t, r.pending, maxPendingReports)
+	assert.Equal(t, 6, r.dropped)
+	assert.Equal(t, true, r.pending[maxPendingReports-1].Context["newest"], "should drop oldest reports first")
+}
+
+func TestHTTPReporterRetry(t *testing.T) {
+	var errorOut, debugOut bytes.Buffer
+	defer golog.SetOutputs(&errorOut, &debugOut)()
+
+	var posted int32
+	var healthy int32
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var reports []*report
+		json.NewDecoder(req.Body).Decode(&reports)
+		if atomic.LoadInt32(&healthy) == 0 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&posted, int32(len(reports)))
+	}))
+	defer s.Close()
+
+	r := NewHTTPReporter(s.URL, "", time.Hour).(*httpReporter)
+	r.Report(nil, &measured.Stats{}, &measured.Stats{SentTotal: 1}, false)
+	assert.Error(t, r.flush())
+	r.Report(nil, &measured.Stats{}, &measured.Stats{SentTotal: 1}, false)
+	assert.Error(t, r.flush())
+	assert.Len(t, r.pending, 2, "reports should be kept while posting fails")
+	unhealthyLogs := 0
+	for _, line := range strings.Split(errorOut.String(), "\n") {
+		if strings.Contains(line, "Unable to post reports") {
+			unhealthyLogs++
+		}
+	}
+	assert.Equal(t, 1, unhealthyLogs, "should log becoming unhealthy once")
+
+	atomic.StoreInt32(&healthy, 1)
+	assert.NoError(t, r.flush())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&posted), "kept reports should be posted once healthy")
+	assert.Empty(t, r.pending)
+	assert.Contains(t, debugOut.String(), "succeeded again")
+	assert.NoError(t, r.Check())
+}
+
+func TestHTTPReporterKeyPrefix(t *testing.T) {
+	r := NewHTTPReporter("http://localhost:0", "eu_", time.Hour).(*httpReporter)
+	ctx := map[string]interface{}{"deviceid": "abc"}
+	r.Report(ctx, &measured.Stats{}, &measured.Stats{SentTotal: 1}, false)
+	if assert.Len(t, r.pending, 1) {
+		assert.Equal(t, map[string]interface{}{"eu_deviceid": "abc"}, r.pending[0].Context)
+	}
+	assert.Equal(t, "abc", ctx["deviceid"], "should not modify the connection's context")
+}
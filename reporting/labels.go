@@ -0,0 +1,37 @@
+package reporting
+
+import (
+	"github.com/getlantern/measured"
+)
+
+type labeled struct {
+	Reporter
+	labels map[string]interface{}
+}
+
+// WithLabels returns a Reporter that adds the given labels, e.g. the region of
+// the proxy, to the context of every report before passing it on to r, so
+// that collectors aggregating reports from several proxies can tell them
+// apart. Labels take the place of context values with the same key. If there
+// are no labels, r is returned as is.
+func WithLabels(r Reporter, labels map[string]interface{}) Reporter {
+	if len(labels) == 0 {
+		return r
+	}
+	copied := make(map[string]interface{}, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return &labeled{Reporter: r, labels: copied}
+}
+
+func (r *labeled) Report(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+	labeledCtx := make(map[string]interface{}, len(ctx)+len(r.labels))
+	for key, value := range ctx {
+		labeledCtx[key] = value
+	}
+	for key, value := range r.labels {
+		labeledCtx[key] = value
+	}
+	r.Reporter.Report(labeledCtx, stats, deltaStats, final)
+}
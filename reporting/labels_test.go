@@ -0,0 +1,23 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithLabels(t *testing.T) {
+	assert.Equal(t, Noop, WithLabels(Noop, nil), "should not wrap reporter without labels")
+
+	hr := NewHTTPReporter("http://localhost:0", "eu_", time.Hour).(*httpReporter)
+	r := WithLabels(hr, map[string]interface{}{"region": "eu-west-1"})
+	ctx := map[string]interface{}{"deviceid": "abc"}
+	r.Report(ctx, &measured.Stats{}, &measured.Stats{SentTotal: 1}, false)
+	if assert.Len(t, hr.pending, 1) {
+		assert.Equal(t, map[string]interface{}{"eu_deviceid": "abc", "eu_region": "eu-west-1"}, hr.pending[0].Context)
+	}
+	assert.Equal(t, map[string]interface{}{"deviceid": "abc"}, ctx, "should not modify the connection's context")
+	assert.NoError(t, r.Check())
+}
@@ -0,0 +1,66 @@
+// Package reporting provides backends for reporting the traffic measured on
+// client connections.
+package reporting
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/measured"
+)
+
+var (
+	log = golog.LoggerFor("reporting")
+)
+
+// Reporter reports traffic stats for client connections.
+type Reporter interface {
+	// Report reports the stats of a client connection. Its signature matches
+	// listeners.MeasuredReportFN.
+	Report(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool)
+
+	// Check returns an error if the reporter is currently unable to report,
+	// for use in health checks.
+	Check() error
+}
+
+// Noop is a Reporter that discards all reports.
+var Noop Reporter = noop{}
+
+type noop struct{}
+
+func (noop) Report(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+}
+
+func (noop) Check() error {
+	return nil
+}
+
+// New creates a Reporter of the given kind, either "none" for Noop or "http"
+// for one that posts to reportURL, see NewHTTPReporter. Rather than quietly not
+// reporting, it fails if the kind is unknown, the URL isn't a valid http or
+// https URL or the interval isn't positive, so that callers can decide whether
+// that's fatal. Once running, failures to report are surfaced by the
+// Reporter's Check method.
+func New(kind string, reportURL string, keyPrefix string, interval time.Duration) (Reporter, error) {
+	switch kind {
+	case "none":
+		return Noop, nil
+	case "http":
+		u, err := url.Parse(reportURL)
+		if err != nil {
+			return nil, errors.New("Invalid report URL %v: %v", reportURL, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("Invalid report URL %q, expected an http or https URL", reportURL)
+		}
+		if interval <= 0 {
+			return nil, errors.New("Invalid report interval %v, expected a positive duration", interval)
+		}
+		return NewHTTPReporter(reportURL, keyPrefix, interval), nil
+	default:
+		return nil, errors.New("Unknown reporter %v", kind)
+	}
+}
@@ -0,0 +1,36 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	r, err := New("none", "", "", time.Minute)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Noop, r)
+	}
+
+	r, err = New("http", "https://collector.example.com/reports", "", time.Hour)
+	if assert.NoError(t, err) {
+		assert.IsType(t, &httpReporter{}, r)
+		assert.NoError(t, r.Check())
+	}
+
+	for _, invalid := range []struct{ kind, url string }{
+		{"redis", "https://collector.example.com/reports"},
+		{"http", ""},
+		{"http", "collector.example.com/reports"},
+		{"http", "ftp://collector.example.com/reports"},
+		{"http", "http://%zz"},
+	} {
+		_, err := New(invalid.kind, invalid.url, "", time.Minute)
+		assert.Error(t, err, "%v %v", invalid.kind, invalid.url)
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		_, err := New("http", "https://collector.example.com/reports", "", interval)
+		assert.Error(t, err, "interval %v should be rejected", interval)
+	}
+}
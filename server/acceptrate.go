@@ -0,0 +1,45 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptLimiter paces accepting client connections to a maximum rate, letting
+// connections wait in the listen backlog instead of being dropped. Bursts of up
+// to a second's worth of connections are accepted right away.
+type acceptLimiter struct {
+	interval time.Duration
+	burst    time.Duration
+	next     time.Time
+	mx       sync.Mutex
+}
+
+// newAcceptLimiter creates a limiter allowing rate accepts per second. It
+// returns nil, which doesn't limit, if rate is not positive.
+func newAcceptLimiter(rate int) *acceptLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	interval := time.Second / time.Duration(rate)
+	return &acceptLimiter{interval: interval, burst: time.Second - interval}
+}
+
+// wait blocks until another connection may be accepted.
+func (l *acceptLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mx.Lock()
+	now := time.Now()
+	// Credit for idle time doesn't accumulate beyond the burst
+	if earliest := now.Add(-l.burst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mx.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// activityConn records when a client connection last read or wrote, so that
+// CloseIdle can tell idle connections from busy ones.
+type activityConn struct {
+	net.Conn
+	lastActive int64
+}
+
+func newActivityConn(conn net.Conn) *activityConn {
+	return &activityConn{Conn: conn, lastActive: time.Now().UnixNano()}
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activityConn) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+func (c *activityConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// OpenConns returns the number of client connections that are currently being
+// handled, including CONNECT tunnels.
+func (s *Server) OpenConns() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.conns)
+}
+
+// CloseIdle closes the client connections, including CONNECT tunnels, that
+// haven't sent or received anything for at least idleFor, returning how many
+// it closed. While draining with Stop, it lets connections that are still busy
+// finish without waiting for idle ones, like kept alive connections between
+// requests.
+func (s *Server) CloseIdle(idleFor time.Duration) int {
+	now := time.Now()
+	var idle []*activityConn
+	s.mx.Lock()
+	for conn := range s.conns {
+		if conn.idleFor(now) >= idleFor {
+			idle = append(idle, conn)
+		}
+	}
+	s.mx.Unlock()
+	for _, conn := range idle {
+		forceClose(conn)
+	}
+	return len(idle)
+}
+
+// forceClose closes the innermost connection wrapped by conn before conn
+// itself, because some wrappers, like idletiming's, only close once pending
+// reads return.
+func forceClose(conn net.Conn) {
+	inner := conn
+	for {
+		wrapper, ok := inner.(interface{ Wrapped() net.Conn })
+		if !ok || wrapper.Wrapped() == nil {
+			break
+		}
+		inner = wrapper.Wrapped()
+	}
+	if inner != conn {
+		safeClose(inner)
+	}
+	safeClose(conn)
+}
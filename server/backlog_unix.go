@@ -0,0 +1,23 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package server
+
+import (
+	"syscall"
+)
+
+const backlogSupported = true
+
+// setBacklog changes the backlog of an already listening socket, which Unix
+// systems allow by calling listen again.
+func setBacklog(c syscall.RawConn, backlog int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
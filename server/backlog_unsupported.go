@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package server
+
+import (
+	"syscall"
+)
+
+const backlogSupported = false
+
+func setBacklog(c syscall.RawConn, backlog int) error {
+	return nil
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	stderrors "errors"
+	"net/http"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// limitRequestBodies wraps filter so that the bodies of forwarded requests are
+// limited to maxBytes, answering requests with larger bodies with a 413 error.
+// Requests declaring a larger Content-Length are rejected before anything is
+// forwarded, others fail once they've sent more than maxBytes. CONNECT
+// tunnels aren't limited.
+func limitRequestBodies(filter filters.Filter, maxBytes int64) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method == http.MethodConnect || req.Body == nil || req.Body == http.NoBody {
+			return filter.Apply(cs, req, next)
+		}
+		if req.ContentLength > maxBytes {
+			return bodyTooLarge(cs, req, maxBytes)
+		}
+		req.Body = http.MaxBytesReader(nil, req.Body, maxBytes)
+		resp, nextCS, err := filter.Apply(cs, req, next)
+		var tooLarge *http.MaxBytesError
+		if err != nil && stderrors.As(err, &tooLarge) {
+			return bodyTooLarge(cs, req, maxBytes)
+		}
+		return resp, nextCS, err
+	})
+}
+
+func bodyTooLarge(cs *filters.ConnectionState, req *http.Request, maxBytes int64) (*http.Response, *filters.ConnectionState, error) {
+	log.Debugf("Rejecting %v request from %v for %v with body over %d bytes", req.Method, req.RemoteAddr, req.Host, maxBytes)
+	return filters.Fail(cs, req, http.StatusRequestEntityTooLarge, errors.New("Request body larger than %d bytes", maxBytes))
+}
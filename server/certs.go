@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+// certificateForSNI returns a tls.Config.GetCertificate callback that selects
+// the certificate matching the server name requested by the client via SNI,
+// including wildcard certificates. If none matches, the first certificate is
+// used.
+func certificateForSNI(certs []tls.Certificate) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	byName := make(map[string]*tls.Certificate)
+	for i := range certs {
+		cert := &certs[i]
+		leaf := cert.Leaf
+		if leaf == nil {
+			var err error
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return nil, errors.New("Unable to parse certificate: %v", err)
+			}
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, found := byName[name]; !found {
+				byName[name] = cert
+			}
+		}
+	}
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if cert, found := byName[name]; found {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, found := byName["*"+name[i:]]; found {
+				return cert, nil
+			}
+		}
+		return &certs[0], nil
+	}, nil
+}
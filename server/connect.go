@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const defaultConnectOKReason = "Connection established"
+
+// respondConnectOK wraps filter so that successful CONNECT requests are
+// answered with a minimal 200 response with the given reason phrase and only
+// the given headers, since some strict clients choke on the headers the proxy
+// library would send. Writing the response gives up after writeTimeout, if
+// positive.
+func respondConnectOK(filter filters.Filter, reason string, headers http.Header, writeTimeout time.Duration) filters.Filter {
+	var ok bytes.Buffer
+	fmt.Fprintf(&ok, "HTTP/1.1 200 %v\r\n", reason)
+	headers.Write(&ok)
+	ok.WriteString("\r\n")
+	okBytes := ok.Bytes()
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		resp, nextCS, err := filter.Apply(cs, req, next)
+		if err != nil || resp == nil || resp.StatusCode != http.StatusOK || req.Method != http.MethodConnect ||
+			nextCS == nil || (nextCS.Upstream() == nil && nextCS.UpstreamAddr() == "") {
+			return resp, nextCS, err
+		}
+		downstream := cs.Downstream()
+		if downstream == nil {
+			return resp, nextCS, err
+		}
+
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		if writeTimeout > 0 {
+			setWriteDeadline(cs, writeTimeout)
+			defer downstream.SetWriteDeadline(time.Time{})
+		}
+		if _, writeErr := downstream.Write(okBytes); writeErr != nil {
+			if upstream := nextCS.Upstream(); upstream != nil {
+				upstream.Close()
+			}
+			return nil, nextCS, errors.New("Unable to respond OK to CONNECT from %v: %v", req.RemoteAddr, writeErr)
+		}
+		// With no response to write, the proxy proceeds to tunnel
+		return nil, nextCS, nil
+	})
+}
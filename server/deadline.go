@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const defaultResponseWriteTimeout = 5 * time.Second
+
+// limitResponseWrites wraps filter so that writing error responses to the
+// client gives up after timeout instead of blocking on a client that stopped
+// reading. Other responses carry bodies from origins and aren't limited.
+func limitResponseWrites(filter filters.Filter, timeout time.Duration) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		resp, nextCS, err := filter.Apply(cs, req, next)
+		if resp != nil && err != nil {
+			// Error responses from OnError are limited separately
+			setWriteDeadline(cs, timeout)
+		}
+		return resp, nextCS, err
+	})
+}
+
+// setWriteDeadline sets a write deadline of timeout from now on the client
+// connection of cs.
+func setWriteDeadline(cs *filters.ConnectionState, timeout time.Duration) {
+	if cs == nil || cs.Downstream() == nil {
+		return
+	}
+	downstream := cs.Downstream()
+	if err := downstream.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		log.Debugf("Unable to set write deadline on connection from %v: %v", downstream.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	stderrors "errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/hidden"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// ErrorResponder builds the body of an error response sent to a client given
+// its status code and the reason for the error, which is the plain text body
+// that would be sent otherwise.
+type ErrorResponder func(status int, reason string) (contentType string, body []byte)
+
+// respondErrors wraps filter so that the bodies of failure responses (see
+// filters.Fail) from it and the rest of the chain are built by responder.
+func respondErrors(filter filters.Filter, responder ErrorResponder) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		resp, nextCS, err := filter.Apply(cs, req, next)
+		if err != nil && resp != nil && resp.StatusCode >= http.StatusBadRequest {
+			setErrorBody(resp, responder, err.Error())
+		}
+		return resp, nextCS, err
+	})
+}
+
+// respondDialErrors wraps filter so that requests failing with a 502 error
+// because dialing upstream failed are answered with the status that the
+// failure calls for, see dialErrorStatus, for example a 504 error if the dial
+// timed out, which tells clients that the origin didn't respond rather than
+// refused them. Responses from origins aren't affected.
+func respondDialErrors(filter filters.Filter) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		resp, nextCS, err := filter.Apply(cs, req, next)
+		if err != nil && resp != nil && resp.StatusCode == http.StatusBadGateway {
+			if status := dialErrorStatus(err); status != resp.StatusCode {
+				resp.StatusCode = status
+				resp.Status = ""
+			}
+		}
+		return resp, nextCS, err
+	})
+}
+
+// statusCoder is implemented by errors that call for a specific status code,
+// like those of checks refusing the address being dialed, see
+// dialers.WithAddressCheck, proxyfilters.Error and the refusals of upstream
+// proxies.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// dialErrorStatus returns the status code of responses to requests whose
+// upstream couldn't be reached because of err: that of err if it has one, 504
+// if it's a timeout and 502 otherwise.
+func dialErrorStatus(err error) int {
+	var withStatus statusCoder
+	if stderrors.As(err, &withStatus) {
+		return withStatus.StatusCode()
+	}
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return stderrors.As(err, &netErr) && netErr.Timeout()
+}
+
+// recoverPanics wraps filter so that a panic while filtering a request, for
+// example from a failed type assertion, is answered with a 500 error instead of
+// just dropping the client connection.
+func recoverPanics(filter filters.Filter) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (resp *http.Response, nextCS *filters.ConnectionState, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Errorf("Caught panic filtering %v request for %v: %v", req.Method, req.Host, p)
+				resp, nextCS, err = filters.Fail(cs, req, http.StatusInternalServerError, errors.New("Internal error handling request for %v", req.Host))
+			}
+		}()
+		return filter.Apply(cs, req, next)
+	})
+}
+
+func setErrorBody(resp *http.Response, responder ErrorResponder, reason string) {
+	contentType, body := responder(resp.StatusCode, hidden.Clean(reason))
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2"
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+const defaultForwardIdleTimeout = 90 * time.Second
+
+// hopByHopHeaders are the headers that apply only to a single connection and
+// mustn't be forwarded, see section 7.1.3 of RFC 7230.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// newForwardTransport creates a transport for forwarding plain HTTP requests
+// that keeps up to poolSize idle connections to each origin, closing them
+// after idling for idleTimeout.
+func newForwardTransport(dial proxy.DialFunc, poolSize int, idleTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, false, network, addr)
+		},
+		MaxIdleConnsPerHost: poolSize,
+		IdleConnTimeout:     idleTimeout,
+		// Leave content encoding to the client and origin
+		DisableCompression: true,
+	}
+}
+
+// forwardPooled wraps filter so that plain HTTP requests that make it through
+// are forwarded with tr, which shares keep-alive connections to origins among
+// all clients, instead of with connections dedicated to each client
+// connection. The transport doesn't reuse connections on which the origin
+// responded with "Connection: close".
+func forwardPooled(filter filters.Filter, tr http.RoundTripper) filters.Filter {
+	roundTrip := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		resp, err := tr.RoundTrip(prepareForwardRequest(req))
+		if err != nil {
+			return nil, cs, errors.New("Unable to round-trip http request to upstream: %v", err)
+		}
+		return resp, cs, nil
+	}
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method == http.MethodConnect {
+			return filter.Apply(cs, req, next)
+		}
+		return filter.Apply(cs, req, roundTrip)
+	})
+}
+
+// prepareForwardRequest returns a copy of the client's request req that's
+// suitable for sending to the origin.
+func prepareForwardRequest(req *http.Request) *http.Request {
+	out := req.WithContext(req.Context())
+	out.Proto, out.ProtoMajor, out.ProtoMinor = "HTTP/1.1", 1, 1
+	out.RequestURI = ""
+	// Whether the client keeps its connection open has no bearing on ours
+	out.Close = false
+
+	out.Header = make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		out.Header[key] = values
+	}
+	for _, connectionHeader := range req.Header["Connection"] {
+		for _, key := range strings.Split(connectionHeader, ",") {
+			out.Header.Del(strings.TrimSpace(key))
+		}
+	}
+	for _, key := range hopByHopHeaders {
+		out.Header.Del(key)
+	}
+
+	url := *req.URL
+	if url.Scheme == "" {
+		url.Scheme = "http"
+	}
+	url.Host = req.Host
+	out.URL = &url
+	return out
+}
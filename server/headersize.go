@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2"
+)
+
+var (
+	// errHeaderTooLarge is returned when reading a request header longer than
+	// the server's MaxHeaderBytes.
+	errHeaderTooLarge = errors.New("Request header too large")
+
+	// errResponseHeaderTooLarge is returned when reading a response header from
+	// an origin longer than the server's MaxResponseHeaderBytes.
+	errResponseHeaderTooLarge = errors.New("Response header too large")
+)
+
+// headerLimit counts the bytes of a header as they're read, up to the empty
+// line that ends it.
+type headerLimit struct {
+	remaining int
+	lineEmpty bool
+	done      bool
+}
+
+func newHeaderLimit(limit int) headerLimit {
+	return headerLimit{remaining: limit}
+}
+
+// exceeded tells whether the header is longer than the limit.
+func (h *headerLimit) exceeded() bool {
+	return !h.done && h.remaining <= 0
+}
+
+// scan accounts the n bytes that were read into b, returning how many of them
+// to hand over, which is only what fits if the limit is reached.
+func (h *headerLimit) scan(b []byte, n int) int {
+	if h.done {
+		return n
+	}
+	for i := 0; i < n; i++ {
+		// The header ends with an empty line, terminated by CRLF or just LF
+		switch b[i] {
+		case '\n':
+			if h.lineEmpty {
+				h.done = true
+				return n
+			}
+			h.lineEmpty = true
+		case '\r':
+		default:
+			h.lineEmpty = false
+		}
+		h.remaining--
+		if h.remaining == 0 {
+			// Hand over what fits and fail on the next read
+			return i + 1
+		}
+	}
+	return n
+}
+
+// headerLimitReader reads from a client connection, failing with
+// errHeaderTooLarge if a request header on it is longer than limit. Everything
+// after a header, such as the body or the data of a CONNECT tunnel, is read
+// without limit until the limit is re-armed for the next request on
+// keep-alive connections, see headerLimitConn.
+type headerLimitReader struct {
+	io.Reader
+	max int
+	// limit is only touched under mx since responses are written from other
+	// goroutines than the one reading requests, e.g. when piping tunnels.
+	limit headerLimit
+	mx    sync.Mutex
+}
+
+func newHeaderLimitReader(r io.Reader, limit int) *headerLimitReader {
+	return &headerLimitReader{Reader: r, max: limit, limit: newHeaderLimit(limit)}
+}
+
+func (r *headerLimitReader) Read(b []byte) (int, error) {
+	r.mx.Lock()
+	done, exceeded := r.limit.done, r.limit.exceeded()
+	r.mx.Unlock()
+	if exceeded {
+		return 0, errHeaderTooLarge
+	}
+	n, err := r.Reader.Read(b)
+	if done {
+		return n, err
+	}
+	r.mx.Lock()
+	n = r.limit.scan(b, n)
+	if r.limit.exceeded() {
+		// Fail on the next read
+		err = nil
+	}
+	r.mx.Unlock()
+	return n, err
+}
+
+// rearm limits the next header read, once the limit of the current one was
+// reached or its header ended.
+func (r *headerLimitReader) rearm() {
+	r.mx.Lock()
+	if r.limit.done {
+		r.limit = newHeaderLimit(r.max)
+	}
+	r.mx.Unlock()
+}
+
+// limitRequestHeaders wraps the client connection conn so that the header of
+// every request read from it through in is limited to limit bytes. The proxy
+// reads the next request on a keep-alive connection only after writing the
+// response to the prior one, so each write to conn re-arms the limit. Tunnels
+// are piped from conn itself, so re-arming doesn't limit their data. What the
+// server had buffered beyond a header before writing the response isn't
+// counted, so headers of pipelined requests may exceed the limit by up to a
+// buffer.
+func limitRequestHeaders(in io.Reader, conn net.Conn, limit int) (io.Reader, net.Conn) {
+	r := newHeaderLimitReader(in, limit)
+	return r, &headerRearmingConn{Conn: conn, reader: r}
+}
+
+type headerRearmingConn struct {
+	net.Conn
+	reader *headerLimitReader
+}
+
+func (c *headerRearmingConn) Write(b []byte) (int, error) {
+	c.reader.rearm()
+	return c.Conn.Write(b)
+}
+
+func (c *headerRearmingConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// limitResponseHeaders wraps dial so that reading a response header longer than
+// limit from connections for plain HTTP requests fails with
+// errResponseHeaderTooLarge. Origins only respond after being sent a request
+// and the transports forwarding requests don't pipeline them, so each write to
+// a connection bounds the next header read from it.
+func limitResponseHeaders(dial proxy.DialFunc, limit int) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		if err != nil || isCONNECT {
+			return conn, err
+		}
+		return &headerLimitConn{Conn: conn, max: limit, limit: newHeaderLimit(limit)}, nil
+	}
+}
+
+type headerLimitConn struct {
+	net.Conn
+	max int
+	// limit is only touched under mx since transports read responses and write
+	// requests from different goroutines.
+	limit headerLimit
+	mx    sync.Mutex
+}
+
+func (c *headerLimitConn) Read(b []byte) (int, error) {
+	c.mx.Lock()
+	exceeded := c.limit.exceeded()
+	c.mx.Unlock()
+	if exceeded {
+		return 0, errResponseHeaderTooLarge
+	}
+	n, err := c.Conn.Read(b)
+	c.mx.Lock()
+	n = c.limit.scan(b, n)
+	if c.limit.exceeded() {
+		err = nil
+	}
+	c.mx.Unlock()
+	return n, err
+}
+
+func (c *headerLimitConn) Write(b []byte) (int, error) {
+	c.mx.Lock()
+	c.limit = newHeaderLimit(c.max)
+	c.mx.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *headerLimitConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleConn closes the wrapped connection once it has seen no reads or writes
+// for idleTimeout. Unlike idletiming, it closes the wrapped connection directly
+// so that pending reads on it return immediately. If idleTimeout isn't
+// positive, the connection isn't idled until it's given a timeout with
+// setIdleTimeout.
+type idleConn struct {
+	net.Conn
+	lastActive  int64
+	idleTimeout int64
+	onIdle      func()
+	timer       *time.Timer
+	timerMx     sync.Mutex
+	closed      bool
+}
+
+func newIdleConn(conn net.Conn, idleTimeout time.Duration, onIdle func()) *idleConn {
+	c := &idleConn{
+		Conn:       conn,
+		lastActive: time.Now().UnixNano(),
+		onIdle:     onIdle,
+	}
+	c.setIdleTimeout(idleTimeout)
+	return c
+}
+
+// setIdleTimeout changes the idle timeout of the connection, counting from
+// when it was last active.
+func (c *idleConn) setIdleTimeout(idleTimeout time.Duration) {
+	atomic.StoreInt64(&c.idleTimeout, int64(idleTimeout))
+	if idleTimeout <= 0 {
+		return
+	}
+	c.timerMx.Lock()
+	defer c.timerMx.Unlock()
+	if c.closed {
+		return
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(idleTimeout, c.checkIdle)
+	} else {
+		// Check again right away in case the timeout got shorter
+		c.timer.Reset(0)
+	}
+}
+
+func (c *idleConn) checkIdle() {
+	idleTimeout := time.Duration(atomic.LoadInt64(&c.idleTimeout))
+	if idleTimeout <= 0 {
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+	if idle >= idleTimeout {
+		c.Conn.Close()
+		c.onIdle()
+		return
+	}
+	c.timerMx.Lock()
+	if !c.closed {
+		c.timer.Reset(idleTimeout - idle)
+	}
+	c.timerMx.Unlock()
+}
+
+func (c *idleConn) markActive(n int) {
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.markActive(n)
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.markActive(n)
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timerMx.Lock()
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timerMx.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *idleConn) Wrapped() net.Conn {
+	return c.Conn
+}
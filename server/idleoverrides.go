@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/hostpatterns"
+)
+
+// idleTimeouts picks the idle timeout of upstream connections by destination
+// host, falling back to a default when no override matches.
+type idleTimeouts struct {
+	fallback  time.Duration
+	overrides map[string]time.Duration
+	patterns  *hostpatterns.Patterns
+}
+
+func newIdleTimeouts(fallback time.Duration, overrides map[string]time.Duration) *idleTimeouts {
+	patterns := make([]string, 0, len(overrides))
+	for pattern := range overrides {
+		patterns = append(patterns, pattern)
+	}
+	return &idleTimeouts{
+		fallback:  fallback,
+		overrides: overrides,
+		patterns:  hostpatterns.New(patterns),
+	}
+}
+
+// forAddr returns the idle timeout of connections to the given host:port.
+func (it *idleTimeouts) forAddr(addr string) time.Duration {
+	if timeout, found := it.override(addr); found {
+		return timeout
+	}
+	return it.fallback
+}
+
+// override returns the override for the given host:port, if any, with the
+// precedence of hostpatterns.
+func (it *idleTimeouts) override(addr string) (time.Duration, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	pattern, found := it.patterns.Match(host)
+	if !found {
+		return 0, false
+	}
+	return it.overrides[pattern], true
+}
+
+type idleTimeoutKey struct{}
+
+type clientConnKey struct{}
+
+// withClientConn returns a context carrying client, for dialing the
+// destinations of its tunnels.
+func withClientConn(ctx context.Context, client *clientConn) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, client)
+}
+
+// clientConn is a client connection that idles after the server's
+// IdleTimeout until it carries a tunnel to a destination with an override,
+// from then on it idles after the override.
+type clientConn struct {
+	*idleConn
+	mx               sync.Mutex
+	tunnelTimeout    time.Duration
+	tunnelOverridden bool
+}
+
+func newClientConn(conn net.Conn, idleTimeout time.Duration) *clientConn {
+	return &clientConn{idleConn: newIdleConn(conn, idleTimeout, func() {
+		log.Debugf("Client connection from %v idled", conn.RemoteAddr())
+	})}
+}
+
+// setTunnel records the idle timeout override of the destination of the
+// client's CONNECT request, if any, for dialing it.
+func (c *clientConn) setTunnel(timeout time.Duration, overridden bool) {
+	c.mx.Lock()
+	c.tunnelTimeout, c.tunnelOverridden = timeout, overridden
+	c.mx.Unlock()
+}
+
+func (c *clientConn) tunnel() (time.Duration, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.tunnelTimeout, c.tunnelOverridden
+}
+
+// findClientConn finds the clientConn that conn wraps, if any.
+func findClientConn(conn net.Conn) *clientConn {
+	for conn != nil {
+		if client, ok := conn.(*clientConn); ok {
+			return client
+		}
+		wrapper, ok := conn.(interface{ Wrapped() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.Wrapped()
+	}
+	return nil
+}
+
+// applyIdleTimeoutOverrides wraps filter so that overrides are looked up by
+// the host that clients requested, before any filter rewrites the
+// destination, for withIdleTimeout to apply when dialing it.
+func applyIdleTimeoutOverrides(filter filters.Filter, timeouts *idleTimeouts) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		timeout, overridden := timeouts.override(req.Host)
+		if req.Method == http.MethodConnect {
+			// Tunnels are dialed with the context of the client connection
+			// rather than that of the request
+			if client := findClientConn(cs.Downstream()); client != nil {
+				client.setTunnel(timeout, overridden)
+			}
+		} else if overridden {
+			req = req.WithContext(context.WithValue(req.Context(), idleTimeoutKey{}, timeout))
+		}
+		return filter.Apply(cs, req, next)
+	})
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientNagle(t *testing.T) {
+	for _, nagle := range []bool{false, true} {
+		l, err := (&Server{clientNagle: nagle}).listen("127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		client, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		conn, err := l.Accept()
+		if assert.NoError(t, err) {
+			raw, _ := conn.(*net.TCPConn).SyscallConn()
+			noDelay := -1
+			raw.Control(func(fd uintptr) {
+				noDelay, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+			})
+			if nagle {
+				assert.Equal(t, 0, noDelay, "should enable Nagle's algorithm on accepted connections")
+			} else {
+				assert.Equal(t, 1, noDelay, "should keep TCP_NODELAY by default")
+			}
+			conn.Close()
+		}
+		client.Close()
+		l.Close()
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	l, err := (&Server{backlog: 1}).listen("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// Without accepting, Linux completes backlog+1 connections and then drops
+	// SYNs
+	failed := 0
+	for i := 0; i < 5; i++ {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 200*time.Millisecond)
+		if err != nil {
+			failed++
+			continue
+		}
+		defer conn.Close()
+	}
+	assert.Equal(t, 3, failed, "connections beyond backlog should not complete")
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+var connectPrefix = []byte(http.MethodConnect + " ")
+
+// connectMethodReader reads from a client connection, rewriting the method of
+// the first request on it to CONNECT if it's CONNECT in another case, like
+// connect or Connect, as sent by some clients. The proxy library only
+// recognizes CONNECT as such, and treats other spellings as requests to be
+// forwarded, if it can parse them at all.
+type connectMethodReader struct {
+	io.Reader
+	checked bool
+	pending []byte
+	err     error
+}
+
+func newConnectMethodReader(r io.Reader) *connectMethodReader {
+	return &connectMethodReader{Reader: r}
+}
+
+func (r *connectMethodReader) Read(b []byte) (int, error) {
+	if !r.checked {
+		r.checked = true
+		// Request lines are always longer than the prefix, so waiting for all of
+		// it doesn't hold up valid requests
+		prefix := make([]byte, len(connectPrefix))
+		n, err := io.ReadFull(r.Reader, prefix)
+		r.pending = prefix[:n]
+		if n == len(prefix) && bytes.EqualFold(r.pending, connectPrefix) {
+			copy(r.pending, connectPrefix)
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		r.err = err
+	}
+	if len(r.pending) > 0 {
+		n := copy(b, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.Reader.Read(b)
+}
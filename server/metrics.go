@@ -0,0 +1,25 @@
+package server
+
+import (
+	"runtime"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+// The difference between started and finished handlers is the number of
+// goroutines handling client connections, including their CONNECT tunnels.
+// Goroutines growing faster than handlers point to goroutines leaking from
+// elsewhere.
+var (
+	handlersStarted  = metrics.NewCounter("http_proxy_conn_handlers_started_total", "Number of goroutines started to handle client connections.")
+	handlersFinished = metrics.NewCounter("http_proxy_conn_handlers_finished_total", "Number of goroutines handling client connections that finished.")
+	activeHandlers   = metrics.NewGaugeFunc("http_proxy_conn_handlers", "Number of goroutines currently handling client connections.", func() int64 {
+		// Load finished first so that a handler finishing in between isn't
+		// counted as negative
+		finished := handlersFinished.Value()
+		return handlersStarted.Value() - finished
+	})
+	goroutines = metrics.NewGaugeFunc("http_proxy_goroutines", "Number of goroutines in the process.", func() int64 {
+		return int64(runtime.NumGoroutine())
+	})
+)
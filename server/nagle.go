@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net"
+)
+
+// nagleListener enables Nagle's algorithm on the TCP connections it accepts.
+type nagleListener struct {
+	net.Listener
+}
+
+func (l *nagleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			log.Debugf("Unable to enable Nagle's algorithm on connection from %v: %v", conn.RemoteAddr(), err)
+		}
+	}
+	return conn, nil
+}
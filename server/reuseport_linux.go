@@ -0,0 +1,26 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!sparc64
+
+package server
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = true
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define. It's
+// different on MIPS and SPARC, which fall back to not supporting it.
+const soReusePort = 0xf
+
+// setReusePort is a net.ListenConfig Control function that sets SO_REUSEPORT.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le || sparc64
+// +build !linux mips mipsle mips64 mips64le sparc64
+
+package server
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -2,11 +2,17 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/getlantern/errors"
@@ -16,6 +22,7 @@ import (
 	"github.com/getlantern/proxy/v2/filters"
 	"github.com/getlantern/tlsdefaults"
 
+	"github.com/getlantern/http-proxy/dialers"
 	"github.com/getlantern/http-proxy/listeners"
 )
 
@@ -24,6 +31,12 @@ var (
 	log          = golog.LoggerFor("server")
 )
 
+const (
+	defaultDialTimeout = 10 * time.Second
+
+	unixAddrPrefix = "unix:"
+)
+
 // A ListenerGenerator generates a new listener from an existing one.
 type ListenerGenerator func(net.Listener) net.Listener
 
@@ -32,16 +45,167 @@ type Opts struct {
 	IdleTimeout  time.Duration
 	BufferSource proxy.BufferSource
 	Filter       filters.Filter
-	Dial         proxy.DialFunc
+
+	// Dial is used to connect to origins, for example to route some of them
+	// through a different network path. If nil, dialers.Direct is used.
+	Dial proxy.DialFunc
+
+	// DialTimeout bounds how long we wait when dialing upstream, 10 seconds if
+	// zero. New fails if it's negative.
+	DialTimeout time.Duration
+
+	// DialRetries is the number of times to retry dialing upstream on transient
+	// errors, waiting DialRetryBackoff before the first retry and doubling that
+	// each time. All retries count against DialTimeout.
+	DialRetries      int
+	DialRetryBackoff time.Duration
 
 	// OKDoesNotWaitForUpstream can be set to true in order to immediately return
 	// OK to CONNECT requests.
 	OKDoesNotWaitForUpstream bool
 
+	// ProxyProtocol can be set to true in order to require a PROXY protocol v1
+	// header on all accepted connections, for running behind load balancers
+	// like AWS NLB or HAProxy. The source address from the header is used as
+	// the connection's remote address, including for Allow. Connections with a
+	// missing or malformed header are closed.
+	ProxyProtocol bool
+
+	// TLSConfig is the TLS configuration used by ListenAndServeHTTPS. Unless it
+	// specifies GetCertificate, the key and certificate passed to
+	// ListenAndServeHTTPS are served by default and any Certificates in
+	// TLSConfig are served to clients requesting one of their names via SNI. If
+	// it doesn't specify a MinVersion, TLS 1.2 is required. If nil, a default
+	// configuration is used. To only accept clients with certificates signed by
+	// given CAs, set ClientCAs and ClientAuth to tls.RequireAndVerifyClientCert:
+	// other clients fail the handshake and their connections are closed before
+	// any request is read. Filters can identify clients with
+	// proxyfilters.ClientCommonName.
+	TLSConfig *tls.Config
+
+	// ErrorResponder, if specified, builds the bodies of the error responses
+	// sent to clients, for example to serve branded HTML or JSON errors. By
+	// default, the reason for the error is sent as plain text.
+	ErrorResponder ErrorResponder
+
+	// Context, if specified, is the parent of the contexts under which client
+	// connections are handled. Once it's done, in-progress dials are abandoned
+	// and all connections, including CONNECT tunnels, are closed.
+	Context context.Context
+
+	// ConnectOKReason is the reason phrase in the status line of OK responses
+	// to CONNECT requests, "Connection established" by default. Some clients
+	// expect "OK".
+	ConnectOKReason string
+
+	// ConnectOKHeaders are the headers included in the OK response to CONNECT
+	// requests, which is otherwise just
+	// "HTTP/1.1 200 Connection established\r\n\r\n".
+	ConnectOKHeaders http.Header
+
+	// ResponseWriteTimeout bounds how long writing an error response, or an OK
+	// response to a CONNECT request, to a client may take, so that clients that
+	// stopped reading don't tie up the server. If zero,
+	// defaultResponseWriteTimeout is used. If negative, writes aren't limited.
+	ResponseWriteTimeout time.Duration
+
+	// MaxHeaderBytes bounds the size of the header of each request on client
+	// connections, including later requests on keep-alive connections, so that
+	// clients can't exhaust memory with huge headers. Clients exceeding it get
+	// a 431.
+	// If zero, http.DefaultMaxHeaderBytes is used. If negative, headers aren't
+	// limited.
+	MaxHeaderBytes int
+
+	// MaxBodyBytes, if positive, bounds the size of the bodies of forwarded
+	// plain HTTP requests, such as POSTs, so that the proxy can't be abused to
+	// relay large uploads. Clients exceeding it get a 413. CONNECT tunnels
+	// aren't affected.
+	MaxBodyBytes int64
+
+	// MaxResponseHeaderBytes, if positive, bounds the size of the headers of the
+	// responses to forwarded plain HTTP requests, so that malicious origins
+	// can't exhaust memory with huge headers. Clients get a 502 if an origin
+	// exceeds it. Otherwise, response headers are only bounded by net/http's
+	// default of 10 MB.
+	MaxResponseHeaderBytes int
+
+	// ForwardPoolSize, if positive, makes plain HTTP requests be forwarded over
+	// keep-alive connections to origins that are shared among all clients,
+	// keeping up to this many idle connections per origin. By default, each
+	// client connection forwards over connections of its own.
+	ForwardPoolSize int
+
+	// ForwardIdleTimeout is how long a shared connection to an origin may sit
+	// idle in the pool before it's closed. If zero, defaultForwardIdleTimeout
+	// is used.
+	ForwardIdleTimeout time.Duration
+
+	// IdleTimeoutOverrides overrides IdleTimeout for upstream connections to
+	// some destinations, for example to let long-polling origins stay quiet for
+	// longer. Keys are either exact host names or wildcards like
+	// "*.example.com", which match any subdomain of example.com. An exact name
+	// takes precedence over wildcards and the wildcard for the closest parent
+	// domain wins. Overrides match the host that clients request, even if a
+	// filter rewrites the address that's dialed. If there are any, the server
+	// idles client connections itself, after IdleTimeout until they carry a
+	// tunnel to a destination with an override, and after the override from
+	// then on.
+	IdleTimeoutOverrides map[string]time.Duration
+
+	// KeepAlive is the TCP keep-alive period of client connections accepted by
+	// ListenAndServeHTTP and ListenAndServeHTTPS. Connections that have been
+	// idle that long send probes, which detect peers that went away, for
+	// example because a NAT dropped the mapping of a long-lived tunnel. If
+	// zero, Go's default of 15 seconds is used. If negative, keep-alives are
+	// disabled. Like all TCP connections in Go, client connections have
+	// TCP_NODELAY set, unless ClientNagle.
+	KeepAlive time.Duration
+
+	// ClientNagle enables Nagle's algorithm on client connections accepted by
+	// ListenAndServeHTTP and ListenAndServeHTTPS, clearing TCP_NODELAY so that
+	// the kernel batches small writes to clients at the cost of latency. See
+	// dialers.WithNagle to do so on connections to origins instead.
+	ClientNagle bool
+
+	// ReusePort sets SO_REUSEPORT on the TCP sockets that ListenAndServeHTTP
+	// and ListenAndServeHTTPS listen on, so that another process, like a new
+	// version of the proxy taking over during a restart, can listen at the same
+	// address meanwhile, with the kernel spreading new connections between
+	// them. It's only supported on Linux. Elsewhere, an error is logged and the
+	// server listens without it, so binding an address in use fails as usual.
+	ReusePort bool
+
+	// Backlog, if positive, is the size of the queue of connections that
+	// ListenAndServeHTTP and ListenAndServeHTTPS let the kernel complete
+	// before they're accepted. Once it's full, further connection attempts are
+	// dropped, so clients only connect after retransmitting their SYN, if at
+	// all. Go uses the largest backlog allowed by default, which the kernel
+	// caps, e.g. at net.core.somaxconn on Linux (4096 by default since Linux
+	// 5.4, 128 before) and at kern.ipc.somaxconn on BSDs. Raise those to
+	// survive bigger bursts. Setting Backlog helps when they were raised after
+	// the proxy started, as Go only reads them once, or to keep queues short.
+	// It's only supported on Unix systems.
+	Backlog int
+
+	// MaxAcceptRate, if positive, limits how many client connections the
+	// server accepts per second across all of its listeners. During bursts,
+	// accepting is delayed so that further connections queue up in the
+	// listen backlog rather than being dropped.
+	MaxAcceptRate int
+
 	// OnError provides a callback that's invoked if the proxy encounters an
 	// error while proxying for the given client connection.
 	OnError func(conn net.Conn, err error)
 
+	// OnDialSuccess and OnDialFailure, if not nil, are called after each dial
+	// to an origin or upstream, with the host:port dialed, so that embedders can
+	// track its health, for example to fail over to a different path. Retries
+	// are part of a single dial, which took d. Dials abandoned because their
+	// client went away aren't reported.
+	OnDialSuccess func(host string, d time.Duration)
+	OnDialFailure func(host string, err error)
+
 	// OnAcceptError is called when the server fails to accept a connection.
 	// If the error is fatal and should halt server operations, this callback
 	// should return an error. That error will be returned by functions like
@@ -59,54 +223,233 @@ type Server struct {
 	// from the given IP address. If unspecified, all connections are allowed.
 	Allow              func(string) bool
 	proxy              proxy.Proxy
+	dial               proxy.DialFunc
 	listenerGenerators []ListenerGenerator
 	onError            func(conn net.Conn, err error)
 	onAcceptError      func(err error) (fatalErr error)
+	proxyProtocol      bool
+	tlsConfig          *tls.Config
+	maxHeader          int
+	forward            *http.Transport
+	keepAlive          time.Duration
+	reusePort          bool
+	clientNagle        bool
+	backlog            int
+	acceptLimiter      *acceptLimiter
+	idleClients        bool
+	idleTimeout        time.Duration
+
+	// ctx is canceled to close all connections
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mx        sync.Mutex
+	stopped   bool
+	listeners map[net.Listener]bool
+	conns     map[*activityConn]bool
+	active    sync.WaitGroup
 }
 
 // New constructs a new HTTP proxy server using the given options
-func New(opts *Opts) *Server {
+func New(opts *Opts) (*Server, error) {
+	if opts.DialTimeout < 0 {
+		return nil, errors.New("Invalid dial timeout %v, expected a positive duration", opts.DialTimeout)
+	}
+	if opts.Dial == nil {
+		opts.Dial = dialers.Direct
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = defaultDialTimeout
+	}
+	dial := withDialTimeout(dialers.WithRetries(opts.Dial, opts.DialRetries, opts.DialRetryBackoff), opts.DialTimeout)
+	if opts.OnDialSuccess != nil || opts.OnDialFailure != nil {
+		dial = withDialHooks(dial, opts.OnDialSuccess, opts.OnDialFailure)
+	}
+	var timeouts *idleTimeouts
+	if opts.IdleTimeout > 0 || len(opts.IdleTimeoutOverrides) > 0 {
+		timeouts = newIdleTimeouts(opts.IdleTimeout, opts.IdleTimeoutOverrides)
+		dial = withIdleTimeout(dial, timeouts)
+	}
+	if opts.MaxResponseHeaderBytes > 0 {
+		dial = limitResponseHeaders(dial, opts.MaxResponseHeaderBytes)
+	}
+	filter := opts.Filter
+	if filter == nil {
+		filter = filters.Join()
+	}
+	if len(opts.IdleTimeoutOverrides) > 0 {
+		filter = applyIdleTimeoutOverrides(filter, timeouts)
+	}
+	var forwardTransport *http.Transport
+	if opts.ForwardPoolSize > 0 {
+		if opts.ForwardIdleTimeout <= 0 {
+			opts.ForwardIdleTimeout = defaultForwardIdleTimeout
+		}
+		forwardTransport = newForwardTransport(dial, opts.ForwardPoolSize, opts.ForwardIdleTimeout)
+		filter = forwardPooled(filter, forwardTransport)
+	}
+	if opts.MaxBodyBytes > 0 {
+		filter = limitRequestBodies(filter, opts.MaxBodyBytes)
+	}
+	filter = respondDialErrors(recoverPanics(filter))
+	if opts.ErrorResponder != nil {
+		filter = respondErrors(filter, opts.ErrorResponder)
+	}
+	if opts.ResponseWriteTimeout == 0 {
+		opts.ResponseWriteTimeout = defaultResponseWriteTimeout
+	}
+	if opts.ConnectOKReason == "" {
+		opts.ConnectOKReason = defaultConnectOKReason
+	}
+	filter = respondConnectOK(filter, opts.ConnectOKReason, opts.ConnectOKHeaders, opts.ResponseWriteTimeout)
+	if opts.ResponseWriteTimeout > 0 {
+		filter = limitResponseWrites(filter, opts.ResponseWriteTimeout)
+	}
 	p, _ := proxy.New(&proxy.Opts{
-		IdleTimeout:         opts.IdleTimeout,
-		Dial:                opts.Dial,
-		Filter:              opts.Filter,
-		BufferSource:        opts.BufferSource,
-		OKWaitsForUpstream:  !opts.OKDoesNotWaitForUpstream,
-		OKSendsServerTiming: true,
-		OnError: func(_ *filters.ConnectionState, req *http.Request, read bool, err error) *http.Response {
+		IdleTimeout:        opts.IdleTimeout,
+		Dial:               dial,
+		Filter:             filter,
+		BufferSource:       opts.BufferSource,
+		OKWaitsForUpstream: !opts.OKDoesNotWaitForUpstream,
+		OnError: func(cs *filters.ConnectionState, req *http.Request, read bool, err error) *http.Response {
+			if opts.ResponseWriteTimeout > 0 {
+				setWriteDeadline(cs, opts.ResponseWriteTimeout)
+			}
 			status := http.StatusBadGateway
-			if read {
+			if err == errHeaderTooLarge {
+				status = http.StatusRequestHeaderFieldsTooLarge
+			} else if read {
 				status = http.StatusBadRequest
+			} else {
+				status = dialErrorStatus(err)
 			}
-			return &http.Response{
+			resp := &http.Response{
 				Request:    req,
 				StatusCode: status,
 				Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
 			}
+			if opts.ErrorResponder != nil {
+				setErrorBody(resp, opts.ErrorResponder, err.Error())
+			}
+			return resp
 		},
 	})
 
 	if opts.OnError == nil {
 		opts.OnError = func(conn net.Conn, err error) {}
 	}
+	if opts.MaxHeaderBytes == 0 {
+		opts.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
 	if opts.OnAcceptError == nil {
 		opts.OnAcceptError = func(err error) (fatalErr error) { return err }
 	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	return &Server{
+		ctx:           ctx,
+		cancel:        cancel,
 		proxy:         p,
+		dial:          dial,
 		onError:       opts.OnError,
 		onAcceptError: opts.OnAcceptError,
+		proxyProtocol: opts.ProxyProtocol,
+		tlsConfig:     opts.TLSConfig,
+		maxHeader:     opts.MaxHeaderBytes,
+		forward:       forwardTransport,
+		keepAlive:     opts.KeepAlive,
+		reusePort:     opts.ReusePort,
+		clientNagle:   opts.ClientNagle,
+		backlog:       opts.Backlog,
+		acceptLimiter: newAcceptLimiter(opts.MaxAcceptRate),
+		idleClients:   len(opts.IdleTimeoutOverrides) > 0,
+		idleTimeout:   opts.IdleTimeout,
+		listeners:     make(map[net.Listener]bool),
+		conns:         make(map[*activityConn]bool),
+	}, nil
+}
+
+// withDialTimeout wraps the given dial function so that dialing gives up after
+// timeout.
+func withDialTimeout(dial proxy.DialFunc, timeout time.Duration) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, isCONNECT, network, addr)
+	}
+}
+
+// withDialHooks wraps the given dial function so that onSuccess or onFailure,
+// whichever isn't nil, are called with the outcome of each dial.
+func withDialHooks(dial proxy.DialFunc, onSuccess func(host string, d time.Duration), onFailure func(host string, err error)) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		if err != nil {
+			if onFailure != nil && ctx.Err() == nil {
+				onFailure(addr, err)
+			}
+			return nil, err
+		}
+		if onSuccess != nil {
+			onSuccess(addr, time.Since(start))
+		}
+		return conn, nil
+	}
+}
+
+// withIdleTimeout wraps the given dial function so that upstream connections
+// are closed after idling for the timeout of their destination. Together with
+// idle timing on client connections, this makes sure that a tunnel is torn down
+// once either side goes quiet. Once a tunnel to a destination with an override
+// is established, its client connection idles after the override as well.
+func withIdleTimeout(dial proxy.DialFunc, timeouts *idleTimeouts) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		idleTimeout := timeouts.fallback
+		client, _ := ctx.Value(clientConnKey{}).(*clientConn)
+		if isCONNECT && client != nil {
+			if timeout, overridden := client.tunnel(); overridden {
+				idleTimeout = timeout
+				client.setIdleTimeout(timeout)
+			}
+		} else if timeout, overridden := ctx.Value(idleTimeoutKey{}).(time.Duration); overridden {
+			idleTimeout = timeout
+		}
+		if idleTimeout <= 0 {
+			return conn, nil
+		}
+		return newIdleConn(conn, idleTimeout, func() {
+			log.Debugf("Upstream connection to %v idled", addr)
+		}), nil
 	}
 }
 
+// Dial dials addr over network like the proxy dials the destinations of
+// CONNECT tunnels, with the timeouts, retries and hooks given in Opts, so
+// that filters can open tunnels of their own.
+func (s *Server) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return s.dial(ctx, true, network, addr)
+}
+
 func (s *Server) AddListenerWrappers(listenerGens ...ListenerGenerator) {
 	for _, g := range listenerGens {
 		s.listenerGenerators = append(s.listenerGenerators, g)
 	}
 }
 
+// ListenAndServeHTTP listens for and serves plain HTTP proxy connections at
+// addr, which can be a TCP address or the path of a Unix domain socket
+// prefixed with "unix:". If readyCb is not nil, it's called with the actual
+// listening address once the server is ready to accept connections.
 func (s *Server) ListenAndServeHTTP(addr string, readyCb func(addr string)) error {
-	listener, err := net.Listen("tcp", addr)
+	listener, err := s.listen(addr)
 	if err != nil {
 		return err
 	}
@@ -114,20 +457,137 @@ func (s *Server) ListenAndServeHTTP(addr string, readyCb func(addr string)) erro
 	return s.serve(s.wrapListenerIfNecessary(listener), readyCb)
 }
 
+// ListenAndServeHTTPS is like ListenAndServeHTTP but serves over TLS using
+// Opts.TLSConfig and the given PEM encoded key and certificate files. If those
+// files don't exist, a new key and self-signed certificate are generated.
 func (s *Server) ListenAndServeHTTPS(addr, keyfile, certfile string, readyCb func(addr string)) error {
-	l, err := net.Listen("tcp", addr)
+	l, err := s.listen(addr)
 	if err != nil {
 		return err
 	}
 
-	listener, err := tlsdefaults.NewListener(s.wrapListenerIfNecessary(l), keyfile, certfile)
+	certAddr := l.Addr().String()
+	if l.Addr().Network() == "unix" {
+		// Generated certificates need a host
+		certAddr = "localhost:0"
+	}
+	tlsConfig, err := s.buildTLSConfig(certAddr, keyfile, certfile)
 	if err != nil {
+		l.Close()
 		return err
 	}
+	listener := tls.NewListener(s.wrapListenerIfNecessary(l), tlsConfig)
 	log.Debugf("Listen https on %s", addr)
 	return s.serve(listener, readyCb)
 }
 
+// listen listens at the given TCP address or, if it's prefixed with "unix:", at
+// the Unix domain socket with the given path. The socket file is removed when
+// the listener is closed. Accepted TCP connections use the server's keep-alive
+// period, following the conventions of net.ListenConfig, and have Nagle's
+// algorithm enabled if ClientNagle. If ReusePort and supported, TCP sockets
+// have SO_REUSEPORT set.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixAddrPrefix) {
+		lc := &net.ListenConfig{KeepAlive: s.keepAlive}
+		if s.reusePort {
+			if reusePortSupported {
+				lc.Control = setReusePort
+			} else {
+				log.Errorf("SO_REUSEPORT isn't supported on %v, listening at %v without it", runtime.GOOS, addr)
+			}
+		}
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.applyBacklog(l); err != nil {
+			l.Close()
+			return nil, err
+		}
+		if s.clientNagle {
+			return &nagleListener{l}, nil
+		}
+		return l, nil
+	}
+
+	path := strings.TrimPrefix(addr, unixAddrPrefix)
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, dialErr := net.Dial("unix", path)
+		if dialErr == nil {
+			conn.Close()
+			return nil, errors.New("Unix socket %v is already in use", path)
+		}
+		// Left behind by a process that didn't shut down cleanly
+		log.Debugf("Removing stale Unix socket %v", path)
+		if err := os.Remove(path); err != nil {
+			return nil, errors.New("Unable to remove stale Unix socket %v: %v", path, err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.applyBacklog(l); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// applyBacklog sets the backlog of the given listener to Backlog, if any.
+func (s *Server) applyBacklog(l net.Listener) error {
+	if s.backlog <= 0 {
+		return nil
+	}
+	if !backlogSupported {
+		log.Errorf("Setting the listen backlog isn't supported on %v, listening at %v with the default", runtime.GOOS, l.Addr())
+		return nil
+	}
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return errors.New("Unable to set backlog of %v: %v", l.Addr(), err)
+	}
+	if err := setBacklog(raw, s.backlog); err != nil {
+		return errors.New("Unable to set backlog of %v: %v", l.Addr(), err)
+	}
+	return nil
+}
+
+func (s *Server) buildTLSConfig(addr, keyfile, certfile string) (*tls.Config, error) {
+	if s.tlsConfig != nil && s.tlsConfig.GetCertificate != nil {
+		tlsConfig := s.tlsConfig.Clone()
+		if tlsConfig.MinVersion == 0 {
+			tlsConfig.MinVersion = tls.VersionTLS12
+		}
+		return tlsConfig, nil
+	}
+
+	tlsConfig, err := tlsdefaults.BuildListenerConfig(addr, keyfile, certfile)
+	if err != nil {
+		return nil, err
+	}
+	if s.tlsConfig != nil {
+		certs := append(tlsConfig.Certificates, s.tlsConfig.Certificates...)
+		tlsConfig = s.tlsConfig.Clone()
+		tlsConfig.Certificates = certs
+	}
+	if len(tlsConfig.Certificates) > 1 {
+		tlsConfig.GetCertificate, err = certificateForSNI(tlsConfig.Certificates)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	return tlsConfig, nil
+}
+
 func (s *Server) Serve(listener net.Listener, readyCb func(addr string)) error {
 	return s.serve(s.wrapListenerIfNecessary(listener), readyCb)
 }
@@ -139,14 +599,24 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 		l = wrap(l)
 	}
 
+	if !s.trackListener(l) {
+		l.Close()
+		return nil
+	}
+	defer s.untrackListener(l)
+
 	if readyCb != nil {
 		readyCb(l.Addr().String())
 	}
 
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
+		s.acceptLimiter.wait()
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isStopped() {
+				return nil
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				// delay code based on net/http.Server
 				if tempDelay == 0 {
@@ -170,14 +640,112 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 }
 
 func (s *Server) handle(conn net.Conn) {
+	tracked := newActivityConn(conn)
+	if !s.trackConn(tracked) {
+		// Accepted just as we were stopping
+		safeClose(conn)
+		return
+	}
 	wrapConn, isWrapConn := conn.(listeners.WrapConn)
 	if isWrapConn {
 		wrapConn.OnState(http.StateNew)
 	}
-	go s.doHandle(conn, isWrapConn, wrapConn)
+	handlersStarted.Inc()
+	go func() {
+		defer handlersFinished.Inc()
+		defer s.untrackConn(tracked)
+		s.doHandle(tracked, isWrapConn, wrapConn)
+	}()
+}
+
+// Stop stops the server from accepting new connections and waits for the
+// connections that are currently being handled (including CONNECT tunnels)
+// to finish. If ctx is done before that happens, all remaining connections
+// are forcibly closed and ctx's error is returned. Once stopped, Serve,
+// ListenAndServeHTTP and ListenAndServeHTTPS return nil.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mx.Lock()
+	s.stopped = true
+	for l := range s.listeners {
+		if err := l.Close(); err != nil {
+			log.Debugf("Error closing listener at %v: %v", l.Addr(), err)
+		}
+	}
+	s.mx.Unlock()
+
+	drained := make(chan interface{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+
+	if s.forward != nil {
+		defer s.forward.CloseIdleConnections()
+	}
+
+	select {
+	case <-drained:
+		log.Debug("All connections finished, server stopped")
+		return nil
+	case <-ctx.Done():
+		s.mx.Lock()
+		remaining := len(s.conns)
+		s.mx.Unlock()
+		log.Debugf("Forcibly closing %d remaining connections", remaining)
+		s.cancel()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isStopped() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.stopped
+}
+
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.listeners[l] = true
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mx.Lock()
+	delete(s.listeners, l)
+	s.mx.Unlock()
+}
+
+func (s *Server) trackConn(conn *activityConn) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = true
+	s.active.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn *activityConn) {
+	s.mx.Lock()
+	delete(s.conns, conn)
+	s.active.Done()
+	s.mx.Unlock()
 }
 
 func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.WrapConn) {
+	if !s.allowed(conn) {
+		safeClose(conn)
+		if isWrapConn {
+			wrapConn.OnState(http.StateClosed)
+		}
+		return
+	}
+
 	clientIP := ""
 	remoteAddr := conn.RemoteAddr()
 	if remoteAddr != nil {
@@ -197,7 +765,29 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 		}
 	}()
 
-	err := s.proxy.Handle(context.Background(), conn, conn)
+	// Close the connection, and with it any tunnel, if the server's context is
+	// done before we finish handling it
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if s.ctx.Err() != nil {
+			forceClose(conn)
+		}
+	}()
+
+	handleCtx := ctx
+	downstream := conn
+	if s.idleClients {
+		client := newClientConn(conn, s.idleTimeout)
+		handleCtx = withClientConn(ctx, client)
+		downstream = client
+	}
+	var downstreamIn io.Reader = newConnectMethodReader(downstream)
+	if s.maxHeader > 0 {
+		downstreamIn, downstream = limitRequestHeaders(downstreamIn, downstream, s.maxHeader)
+	}
+	err := s.proxy.Handle(handleCtx, downstreamIn, downstream)
 	if err != nil {
 		op.FailIf(errors.New("Error handling connection from %v: %v", conn.RemoteAddr(), err))
 		s.onError(conn, err)
@@ -219,48 +809,31 @@ func safeClose(conn net.Conn) {
 }
 
 func (s *Server) wrapListenerIfNecessary(l net.Listener) net.Listener {
-	if s.Allow != nil {
-		log.Debug("Wrapping listener with Allow")
-		return &allowinglistener{l, s.Allow}
+	if s.proxyProtocol {
+		log.Debug("Wrapping listener with PROXY protocol support")
+		l = listeners.NewProxyProtocolListener(l)
 	}
 	return l
 }
 
-type allowinglistener struct {
-	wrapped net.Listener
-	allow   func(string) bool
-}
-
-func (l *allowinglistener) Accept() (net.Conn, error) {
-	conn, err := l.wrapped.Accept()
-	if err != nil {
-		return conn, err
+// allowed tells whether Allow allows the client of conn. It's checked while
+// handling the connection rather than on Accept, because with ProxyProtocol,
+// getting the client's address means waiting for the PROXY protocol header.
+func (s *Server) allowed(conn net.Conn) bool {
+	if s.Allow == nil {
+		return true
 	}
-
-	ip := ""
 	remoteAddr := conn.RemoteAddr()
 	switch addr := remoteAddr.(type) {
 	case *net.TCPAddr:
-		ip = addr.IP.String()
+		return s.Allow(addr.IP.String())
 	case *net.UDPAddr:
-		ip = addr.IP.String()
+		return s.Allow(addr.IP.String())
+	case *net.UnixAddr:
+		// Local clients connecting through a Unix domain socket have no IP
+		return true
 	default:
 		log.Errorf("Remote addr %v is of unknown type %v, unable to determine IP", remoteAddr, reflect.TypeOf(remoteAddr))
-		return conn, err
+		return true
 	}
-	if !l.allow(ip) {
-		conn.Close()
-		// Note - we don't return an error, because that causes http.Server to stop
-		// serving.
-	}
-
-	return conn, err
-}
-
-func (l *allowinglistener) Close() error {
-	return l.wrapped.Close()
-}
-
-func (l *allowinglistener) Addr() net.Addr {
-	return l.wrapped.Addr()
 }
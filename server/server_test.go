@@ -3,18 +3,25 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,7 +31,9 @@ import (
 	"github.com/getlantern/proxy/v2/filters"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/getlantern/http-proxy/dialers"
 	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/proxyfilters"
 )
 
 const (
@@ -171,7 +180,7 @@ func TestIdleClientConnections(t *testing.T) {
 
 // A proxy with a custom origin server connection timeout
 func impatientProxy(maxConns uint64, idleTimeout time.Duration) (string, error) {
-	srv := New(&Opts{IdleTimeout: idleTimeout})
+	srv := newServer(&Opts{IdleTimeout: idleTimeout})
 
 	// Add net.Listener wrappers for inbound connections
 
@@ -302,8 +311,9 @@ func TestConnectOK(t *testing.T) {
 			t.FailNow()
 		}
 
-		resp, _ := http.ReadResponse(bufio.NewReader(conn), nil)
-		ioutil.ReadAll(resp.Body)
+		// A 200 response to CONNECT has no body, the tunnel follows
+		resp, _ := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		resp.Body.Close()
 		if !assert.Equal(t, 200, resp.StatusCode) {
 			t.FailNow()
 		}
@@ -326,8 +336,9 @@ func TestConnectOK(t *testing.T) {
 			t.FailNow()
 		}
 
-		resp, _ := http.ReadResponse(bufio.NewReader(conn), nil)
-		ioutil.ReadAll(resp.Body)
+		// A 200 response to CONNECT has no body, the tunnel follows
+		resp, _ := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		resp.Body.Close()
 		if !assert.Equal(t, 200, resp.StatusCode) {
 			t.FailNow()
 		}
@@ -348,110 +359,1109 @@ func TestConnectOK(t *testing.T) {
 		assert.Contains(t, string(buf[:]), originResponse, "should read tunneled response")
 	}
 
-	testRoundTrip(t, httpProxyAddr, false, httpOriginServer, testHTTP)
-	testRoundTrip(t, tlsProxyAddr, true, httpOriginServer, testHTTP)
-
-	testRoundTrip(t, httpProxyAddr, false, tlsOriginServer, testTLS)
-	testRoundTrip(t, tlsProxyAddr, true, tlsOriginServer, testTLS)
+	testRoundTrip(t, httpProxyAddr, false, httpOriginServer, testHTTP)
+	testRoundTrip(t, tlsProxyAddr, true, httpOriginServer, testHTTP)
+
+	testRoundTrip(t, httpProxyAddr, false, tlsOriginServer, testTLS)
+	testRoundTrip(t, tlsProxyAddr, true, tlsOriginServer, testTLS)
+}
+
+// X-Lantern-Auth-Token + X-Lantern-Device-Id -> Forward
+func TestDirectOK(t *testing.T) {
+	reqTempl := "GET /%s HTTP/1.1\r\nHost: %s\r\n\r\n"
+
+	testOk := func(conn net.Conn, originURL *url.URL) {
+		req := fmt.Sprintf(reqTempl, originURL.Path, originURL.Host)
+		t.Log("\n" + req)
+		_, err := conn.Write([]byte(req))
+		if !assert.NoError(t, err, "should write GET request") {
+			t.FailNow()
+		}
+
+		resp, _ := http.ReadResponse(bufio.NewReader(conn), nil)
+		buf, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(buf[:]), originResponse, "should read tunneled response")
+
+	}
+
+	testFail := func(conn net.Conn, originURL *url.URL) {
+		req := fmt.Sprintf(reqTempl, originURL.Path, originURL.Host)
+		t.Log("\n" + req)
+		_, err := conn.Write([]byte(req))
+		if !assert.NoError(t, err, "should write GET request") {
+			t.FailNow()
+		}
+
+		resp, _ := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "should fail")
+		defer resp.Body.Close()
+	}
+
+	testRoundTrip(t, httpProxyAddr, false, httpOriginServer, testOk)
+	testRoundTrip(t, tlsProxyAddr, true, httpOriginServer, testOk)
+
+	// HTTPS can't be tunneled using Direct Proxying, as redirections
+	// require a TLS handshake between the proxy and the origin
+	testRoundTrip(t, httpProxyAddr, false, tlsOriginServer, testFail)
+	testRoundTrip(t, tlsProxyAddr, true, tlsOriginServer, testFail)
+}
+
+func TestInvalidRequest(t *testing.T) {
+	connectResp := "HTTP/1.1 400 Bad Request\r\n"
+	testFn := func(conn net.Conn, originURL *url.URL) {
+		_, err := conn.Write([]byte("GET HTTP/1.1\r\n\r\n"))
+		if !assert.NoError(t, err, "should write GET request") {
+			t.FailNow()
+		}
+
+		buf := [400]byte{}
+		conn.Read(buf[:])
+		assert.Contains(t, string(buf[:]), connectResp, "should 400")
+
+	}
+	for i := 0; i < 10; i++ {
+		testRoundTrip(t, httpProxyAddr, false, tlsOriginServer, testFn)
+		testRoundTrip(t, tlsProxyAddr, true, tlsOriginServer, testFn)
+	}
+}
+
+func TestDisconnectingServer(t *testing.T) {
+	idleTimeout := 500 * time.Millisecond
+	addr, err := setupNewDisconnectingServer(0, idleTimeout)
+	if err != nil {
+		assert.Fail(t, "Error starting proxy server")
+	}
+
+	t.Logf("Dialing %v", addr)
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err, "Should be able to connect") {
+		return
+	}
+
+	time.Sleep(idleTimeout)
+	_, err = conn.Write([]byte("GET HTTP/1.1\r\n\r\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	out, err := ioutil.ReadAll(conn)
+	if err == nil {
+		// We either get a connection reset or read nothing
+		assert.Empty(t, string(out), "Server shouldn't have sent anything")
+	}
+}
+
+func TestCustomDial(t *testing.T) {
+	dialed := make(chan string, 1)
+	srv := newServer(&Opts{
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			conn, origin := net.Pipe()
+			go func() {
+				defer origin.Close()
+				io.Copy(origin, origin)
+			}()
+			return conn, nil
+		},
+	})
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	br := openTunnel(t, conn, "example.com:443")
+	assert.Equal(t, "example.com:443", <-dialed)
+
+	_, err = conn.Write([]byte("ping"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ping", string(buf), "should tunnel through custom dialed connection")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	srv := newServer(&Opts{
+		DialTimeout: 50 * time.Millisecond,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, request := range []string{
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		start := time.Now()
+		_, err = conn.Write([]byte(request))
+		if !assert.NoError(t, err) {
+			conn.Close()
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode, request)
+		assert.True(t, time.Since(start) < 5*time.Second, "dial should have timed out quickly")
+	}
+}
+
+func TestDialTimeoutDefault(t *testing.T) {
+	opts := &Opts{}
+	_, err := New(opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10*time.Second, opts.DialTimeout)
+	}
+	_, err = New(&Opts{DialTimeout: -time.Second})
+	assert.Error(t, err, "negative dial timeout should be rejected")
+}
+
+func TestDialRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Nothing listens at a closed listener's address
+	origin := l.Addr().String()
+	l.Close()
+
+	addr, err := serveInBackground(newServer(&Opts{}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, method := range []string{http.MethodConnect, http.MethodGet} {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if method == http.MethodConnect {
+			fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", origin, origin)
+		} else {
+			fmt.Fprintf(conn, "GET http://%v/ HTTP/1.1\r\nHost: %v\r\n\r\n", origin, origin)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+		conn.Close()
+		if assert.NoError(t, err, method) {
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "%v to refusing origin", method)
+		}
+	}
+}
+
+func TestDialRefusedByUpstream(t *testing.T) {
+	// An upstream proxy that refuses all CONNECT requests
+	upstream, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+					fmt.Fprint(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+				}
+			}()
+		}
+	}()
+
+	addr, err := serveInBackground(newServer(&Opts{Dial: dialers.HTTPUpstream(upstream.Addr().String(), dialers.Direct)}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "should pass on the upstream's refusal")
+	}
+}
+
+func TestErrorResponder(t *testing.T) {
+	srv := newServer(&Opts{
+		Filter: filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			if req.Host == "blocked.com:25" {
+				return filters.Fail(cs, req, http.StatusForbidden, errors.New("Port not allowed"))
+			}
+			return next(cs, req)
+		}),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return nil, errors.New("Unable to dial %v", addr)
+		},
+		ErrorResponder: func(status int, reason string) (string, []byte) {
+			return "application/json", []byte(fmt.Sprintf(`{"status":%d,"reason":%q}`, status, reason))
+		},
+	})
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doConnect := func(host string) (*http.Response, string) {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := doConnect("blocked.com:25")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, `{"status":403,"reason":"Port not allowed"}`, body)
+	}
+
+	resp, body = doConnect("example.com:443")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, `{"status":502,"reason":"Unable to dial example.com:443"}`, body)
+	}
+}
+
+func TestDialHooks(t *testing.T) {
+	var mx sync.Mutex
+	var succeeded, failed []string
+	srv := newServer(&Opts{
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			if addr == "down.com:443" {
+				return nil, errors.New("Unable to dial %v", addr)
+			}
+			return dialers.Direct(ctx, isCONNECT, network, addr)
+		},
+		OnDialSuccess: func(host string, d time.Duration) {
+			mx.Lock()
+			succeeded = append(succeeded, host)
+			mx.Unlock()
+			assert.True(t, d > 0)
+		},
+		OnDialFailure: func(host string, err error) {
+			mx.Lock()
+			failed = append(failed, host)
+			mx.Unlock()
+			assert.Contains(t, err.Error(), "Unable to dial down.com:443")
+		},
+	})
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	originURL, _ := url.Parse(httpOriginURL)
+	for _, host := range []string{originURL.Host, "down.com:443"} {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+		_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		assert.NoError(t, err)
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, []string{originURL.Host}, succeeded)
+	assert.Equal(t, []string{"down.com:443"}, failed)
+}
+
+func TestIdleUpstreamClosesTunnel(t *testing.T) {
+	// An origin that accepts connections but never sends anything
+	ol, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ol.Close()
+	go func() {
+		for {
+			conn, err := ol.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// No idle timing on the client connection
+	srv := newServer(&Opts{IdleTimeout: 200 * time.Millisecond})
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	br := openTunnel(t, conn, ol.Addr().String())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(br)
+	assert.NoError(t, err, "tunnel should have been closed once upstream idled")
+}
+
+func TestIdleTimeoutOverrides(t *testing.T) {
+	timeouts := newIdleTimeouts(time.Minute, map[string]time.Duration{
+		"*.example.com":        2 * time.Minute,
+		"*.api.example.com":    3 * time.Minute,
+		"Poll.API.example.com": 4 * time.Minute,
+		"quiet.example.org.":   0,
+	})
+	assert.Equal(t, 2*time.Minute, timeouts.forAddr("www.example.com:443"))
+	assert.Equal(t, 3*time.Minute, timeouts.forAddr("v1.api.example.com:443"), "closer wildcard should take precedence")
+	assert.Equal(t, 4*time.Minute, timeouts.forAddr("poll.api.example.com.:443"), "exact name should take precedence over wildcards")
+	assert.Equal(t, 2*time.Minute, timeouts.forAddr("api.example.com:443"), "wildcard should not match its own domain")
+	assert.Equal(t, time.Duration(0), timeouts.forAddr("quiet.example.org:80"))
+	assert.Equal(t, time.Minute, timeouts.forAddr("example.com:443"), "should fall back to default")
+	assert.Equal(t, time.Minute, timeouts.forAddr("other.org:443"), "should fall back to default")
+}
+
+func TestIdleTimeoutOverrideClosesTunnel(t *testing.T) {
+	// An origin that accepts connections but never sends anything
+	ol, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ol.Close()
+	go func() {
+		for {
+			conn, err := ol.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	srv := newServer(&Opts{
+		IdleTimeout:          time.Minute,
+		IdleTimeoutOverrides: map[string]time.Duration{"127.0.0.1": 200 * time.Millisecond},
+	})
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, port, _ := net.SplitHostPort(ol.Addr().String())
+	br := openTunnel(t, conn, net.JoinHostPort("127.0.0.1", port))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(br)
+	assert.NoError(t, err, "tunnel should have been closed once upstream idled for its overridden timeout")
+}
+
+func TestIdleTimeoutOverrideExtendsClient(t *testing.T) {
+	echo, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// Route every .invalid host to the echo server, to check that overrides
+	// match the requested host rather than the dialed one
+	srv := newServer(&Opts{
+		IdleTimeout: 200 * time.Millisecond,
+		IdleTimeoutOverrides: map[string]time.Duration{
+			"long.invalid": time.Minute,
+			"127.0.0.1":    time.Minute,
+		},
+		Filter: filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			if strings.HasSuffix(req.URL.Hostname(), ".invalid") {
+				req.URL.Host = echo.Addr().String()
+			}
+			return next(cs, req)
+		}),
+	})
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	idleThenEcho := func(host string) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if host != "" {
+			br := openTunnel(t, conn, host)
+			time.Sleep(500 * time.Millisecond)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				return err
+			}
+			_, err = io.ReadFull(br, make([]byte, 5))
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	assert.Equal(t, io.EOF, idleThenEcho(""), "client should idle after IdleTimeout before it has a tunnel")
+	assert.NoError(t, idleThenEcho("long.invalid:443"), "client should idle after the override of the requested host once tunneled")
+	assert.Error(t, idleThenEcho("short.invalid:443"), "override of the dialed address shouldn't apply")
+}
+
+func TestStopDrainsTunnels(t *testing.T) {
+	srv := basicServer(0, 30*time.Second)
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	originURL, _ := url.Parse(httpOriginURL)
+	br := openTunnel(t, conn, originURL.Host)
+
+	stopErr := make(chan error)
+	go func() {
+		stopErr <- srv.Stop(context.Background())
+	}()
+
+	// Wait for the listener to close
+	for i := 0; i < 100; i++ {
+		newConn, dialErr := net.Dial("tcp", addr)
+		if dialErr != nil {
+			break
+		}
+		newConn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err, "should not accept new connections after stopping")
+
+	// The existing tunnel should still work
+	_, err = conn.Write([]byte(tunneledReq))
+	if assert.NoError(t, err) {
+		resp, err := http.ReadResponse(br, nil)
+		if assert.NoError(t, err) {
+			buf, _ := ioutil.ReadAll(resp.Body)
+			assert.Contains(t, string(buf), originResponse, "should read tunneled response after stopping")
+		}
+	}
+
+	select {
+	case <-stopErr:
+		assert.Fail(t, "should still be waiting on open tunnel")
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-stopErr:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "should have stopped after tunnel closed")
+	}
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	srv := basicServer(0, 30*time.Second)
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Stop(context.Background())
+
+	startedBefore := handlersStarted.Value()
+	finishedBefore := handlersFinished.Value()
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	originURL, _ := url.Parse(httpOriginURL)
+	openTunnel(t, conn, originURL.Host)
+	assert.Equal(t, startedBefore+1, handlersStarted.Value())
+	assert.Equal(t, finishedBefore, handlersFinished.Value(), "handler should run while tunnel is open")
+	assert.True(t, activeHandlers.Value() >= 1)
+	assert.True(t, goroutines.Value() > activeHandlers.Value())
+
+	conn.Close()
+	for i := 0; i < 50 && handlersFinished.Value() == finishedBefore; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, finishedBefore+1, handlersFinished.Value(), "handler should finish once tunnel is closed")
+}
+
+func TestServeMultipleAddresses(t *testing.T) {
+	srv := basicServer(0, 30*time.Second)
+	addrA, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+	addrB, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	originURL, _ := url.Parse(httpOriginURL)
+	for _, addr := range []string{addrA, addrB} {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		br := openTunnel(t, conn, originURL.Host)
+		_, err = conn.Write([]byte(tunneledReq))
+		if assert.NoError(t, err) {
+			resp, err := http.ReadResponse(br, nil)
+			if assert.NoError(t, err) {
+				buf, _ := ioutil.ReadAll(resp.Body)
+				assert.Contains(t, string(buf), originResponse, "should tunnel through %v", addr)
+			}
+		}
+		conn.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Stop(ctx))
+	for _, addr := range []string{addrA, addrB} {
+		_, err := net.Dial("tcp", addr)
+		assert.Error(t, err, "should have stopped listening at %v", addr)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT isn't supported")
+	}
+	listenAt := func(srv *Server, addr string) (string, error) {
+		ready := make(chan string, 1)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- srv.ListenAndServeHTTP(addr, func(addr string) { ready <- addr })
+		}()
+		select {
+		case addr := <-ready:
+			return addr, nil
+		case err := <-errs:
+			return "", err
+		}
+	}
+
+	first := newServer(&Opts{ReusePort: true})
+	addr, err := listenAt(first, "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer first.Stop(context.Background())
+
+	second := newServer(&Opts{ReusePort: true})
+	_, err = listenAt(second, addr)
+	if !assert.NoError(t, err, "should have been able to listen at the same address") {
+		return
+	}
+	defer second.Stop(context.Background())
+
+	_, err = listenAt(newServer(&Opts{}), addr)
+	assert.Error(t, err, "should not have been able to listen without SO_REUSEPORT")
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-proxy")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	// Leave behind a stale socket file, as if from a crashed process
+	stale, err := net.Listen("unix", path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := basicServer(0, 30*time.Second)
+	ready := make(chan string)
+	go func() {
+		if err := srv.ListenAndServeHTTP("unix:"+path, func(addr string) { ready <- addr }); err != nil {
+			log.Errorf("Unable to serve: %v", err)
+			close(ready)
+		}
+	}()
+	if !assert.Equal(t, path, <-ready) {
+		return
+	}
+	assert.Error(t, srv.ListenAndServeHTTP("unix:"+path, nil), "should not take over socket in use")
+
+	conn, err := net.Dial("unix", path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	originURL, _ := url.Parse(httpOriginURL)
+	br := openTunnel(t, conn, originURL.Host)
+	_, err = conn.Write([]byte(tunneledReq))
+	if assert.NoError(t, err) {
+		resp, err := http.ReadResponse(br, nil)
+		if assert.NoError(t, err) {
+			buf, _ := ioutil.ReadAll(resp.Body)
+			assert.Contains(t, string(buf), originResponse)
+		}
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Stop(ctx))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "should have removed socket file")
+}
+
+func TestCloseIdle(t *testing.T) {
+	srv := newServer(&Opts{})
+	// idletiming connections only close once pending reads return, which
+	// would take half a minute here
+	srv.AddListenerWrappers(func(l net.Listener) net.Listener {
+		return listeners.NewIdleConnListener(l, time.Minute)
+	})
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Stop(context.Background())
+
+	idle, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer idle.Close()
+	busy, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer busy.Close()
+	waitFor(t, func() bool { return srv.OpenConns() == 2 }, "connections should have been accepted")
+
+	time.Sleep(200 * time.Millisecond)
+	_, err = busy.Write([]byte("GET"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	assert.Equal(t, 1, srv.CloseIdle(150*time.Millisecond), "only the idle connection should have been closed")
+	assert.True(t, time.Since(start) < 5*time.Second, "closing should not wait for pending reads")
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	waitFor(t, func() bool { return srv.OpenConns() == 1 }, "idle connection should no longer be open")
+
+	assert.Equal(t, 1, srv.CloseIdle(0))
+	waitFor(t, func() bool { return srv.OpenConns() == 0 }, "all connections should have been closed")
+}
+
+func waitFor(t *testing.T, condition func() bool, msg string) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Fail(t, msg)
+}
+
+func TestStopForceCloses(t *testing.T) {
+	srv := basicServer(0, 2*time.Second)
+	addr, err := serveInBackground(srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	originURL, _ := url.Parse(httpOriginURL)
+	br := openTunnel(t, conn, originURL.Host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Stop(ctx))
+
+	_, err = ioutil.ReadAll(br)
+	assert.NoError(t, err, "tunnel should have been closed")
+}
+
+func TestContextClosesTunnels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, err := serveInBackground(newServer(&Opts{Context: ctx}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	originURL, _ := url.Parse(httpOriginURL)
+	br := openTunnel(t, conn, originURL.Host)
+
+	cancel()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = ioutil.ReadAll(br)
+	assert.NoError(t, err, "tunnel should have been closed")
+}
+
+func TestResponseWriteDeadline(t *testing.T) {
+	reject := filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return filters.Fail(cs, req, http.StatusForbidden, errors.New("rejected"))
+	})
+	proxied := filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	})
+
+	apply := func(filter filters.Filter, method string) *deadlineConn {
+		downstream := &deadlineConn{}
+		req, _ := http.NewRequest(method, "http://example.com:443", nil)
+		limitResponseWrites(filter, time.Second).Apply(filters.NewConnectionState(req, nil, downstream), req, nil)
+		return downstream
+	}
+
+	assert.False(t, apply(reject, http.MethodConnect).deadline.IsZero(), "error response should have write deadline")
+	assert.True(t, apply(proxied, http.MethodGet).deadline.IsZero(), "proxied responses should not have write deadline")
+}
+
+func TestConnectOKHeaders(t *testing.T) {
+	tunnel := filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		nextCS := cs.Clone()
+		upstream, _ := net.Pipe()
+		nextCS.SetUpstream(upstream)
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Server-Timing": []string{"dialupstream;dur=0"}}}, nextCS, nil
+	})
+
+	apply := func(headers http.Header) (*deadlineConn, *http.Response, *filters.ConnectionState) {
+		downstream := &deadlineConn{}
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		resp, nextCS, err := respondConnectOK(tunnel, defaultConnectOKReason, headers, time.Second).Apply(filters.NewConnectionState(req, nil, downstream), req, nil)
+		assert.NoError(t, err)
+		return downstream, resp, nextCS
+	}
+
+	downstream, resp, nextCS := apply(nil)
+	assert.Equal(t, "HTTP/1.1 200 Connection established\r\n\r\n", downstream.written.String())
+	assert.Nil(t, resp, "proxy should have nothing left to write")
+	assert.NotNil(t, nextCS.Upstream(), "proxy should proceed to tunnel")
+	assert.True(t, downstream.deadline.IsZero(), "deadline should be cleared once OK is written")
+	assert.True(t, downstream.hadDeadline, "OK should be written with deadline")
+
+	downstream, _, _ = apply(http.Header{"Proxy-Agent": []string{"http-proxy"}})
+	assert.Equal(t, "HTTP/1.1 200 Connection established\r\nProxy-Agent: http-proxy\r\n\r\n", downstream.written.String())
+}
+
+func TestConnectOKReason(t *testing.T) {
+	addr, err := serveInBackground(newServer(&Opts{ConnectOKReason: "OK"}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	originURL, _ := url.Parse(httpOriginURL)
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", originURL.Host, originURL.Host)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, "200 OK", resp.Status)
+
+	_, err = conn.Write([]byte(tunneledReq))
+	if assert.NoError(t, err) {
+		resp, err := http.ReadResponse(br, nil)
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Contains(t, string(body), originResponse)
+		}
+	}
+}
+
+func TestConnectOKBytes(t *testing.T) {
+	addr, err := serveInBackground(newServer(&Opts{}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	originURL, _ := url.Parse(httpOriginURL)
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", originURL.Host, originURL.Host)
+
+	expected := "HTTP/1.1 200 Connection established\r\n\r\n"
+	buf := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, string(buf))
+	}
+
+	_, err = conn.Write([]byte(tunneledReq))
+	if assert.NoError(t, err) {
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if assert.NoError(t, err, "response to tunneled request should follow OK immediately") {
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Contains(t, string(body), originResponse)
+		}
+	}
+}
+
+type deadlineConn struct {
+	net.Conn
+	written     bytes.Buffer
+	deadline    time.Time
+	hadDeadline bool
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	c.hadDeadline = c.hadDeadline || !t.IsZero()
+	return nil
+}
+
+func (c *deadlineConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	tls11 := &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11, InsecureSkipVerify: true}
+
+	addr, err := serveHTTPSInBackground(newServer(&Opts{}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tls.Dial("tcp", addr, tls11)
+	assert.Error(t, err, "should require TLS 1.2 by default")
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	addr, err = serveHTTPSInBackground(newServer(&Opts{TLSConfig: &tls.Config{MinVersion: tls.VersionTLS10}}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err = tls.Dial("tcp", addr, tls11)
+	if assert.NoError(t, err, "configured MinVersion should have been used") {
+		conn.Close()
+	}
 }
 
-// X-Lantern-Auth-Token + X-Lantern-Device-Id -> Forward
-func TestDirectOK(t *testing.T) {
-	reqTempl := "GET /%s HTTP/1.1\r\nHost: %s\r\n\r\n"
+func TestSNICertificates(t *testing.T) {
+	certA, err := generateCertificate("a.example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	certB, err := generateCertificate("*.b.example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
 
-	testOk := func(conn net.Conn, originURL *url.URL) {
-		req := fmt.Sprintf(reqTempl, originURL.Path, originURL.Host)
-		t.Log("\n" + req)
-		_, err := conn.Write([]byte(req))
-		if !assert.NoError(t, err, "should write GET request") {
-			t.FailNow()
+	addr, err := serveHTTPSInBackground(newServer(&Opts{TLSConfig: &tls.Config{Certificates: []tls.Certificate{certA, certB}}}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	servedCert := func(serverName string) []string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if !assert.NoError(t, err) {
+			return nil
 		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].DNSNames
+	}
 
-		resp, _ := http.ReadResponse(bufio.NewReader(conn), nil)
-		buf, _ := ioutil.ReadAll(resp.Body)
-		assert.Contains(t, string(buf[:]), originResponse, "should read tunneled response")
+	assert.Equal(t, []string{"a.example.com"}, servedCert("a.example.com"))
+	assert.Equal(t, []string{"*.b.example.com"}, servedCert("www.b.example.com"))
+	assert.Empty(t, servedCert("c.example.com"), "should have fallen back to default certificate")
+}
 
+func TestClientCertificates(t *testing.T) {
+	caKey, err := keyman.GeneratePK(2048)
+	if !assert.NoError(t, err) {
+		return
 	}
-
-	testFail := func(conn net.Conn, originURL *url.URL) {
-		req := fmt.Sprintf(reqTempl, originURL.Path, originURL.Host)
-		t.Log("\n" + req)
-		_, err := conn.Write([]byte(req))
-		if !assert.NoError(t, err, "should write GET request") {
+	ca, err := caKey.TLSCertificateFor(time.Now().Add(time.Hour), true, nil, "Lantern", "Test CA")
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientCert := func(issuerKey *keyman.PrivateKey, issuer *keyman.Certificate) tls.Certificate {
+		key, err := keyman.GeneratePK(2048)
+		if !assert.NoError(t, err) {
 			t.FailNow()
 		}
-
-		resp, _ := http.ReadResponse(bufio.NewReader(conn), nil)
-		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "should fail")
-		defer resp.Body.Close()
+		cert, err := issuerKey.CertificateForKey(&x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: "client1"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, issuer, &key.RSA().PublicKey)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return tls.Certificate{Certificate: [][]byte{cert.DER()}, PrivateKey: key.RSA()}
 	}
 
-	testRoundTrip(t, httpProxyAddr, false, httpOriginServer, testOk)
-	testRoundTrip(t, tlsProxyAddr, true, httpOriginServer, testOk)
-
-	// HTTPS can't be tunneled using Direct Proxying, as redirections
-	// require a TLS handshake between the proxy and the origin
-	testRoundTrip(t, httpProxyAddr, false, tlsOriginServer, testFail)
-	testRoundTrip(t, tlsProxyAddr, true, tlsOriginServer, testFail)
-}
+	clientCNs := make(chan string, 1)
+	s := newServer(&Opts{
+		TLSConfig: &tls.Config{ClientCAs: ca.PoolContainingCert(), ClientAuth: tls.RequireAndVerifyClientCert},
+		Filter: filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			clientCNs <- proxyfilters.ClientCommonName(cs)
+			return filters.ShortCircuit(cs, req, &http.Response{StatusCode: http.StatusNoContent})
+		}),
+	})
+	addr, err := serveHTTPSInBackground(s)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Stop(context.Background())
 
-func TestInvalidRequest(t *testing.T) {
-	connectResp := "HTTP/1.1 400 Bad Request\r\n"
-	testFn := func(conn net.Conn, originURL *url.URL) {
-		_, err := conn.Write([]byte("GET HTTP/1.1\r\n\r\n"))
-		if !assert.NoError(t, err, "should write GET request") {
-			t.FailNow()
+	request := func(certs ...tls.Certificate) (*http.Response, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err != nil {
+			return nil, err
 		}
+		defer conn.Close()
+		if _, err := fmt.Fprint(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
 
-		buf := [400]byte{}
-		conn.Read(buf[:])
-		assert.Contains(t, string(buf[:]), connectResp, "should 400")
+	resp, err := request(clientCert(caKey, ca))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "client1", <-clientCNs)
+	}
 
+	_, err = request()
+	assert.Error(t, err, "clients without a certificate should be rejected")
+
+	otherKey, err := keyman.GeneratePK(2048)
+	if !assert.NoError(t, err) {
+		return
 	}
-	for i := 0; i < 10; i++ {
-		testRoundTrip(t, httpProxyAddr, false, tlsOriginServer, testFn)
-		testRoundTrip(t, tlsProxyAddr, true, tlsOriginServer, testFn)
+	otherCA, err := otherKey.TLSCertificateFor(time.Now().Add(time.Hour), true, nil, "Lantern", "Other CA")
+	if !assert.NoError(t, err) {
+		return
 	}
+	_, err = request(clientCert(otherKey, otherCA))
+	assert.Error(t, err, "clients with a certificate from another CA should be rejected")
+	assert.Empty(t, clientCNs, "rejected clients should not have reached the filters")
 }
 
-func TestDisconnectingServer(t *testing.T) {
-	idleTimeout := 500 * time.Millisecond
-	addr, err := setupNewDisconnectingServer(0, idleTimeout)
+func generateCertificate(host string) (tls.Certificate, error) {
+	pk, err := keyman.GeneratePK(2048)
 	if err != nil {
-		assert.Fail(t, "Error starting proxy server")
+		return tls.Certificate{}, err
 	}
-
-	t.Logf("Dialing %v", addr)
-	conn, err := net.Dial("tcp", addr)
-	if !assert.NoError(t, err, "Should be able to connect") {
-		return
+	cert, err := pk.TLSCertificateFor(time.Now().Add(time.Hour), true, nil, "Lantern", host)
+	if err != nil {
+		return tls.Certificate{}, err
 	}
+	return tls.X509KeyPair(cert.PEMEncoded(), pk.PEMEncoded())
+}
 
-	time.Sleep(idleTimeout)
-	_, err = conn.Write([]byte("GET HTTP/1.1\r\n\r\n"))
+func openTunnel(t *testing.T, conn net.Conn, host string) *bufio.Reader {
+	_, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
 	if !assert.NoError(t, err) {
-		return
+		t.FailNow()
 	}
-
-	out, err := ioutil.ReadAll(conn)
-	if err == nil {
-		// We either get a connection reset or read nothing
-		assert.Empty(t, string(out), "Server shouldn't have sent anything")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		t.FailNow()
 	}
+	return br
 }
 
 func TestPanicRecover(t *testing.T) {
 	req := "GET / HTTP/1.1\r\nHost: thehost.com\r\n\r\n"
-	conn := mockconn.New(&bytes.Buffer{}, strings.NewReader(req))
+	var written bytes.Buffer
+	conn := mockconn.New(&written, strings.NewReader(req))
 
 	// Use a filter that alwasy panics to make sure server handles it
-	server := New(&Opts{
+	server := newServer(&Opts{
 		Filter: filters.FilterFunc(func(_ *filters.ConnectionState, _ *http.Request, _ filters.Next) (*http.Response, *filters.ConnectionState, error) {
 			panic(errors.New("I'm panicking!"))
 		}),
 	})
 	server.doHandle(conn, false, nil)
 	assert.True(t, conn.Closed(), "Connection should have been closed after recovering from panic")
+	resp, err := http.ReadResponse(bufio.NewReader(&written), nil)
+	if assert.NoError(t, err, "Client should have gotten a response") {
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
 }
 
 //
@@ -495,9 +1505,18 @@ func testRoundTrip(t *testing.T, addr string, isTLS bool, origin *originHandler,
 	checkerFn(conn, url)
 }
 
+// newServer is like New for options that are known to be valid.
+func newServer(opts *Opts) *Server {
+	srv, err := New(opts)
+	if err != nil {
+		panic(err)
+	}
+	return srv
+}
+
 func basicServer(maxConns uint64, idleTimeout time.Duration) *Server {
 	// Create server
-	srv := New(&Opts{IdleTimeout: idleTimeout})
+	srv := newServer(&Opts{IdleTimeout: idleTimeout})
 
 	// Add net.Listener wrappers for inbound connections
 	srv.AddListenerWrappers(
@@ -552,6 +1571,34 @@ func setupNewHTTPSServer(maxConns uint64, idleTimeout time.Duration) (string, er
 	return addr, err
 }
 
+func serveInBackground(s *Server) (string, error) {
+	var err error
+	ready := make(chan string)
+	wait := func(addr string) {
+		ready <- addr
+	}
+	go func(err *error) {
+		if *err = s.ListenAndServeHTTP("localhost:0", wait); *err != nil {
+			log.Errorf("Unable to serve: %v", *err)
+		}
+	}(&err)
+	return <-ready, err
+}
+
+func serveHTTPSInBackground(s *Server) (string, error) {
+	var err error
+	ready := make(chan string)
+	wait := func(addr string) {
+		ready <- addr
+	}
+	go func(err *error) {
+		if *err = s.ListenAndServeHTTPS("localhost:0", "key.pem", "cert.pem", wait); *err != nil {
+			log.Errorf("Unable to serve: %v", *err)
+		}
+	}(&err)
+	return <-ready, err
+}
+
 func setupNewDisconnectingServer(maxConns uint64, idleTimeout time.Duration) (string, error) {
 	s := basicServer(maxConns, idleTimeout)
 	s.Allow = func(ip string) bool {
@@ -631,3 +1678,371 @@ func newOriginHandler(msg string, tls bool) (string, *originHandler) {
 	log.Debugf("Started origin server at %v", m.server.URL)
 	return m.server.URL, &m
 }
+
+func TestAllowWithProxyProtocol(t *testing.T) {
+	s := newServer(&Opts{ProxyProtocol: true})
+	s.Allow = func(ip string) bool {
+		return ip == "192.0.2.1"
+	}
+	addr, err := serveInBackground(s)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// A client that never sends the PROXY protocol header shouldn't hold up
+	// accepting others
+	silent, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	get := func(clientIP string) (*http.Response, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "PROXY TCP4 %v 192.0.2.2 5678 8080\r\n", clientIP)
+		fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\n\r\n", httpOriginURL, strings.TrimPrefix(httpOriginURL, "http://"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodGet})
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	resp, err := get("192.0.2.1")
+	if assert.NoError(t, err, "allowed client should be served while another one hasn't sent its header") {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	_, err = get("192.0.2.3")
+	assert.Error(t, err, "client not allowed by its address in the PROXY protocol header should be disconnected")
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	addr, err := serveInBackground(newServer(&Opts{MaxHeaderBytes: 1024}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	originURL, _ := url.Parse(httpOriginURL)
+
+	connect := func(padding int) (*http.Response, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\nX-Padding: %v\r\n\r\n", originURL.Host, originURL.Host, strings.Repeat("a", padding))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	resp, err := connect(2048)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	}
+	resp, err = connect(10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "small header should be allowed")
+	}
+}
+
+func TestMaxHeaderBytesKeepAlive(t *testing.T) {
+	addr, err := serveInBackground(newServer(&Opts{MaxHeaderBytes: 1024}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	get := func(padding int) (*http.Response, error) {
+		fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\nX-Padding: %v\r\n\r\n", httpOriginURL, strings.TrimPrefix(httpOriginURL, "http://"), strings.Repeat("a", padding))
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	resp, err := get(10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "small header should be allowed")
+	}
+	resp, err = get(10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "small header of second request should be allowed")
+	}
+	resp, err = get(8192)
+	if assert.NoError(t, err, "oversized header of later request should get an error response") {
+		assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode, "oversized header of later request should be rejected")
+	}
+}
+
+func TestHeaderLimitReader(t *testing.T) {
+	header := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+	tunneled := strings.Repeat("x", 4096)
+	b, err := ioutil.ReadAll(newHeaderLimitReader(strings.NewReader(header+tunneled), len(header)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, header+tunneled, string(b), "data after header should not be limited")
+	}
+
+	b, err = ioutil.ReadAll(newHeaderLimitReader(strings.NewReader("GET / HTTP/1.1\nHost: example.com\n\nbody"), 40))
+	if assert.NoError(t, err, "LF terminated header should be recognized") {
+		assert.Equal(t, "GET / HTTP/1.1\nHost: example.com\n\nbody", string(b))
+	}
+
+	_, err = ioutil.ReadAll(newHeaderLimitReader(strings.NewReader(header+tunneled), len(header)-1))
+	assert.Equal(t, errHeaderTooLarge, err)
+}
+
+func TestConnectMethodCase(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	s := newServer(&Opts{})
+	addr, err := serveInBackground(s)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, method := range []string{"CONNECT", "connect", "Connect"} {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fmt.Fprintf(conn, "%v %v HTTP/1.1\r\nHost: %v\r\n\r\n", method, origin.Addr(), origin.Addr())
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if assert.NoError(t, err, method) && assert.Equal(t, http.StatusOK, resp.StatusCode, method) {
+			resp.Body.Close()
+			conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(br, buf)
+			if assert.NoError(t, err, method) {
+				assert.Equal(t, "ping", string(buf), "%v should open a tunnel", method)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestConnectMethodReader(t *testing.T) {
+	for input, expected := range map[string]string{
+		"connect example.com:443 HTTP/1.1\r\n\r\n": "CONNECT example.com:443 HTTP/1.1\r\n\r\n",
+		"Connect example.com:443 HTTP/1.1\r\n\r\n": "CONNECT example.com:443 HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\n\r\nconnect ":           "GET / HTTP/1.1\r\n\r\nconnect ",
+		"CONNECTED / HTTP/1.1\r\n\r\n":             "CONNECTED / HTTP/1.1\r\n\r\n",
+		"conn":                                     "conn",
+		"":                                         "",
+	} {
+		b, err := ioutil.ReadAll(newConnectMethodReader(strings.NewReader(input)))
+		if assert.NoError(t, err, input) {
+			assert.Equal(t, expected, string(b))
+		}
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+	defer origin.Close()
+
+	s := newServer(&Opts{MaxBodyBytes: 10})
+	addr, err := serveInBackground(s)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Stop(context.Background())
+
+	post := func(body io.Reader) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, origin.URL, body)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	status, body := post(strings.NewReader("0123456789"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "10", body)
+
+	status, _ = post(strings.NewReader(strings.Repeat("x", 11)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status, "declared length over limit should be rejected")
+
+	// Hiding the length makes the client send the body chunked
+	status, _ = post(struct{ io.Reader }{strings.NewReader(strings.Repeat("x", 4096))})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status, "chunked body over limit should be rejected")
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/huge" {
+			w.Header().Set("X-Huge", strings.Repeat("x", 4096))
+		}
+		w.Write([]byte(originResponse))
+	}))
+	defer origin.Close()
+
+	for _, poolSize := range []int{0, 2} {
+		s := newServer(&Opts{MaxResponseHeaderBytes: 1024, ForwardPoolSize: poolSize})
+		addr, err := serveInBackground(s)
+		if !assert.NoError(t, err) {
+			return
+		}
+		// Keep alive the connection to the proxy so that several responses are
+		// read from the same connection to the origin
+		client := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+		}}
+		get := func(path string) int {
+			resp, err := client.Get(origin.URL + path)
+			if !assert.NoError(t, err) {
+				return 0
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, get("/"), "small headers on reused connection should be allowed (pool size %d)", poolSize)
+		}
+		assert.Equal(t, http.StatusBadGateway, get("/huge"), "huge headers should be rejected (pool size %d)", poolSize)
+		assert.Equal(t, http.StatusOK, get("/"), "small headers after huge ones should be allowed (pool size %d)", poolSize)
+		client.CloseIdleConnections()
+		s.Stop(context.Background())
+	}
+}
+
+func TestForwardPool(t *testing.T) {
+	var originConns int32
+	var proxyAuth atomic.Value
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxyAuth.Store(req.Header.Get("Proxy-Authorization"))
+		if req.URL.Path == "/close" {
+			w.Header().Set("Connection", "close")
+		}
+		w.Write([]byte(originResponse))
+	}))
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&originConns, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	s := newServer(&Opts{ForwardPoolSize: 2})
+	addr, err := serveInBackground(s)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Stop(context.Background())
+	get := func(path string) {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL+path, nil)
+		req.Header.Set("Proxy-Authorization", "Basic secret")
+		// A new client connection for every request
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Do(req)
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, originResponse, string(body))
+		}
+	}
+
+	get("/")
+	get("/")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&originConns), "clients should share connection to origin")
+	assert.Empty(t, proxyAuth.Load(), "hop-by-hop headers should not be forwarded")
+
+	get("/close")
+	get("/")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&originConns), "connection closed by origin should not be reused")
+}
+
+func TestAcceptLimiter(t *testing.T) {
+	var unlimited *acceptLimiter
+	unlimited.wait()
+	assert.Nil(t, newAcceptLimiter(0), "should not limit by default")
+
+	limiter := newAcceptLimiter(20)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		limiter.wait()
+	}
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "should accept a second's worth of connections right away")
+
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		limiter.wait()
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 150*time.Millisecond, "should pace connections beyond burst, took %v", elapsed)
+	assert.True(t, elapsed < 500*time.Millisecond, "should only delay briefly, took %v", elapsed)
+}
+
+func TestMaxAcceptRate(t *testing.T) {
+	addr, err := serveInBackground(newServer(&Opts{MaxAcceptRate: 10}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	originURL, _ := url.Parse(httpOriginURL)
+
+	// More connections than the burst, which should be delayed rather than dropped
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", originURL.Host, originURL.Host)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+}